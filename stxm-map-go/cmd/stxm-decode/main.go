@@ -1,24 +1,29 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 
-	"github.com/fxamacker/cbor/v2"
+	"stxm-map-go/internal/ingest"
+	"stxm-map-go/internal/output"
+	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/types"
 )
 
-const (
-	tagMultiDimArray = 40
-	tagDectris       = 56500
-)
+// reducers are reported for every channel, the live one first.
+var reducers = []string{processing.ReduceCount, processing.ReduceSum, processing.ReduceMax}
 
 func main() {
 	path := flag.String("path", "", "Path to CBOR file or directory")
-	limit := flag.Int("limit", 5, "Max number of image messages to summarize")
+	limit := flag.Int("limit", 5, "Max number of image messages, and of undecodable ones, to describe (0 describes all)")
+	jsonOut := flag.Bool("json", false, "Print one JSON object per message and a summary object, for diffing")
+	saturation := flag.Float64("saturation", 0, "Count cutoff for saturated pixels (0 takes saturation_value or countrate_correction_count_cutoff from the start message)")
 	flag.Parse()
 
 	if *path == "" {
@@ -30,10 +35,8 @@ func main() {
 		log.Fatalf("list files: %v", err)
 	}
 
-	var imageCount int
-	var startCount int
-	var endCount int
-
+	summary := map[string]int{"start": 0, "image": 0, "end": 0, "failed": 0, "channel_errors": 0}
+	cutoff := *saturation
 	for _, file := range files {
 		data, err := os.ReadFile(file)
 		if err != nil {
@@ -41,93 +44,227 @@ func main() {
 			continue
 		}
 
-		msg, err := decodeMessage(data)
+		msg, channelErrs, err := ingest.Decode(data)
+		report := messageReport{File: file, Type: msg.Type, Errors: errorStrings(channelErrs)}
+		summary["channel_errors"] += len(channelErrs)
 		if err != nil {
-			log.Printf("decode %s: %v", file, err)
+			summary["failed"]++
+			report.Error = err.Error()
+			if *limit == 0 || summary["failed"] <= *limit {
+				printReport(report, *jsonOut)
+			}
 			continue
 		}
 
 		switch msg.Type {
-		case "start":
-			startCount++
-			fmt.Printf("start: %s\n", file)
-			fmt.Printf("  channels: %v\n", msg.Channels)
-		case "end":
-			endCount++
 		case "image":
-			imageCount++
-			if imageCount <= *limit {
-				fmt.Printf("image: %s\n", file)
-				fmt.Printf("  image_id: %v\n", msg.ImageID)
-				fmt.Printf("  series_id: %v\n", msg.SeriesID)
-				for ch, info := range msg.ChannelInfo {
-					fmt.Printf("  channel %s: %s\n", ch, info)
-				}
+			summary["image"]++
+			if *limit > 0 && summary["image"] > *limit {
+				continue
 			}
+			report.ImageID = &msg.Image.ImageID
+			report.SeriesID = &msg.Image.SeriesID
+			report.Channels = describeChannels(msg.Image, cutoff)
+			printReport(report, *jsonOut)
+		default:
+			summary[msg.Type]++
+			report.Meta = scalarMeta(msg.Meta)
+			if msg.Type == "start" && *saturation == 0 {
+				cutoff = startSaturation(report.Meta)
+			}
+			printReport(report, *jsonOut)
 		}
 	}
 
-	fmt.Printf("summary: start=%d image=%d end=%d\n", startCount, imageCount, endCount)
+	if *jsonOut {
+		data, _ := json.Marshal(map[string]any{"summary": summary})
+		fmt.Println(string(data))
+		return
+	}
+	fmt.Printf("summary: start=%d image=%d end=%d failed=%d channel_errors=%d\n",
+		summary["start"], summary["image"], summary["end"], summary["failed"], summary["channel_errors"])
 }
 
-type messageSummary struct {
-	Type        string
-	ImageID     any
-	SeriesID    any
-	Channels    []string
-	ChannelInfo map[string]string
+// messageReport describes one message file.
+type messageReport struct {
+	File     string                   `json:"file"`
+	Type     string                   `json:"type,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+	ImageID  *int                     `json:"image_id,omitempty"`
+	SeriesID *int                     `json:"series_id,omitempty"`
+	Meta     map[string]any           `json:"meta,omitempty"`
+	Channels map[string]channelReport `json:"channels,omitempty"`
+	// Errors are the channels the decoder could not decode.
+	Errors map[string]string `json:"errors,omitempty"`
 }
 
-func decodeMessage(data []byte) (messageSummary, error) {
-	var payload map[string]any
-	if err := cbor.Unmarshal(data, &payload); err != nil {
-		return messageSummary{}, err
-	}
-	msgType, _ := payload["type"].(string)
-	summary := messageSummary{Type: msgType}
-	switch msgType {
-	case "start":
-		if channels, ok := payload["channels"].([]any); ok {
-			for _, ch := range channels {
-				if s, ok := ch.(string); ok {
-					summary.Channels = append(summary.Channels, s)
-				}
+// channelReport describes the image of one channel.
+type channelReport struct {
+	Dtype     string            `json:"dtype"`
+	Shape     []int             `json:"shape"`
+	Min       float64           `json:"min"`
+	Max       float64           `json:"max"`
+	Sum       float64           `json:"sum"`
+	Masked    int               `json:"masked"`
+	Saturated int               `json:"saturated"`
+	Reducers  map[string]uint32 `json:"reducers"`
+}
+
+func describeChannels(frame types.RawFrame, saturation float64) map[string]channelReport {
+	channels := map[string]channelReport{}
+	for channel, payload := range frame.Data {
+		stats, ok := processing.Stats(payload, saturation)
+		if !ok {
+			continue
+		}
+		report := channelReport{
+			Dtype:     stats.Dtype,
+			Shape:     []int{stats.Height, stats.Width},
+			Min:       stats.Min,
+			Max:       stats.Max,
+			Sum:       stats.Sum,
+			Masked:    stats.Masked,
+			Saturated: stats.Saturated,
+			Reducers:  map[string]uint32{},
+		}
+		single := types.RawFrame{Data: map[string]any{channel: payload}}
+		for _, reducer := range reducers {
+			if reduced, ok := (processing.Reduction{Reducer: reducer}).Process(single); ok {
+				report.Reducers[reducer] = reduced.Data[channel]
 			}
 		}
-	case "image":
-		summary.ImageID = payload["image_id"]
-		summary.SeriesID = payload["series_id"]
-		summary.ChannelInfo = map[string]string{}
-		if dataMap, ok := payload["data"].(map[string]any); ok {
-			for ch, v := range dataMap {
-				summary.ChannelInfo[ch] = describeData(v)
+		channels[channel] = report
+	}
+	return channels
+}
+
+func printReport(report messageReport, jsonOut bool) {
+	if jsonOut {
+		data, err := json.Marshal(report)
+		if err != nil {
+			log.Printf("encode %s: %v", report.File, err)
+			return
+		}
+		fmt.Println(string(data))
+		return
+	}
+	if report.Error != "" {
+		fmt.Printf("%s: %s\n", report.File, report.Error)
+	} else {
+		fmt.Printf("%s: %s\n", report.Type, report.File)
+	}
+	keys := make([]string, 0, len(report.Meta))
+	for key := range report.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  %s: %v\n", key, report.Meta[key])
+	}
+	if report.ImageID != nil {
+		fmt.Printf("  image_id: %d\n", *report.ImageID)
+		fmt.Printf("  series_id: %d\n", *report.SeriesID)
+	}
+	for _, channel := range channelNames(report) {
+		if msg, failed := report.Errors[channel]; failed {
+			fmt.Printf("  channel %s: %s\n", channel, msg)
+			continue
+		}
+		ch := report.Channels[channel]
+		var reduced []string
+		for _, reducer := range reducers {
+			if v, ok := ch.Reducers[reducer]; ok {
+				reduced = append(reduced, fmt.Sprintf("%s=%d", reducer, v))
+			}
+		}
+		fmt.Printf("  channel %s: %s shape=[%d %d] min=%g max=%g sum=%g masked=%d saturated=%d reduced %s\n",
+			channel, ch.Dtype, ch.Shape[0], ch.Shape[1], ch.Min, ch.Max, ch.Sum, ch.Masked, ch.Saturated, strings.Join(reduced, " "))
+	}
+}
+
+// channelNames lists the described and the undecodable channels of report.
+func channelNames(report messageReport) []string {
+	var names []string
+	for channel := range report.Channels {
+		names = append(names, channel)
+	}
+	for channel := range report.Errors {
+		names = append(names, channel)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scalarMeta keeps the scalar fields of a start message, and lists of them
+// such as the channels; arrays like the pixel mask are left out.
+func scalarMeta(meta map[string]any) map[string]any {
+	normalized, _ := output.NormalizeJSONValue(meta).(map[string]any)
+	out := map[string]any{}
+	for key, value := range normalized {
+		if isScalar(value) {
+			out[key] = value
+			continue
+		}
+		if list, ok := value.([]any); ok {
+			scalars := true
+			for _, item := range list {
+				scalars = scalars && isScalar(item)
+			}
+			if scalars {
+				out[key] = list
 			}
 		}
 	}
-	return summary, nil
+	return out
 }
 
-func describeData(value any) string {
-	tag, ok := value.(cbor.Tag)
-	if !ok {
-		return fmt.Sprintf("type %T", value)
+func isScalar(value any) bool {
+	switch value.(type) {
+	case string, bool, int, int64, uint64, float32, float64:
+		return true
 	}
-	if tag.Number != tagMultiDimArray {
-		return fmt.Sprintf("tag %d", tag.Number)
+	return false
+}
+
+// startSaturation is the count cutoff a start message announces, or 0.
+func startSaturation(meta map[string]any) float64 {
+	for _, key := range []string{"saturation_value", "countrate_correction_count_cutoff"} {
+		if v, ok := toFloat(meta[key]); ok {
+			return v
+		}
 	}
-	items, ok := tag.Content.([]any)
-	if !ok || len(items) != 2 {
-		return "invalid multidim"
+	return 0
+}
+
+// toFloat converts the numbers a CBOR or JSON decoder yields.
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	default:
+		return 0, false
 	}
-	dims, ok := items[0].([]any)
-	if !ok || len(dims) != 2 {
-		return "invalid dims"
+}
+
+func errorStrings(errs map[string]error) map[string]string {
+	if len(errs) == 0 {
+		return nil
 	}
-	dataTag, _ := items[1].(cbor.Tag)
-	if dataTag.Number == tagDectris {
-		return fmt.Sprintf("dims %v (compressed)", dims)
+	out := make(map[string]string, len(errs))
+	for channel, err := range errs {
+		out[channel] = err.Error()
 	}
-	return fmt.Sprintf("dims %v tag %d", dims, dataTag.Number)
+	return out
 }
 
 func listFiles(path string) ([]string, error) {
@@ -8,15 +8,20 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"stxm-map-go/internal/config"
+	"stxm-map-go/internal/history"
 	"stxm-map-go/internal/ingest"
 	"stxm-map-go/internal/output"
+	"stxm-map-go/internal/pipeline"
 	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/rawlog"
 	"stxm-map-go/internal/server"
 	"stxm-map-go/internal/simplon"
 	"stxm-map-go/internal/simulator"
@@ -36,22 +41,28 @@ type metrics struct {
 	processNanos     atomic.Uint64
 	writeCount       atomic.Uint64
 	writeNanos       atomic.Uint64
+	checkpointWrites atomic.Uint64
+	// framesLate counts the frames of finalized series that reached the
+	// aggregator too late and were dropped.
+	framesLate atomic.Uint64
 }
 
 func (m *metrics) snapshot() map[string]any {
 	return map[string]any{
-		"raw_messages_total":       m.rawMessages.Load(),
-		"image_messages_total":     m.imageMessages.Load(),
-		"meta_messages_total":      m.metaMessages.Load(),
-		"frames_processed_total":   m.framesProcessed.Load(),
-		"frames_broadcast_total":   m.framesBroadcast.Load(),
-		"output_write_ok_total":    m.outputWriteOK.Load(),
-		"output_write_err_total":   m.outputWriteError.Load(),
-		"metadata_write_err_total": m.metadataWriteErr.Load(),
-		"process_total":            m.processCount.Load(),
-		"process_nanos_total":      m.processNanos.Load(),
-		"write_total":              m.writeCount.Load(),
-		"write_nanos_total":        m.writeNanos.Load(),
+		"raw_messages_total":        m.rawMessages.Load(),
+		"image_messages_total":      m.imageMessages.Load(),
+		"meta_messages_total":       m.metaMessages.Load(),
+		"frames_processed_total":    m.framesProcessed.Load(),
+		"frames_broadcast_total":    m.framesBroadcast.Load(),
+		"output_write_ok_total":     m.outputWriteOK.Load(),
+		"output_write_err_total":    m.outputWriteError.Load(),
+		"metadata_write_err_total":  m.metadataWriteErr.Load(),
+		"process_total":             m.processCount.Load(),
+		"process_nanos_total":       m.processNanos.Load(),
+		"write_total":               m.writeCount.Load(),
+		"write_nanos_total":         m.writeNanos.Load(),
+		"checkpoint_write_total":    m.checkpointWrites.Load(),
+		"frames_late_dropped_total": m.framesLate.Load(),
 	}
 }
 
@@ -73,8 +84,45 @@ func main() {
 		outputDir       = flag.String("output-dir", "output", "Directory for output data files")
 		rawLogEnabled   = flag.Bool("raw-log", false, "Write raw CBOR messages to disk")
 		rawLogDir       = flag.String("raw-log-dir", "rawlog", "Directory for raw ingest logs")
+		rawLogMaxMB     = flag.Int64("raw-log-max-mb", 0, "Start a new raw log file before the current one exceeds this many MiB (0: no limit)")
+		rawLogMaxAge    = flag.Duration("raw-log-max-age", 0, "Start a new raw log file once the current one is this old (0: no limit)")
+		rawLogSeries    = flag.Bool("raw-log-per-series", false, "Start a new raw log file with every start message")
+		rawLogRetainMB  = flag.Int64("raw-log-retain-mb", 0, "Delete the oldest raw log files while all of them take more than this many MiB (0 keeps all)")
+		rawLogQueue     = flag.Int("raw-log-queue", 1024, "Messages waiting for the raw log writer before further ones are dropped")
+		rawLogQueueMB   = flag.Int64("raw-log-queue-mb", 256, "MiB of messages waiting for the raw log writer before further ones are dropped")
+		rawLogBufferKB  = flag.Int("raw-log-buffer-kb", 1024, "Raw log write buffer in KiB, flushed whenever it fills")
+		rawLogFlush     = flag.Duration("raw-log-flush-interval", time.Second, "Flush a partly filled raw log buffer this often")
+		rawLogSync      = flag.String("raw-log-sync", output.RawLogSyncClose, "Sync raw log files to disk: never, close (when rotated or closed) or flush (after every flush)")
+		rawLogVersion   = flag.Int("raw-log-format-version", 1, "Raw log format: 1 (STXMRAW1, readable by older tools) or 2 (STXMRAW2, with a header, record flags and compression)")
+		rawLogCompress  = flag.String("raw-log-compression", rawlog.CompressionNone, "Compress raw log records of format version 2: none or gzip")
 		ingestLogEvery  = flag.Int("ingest-log-every", 100, "Log every Nth ingest error")
 		ingestFallback  = flag.Bool("ingest-fallback", true, "Fall back to simulator when ingest fails")
+		diffractionSum  = flag.Bool("diffraction-sum", true, "Accumulate sum and max diffraction patterns per series")
+		scanOrder       = flag.String("scan-order", "raster", "Default scan traversal: raster, snake, column or column-snake, optionally with flip-x/flip-y")
+		positionEP      = flag.String("position-endpoint", "", "ZMQ endpoint of a separate encoder position stream")
+		gridding        = flag.String("gridding", processing.GriddingBin, "Gridding of position based scans: bin or nearest")
+		stackMode       = flag.Bool("stack", false, "Group consecutive series into photon energy stacks")
+		framesPerPoint  = flag.Int("frames-per-point", 0, "Detector frames per scan point (0 derives it from nimages/ntrigger)")
+		subframeCombine = flag.String("subframe-combine", processing.CombineSum, "Combination of the frames of a scan point: sum, mean or max")
+		subframeVar     = flag.Bool("subframe-variance", false, "Export the variance of the frames of each scan point as float maps")
+		average         = flag.Bool("average", false, "Average successive complete series of the same scan")
+		averageRepeats  = flag.Int("average-repeats", 0, "Passes per average (0 averages until reset)")
+		historySize     = flag.Int("history-size", 10, "Finished scans kept in memory for /history (0 disables the history)")
+		historyDisk     = flag.Int("history-disk", 100, "Finished scans kept on disk for /history (0 keeps them in memory only)")
+		historyDir      = flag.String("history-dir", "", "Directory of the scan history (default: <output-dir>/history)")
+		catalogEnabled  = flag.Bool("catalog", true, "Index the output directory in <output-dir>/catalog.json for /runs")
+		catalogRebuild  = flag.Bool("catalog-rebuild", false, "Rebuild the run catalog from the output directory at startup")
+		outputFormats   = flag.String("output-formats", "text", "Comma separated output formats for finished scans: text, tiff, npy, npz, zarr")
+		tiffDtype       = flag.String("tiff-dtype", output.TIFFFloat32, "Sample type of TIFF maps: float32 or uint32")
+		pixelSize       = flag.Float64("pixel-size", 0, "Scan step in micrometres, stored in TIFF maps (0 if unknown)")
+		zarrSide        = flag.Int("zarr-diffraction-side", 32, "Bin diffraction patterns in Zarr stores to at most this many pixels per side (0 stores no patterns)")
+		webhookURL      = flag.String("webhook-url", "", "POST a JSON notification to this URL when a series starts and ends")
+		webhookTimeout  = flag.Duration("webhook-timeout", 5*time.Second, "Timeout of webhook requests")
+		checkpointEvery = flag.Duration("checkpoint-interval", 30*time.Second, "Save the scan in progress to <output-dir>/checkpoint.json this often (0 disables checkpoints)")
+		shutdownWait    = flag.Duration("shutdown-timeout", 10*time.Second, "Time to drain the pipeline and write the series in progress on shutdown")
+		resumeScans     = flag.Bool("checkpoint-resume", true, "Resume the checkpointed scan when its series continues after a restart; otherwise it is written out as interrupted")
+		runTemplate     = flag.String("output-template", output.DefaultRunTemplate, "Path of every run below --output-dir; fields: {proposal}, {sample_name}, {series_unique_id}, {series_id}, {date}, {time}, {timestamp}")
+		mapTemplate     = flag.String("output-map-template", "", "File names of the text and npy maps of a run without extension, e.g. {run}_{channel} (default: {run}_output_{channel}_data / {run}_map_{channel})")
 	)
 	flag.Parse()
 
@@ -102,14 +150,90 @@ func main() {
 		UIRate:              *uiRate,
 		RawLogEnabled:       *rawLogEnabled,
 		RawLogDir:           *rawLogDir,
+		RawLogMaxBytes:      *rawLogMaxMB << 20,
+		RawLogMaxAge:        *rawLogMaxAge,
+		RawLogPerSeries:     *rawLogSeries,
+		RawLogRetainBytes:   *rawLogRetainMB << 20,
+		RawLogQueue:         *rawLogQueue,
+		RawLogQueueBytes:    *rawLogQueueMB << 20,
+		RawLogBufferBytes:   *rawLogBufferKB << 10,
+		RawLogFlush:         *rawLogFlush,
+		RawLogSync:          *rawLogSync,
+		RawLogVersion:       *rawLogVersion,
+		RawLogCompression:   *rawLogCompress,
 		PlotThreshold:       []string{"threshold_0", "threshold_1"},
 		OutputDir:           *outputDir,
 		IngestLogEvery:      *ingestLogEvery,
 		IngestFallback:      *ingestFallback,
+		DiffractionSum:      *diffractionSum,
+		ScanOrder:           *scanOrder,
+		PositionEndpoint:    *positionEP,
+		Gridding:            *gridding,
+		StackMode:           *stackMode,
+		FramesPerPoint:      *framesPerPoint,
+		SubframeCombine:     *subframeCombine,
+		SubframeVariance:    *subframeVar,
+		Average:             *average,
+		AverageRepeats:      *averageRepeats,
+		HistorySize:         *historySize,
+		HistoryDisk:         *historyDisk,
+		HistoryDir:          *historyDir,
+		Catalog:             *catalogEnabled,
+		OutputFormats:       splitList(*outputFormats),
+		TIFFDtype:           *tiffDtype,
+		PixelSize:           *pixelSize,
+		ZarrDiffractionSide: *zarrSide,
+		WebhookURL:          *webhookURL,
+		WebhookTimeout:      *webhookTimeout,
+		CheckpointInterval:  *checkpointEvery,
+		CheckpointResume:    *resumeScans,
+		ShutdownTimeout:     *shutdownWait,
+		OutputTemplate:      *runTemplate,
+		OutputMapTemplate:   *mapTemplate,
+	}
+	if cfg.HistoryDir == "" {
+		cfg.HistoryDir = filepath.Join(cfg.OutputDir, "history")
+	}
+
+	defaultOrder, err := processing.ParseScanOrder(cfg.ScanOrder)
+	if err != nil {
+		log.Fatalf("invalid --scan-order: %v", err)
+	}
+	runNames, err := output.ParseRunTemplate(cfg.OutputTemplate)
+	if err != nil {
+		log.Fatalf("invalid --output-template: %v", err)
+	}
+	var mapNames *output.PathTemplate
+	if cfg.OutputMapTemplate != "" {
+		mapNames, err = output.ParseMapTemplate(cfg.OutputMapTemplate)
+		if err != nil {
+			log.Fatalf("invalid --output-map-template: %v", err)
+		}
+	}
+	if cfg.Gridding != processing.GriddingBin && cfg.Gridding != processing.GriddingNearest {
+		log.Fatalf("invalid --gridding %q", cfg.Gridding)
+	}
+	switch cfg.SubframeCombine {
+	case processing.CombineSum, processing.CombineMean, processing.CombineMax:
+	default:
+		log.Fatalf("invalid --subframe-combine %q", cfg.SubframeCombine)
+	}
+	if cfg.FramesPerPoint < 0 {
+		log.Fatalf("invalid --frames-per-point %d", cfg.FramesPerPoint)
+	}
+	if cfg.ZarrDiffractionSide < 0 {
+		log.Fatalf("invalid --zarr-diffraction-side %d", cfg.ZarrDiffractionSide)
+	}
+	if cfg.TIFFDtype != output.TIFFFloat32 && cfg.TIFFDtype != output.TIFFUint32 {
+		log.Fatalf("invalid --tiff-dtype %q", cfg.TIFFDtype)
 	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
+	// pipelineCtx stops the workers and the aggregator. It outlives ctx by
+	// up to --shutdown-timeout so that the frames in flight are written.
+	pipelineCtx, cancelPipeline := context.WithCancel(context.Background())
+	defer cancelPipeline()
 
 	gridXVal := cfg.GridX
 	gridYVal := cfg.GridY
@@ -127,6 +251,7 @@ func main() {
 	}
 
 	var rawMessages <-chan types.RawMessage
+	var rawLog *output.RawLogWriter
 	endpointUpdates := make(chan string, 1)
 	if cfg.Debug {
 		rawMessages = simulator.Stream(ctx, cfg.GridX, cfg.GridY, cfg.DebugAcqRate)
@@ -135,11 +260,25 @@ func main() {
 		rawMessages = out
 		var recorder ingest.RawRecorder
 		if cfg.RawLogEnabled {
-			writer, err := output.NewRawLogWriter(cfg.RawLogDir, "raw_cbor")
+			writer, err := output.NewRawLogWriter(cfg.RawLogDir, "raw_cbor", output.RawLogOptions{
+				MaxBytes:      cfg.RawLogMaxBytes,
+				MaxAge:        cfg.RawLogMaxAge,
+				PerSeries:     cfg.RawLogPerSeries,
+				RetainBytes:   cfg.RawLogRetainBytes,
+				QueueSize:     cfg.RawLogQueue,
+				QueueBytes:    cfg.RawLogQueueBytes,
+				FlushBytes:    cfg.RawLogBufferBytes,
+				FlushInterval: cfg.RawLogFlush,
+				Sync:          cfg.RawLogSync,
+				Version:       cfg.RawLogVersion,
+				Compression:   cfg.RawLogCompression,
+				Endpoint:      resolvedEndpoint,
+			})
 			if err != nil {
 				log.Fatalf("failed to start raw log: %v", err)
 			}
 			recorder = writer
+			rawLog = writer
 			go func() {
 				<-ctx.Done()
 				if err := writer.Close(); err != nil {
@@ -158,6 +297,11 @@ func main() {
 				}
 				ingestCtx, cancel := context.WithCancel(ctx)
 				ingestCancel = cancel
+				if rawLog != nil {
+					if err := rawLog.SetEndpoint(endpoint); err != nil {
+						log.Printf("raw log endpoint: %v", err)
+					}
+				}
 				frames, err := ingest.StreamWithLogEveryAndRecorder(ingestCtx, endpoint, cfg.IngestLogEvery, recorder)
 				if err != nil {
 					if cfg.IngestFallback {
@@ -205,13 +349,134 @@ func main() {
 	processed := make(chan types.Frame, 128)
 	incoming := make(chan types.RawFrame, 128)
 	uiMessages := make(chan any, 16)
+	defaultSeries := func() processing.SeriesConfig {
+		x, y := getGrid()
+		return processing.SeriesConfig{
+			GridX:          x,
+			GridY:          y,
+			Order:          defaultOrder,
+			PositionMode:   cfg.PositionEndpoint != "",
+			Gridding:       cfg.Gridding,
+			FramesPerPoint: cfg.FramesPerPoint,
+			Combine:        cfg.SubframeCombine,
+			Variance:       cfg.SubframeVariance,
+			PixelSize:      cfg.PixelSize,
+		}
+	}
 	agg := processing.NewAggregator(gridXVal, gridYVal)
-	runTimestamp := ""
+	agg.Configure(defaultSeries())
+	positionUpdates := make(chan types.PositionUpdate, 1024)
+	if cfg.PositionEndpoint != "" {
+		updates, err := ingest.StreamPositions(ctx, cfg.PositionEndpoint, cfg.IngestLogEvery)
+		if err != nil {
+			log.Fatalf("failed to start position stream: %v", err)
+		}
+		go func() {
+			for update := range updates {
+				select {
+				case positionUpdates <- update:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	// The ingest goroutine derives the layout of a series from its start
+	// message; the aggregator picks it up with the first frame of that series.
+	// Frames of earlier series may still be queued when the next start
+	// message arrives, so every series keeps its own entry until then.
+	var pendingSeriesMu sync.Mutex
+	pendingSeries := map[int]processing.SeriesConfig{}
+	var diffraction *processing.DiffractionAccumulator
+	if cfg.DiffractionSum {
+		diffraction = processing.NewDiffractionAccumulator()
+	}
+	var stack *processing.Stack
+	if cfg.StackMode {
+		stack = processing.NewStack()
+	}
+	// nextEnergy is set through the API for series whose start message does
+	// not carry a photon energy.
+	var energyMu sync.Mutex
+	nextEnergy := 0.0
+	// Every series writes its files under the run named by --output-template
+	// from its start message. A run name already in use gets a -2, -3, ...
+	// suffix so that no run overwrites another.
+	runTimestamps := map[int]string{}
+	runFields := map[int]output.TemplateFields{}
+	// retiredRuns are the runs of series ids that a restarted detector
+	// announced again; their names stay taken.
+	retiredRuns := map[string]bool{}
+	seriesStartMeta := map[int]map[string]any{}
+	// resumeRun is the checkpoint to resume: the series it continues keeps
+	// its run instead of being named anew. settleCheckpoint drops it.
+	var resumeRun *output.Checkpoint
 	var runMu sync.Mutex
+	runTimestampFor := func(seriesID int) string {
+		runMu.Lock()
+		if ts, ok := runTimestamps[seriesID]; ok {
+			runMu.Unlock()
+			return ts
+		}
+		if cp := resumeRun; cp != nil && cp.Continues(seriesID, seriesStartMeta[seriesID]) {
+			resumeRun = nil
+			runTimestamps[seriesID] = cp.RunTimestamp
+			runFields[seriesID] = output.FieldsFromStart(cp.Start, cp.SeriesID, cp.Saved)
+			runMu.Unlock()
+			return cp.RunTimestamp
+		}
+		fields := output.FieldsFromStart(seriesStartMeta[seriesID], seriesID, time.Now())
+		runMu.Unlock()
+		taken := func(id string) bool {
+			runMu.Lock()
+			defer runMu.Unlock()
+			return runNameUsed(runTimestamps, retiredRuns, id)
+		}
+		// The output directory is globbed without runMu held; a name
+		// claimed meanwhile is looked up again.
+		for {
+			ts := output.UniqueRunID(cfg.OutputDir, runNames.Expand(fields), taken)
+			runMu.Lock()
+			if current, ok := runTimestamps[seriesID]; ok {
+				runMu.Unlock()
+				return current
+			}
+			if !runNameUsed(runTimestamps, retiredRuns, ts) {
+				if len(runTimestamps) >= maxRunTimestamps {
+					runTimestamps = map[int]string{}
+					runFields = map[int]output.TemplateFields{}
+					retiredRuns = map[string]bool{}
+				}
+				runTimestamps[seriesID] = ts
+				runFields[seriesID] = fields
+				runMu.Unlock()
+				return ts
+			}
+			runMu.Unlock()
+		}
+	}
+	// runFor describes the run of a series to the sinks.
+	runFor := func(seriesID int, seriesCfg processing.SeriesConfig) output.Run {
+		ts := runTimestampFor(seriesID)
+		runMu.Lock()
+		defer runMu.Unlock()
+		return output.Run{RunTimestamp: ts, SeriesID: seriesID, Config: seriesCfg, Fields: runFields[seriesID]}
+	}
 	var statusMu sync.Mutex
 	var metrics metrics
+	var scanHistory *history.Store
+	if cfg.HistorySize > 0 {
+		scanHistory, err = history.Open(cfg.HistoryDir, cfg.HistorySize, cfg.HistoryDisk, func(err error) {
+			metrics.outputWriteError.Add(1)
+			log.Printf("history write failed: %v", err)
+		})
+		if err != nil {
+			log.Fatalf("failed to open scan history: %v", err)
+		}
+	}
 	var latestSnapshotMu sync.Mutex
 	var latestSnapshot types.UISnapshot
+	var latestMaps output.MapSet
 	var hasSnapshot bool
 	var thresholdsMu sync.Mutex
 	currentThresholds := append([]string(nil), cfg.PlotThreshold...)
@@ -230,12 +495,126 @@ func main() {
 		"last_frame":  "",
 		"last_write":  "",
 		"last_ingest": "",
+		"scan_order":  defaultOrder.String(),
 	}
 	type gridUpdate struct {
 		x int
 		y int
 	}
+	type seriesEvent struct {
+		kind     string
+		seriesID int
+		meta     map[string]any
+	}
 	gridUpdates := make(chan gridUpdate, 1)
+	seriesEvents := make(chan seriesEvent, 16)
+
+	if removed, err := output.RemoveTempFiles(cfg.OutputDir); err != nil {
+		log.Printf("failed to remove interrupted output files: %v", err)
+	} else if removed > 0 {
+		log.Printf("removed %d interrupted output files", removed)
+	}
+	var catalog *output.Catalog
+	if cfg.Catalog {
+		catalog, err = output.OpenCatalog(cfg.OutputDir, filepath.Join(cfg.OutputDir, "catalog.json"))
+		if err == nil && *catalogRebuild {
+			err = catalog.Rebuild()
+		}
+		if err != nil {
+			log.Fatalf("failed to open run catalog: %v", err)
+		}
+	}
+	sinks, err := output.NewSinkRegistry(output.SinkConfig{
+		OutputDir:           cfg.OutputDir,
+		Formats:             cfg.OutputFormats,
+		TIFFDtype:           cfg.TIFFDtype,
+		ZarrDiffractionSide: cfg.ZarrDiffractionSide,
+		Catalog:             catalog,
+		WebhookURL:          cfg.WebhookURL,
+		WebhookTimeout:      cfg.WebhookTimeout,
+		MapTemplate:         mapNames,
+	})
+	if err != nil {
+		log.Fatalf("invalid --output-formats: %v", err)
+	}
+	sinks.OnError = func(sink, event string, err error) {
+		if sink == "metadata" {
+			metrics.metadataWriteErr.Add(1)
+		}
+		metrics.outputWriteError.Add(1)
+		log.Printf("%s sink: %s failed: %v", sink, event, err)
+	}
+	log.Printf("output sinks: %s", strings.Join(sinks.Names(), ", "))
+
+	// A checkpoint left by a previous process is resumed or written out by
+	// the aggregator once it knows which series comes next.
+	checkpointPath := filepath.Join(cfg.OutputDir, output.CheckpointFile)
+	resume, err := output.ReadCheckpoint(checkpointPath)
+	if err != nil {
+		log.Printf("ignoring checkpoint: %v", err)
+		resume = nil
+	} else if resume != nil {
+		log.Printf("found checkpoint of series %d (%s) with %d points from %s",
+			resume.SeriesID, resume.RunTimestamp, resume.State.FrameCount, resume.Saved.Format(time.RFC3339))
+		statusMu.Lock()
+		status["checkpoint_pending"] = checkpointStatus(resume)
+		statusMu.Unlock()
+		if cfg.CheckpointResume {
+			resumeRun = resume
+		}
+	}
+	checkpointer := output.NewCheckpointer(checkpointPath, func(cp *output.Checkpoint) {
+		metrics.checkpointWrites.Add(1)
+		// The Zarr chunks of the series are made durable with the checkpoint.
+		sinks.Checkpoint(output.Run{RunTimestamp: cp.RunTimestamp, SeriesID: cp.SeriesID})
+		statusMu.Lock()
+		status["checkpoint"] = checkpointStatus(cp)
+		statusMu.Unlock()
+	}, func(err error) {
+		metrics.outputWriteError.Add(1)
+		log.Printf("checkpoint failed: %v", err)
+	})
+	// Stacks and averages are written by the background writer; the
+	// aggregator hands over copies of them.
+	background := output.NewBackground(16)
+	// recordRun writes the checksum manifest of a run and indexes it in the
+	// catalog. Stacks and averages use it; series runs are recorded by their
+	// sinks.
+	recordRun := func(runTimestamp string) {
+		if err := output.WriteManifest(cfg.OutputDir, runTimestamp); err != nil {
+			metrics.outputWriteError.Add(1)
+			log.Printf("manifest write failed: %v", err)
+		}
+		if catalog == nil {
+			return
+		}
+		if err := catalog.Update(cfg.OutputDir, runTimestamp); err != nil {
+			metrics.outputWriteError.Add(1)
+			log.Printf("catalog update failed: %v", err)
+		}
+	}
+	writeStack := func() {
+		info, layers := stack.Take()
+		if len(layers) == 0 {
+			return
+		}
+		background.Post(func() {
+			if err := output.WriteStack(cfg.OutputDir, info, layers); err != nil {
+				metrics.outputWriteError.Add(1)
+				log.Printf("stack write failed: %v", err)
+				return
+			}
+			if hasFormat(cfg.OutputFormats, "npy") || hasFormat(cfg.OutputFormats, "npz") {
+				if err := output.WriteStackNPZ(cfg.OutputDir, info, layers); err != nil {
+					metrics.outputWriteError.Add(1)
+					log.Printf("stack npz write failed: %v", err)
+				}
+			}
+			recordRun(info.RunTimestamp)
+			metrics.outputWriteOK.Add(1)
+			log.Printf("wrote stack %s with %d energies", info.RunTimestamp, len(layers))
+		})
+	}
 
 	if cfg.Workers < 1 {
 		cfg.Workers = 1
@@ -277,6 +656,7 @@ func main() {
 
 	go func() {
 		defer close(incoming)
+		currentSeries := 0
 		for msg := range rawMessages {
 			metrics.rawMessages.Add(1)
 			statusMu.Lock()
@@ -284,19 +664,71 @@ func main() {
 			statusMu.Unlock()
 			if msg.Type != "image" {
 				metrics.metaMessages.Add(1)
+				runCfg := defaultSeries()
+				var startMeta map[string]any
 				if msg.Type == "start" {
 					normalized := output.NormalizeJSONValue(msg.Meta)
 					log.Printf("start meta:\n%s", mustPrettyJSON(normalized))
+					currentSeries = pipeline.SeriesIDFromMeta(msg.Meta, currentSeries+1)
 					if metaMap, ok := normalized.(map[string]any); ok {
+						seriesCfg, warnings := processing.SeriesConfigFromMeta(metaMap, defaultSeries())
+						if stack != nil && seriesCfg.Energy == 0 {
+							energyMu.Lock()
+							seriesCfg.Energy, nextEnergy = nextEnergy, 0
+							energyMu.Unlock()
+							if seriesCfg.Energy == 0 {
+								seriesCfg.Energy = processing.IncidentEnergy(metaMap)
+							}
+							if seriesCfg.Energy == 0 {
+								warnings = append(warnings, "no photon energy in start message or set through /stack/energy; series is not added to the stack")
+							}
+						}
+						for _, warning := range warnings {
+							log.Printf("series %d: %s", currentSeries, warning)
+							select {
+							case uiMessages <- map[string]any{
+								"type":      "warning",
+								"series_id": currentSeries,
+								"message":   warning,
+							}:
+							default:
+							}
+						}
+						statusMu.Lock()
+						if len(warnings) > 0 {
+							status["series_warnings"] = warnings
+						} else {
+							delete(status, "series_warnings")
+						}
+						statusMu.Unlock()
+						pendingSeriesMu.Lock()
+						if len(pendingSeries) >= maxPendingSeries {
+							pendingSeries = map[int]processing.SeriesConfig{}
+						}
+						pendingSeries[currentSeries] = seriesCfg
+						pendingSeriesMu.Unlock()
+						runMu.Lock()
+						if len(seriesStartMeta) >= maxRunTimestamps {
+							seriesStartMeta = map[int]map[string]any{}
+						}
+						seriesStartMeta[currentSeries] = metaMap
+						// A series id reused after a detector restart
+						// gets a run of its own.
+						if ts, ok := runTimestamps[currentSeries]; ok {
+							retiredRuns[ts] = true
+							delete(runTimestamps, currentSeries)
+							delete(runFields, currentSeries)
+						}
+						runMu.Unlock()
+						runCfg = seriesCfg
+						startMeta = metaMap
 						runMuStatus.Lock()
 						runStartMeta = metaMap
 						runEndMeta = nil
 						framesReceived = 0
-						if v, ok := metaMap["number_of_images"]; ok {
-							if n, err := toInt(v); err == nil {
-								framesExpected = n
-							}
-						}
+						// Images times triggers, like the frames counted
+						// in framesReceived.
+						framesExpected = processing.AnnouncedImages(metaMap)
 						runMuStatus.Unlock()
 					}
 					if channels := extractChannels(msg.Meta); len(channels) > 0 {
@@ -323,36 +755,37 @@ func main() {
 						runMuStatus.Unlock()
 					}
 				}
-				runMu.Lock()
-				if runTimestamp == "" {
-					runTimestamp = processing.Timestamp()
-				}
-				ts := runTimestamp
-				runMu.Unlock()
+				run := runFor(currentSeries, runCfg)
 
 				kind := msg.Type
 				if kind == "" {
 					kind = "metadata"
 				}
-				if err := output.WriteMetadata(cfg.OutputDir, ts, kind, msg.Meta); err != nil {
-					metrics.metadataWriteErr.Add(1)
-					log.Printf("metadata write failed: %v", err)
+				if kind == "start" {
+					sinks.Start(run, msg.Meta)
+				} else {
+					sinks.Metadata(run, kind, msg.Meta)
 				}
-				if msg.Type == "end" {
-					runMu.Lock()
-					runTimestamp = ""
-					runMu.Unlock()
+				if msg.Type == "start" || msg.Type == "end" {
+					select {
+					case <-pipelineCtx.Done():
+						return
+					case seriesEvents <- seriesEvent{kind: msg.Type, seriesID: currentSeries, meta: startMeta}:
+					}
 				}
 				continue
 			}
 
 			metrics.imageMessages.Add(1)
 			frame := msg.Image
+			if frame.SeriesID == 0 {
+				frame.SeriesID = currentSeries
+			}
 			runMuStatus.Lock()
 			framesReceived++
 			runMuStatus.Unlock()
 			select {
-			case <-ctx.Done():
+			case <-pipelineCtx.Done():
 				return
 			case incoming <- frame:
 			}
@@ -366,6 +799,10 @@ func main() {
 			defer wg.Done()
 			for raw := range incoming {
 				start := time.Now()
+				if diffraction != nil {
+					diffraction.Add(raw)
+				}
+				sinks.Frame(raw)
 				frame, ok := processing.ProcessRawFrame(raw)
 				metrics.processCount.Add(1)
 				metrics.processNanos.Add(uint64(time.Since(start).Nanoseconds()))
@@ -378,7 +815,7 @@ func main() {
 				status["last_frame"] = time.Now().Format(time.RFC3339)
 				statusMu.Unlock()
 				select {
-				case <-ctx.Done():
+				case <-pipelineCtx.Done():
 					return
 				case processed <- frame:
 				}
@@ -391,82 +828,415 @@ func main() {
 		close(processed)
 	}()
 
+	// publishGrid makes a new grid visible to the UI and drops the snapshot
+	// of the old one. It runs on the aggregator goroutine.
+	publishGrid := func(x, y int) {
+		setGrid(x, y)
+		latestSnapshotMu.Lock()
+		hasSnapshot = false
+		latestSnapshot = types.UISnapshot{}
+		latestMaps = output.MapSet{}
+		latestSnapshotMu.Unlock()
+		thresholdsMu.Lock()
+		thresholds := append([]string(nil), currentThresholds...)
+		thresholdsMu.Unlock()
+		select {
+		case uiMessages <- map[string]any{
+			"type":       "config",
+			"grid_x":     x,
+			"grid_y":     y,
+			"thresholds": thresholds,
+		}:
+		default:
+		}
+	}
+
+	aggDone := make(chan struct{})
 	go func() {
+		defer close(aggDone)
 		defer close(uiMessages)
 		if cfg.UIRate <= 0 {
 			cfg.UIRate = 1 * time.Second
 		}
 		ticker := time.NewTicker(cfg.UIRate)
 		defer ticker.Stop()
+		lastDiffractionSeries := 0
+		lastDiffractionCount := 0
+		snapshotSeries, snapshotFrames := 0, 0
+		defer checkpointer.Close()
+		var checkpointTick <-chan time.Time
+		if cfg.CheckpointInterval > 0 {
+			checkpointTicker := time.NewTicker(cfg.CheckpointInterval)
+			defer checkpointTicker.Stop()
+			checkpointTick = checkpointTicker.C
+		}
+		// checkpointSeries and checkpointFrames describe the checkpoint on
+		// disk, if checkpointed.
+		checkpointed := false
+		checkpointSeries, checkpointFrames := 0, 0
+		// clearCheckpoint drops the checkpoint once its series is written
+		// out or discarded.
+		clearCheckpoint := func() {
+			if checkpointed {
+				checkpointer.Clear()
+			}
+			checkpointed = false
+		}
+		earlyPositions := map[int][]types.PositionUpdate{}
+		// endTimer fires once the frames of a series whose end message,
+		// abort or disarm is pending should be through the workers.
+		var endTimer <-chan time.Time
+		var lastFrameAt time.Time
+		var average *processing.RepeatAverage
+		if cfg.Average {
+			average = processing.NewRepeatAverage(cfg.AverageRepeats)
+		}
+		publishAverage := func(seriesID int) {
+			statusMu.Lock()
+			status["average"] = map[string]any{
+				"passes":     average.Passes(),
+				"repeats":    average.Repeats(),
+				"series_ids": average.SeriesIDs(),
+			}
+			statusMu.Unlock()
+			select {
+			case uiMessages <- averageMessage(seriesID, average):
+			default:
+			}
+		}
+
+		// finalizeSeries writes the series in the aggregator, complete or
+		// not; the tracker then leaves a clean aggregator for the next one.
+		finalizeSeries := func(seriesID int, reason string) {
+			received := agg.FrameCount()
+			seriesCfg := agg.Config()
+			expected := seriesCfg.ExpectedPoints()
+			run := runFor(seriesID, seriesCfg)
+			ts := run.RunTimestamp
+			result := output.NewSeriesResult(run, agg, reason)
+			complete, summary, maps := result.Complete, result.Summary, result.Maps
+			if diffraction != nil {
+				result.Diffraction = diffraction.Snapshot(seriesID)
+			}
+
+			statusMu.Lock()
+			status["filewriter"] = "writing"
+			statusMu.Unlock()
+			// The sinks write from their own goroutines; the aggregator
+			// goes on with the next series meanwhile.
+			writeStart := time.Now()
+			sinks.End(result, func(failed int) {
+				metrics.writeCount.Add(1)
+				metrics.writeNanos.Add(uint64(time.Since(writeStart).Nanoseconds()))
+				if failed > 0 {
+					log.Printf("series outputs for %s: %d sinks failed", ts, failed)
+					statusMu.Lock()
+					status["filewriter"] = "error"
+					statusMu.Unlock()
+					return
+				}
+				metrics.outputWriteOK.Add(1)
+				log.Printf("wrote series outputs for %s", ts)
+				statusMu.Lock()
+				status["filewriter"] = "ok"
+				status["last_write"] = time.Now().Format(time.RFC3339)
+				statusMu.Unlock()
+			})
+			if stack != nil && seriesCfg.Energy > 0 {
+				if !stack.Fits(seriesCfg.StackID, seriesCfg.GridX, seriesCfg.GridY) {
+					writeStack()
+				}
+				layer := processing.StackLayer{
+					Energy:   seriesCfg.Energy,
+					SeriesID: seriesID,
+					Complete: complete,
+					Channels: agg.SnapshotCopy(),
+				}
+				if stack.Add(seriesCfg.StackID, ts, seriesCfg.GridX, seriesCfg.GridY, seriesCfg.StackSize, layer) {
+					writeStack()
+				}
+			}
+			if average != nil && complete {
+				done := average.Add(seriesID, ts, seriesCfg, agg.Snapshot())
+				snapshot := average.Snapshot()
+				background.Post(func() {
+					if err := output.WriteAverage(cfg.OutputDir, snapshot); err != nil {
+						metrics.outputWriteError.Add(1)
+						log.Printf("average write failed: %v", err)
+					}
+					recordRun(snapshot.RunTimestamp)
+				})
+				publishAverage(seriesID)
+				if done {
+					log.Printf("average %s complete after %d passes", average.RunTimestamp(), average.Passes())
+					average.Reset()
+				}
+			}
+			if scanHistory != nil {
+				runMu.Lock()
+				startMeta := seriesStartMeta[seriesID]
+				runMu.Unlock()
+				scanHistory.Add(history.Entry{
+					Summary: history.Summary{
+						SeriesID:     seriesID,
+						RunTimestamp: ts,
+						Finished:     time.Now(),
+						Complete:     complete,
+						Reason:       reason,
+						GridX:        seriesCfg.GridX,
+						GridY:        seriesCfg.GridY,
+						Frames:       received,
+						PixelSize:    seriesCfg.StepSize(),
+					},
+					Meta:       startMeta,
+					Timestamps: maps.Timestamps,
+					Snapshot:   types.UISnapshot{Type: "snapshot", Data: maps.Maps},
+				})
+			}
+			statusMu.Lock()
+			status["last_series"] = summary
+			statusMu.Unlock()
+			if !complete {
+				log.Printf("series %d finalized incomplete (%s): %d/%d points", seriesID, reason, received, expected)
+			}
+			// A series cut short by shutdown keeps its checkpoint so that
+			// the next start resumes it into the same run.
+			if reason != "shutdown" {
+				clearCheckpoint()
+			}
+		}
+		// The tracker decides when a series is finalized, with the same
+		// rules as stxm-reprocess.
+		tracker := pipeline.NewTracker(agg, func(seriesID int) processing.SeriesConfig {
+			pendingSeriesMu.Lock()
+			defer pendingSeriesMu.Unlock()
+			// A series without a start message of its own gets the
+			// defaults, not the layout of the series before it.
+			if seriesCfg, ok := pendingSeries[seriesID]; ok {
+				delete(pendingSeries, seriesID)
+				return seriesCfg
+			}
+			return defaultSeries()
+		}, finalizeSeries)
+		tracker.OnSeries = func(seriesID int, previousCfg processing.SeriesConfig) {
+			seriesCfg := agg.Config()
+			if seriesCfg.GridX != previousCfg.GridX || seriesCfg.GridY != previousCfg.GridY {
+				log.Printf("series %d: grid %dx%d", seriesID, seriesCfg.GridX, seriesCfg.GridY)
+				publishGrid(seriesCfg.GridX, seriesCfg.GridY)
+			}
+			statusMu.Lock()
+			status["scan_order"] = seriesCfg.Order.String()
+			statusMu.Unlock()
+			for _, update := range earlyPositions[seriesID] {
+				agg.SetPosition(update.ImageID, update.Position)
+			}
+			earlyPositions = map[int][]types.PositionUpdate{}
+		}
+
+		// settleCheckpoint restores the checkpoint of the previous process.
+		// It carries on with the series when seriesID continues it and
+		// otherwise writes it out as interrupted.
+		settleCheckpoint := func(seriesID int, start map[string]any) {
+			cp := resume
+			resume = nil
+			statusMu.Lock()
+			delete(status, "checkpoint_pending")
+			statusMu.Unlock()
+			runMu.Lock()
+			resumeRun = nil
+			runMu.Unlock()
+			if err := agg.Restore(cp.State); err != nil {
+				log.Printf("discarding checkpoint of series %d: %v", cp.SeriesID, err)
+				checkpointed = true
+				clearCheckpoint()
+				return
+			}
+			runMu.Lock()
+			currentTS, hasTS := runTimestamps[cp.SeriesID]
+			currentFields := runFields[cp.SeriesID]
+			currentStart, hasStart := seriesStartMeta[cp.SeriesID]
+			runTimestamps[cp.SeriesID] = cp.RunTimestamp
+			runFields[cp.SeriesID] = output.FieldsFromStart(cp.Start, cp.SeriesID, cp.Saved)
+			seriesStartMeta[cp.SeriesID] = cp.Start
+			runMu.Unlock()
+			revert := tracker.Resume(cp.SeriesID)
+			checkpointed = true
+			checkpointSeries, checkpointFrames = cp.SeriesID, agg.FrameCount()
+			restored := agg.Config()
+			if x, y := getGrid(); x != restored.GridX || y != restored.GridY {
+				publishGrid(restored.GridX, restored.GridY)
+			}
+			if cfg.CheckpointResume && cp.Continues(seriesID, start) {
+				log.Printf("resumed series %d (%s) from checkpoint with %d points", cp.SeriesID, cp.RunTimestamp, agg.FrameCount())
+				return
+			}
+			tracker.Finalize("interrupted")
+			// The next series may reuse the id of the checkpoint when the
+			// detector restarted; its frames are not late frames and it
+			// keeps its own run.
+			revert()
+			runMu.Lock()
+			delete(runTimestamps, cp.SeriesID)
+			delete(runFields, cp.SeriesID)
+			delete(seriesStartMeta, cp.SeriesID)
+			if hasTS {
+				runTimestamps[cp.SeriesID] = currentTS
+				runFields[cp.SeriesID] = currentFields
+			}
+			if hasStart {
+				seriesStartMeta[cp.SeriesID] = currentStart
+			}
+			runMu.Unlock()
+		}
+		if resume != nil && !cfg.CheckpointResume {
+			settleCheckpoint(0, nil)
+		}
+
+		// saveCheckpoint checkpoints the series in progress unless the
+		// checkpoint on disk is up to date.
+		saveCheckpoint := func() {
+			series := tracker.Series()
+			if agg.FrameCount() == 0 || (checkpointed && series == checkpointSeries && agg.FrameCount() == checkpointFrames) {
+				return
+			}
+			runMu.Lock()
+			start := seriesStartMeta[series]
+			runMu.Unlock()
+			cp := &output.Checkpoint{
+				SeriesID:     series,
+				RunTimestamp: runTimestampFor(series),
+				Saved:        time.Now(),
+				Start:        start,
+				State:        agg.State(),
+			}
+			if checkpointer.Save(cp) {
+				checkpointed = true
+				checkpointSeries, checkpointFrames = series, agg.FrameCount()
+			}
+		}
+
+		// finishPipeline writes what the pipeline holds once it stops: the
+		// series in progress as incomplete and an unfinished energy stack.
+		finishPipeline := func() {
+			if resume != nil {
+				log.Printf("shutdown: keeping the checkpoint of series %d for the next start", resume.SeriesID)
+			}
+			if received := agg.FrameCount(); received > 0 {
+				reason := tracker.StopReason("shutdown")
+				seriesID, expected := tracker.Series(), agg.Config().ExpectedPoints()
+				ts := runTimestampFor(seriesID)
+				if reason == "shutdown" && checkpointTick != nil {
+					saveCheckpoint()
+				}
+				tracker.Finalize(reason)
+				log.Printf("shutdown: saved series %d as %s with %d/%d points", seriesID, ts, received, expected)
+			} else {
+				log.Printf("shutdown: no series in progress")
+			}
+			if stack != nil && stack.Len() > 0 {
+				writeStack()
+			}
+		}
+
 		for {
 			select {
 			case update := <-gridUpdates:
 				if update.x < 1 || update.y < 1 {
 					continue
 				}
-				setGrid(update.x, update.y)
-				agg = processing.NewAggregator(update.x, update.y)
-				latestSnapshotMu.Lock()
-				hasSnapshot = false
-				latestSnapshot = types.UISnapshot{}
-				latestSnapshotMu.Unlock()
+				seriesCfg := agg.Config()
+				seriesCfg.GridX = update.x
+				seriesCfg.GridY = update.y
+				agg.Configure(seriesCfg)
+				clearCheckpoint()
+				if diffraction != nil {
+					diffraction.Reset()
+				}
 				runMuStatus.Lock()
 				framesExpected = 0
 				framesReceived = 0
 				runMuStatus.Unlock()
-				thresholdsMu.Lock()
-				thresholds := append([]string(nil), currentThresholds...)
-				thresholdsMu.Unlock()
-				select {
-				case uiMessages <- map[string]any{
-					"type":       "config",
-					"grid_x":     update.x,
-					"grid_y":     update.y,
-					"thresholds": thresholds,
-				}:
+				publishGrid(update.x, update.y)
+			case update := <-positionUpdates:
+				if update.SeriesID != 0 && update.SeriesID != tracker.Series() {
+					if len(earlyPositions[update.SeriesID]) < maxEarlyPositions {
+						earlyPositions[update.SeriesID] = append(earlyPositions[update.SeriesID], update)
+					}
+					continue
+				}
+				agg.SetPosition(update.ImageID, update.Position)
+			case event := <-seriesEvents:
+				switch event.kind {
+				case "start":
+					if resume != nil {
+						settleCheckpoint(event.seriesID, event.meta)
+					}
+					tracker.Start(event.seriesID)
+				case "end":
+					tracker.End(event.seriesID, "end")
+					endTimer = time.After(endGrace)
+				case "stack_finish":
+					writeStack()
+				case "average_reset":
+					if average != nil {
+						average.Reset()
+						publishAverage(tracker.Series())
+					}
 				default:
+					// Abort and disarm: the frames already in the workers
+					// still belong to the series.
+					tracker.End(tracker.Series(), event.kind)
+					endTimer = time.After(endGrace)
 				}
-			case <-ctx.Done():
+			case <-endTimer:
+				// Frames of the ended series may still be in the workers;
+				// wait until the pipeline has been quiet for endGrace. An
+				// aborted series may still be acquiring, so it is written
+				// after one grace period.
+				if wait := endGrace - time.Since(lastFrameAt); wait > 0 && tracker.PendingReason() == "end" {
+					endTimer = time.After(wait)
+					continue
+				}
+				endTimer = nil
+				tracker.FinishEnd()
+			case <-pipelineCtx.Done():
+				finishPipeline()
 				return
 			case frame, ok := <-processed:
 				if !ok {
-					flushSnapshot(&metrics, uiMessages, agg, &latestSnapshotMu, &latestSnapshot, &hasSnapshot, &imageStatsMu, &imageStats)
+					flushSnapshot(&metrics, uiMessages, agg, &latestSnapshotMu, &latestSnapshot, &latestMaps, &hasSnapshot, &imageStatsMu, &imageStats)
+					finishPipeline()
 					return
 				}
-				if agg.AddFrame(frame) {
-					runMu.Lock()
-					if runTimestamp == "" {
-						runTimestamp = processing.Timestamp()
-					}
-					ts := runTimestamp
-					runMu.Unlock()
-
-					statusMu.Lock()
-					status["filewriter"] = "writing"
-					statusMu.Unlock()
-					writeStart := time.Now()
-					x, y := getGrid()
-					err := output.WriteSeries(cfg.OutputDir, ts, x, y, agg.Snapshot())
-					metrics.writeCount.Add(1)
-					metrics.writeNanos.Add(uint64(time.Since(writeStart).Nanoseconds()))
-					if err != nil {
-						metrics.outputWriteError.Add(1)
-						log.Printf("output write failed: %v", err)
-						statusMu.Lock()
-						status["filewriter"] = "error"
-						statusMu.Unlock()
-					} else {
-						metrics.outputWriteOK.Add(1)
-						log.Printf("wrote series outputs for %s", ts)
-						statusMu.Lock()
-						status["filewriter"] = "ok"
-						status["last_write"] = time.Now().Format(time.RFC3339)
-						statusMu.Unlock()
-					}
-					agg.Reset()
+				lastFrameAt = time.Now()
+				if resume != nil && frame.SeriesID != tracker.Series() {
+					settleCheckpoint(frame.SeriesID, nil)
+				}
+				if !tracker.Add(frame) {
+					metrics.framesLate.Add(1)
 				}
+			case <-checkpointTick:
+				saveCheckpoint()
 			case <-ticker.C:
-				flushSnapshot(&metrics, uiMessages, agg, &latestSnapshotMu, &latestSnapshot, &hasSnapshot, &imageStatsMu, &imageStats)
+				maps, ok := flushSnapshot(&metrics, uiMessages, agg, &latestSnapshotMu, &latestSnapshot, &latestMaps, &hasSnapshot, &imageStatsMu, &imageStats)
+				// The sinks only see snapshots that have new frames.
+				if series := tracker.Series(); ok && (series != snapshotSeries || agg.FrameCount() != snapshotFrames) {
+					snapshotSeries, snapshotFrames = series, agg.FrameCount()
+					sinks.Snapshot(runFor(series, agg.Config()), maps)
+				}
+				if diffraction != nil {
+					seriesID, frames := diffraction.Latest()
+					if count := diffractionFrameCount(frames); count != lastDiffractionCount || seriesID != lastDiffractionSeries {
+						lastDiffractionCount = count
+						lastDiffractionSeries = seriesID
+						if count > 0 {
+							select {
+							case uiMessages <- diffractionMessage(seriesID, frames):
+							default:
+							}
+						}
+					}
+				}
 			}
 		}
 	}()
@@ -519,6 +1289,11 @@ func main() {
 		metricsPayload["ingest_decode_failures_total"] = ingest.DecodeFailures()
 		decodeCount, decodeNanos := ingest.DecodeTiming()
 		metricsPayload["ingest_decode_total"] = decodeCount
+		if rawLog != nil {
+			rawStatus := rawLog.Status()
+			metricsPayload["raw_log_dropped_total"] = rawStatus.Dropped
+			metricsPayload["raw_log_lag_seconds"] = rawStatus.LagSeconds
+		}
 		metricsPayload["ingest_decode_nanos_total"] = decodeNanos
 		copy["metrics"] = metricsPayload
 		runMuStatus.Lock()
@@ -536,9 +1311,19 @@ func main() {
 			copy["image_stats"] = imageStats
 		}
 		imageStatsMu.Unlock()
+		copy["sinks"] = sinks.Stats()
+		if rawLog != nil {
+			copy["raw_log"] = rawLog.Status()
+		}
 		return copy
 	}
 
+	mapsFn := func() (output.MapSet, bool) {
+		latestSnapshotMu.Lock()
+		defer latestSnapshotMu.Unlock()
+		return latestMaps, hasSnapshot
+	}
+
 	snapshotFn := func() any {
 		latestSnapshotMu.Lock()
 		defer latestSnapshotMu.Unlock()
@@ -577,6 +1362,38 @@ func main() {
 		}
 	}
 
+	abortFn := func(reason string) error {
+		select {
+		case seriesEvents <- seriesEvent{kind: reason}:
+			return nil
+		default:
+			return fmt.Errorf("series event queue full")
+		}
+	}
+
+	stackEnergyFn := func(energy float64) error {
+		energyMu.Lock()
+		nextEnergy = energy
+		energyMu.Unlock()
+		return nil
+	}
+	stackFinishFn := func() error {
+		select {
+		case seriesEvents <- seriesEvent{kind: "stack_finish"}:
+			return nil
+		default:
+			return fmt.Errorf("series event queue full")
+		}
+	}
+	averageResetFn := func() error {
+		select {
+		case seriesEvents <- seriesEvent{kind: "average_reset"}:
+			return nil
+		default:
+			return fmt.Errorf("series event queue full")
+		}
+	}
+
 	endpointFn := func(ip string, zmqPort int, apiPort int) error {
 		if ip == "" || zmqPort < 1 || apiPort < 1 {
 			return fmt.Errorf("invalid endpoint configuration")
@@ -594,15 +1411,72 @@ func main() {
 		return nil
 	}
 
-	if err := server.Run(ctx, cfg, uiMessages, statusFn, snapshotFn, configFn, gridFn, endpointFn); err != nil {
+	handlers := server.Handlers{
+		Status:   statusFn,
+		Snapshot: snapshotFn,
+		Maps:     mapsFn,
+		Config:   configFn,
+		Grid:     gridFn,
+		Endpoint: endpointFn,
+		Abort:    abortFn,
+		History:  scanHistory,
+		Catalog:  catalog,
+	}
+	if stack != nil {
+		handlers.Stack = stack
+		handlers.StackEnergy = stackEnergyFn
+		handlers.StackFinish = stackFinishFn
+	}
+	if cfg.Average {
+		handlers.AverageReset = averageResetFn
+	}
+	if diffraction != nil {
+		handlers.Diffraction = diffraction.Latest
+	}
+
+	var processedAtStop atomic.Uint64
+	go func() {
+		<-ctx.Done()
+		processedAtStop.Store(metrics.framesProcessed.Load())
+	}()
+	if err := server.Run(ctx, cfg, uiMessages, handlers); err != nil {
 		log.Printf("server stopped: %v", err)
 	}
+
+	// Ingest stops with ctx; the frames already received still go through
+	// the workers and the aggregator, which writes the series in progress.
+	stop()
+	log.Printf("shutdown: draining the pipeline (timeout %s)", cfg.ShutdownTimeout)
+	select {
+	case <-aggDone:
+	case <-time.After(cfg.ShutdownTimeout):
+		log.Printf("shutdown: pipeline not drained after %s; writing the frames aggregated so far", cfg.ShutdownTimeout)
+		cancelPipeline()
+		select {
+		case <-aggDone:
+		case <-time.After(cfg.ShutdownTimeout):
+			log.Printf("shutdown: series not written after another %s; exiting", cfg.ShutdownTimeout)
+			os.Exit(1)
+		}
+	}
+	cancelPipeline()
+	background.Close()
+	if err := sinks.Close(); err != nil {
+		log.Printf("closing output sinks: %v", err)
+	}
+	if scanHistory != nil {
+		scanHistory.Close()
+	}
+	snapshot := metrics.snapshot()
+	log.Printf("shutdown complete: %d frames drained, %v outputs written, %v write errors",
+		metrics.framesProcessed.Load()-processedAtStop.Load(), snapshot["output_write_ok_total"], snapshot["output_write_err_total"])
 }
 
-func flushSnapshot(metrics *metrics, uiMessages chan any, agg *processing.Aggregator, latestSnapshotMu *sync.Mutex, latestSnapshot *types.UISnapshot, hasSnapshot *bool, imageStatsMu *sync.Mutex, imageStats *map[string]map[string]float64) {
-	snapshotData := agg.SnapshotCopy()
+func flushSnapshot(metrics *metrics, uiMessages chan any, agg *processing.Aggregator, latestSnapshotMu *sync.Mutex, latestSnapshot *types.UISnapshot, latestMaps *output.MapSet, hasSnapshot *bool, imageStatsMu *sync.Mutex, imageStats *map[string]map[string]float64) (output.MapSet, bool) {
+	maps := output.MapsOf(agg)
+	snapshotData := maps.Maps
 	if len(snapshotData) == 0 {
-		return
+		return maps, false
 	}
 	if imageStatsMu != nil && imageStats != nil {
 		stats := make(map[string]map[string]float64, len(snapshotData))
@@ -652,6 +1526,7 @@ func flushSnapshot(metrics *metrics, uiMessages chan any, agg *processing.Aggreg
 	}
 	latestSnapshotMu.Lock()
 	*latestSnapshot = message
+	*latestMaps = maps
 	*hasSnapshot = true
 	latestSnapshotMu.Unlock()
 	select {
@@ -659,6 +1534,111 @@ func flushSnapshot(metrics *metrics, uiMessages chan any, agg *processing.Aggreg
 		metrics.framesBroadcast.Add(1)
 	default:
 	}
+	return maps, true
+}
+
+// diffractionMessage builds the websocket update for the accumulated patterns.
+// Patterns are binned down to a preview so the message stays small; the full
+// resolution data is available from GET /diffraction.
+func diffractionMessage(seriesID int, frames map[string]types.DiffractionFrame) map[string]any {
+	channels := make(map[string]any, len(frames))
+	for channel, frame := range frames {
+		preview, width, height := processing.BinPattern(processing.DiffractionMean(frame), frame.Width, frame.Height, diffractionPreviewSide)
+		channels[channel] = map[string]any{
+			"width":          frame.Width,
+			"height":         frame.Height,
+			"frames":         frame.Frames,
+			"preview_width":  width,
+			"preview_height": height,
+			"preview_mean":   preview,
+		}
+	}
+	return map[string]any{
+		"type":      "diffraction",
+		"series_id": seriesID,
+		"channels":  channels,
+	}
+}
+
+const diffractionPreviewSide = 128
+
+// endGrace is how long the pipeline must be quiet after an end message before
+// a partial series is finalized.
+const endGrace = 500 * time.Millisecond
+
+// runNameUsed reports whether a series already has or had the run named id.
+func runNameUsed(runTimestamps map[int]string, retired map[string]bool, id string) bool {
+	if retired[id] {
+		return true
+	}
+	for _, used := range runTimestamps {
+		if used == id {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRunTimestamps bounds the per-series timestamp table.
+const maxRunTimestamps = 64
+
+// maxPendingSeries bounds the layouts of announced series whose first frame
+// has not reached the aggregator yet.
+const maxPendingSeries = 16
+
+// maxEarlyPositions bounds the positions buffered for a series whose first
+// frame has not reached the aggregator yet.
+const maxEarlyPositions = 1 << 20
+
+func diffractionFrameCount(frames map[string]types.DiffractionFrame) int {
+	count := 0
+	for _, frame := range frames {
+		count += frame.Frames
+	}
+	return count
+}
+
+// checkpointStatus summarizes a checkpoint for /status.
+func checkpointStatus(cp *output.Checkpoint) map[string]any {
+	return map[string]any{
+		"series_id": cp.SeriesID,
+		"run":       cp.RunTimestamp,
+		"points":    cp.State.FrameCount,
+		"saved":     cp.Saved.Format(time.RFC3339),
+	}
+}
+
+// averageMessage carries the mean and standard deviation maps of a repeated
+// scan to the UI.
+func averageMessage(seriesID int, average *processing.RepeatAverage) map[string]any {
+	mean, std := processing.AverageSnapshots(average.Maps())
+	return map[string]any{
+		"type":      "average",
+		"series_id": seriesID,
+		"passes":    average.Passes(),
+		"repeats":   average.Repeats(),
+		"data":      mean,
+		"std":       std,
+	}
+}
+
+func splitList(value string) []string {
+	var out []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func hasFormat(formats []string, format string) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
 }
 
 func mustPrettyJSON(value any) string {
@@ -693,22 +1673,3 @@ func extractChannels(meta map[string]any) []string {
 	}
 	return out
 }
-
-func toInt(v any) (int, error) {
-	switch n := v.(type) {
-	case int:
-		return n, nil
-	case int64:
-		return int(n), nil
-	case uint64:
-		return int(n), nil
-	case uint32:
-		return int(n), nil
-	case float64:
-		return int(n), nil
-	case float32:
-		return int(n), nil
-	default:
-		return 0, fmt.Errorf("unsupported int type %T", v)
-	}
-}
@@ -1,85 +1,500 @@
 package main
 
 import (
-	"encoding/binary"
+	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/bits"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
 
 	"stxm-map-go/internal/output"
+	"stxm-map-go/internal/rawlog"
 )
 
-const rawLogMagic = "STXMRAW1"
-
 func main() {
 	var (
-		path  = flag.String("path", "", "Path to rawlog .bin file")
-		limit = flag.Int("limit", 1, "Number of records to dump")
+		path     = flag.String("path", "", "Path to rawlog .bin file")
+		limit    = flag.Int("limit", -1, "Number of records to dump, list or export (0 for all; default 1 to dump or list, all to export)")
+		from     = flag.Int("record", 0, "Start at this record number")
+		imageID  = flag.Int("image-id", -1, "Start at the first image with this image_id")
+		seriesID = flag.Int("series", 0, "Only records of this series, and the series of --image-id (0 matches any)")
+		types    = flag.String("type", "", "Only these message types, comma separated (start, image, end, undecodable, ...)")
+		images   = flag.String("images", "", "Only images with image_id in N, N-M, N- or -M; other messages are kept")
+		since    = flag.String("since", "", "Only records received at or after this RFC3339 time")
+		until    = flag.String("until", "", "Only records received before this RFC3339 time")
+		index    = flag.Bool("index", false, "List the index (offset, time, type, series, image_id) instead of the payloads")
+		summary  = flag.Bool("summary", false, "Summarize the selected records (counts, rates, gaps, sizes) instead of the payloads")
+		truncate = flag.Int("truncate", 0, "Shorten byte strings and arrays in dumped payloads to this many elements (0 prints them in full)")
+		exportTo = flag.String("export-dir", "", "Write the selected records to this directory as individual .cbor files")
+		exportLg = flag.String("export-rawlog", "", "Write the selected records to this new raw log, with their receive times")
+		exportV  = flag.Int("export-version", 0, "Format version of --export-rawlog: 1 or 2 (default: that of the input)")
+		exportGz = flag.String("export-compression", "", "Compression of --export-rawlog: none or gzip (default: that of the input)")
+		tolerant = flag.Bool("recover", true, "Stop quietly at a truncated last record")
 	)
 	flag.Parse()
 
 	if *path == "" {
 		log.Fatal("path is required")
 	}
+	filter, err := parseFilter(*types, *seriesID, *images, *since, *until)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	f, err := os.Open(*path)
+	r, err := rawlog.Open(*path)
 	if err != nil {
 		log.Fatalf("open rawlog: %v", err)
 	}
-	defer f.Close()
+	defer r.Close()
+	r.Recover = *tolerant
+	logHeader(r.Header())
 
-	header := make([]byte, len(rawLogMagic))
-	if _, err := io.ReadFull(f, header); err != nil {
-		log.Fatalf("read magic: %v", err)
+	var sinks []sink
+	if *exportTo != "" {
+		if err := os.MkdirAll(*exportTo, 0o755); err != nil {
+			log.Fatalf("export dir: %v", err)
+		}
+		sinks = append(sinks, exportFile(*exportTo))
+	}
+	if *exportLg != "" {
+		w, err := newExportLog(*exportLg, r.Header(), *exportV, *exportGz)
+		if err != nil {
+			log.Fatalf("export rawlog: %v", err)
+		}
+		defer func() {
+			if err := w.Close(); err != nil {
+				log.Fatalf("export rawlog: %v", err)
+			}
+			log.Printf("wrote %d records to %s", w.records, *exportLg)
+		}()
+		sinks = append(sinks, w.write)
 	}
-	if string(header) != rawLogMagic {
-		log.Fatalf("unexpected rawlog magic %q", string(header))
+	// Exports take every selected record unless --limit says otherwise.
+	if *limit < 0 {
+		*limit = 1
+		if len(sinks) > 0 {
+			*limit = 0
+		}
+	}
+	if len(sinks) == 0 {
+		sinks = append(sinks, printRecord(*truncate))
 	}
 
-	count := 0
-	for {
-		if *limit > 0 && count >= *limit {
+	// Seeking, filtering and listing use the sidecar index, built on first
+	// use.
+	next := r.Next
+	if *index || *summary || *from > 0 || *imageID >= 0 || !filter.IsZero() {
+		idx, err := rawlog.LoadIndex(*path)
+		if err != nil {
+			log.Fatalf("index rawlog: %v", err)
+		}
+		start := *from
+		switch {
+		case *imageID >= 0:
+			entry, ok := idx.FindImage(*seriesID, *imageID)
+			if !ok {
+				log.Fatalf("no image %d (series %d) in %s", *imageID, *seriesID, *path)
+			}
+			start = entry.Index
+		case *from > 0:
+			if _, ok := idx.Record(*from); !ok {
+				log.Fatalf("no record %d: %s has %d records", *from, *path, len(idx.Entries))
+			}
+		}
+		entries := idx.Select(filter, start)
+		if *summary {
+			summarize(entries)
 			return
 		}
-		var meta [12]byte
-		if _, err := io.ReadFull(f, meta[:]); err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return
+		if *limit > 0 && len(entries) > *limit {
+			entries = entries[:*limit]
+		}
+		if *index {
+			listIndex(entries)
+			if idx.Truncated {
+				log.Printf("the log ends in a truncated record")
 			}
-			log.Fatalf("read record header: %v", err)
+			return
+		}
+		next = selected(r, entries)
+	}
+
+	for count := 0; *limit <= 0 || count < *limit; count++ {
+		record, err := next()
+		if err == io.EOF {
+			break
 		}
-		ts := int64(binary.LittleEndian.Uint64(meta[:8]))
-		size := binary.LittleEndian.Uint32(meta[8:12])
-		if size == 0 {
-			log.Printf("record %d: empty payload", count)
+		if errors.Is(err, rawlog.ErrCorrupt) {
+			log.Printf("skipping %v", err)
 			continue
 		}
-		payload := make([]byte, size)
-		if _, err := io.ReadFull(f, payload); err != nil {
-			log.Fatalf("read payload: %v", err)
+		if err != nil {
+			log.Fatalf("read record: %v", err)
+		}
+		for _, write := range sinks {
+			if err := write(record); err != nil {
+				log.Fatalf("record %d: %v", record.Index, err)
+			}
+		}
+	}
+	if r.Truncated() {
+		log.Printf("skipped a truncated record at offset %d", r.Offset())
+	}
+}
+
+func parseFilter(types string, seriesID int, images, since, until string) (rawlog.Filter, error) {
+	filter := rawlog.Filter{SeriesID: seriesID}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			filter.Types = append(filter.Types, t)
+		}
+	}
+	if images != "" {
+		r, err := rawlog.ParseIDRange(images)
+		if err != nil {
+			return rawlog.Filter{}, err
+		}
+		filter.Images = &r
+	}
+	var err error
+	if since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339Nano, since); err != nil {
+			return rawlog.Filter{}, fmt.Errorf("invalid --since: %w", err)
+		}
+	}
+	if until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339Nano, until); err != nil {
+			return rawlog.Filter{}, fmt.Errorf("invalid --until: %w", err)
+		}
+	}
+	return filter, nil
+}
+
+// selected reads the records of entries, seeking only past the records in
+// between.
+func selected(r *rawlog.Reader, entries []rawlog.IndexEntry) func() (rawlog.Record, error) {
+	return func() (rawlog.Record, error) {
+		if len(entries) == 0 {
+			return rawlog.Record{}, io.EOF
+		}
+		entry := entries[0]
+		entries = entries[1:]
+		if r.Offset() != entry.Offset {
+			if err := r.Seek(entry); err != nil {
+				return rawlog.Record{}, fmt.Errorf("seek rawlog: %w", err)
+			}
+		}
+		return r.Next()
+	}
+}
+
+// sink handles a selected record.
+type sink func(rawlog.Record) error
+
+// printRecord logs the record and prints its payload as JSON.
+func printRecord(truncate int) sink {
+	return func(record rawlog.Record) error {
+		if len(record.Payload) == 0 {
+			log.Printf("record %d: empty payload", record.Index)
+			return nil
 		}
 
 		var decoded any
-		if err := cbor.Unmarshal(payload, &decoded); err != nil {
-			log.Printf("record %d: CBOR decode error: %v", count, err)
-			continue
+		if err := cbor.Unmarshal(record.Payload, &decoded); err != nil {
+			log.Printf("record %d: CBOR decode error: %v", record.Index, err)
+			return nil
 		}
 
 		normalized := output.NormalizeJSONValue(decoded)
+		if truncate > 0 {
+			normalized = truncateValue(normalized, truncate)
+		}
 		pretty, err := json.MarshalIndent(normalized, "", "  ")
 		if err != nil {
-			log.Printf("record %d: JSON encode error: %v", count, err)
-			continue
+			log.Printf("record %d: JSON encode error: %v", record.Index, err)
+			return nil
 		}
 
-		log.Printf("record %d timestamp=%s size=%d", count, time.Unix(0, ts).Format(time.RFC3339Nano), size)
+		log.Printf("record %d timestamp=%s size=%d stored=%d flags=%s", record.Index, record.Received.Format(time.RFC3339Nano), len(record.Payload), record.StoredSize, rawlog.FlagNames(record.Flags))
 		fmt.Println(string(pretty))
-		count++
+		return nil
+	}
+}
+
+// truncateValue shortens the byte strings and arrays of a decoded payload,
+// the typed arrays in tags included, to n elements.
+func truncateValue(value any, n int) any {
+	switch v := value.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, val := range v {
+			out[key] = truncateValue(val, n)
+		}
+		return out
+	case []any:
+		if len(v) <= n {
+			out := make([]any, len(v))
+			for i, val := range v {
+				out[i] = truncateValue(val, n)
+			}
+			return out
+		}
+		out := make([]any, n+1)
+		for i, val := range v[:n] {
+			out[i] = truncateValue(val, n)
+		}
+		out[n] = fmt.Sprintf("... %d of %d items", len(v)-n, len(v))
+		return out
+	case []byte:
+		if len(v) <= n {
+			return v
+		}
+		return fmt.Sprintf("%x... %d bytes", v[:n], len(v))
+	case cbor.Tag:
+		return cbor.Tag{Number: v.Number, Content: truncateValue(v.Content, n)}
+	default:
+		return value
+	}
+}
+
+// exportFile writes each record to dir as a CBOR file named after its
+// record number, type, series and image, so that the files sort in record
+// order.
+func exportFile(dir string) sink {
+	return func(record rawlog.Record) error {
+		entry := rawlog.EntryOf(record)
+		var name string
+		switch entry.Type {
+		case "image":
+			name = fmt.Sprintf("%06d_image_s%06d_%06d.cbor", entry.Index, entry.SeriesID, entry.ImageID)
+		case "start", "end":
+			name = fmt.Sprintf("%06d_%s_s%06d.cbor", entry.Index, entry.Type, entry.SeriesID)
+		case "":
+			name = fmt.Sprintf("%06d_%s.cbor", entry.Index, rawlog.TypeUndecodable)
+		default:
+			name = fmt.Sprintf("%06d_other.cbor", entry.Index)
+		}
+		return os.WriteFile(filepath.Join(dir, name), record.Payload, 0o644)
+	}
+}
+
+// exportLog is a new raw log of selected records.
+type exportLog struct {
+	file    *os.File
+	w       *bufio.Writer
+	enc     *rawlog.Encoder
+	records int
+}
+
+// newExportLog creates path, which must not exist, with the endpoint of the
+// input header, format version and compression. A version of 0 keeps that
+// of the input, and an empty compression that of the input when the version
+// is kept.
+func newExportLog(path string, input rawlog.Header, version int, compression string) (*exportLog, error) {
+	if version == 0 {
+		version = input.Version
+	}
+	if compression == "" && version == input.Version {
+		compression = input.Compression
+	}
+	enc, err := rawlog.NewEncoder(rawlog.Header{Version: version, Compression: compression, Endpoint: input.Endpoint})
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	e := &exportLog{file: file, w: bufio.NewWriter(file), enc: enc}
+	if _, err := enc.WriteHeader(e.w, time.Now()); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *exportLog) write(record rawlog.Record) error {
+	if _, err := e.enc.WriteRecord(e.w, record.Received, record.Payload); err != nil {
+		return err
+	}
+	e.records++
+	return nil
+}
+
+// Close flushes and closes the log.
+func (e *exportLog) Close() error {
+	if err := e.w.Flush(); err != nil {
+		_ = e.file.Close()
+		return err
+	}
+	return e.file.Close()
+}
+
+// listIndex prints index entries.
+func listIndex(entries []rawlog.IndexEntry) {
+	fmt.Println("record\toffset\tsize\ttimestamp\ttype\tseries_id\timage_id\tflags")
+	for _, e := range entries {
+		fmt.Printf("%d\t%d\t%d\t%s\t%s\t%d\t%d\t%s\n", e.Index, e.Offset, e.Size, e.Received.Format(time.RFC3339Nano), e.Type, e.SeriesID, e.ImageID, rawlog.FlagNames(e.Flags))
+	}
+}
+
+// summarize prints the counts and rates per message type and series, the
+// largest gaps between records and the distribution of stored record sizes.
+func summarize(entries []rawlog.IndexEntry) {
+	if len(entries) == 0 {
+		fmt.Println("no records selected")
+		return
+	}
+	first, last := entries[0].Received, entries[len(entries)-1].Received
+	span := last.Sub(first)
+	fmt.Printf("records: %d from %s to %s (%s)\n", len(entries), first.Format(time.RFC3339Nano), last.Format(time.RFC3339Nano), span)
+
+	type typeStats struct {
+		count int
+		bytes int64
+	}
+	byType := map[string]*typeStats{}
+	var typeNames []string
+	for _, e := range entries {
+		name := e.Type
+		if name == "" {
+			name = rawlog.TypeUndecodable
+		}
+		if byType[name] == nil {
+			byType[name] = &typeStats{}
+			typeNames = append(typeNames, name)
+		}
+		byType[name].count++
+		byType[name].bytes += int64(e.Size)
+	}
+	sort.Strings(typeNames)
+	fmt.Println("type\tcount\trate/s\tbytes")
+	for _, name := range typeNames {
+		s := byType[name]
+		fmt.Printf("%s\t%d\t%s\t%d\n", name, s.count, rate(s.count, span), s.bytes)
+	}
+
+	summarizeSeries(entries)
+	summarizeGaps(entries)
+	summarizeSizes(entries)
+}
+
+// summarizeSeries prints the images of every series, with the image ids
+// missing between its first and last image.
+func summarizeSeries(entries []rawlog.IndexEntry) {
+	type seriesStats struct {
+		images        int
+		ids           map[int]bool
+		first, last   int
+		start, finish time.Time
+	}
+	series := map[int]*seriesStats{}
+	var ids []int
+	for _, e := range entries {
+		if e.Type != "image" {
+			continue
+		}
+		s := series[e.SeriesID]
+		if s == nil {
+			s = &seriesStats{ids: map[int]bool{}, first: e.ImageID, last: e.ImageID, start: e.Received}
+			series[e.SeriesID] = s
+			ids = append(ids, e.SeriesID)
+		}
+		s.images++
+		s.ids[e.ImageID] = true
+		if e.ImageID < s.first {
+			s.first = e.ImageID
+		}
+		if e.ImageID > s.last {
+			s.last = e.ImageID
+		}
+		s.finish = e.Received
+	}
+	if len(ids) == 0 {
+		return
+	}
+	sort.Ints(ids)
+	fmt.Println("series\timages\timage_ids\tmissing\tduplicates\trate/s")
+	for _, id := range ids {
+		s := series[id]
+		missing := s.last - s.first + 1 - len(s.ids)
+		fmt.Printf("%d\t%d\t%d-%d\t%d\t%d\t%s\n", id, s.images, s.first, s.last, missing, s.images-len(s.ids), rate(s.images, s.finish.Sub(s.start)))
+	}
+}
+
+// maxGaps is the number of gaps between records the summary lists.
+const maxGaps = 5
+
+// summarizeGaps prints the largest gaps between consecutive records.
+func summarizeGaps(entries []rawlog.IndexEntry) {
+	if len(entries) < 2 {
+		return
+	}
+	gaps := make([]int, 0, len(entries)-1)
+	for i := 1; i < len(entries); i++ {
+		gaps = append(gaps, i)
+	}
+	gap := func(i int) time.Duration { return entries[i].Received.Sub(entries[i-1].Received) }
+	sort.SliceStable(gaps, func(a, b int) bool { return gap(gaps[a]) > gap(gaps[b]) })
+	if len(gaps) > maxGaps {
+		gaps = gaps[:maxGaps]
+	}
+	fmt.Println("largest gaps:")
+	for _, i := range gaps {
+		fmt.Printf("  %s before record %d (%s)\n", gap(i), entries[i].Index, entries[i].Received.Format(time.RFC3339Nano))
+	}
+}
+
+// summarizeSizes prints percentiles and a power of two histogram of the
+// stored record sizes.
+func summarizeSizes(entries []rawlog.IndexEntry) {
+	sizes := make([]int, len(entries))
+	var total int64
+	for i, e := range entries {
+		sizes[i] = e.Size
+		total += int64(e.Size)
+	}
+	sort.Ints(sizes)
+	percentile := func(q float64) int { return sizes[int(q*float64(len(sizes)-1))] }
+	fmt.Printf("stored size: total=%d min=%d p50=%d p90=%d p99=%d max=%d\n",
+		total, sizes[0], percentile(0.5), percentile(0.9), percentile(0.99), sizes[len(sizes)-1])
+
+	// Bucket k holds the sizes below 2^k.
+	var buckets [65]int
+	for _, size := range sizes {
+		buckets[bits.Len64(uint64(size))]++
+	}
+	for k, n := range buckets {
+		if n > 0 {
+			fmt.Printf("  < %d\t%d\n", uint64(1)<<k, n)
+		}
+	}
+}
+
+// rate formats count per second of span, "-" for an empty span.
+func rate(count int, span time.Duration) string {
+	if span <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.3g", float64(count)/span.Seconds())
+}
+
+// logHeader describes the file. Version 1 files have no header beyond their
+// magic.
+func logHeader(h rawlog.Header) {
+	if h.Version == 1 {
+		log.Printf("format version 1 (%s)", rawlog.Magic)
+		return
 	}
+	log.Printf("format version %d (%s) compression=%s endpoint=%q created=%s", h.Version, rawlog.MagicV2, h.Compression, h.Endpoint, h.Created.Format(time.RFC3339Nano))
 }
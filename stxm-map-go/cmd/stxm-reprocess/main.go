@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"stxm-map-go/internal/output"
+	"stxm-map-go/internal/pipeline"
+	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/rawlog"
+)
+
+// roiFlags collects repeated --roi flags.
+type roiFlags []processing.ROI
+
+func (f *roiFlags) String() string {
+	specs := make([]string, len(*f))
+	for i, roi := range *f {
+		specs[i] = fmt.Sprintf("%s=%d,%d,%d,%d", roi.Name, roi.X, roi.Y, roi.Width, roi.Height)
+	}
+	return strings.Join(specs, " ")
+}
+
+func (f *roiFlags) Set(spec string) error {
+	roi, err := processing.ParseROI(spec)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, roi)
+	return nil
+}
+
+func main() {
+	var rois roiFlags
+	var (
+		input           = flag.String("input", "", "Raw log (.bin), directory of raw logs, or directory of .cbor messages")
+		outputDir       = flag.String("output-dir", "reprocessed", "Directory for the output data files")
+		outputFormats   = flag.String("output-formats", "text", "Comma separated output formats: text, tiff, npy, npz, zarr")
+		tiffDtype       = flag.String("tiff-dtype", output.TIFFFloat32, "Sample type of TIFF maps: float32 or uint32")
+		pixelSize       = flag.Float64("pixel-size", 0, "Scan step in micrometres, stored in TIFF maps (0 if unknown)")
+		zarrSide        = flag.Int("zarr-diffraction-side", 32, "Bin diffraction patterns in Zarr stores to at most this many pixels per side (0 stores no patterns)")
+		diffractionSum  = flag.Bool("diffraction-sum", true, "Accumulate sum and max diffraction patterns per series")
+		catalogEnabled  = flag.Bool("catalog", true, "Index the output directory in <output-dir>/catalog.json")
+		runTemplate     = flag.String("output-template", output.DefaultRunTemplate, "Path of every run below --output-dir; fields: {proposal}, {sample_name}, {series_unique_id}, {series_id}, {date}, {time}, {timestamp}")
+		mapTemplate     = flag.String("output-map-template", "", "File names of the text and npy maps of a run without extension")
+		gridX           = flag.Int("grid-x", 52, "Grid width of series whose start message has no layout")
+		gridY           = flag.Int("grid-y", 52, "Grid height of series whose start message has no layout")
+		forceGrid       = flag.Bool("force-grid", false, "Use --grid-x/--grid-y for every series, whatever its start message announces")
+		scanOrder       = flag.String("scan-order", "raster", "Default scan traversal: raster, snake, column or column-snake, optionally with flip-x/flip-y")
+		gridding        = flag.String("gridding", processing.GriddingBin, "Gridding of position based scans: bin or nearest")
+		positionMode    = flag.Bool("position-mode", false, "Place points by position, as the service does with --position-endpoint; the positions come from user_data or the images, since the position stream is not recorded")
+		framesPerPoint  = flag.Int("frames-per-point", 0, "Detector frames per scan point (0 derives it from nimages/ntrigger)")
+		subframeCombine = flag.String("subframe-combine", processing.CombineSum, "Combination of the frames of a scan point: sum, mean or max")
+		subframeVar     = flag.Bool("subframe-variance", false, "Export the variance of the frames of each scan point as float maps")
+		reducer         = flag.String("reducer", processing.ReduceCount, "Reduction of a detector image to a map value: count (as the live service), sum or max")
+		maskPath        = flag.String("mask", "", "Detector pixel mask as a 2-D .npy array; nonzero pixels are left out")
+		onlySeries      = flag.Int("series", 0, "Only reprocess this series (0 reprocesses all)")
+	)
+	flag.Var(&rois, "roi", "Detector region [name=]x,y,width,height; repeat for several. A named region adds the channels {channel}_{name}, an unnamed one restricts the channels")
+	flag.Parse()
+
+	if *input == "" {
+		log.Fatal("--input is required")
+	}
+	order, err := processing.ParseScanOrder(*scanOrder)
+	if err != nil {
+		log.Fatalf("invalid --scan-order: %v", err)
+	}
+	if *gridding != processing.GriddingBin && *gridding != processing.GriddingNearest {
+		log.Fatalf("invalid --gridding %q", *gridding)
+	}
+	switch *subframeCombine {
+	case processing.CombineSum, processing.CombineMean, processing.CombineMax:
+	default:
+		log.Fatalf("invalid --subframe-combine %q", *subframeCombine)
+	}
+	if *gridX < 1 || *gridY < 1 {
+		log.Fatalf("invalid grid %dx%d", *gridX, *gridY)
+	}
+	reduction := processing.Reduction{Reducer: *reducer, ROIs: rois}
+	if *maskPath != "" {
+		reduction.Mask, reduction.MaskWidth, err = output.ReadMaskNPY(*maskPath)
+		if err != nil {
+			log.Fatalf("read --mask: %v", err)
+		}
+	}
+	if err := reduction.Validate(); err != nil {
+		log.Fatalf("invalid reduction: %v", err)
+	}
+	runNames, err := output.ParseRunTemplate(*runTemplate)
+	if err != nil {
+		log.Fatalf("invalid --output-template: %v", err)
+	}
+	var mapNames *output.PathTemplate
+	if *mapTemplate != "" {
+		mapNames, err = output.ParseMapTemplate(*mapTemplate)
+		if err != nil {
+			log.Fatalf("invalid --output-map-template: %v", err)
+		}
+	}
+	files, rawLogs, err := listInput(*input)
+	if err != nil {
+		log.Fatalf("list input: %v", err)
+	}
+
+	var catalog *output.Catalog
+	if *catalogEnabled {
+		catalog, err = output.OpenCatalog(*outputDir, filepath.Join(*outputDir, "catalog.json"))
+		if err != nil {
+			log.Fatalf("open run catalog: %v", err)
+		}
+	}
+	sinks, err := output.NewSinkRegistry(output.SinkConfig{
+		OutputDir:           *outputDir,
+		Formats:             splitList(*outputFormats),
+		TIFFDtype:           *tiffDtype,
+		ZarrDiffractionSide: *zarrSide,
+		Catalog:             catalog,
+		MapTemplate:         mapNames,
+		// Offline, a slow sink holds up the input instead of losing frames.
+		Lossless: true,
+	})
+	if err != nil {
+		log.Fatalf("invalid --output-formats: %v", err)
+	}
+	p := pipeline.NewReplayer(pipeline.ReplayConfig{
+		OutputDir: *outputDir,
+		Sinks:     sinks,
+		RunNames:  runNames,
+		Reduction: reduction,
+		Defaults: processing.SeriesConfig{
+			GridX:          *gridX,
+			GridY:          *gridY,
+			Order:          order,
+			PositionMode:   *positionMode,
+			Gridding:       *gridding,
+			FramesPerPoint: *framesPerPoint,
+			Combine:        *subframeCombine,
+			Variance:       *subframeVar,
+			PixelSize:      *pixelSize,
+		},
+		ForceGrid:   *forceGrid,
+		Series:      *onlySeries,
+		Diffraction: *diffractionSum,
+	})
+	// failures is counted from the goroutines of the sinks.
+	var failures atomic.Int64
+	sinks.OnError = func(sink, event string, err error) {
+		failures.Add(1)
+		log.Printf("%s sink: %s failed: %v", sink, event, err)
+	}
+	log.Printf("output sinks: %s", strings.Join(sinks.Names(), ", "))
+
+	for _, file := range files {
+		if rawLogs {
+			err = readRawLog(file, p.Message)
+		} else {
+			err = readCBOR(file, p.Message)
+		}
+		if err != nil {
+			log.Fatalf("%s: %v", file, err)
+		}
+	}
+	p.Finish()
+	if err := sinks.Close(); err != nil {
+		log.Printf("close sinks: %v", err)
+		failures.Add(1)
+	}
+	log.Printf("read %d messages (%d images, %d undecodable, %d late) from %d files; wrote %d series",
+		p.Messages, p.Images, p.Undecodable, p.Late, len(files), p.Written)
+	if n := failures.Load(); n > 0 {
+		log.Fatalf("%d output writes failed", n)
+	}
+}
+
+// listInput returns the raw logs or .cbor messages of path in name order,
+// which is the order they were recorded in.
+func listInput(path string) ([]string, bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if !info.IsDir() {
+		return []string{path}, filepath.Ext(path) != ".cbor", nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, false, err
+	}
+	var logs, messages []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".bin":
+			logs = append(logs, filepath.Join(path, entry.Name()))
+		case ".cbor":
+			messages = append(messages, filepath.Join(path, entry.Name()))
+		}
+	}
+	switch {
+	case len(logs) > 0 && len(messages) > 0:
+		return nil, false, fmt.Errorf("%s holds both raw logs and .cbor files", path)
+	case len(logs) > 0:
+		sort.Strings(logs)
+		return logs, true, nil
+	case len(messages) > 0:
+		sort.Strings(messages)
+		return messages, false, nil
+	}
+	return nil, false, fmt.Errorf("no raw logs or .cbor files in %s", path)
+}
+
+// readRawLog passes the records of a raw log to fn. A truncated last record,
+// as left by a service that did not shut down, and records that cannot be
+// decompressed are skipped.
+func readRawLog(path string, fn func([]byte, time.Time) error) error {
+	r, err := rawlog.Open(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	r.Recover = true
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, rawlog.ErrCorrupt) {
+			log.Printf("%s: %v", path, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(record.Payload, record.Received); err != nil {
+			return err
+		}
+	}
+	if r.Truncated() {
+		log.Printf("%s: skipped a truncated record at offset %d", path, r.Offset())
+	}
+	return nil
+}
+
+// readCBOR passes one message file to fn with its modification time.
+func readCBOR(path string, fn func([]byte, time.Time) error) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return fn(data, info.ModTime())
+}
+
+func splitList(value string) []string {
+	var out []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -16,8 +16,44 @@ type AppConfig struct {
 	UIRate              time.Duration
 	RawLogEnabled       bool
 	RawLogDir           string
+	RawLogMaxBytes      int64
+	RawLogMaxAge        time.Duration
+	RawLogPerSeries     bool
+	RawLogRetainBytes   int64
+	RawLogQueue         int
+	RawLogQueueBytes    int64
+	RawLogBufferBytes   int
+	RawLogFlush         time.Duration
+	RawLogSync          string
+	RawLogVersion       int
+	RawLogCompression   string
 	PlotThreshold       []string
 	OutputDir           string
 	IngestLogEvery      int
 	IngestFallback      bool
+	DiffractionSum      bool
+	ScanOrder           string
+	PositionEndpoint    string
+	Gridding            string
+	StackMode           bool
+	FramesPerPoint      int
+	SubframeCombine     string
+	SubframeVariance    bool
+	Average             bool
+	AverageRepeats      int
+	HistorySize         int
+	HistoryDisk         int
+	HistoryDir          string
+	Catalog             bool
+	OutputFormats       []string
+	TIFFDtype           string
+	PixelSize           float64
+	ZarrDiffractionSide int
+	WebhookURL          string
+	WebhookTimeout      time.Duration
+	CheckpointInterval  time.Duration
+	CheckpointResume    bool
+	ShutdownTimeout     time.Duration
+	OutputTemplate      string
+	OutputMapTemplate   string
 }
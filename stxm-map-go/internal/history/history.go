@@ -0,0 +1,358 @@
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"stxm-map-go/internal/output"
+	"stxm-map-go/internal/types"
+)
+
+const indexFile = "index.json"
+
+// Summary describes a finished scan without its maps.
+type Summary struct {
+	ID           string    `json:"id"`
+	SeriesID     int       `json:"series_id"`
+	RunTimestamp string    `json:"run_timestamp"`
+	Finished     time.Time `json:"finished"`
+	Complete     bool      `json:"complete"`
+	Reason       string    `json:"reason"`
+	GridX        int       `json:"grid_x"`
+	GridY        int       `json:"grid_y"`
+	Frames       int       `json:"frames"`
+	PixelSize    float64   `json:"pixel_size,omitempty"`
+	Channels     []string  `json:"channels"`
+	InMemory     bool      `json:"in_memory"`
+}
+
+// Entry is a finished scan: its maps and masks in the UI snapshot format,
+// the acquisition time of every pixel and the start message metadata.
+type Entry struct {
+	Summary
+	Meta       map[string]any       `json:"meta,omitempty"`
+	Timestamps map[string][]float64 `json:"timestamps,omitempty"`
+	Snapshot   types.UISnapshot     `json:"snapshot"`
+}
+
+// ID names an entry after its run timestamp and series. The directories of
+// runs below the output directory are joined with '~', which run names
+// never contain, so that the id stays one file name and URL element.
+func ID(runTimestamp string, seriesID int) string {
+	return fmt.Sprintf("%s_s%d", strings.ReplaceAll(runTimestamp, "/", "~"), seriesID)
+}
+
+// Store holds the last memory entries in memory and the last disk entries
+// as JSON files in dir. A disk limit of zero keeps the history in memory only.
+// The files are written from a goroutine of the store so that Add does not
+// wait for the disk.
+type Store struct {
+	mu        sync.Mutex
+	dir       string
+	memory    int
+	disk      int
+	summaries []Summary
+	entries   map[string]*Entry
+	// pending holds the entries queued for writing, so that Get finds them
+	// before their file exists.
+	pending map[string]*Entry
+	queue   []diskOp
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+	onError func(error)
+}
+
+// diskOp writes the file of an entry, or removes the file of id when entry
+// is nil.
+type diskOp struct {
+	id    string
+	entry *Entry
+}
+
+// Open loads the index of the entries already in dir. onError, if not nil,
+// is called from the writer goroutine for every failed write.
+func Open(dir string, memory, disk int, onError func(error)) (*Store, error) {
+	if memory < 1 {
+		memory = 1
+	}
+	s := &Store{
+		dir:     dir,
+		memory:  memory,
+		disk:    disk,
+		entries: make(map[string]*Entry),
+		pending: make(map[string]*Entry),
+		onError: onError,
+	}
+	if disk <= 0 {
+		return s, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	summaries, err := s.loadIndex()
+	if err != nil {
+		summaries, err = s.scan()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Only the newest disk entries have files; the index may list more
+	// when it was written with larger limits.
+	for len(summaries) > disk {
+		_ = os.Remove(s.path(summaries[0].ID))
+		summaries = summaries[1:]
+	}
+	s.summaries = summaries
+	s.wake = make(chan struct{}, 1)
+	s.done = make(chan struct{})
+	go s.run()
+	return s, nil
+}
+
+func (s *Store) loadIndex() ([]Summary, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, indexFile))
+	if err != nil {
+		return nil, err
+	}
+	var summaries []Summary
+	if err := json.Unmarshal(data, &summaries); err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
+
+// scan rebuilds the index from the entry files.
+func (s *Store) scan() ([]Summary, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var summaries []Summary
+	for _, file := range files {
+		if filepath.Base(file) == indexFile {
+			continue
+		}
+		entry, err := readEntry(file)
+		if err != nil {
+			continue
+		}
+		summaries = append(summaries, entry.Summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Finished.Before(summaries[j].Finished)
+	})
+	return summaries, nil
+}
+
+// Add stores a finished scan, evicting the oldest entries beyond the limits.
+// Its file is written in the background.
+func (s *Store) Add(entry Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry.ID == "" {
+		entry.ID = ID(entry.RunTimestamp, entry.SeriesID)
+	}
+	if entry.Channels == nil {
+		for channel := range entry.Snapshot.Data {
+			entry.Channels = append(entry.Channels, channel)
+		}
+		sort.Strings(entry.Channels)
+	}
+	for i, summary := range s.summaries {
+		if summary.ID == entry.ID {
+			s.summaries = append(s.summaries[:i], s.summaries[i+1:]...)
+			break
+		}
+	}
+	s.summaries = append(s.summaries, entry.Summary)
+	s.entries[entry.ID] = &entry
+	if s.disk > 0 && !s.closed {
+		s.pending[entry.ID] = &entry
+		s.queue = append(s.queue, diskOp{id: entry.ID, entry: &entry})
+	}
+	s.prune()
+	if s.disk > 0 && !s.closed {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// prune keeps the newest memory entries in memory and the files of the
+// newest disk entries, and forgets the scans that are in neither.
+func (s *Store) prune() {
+	kept := make([]Summary, 0, len(s.summaries))
+	inMemory := 0
+	for i := len(s.summaries) - 1; i >= 0; i-- {
+		rank := len(s.summaries) - 1 - i
+		id := s.summaries[i].ID
+		if _, ok := s.entries[id]; ok {
+			inMemory++
+			if inMemory > s.memory {
+				delete(s.entries, id)
+			}
+		}
+		// Every Add moves at most one entry past the disk limit.
+		if s.disk > 0 && rank == s.disk && !s.closed {
+			delete(s.pending, id)
+			s.queue = append(s.queue, diskOp{id: id})
+		}
+		if _, ok := s.entries[id]; ok || rank < s.disk {
+			kept = append(kept, s.summaries[i])
+		}
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	s.summaries = kept
+}
+
+// run applies the queued disk operations in order and rewrites the index
+// after each batch.
+func (s *Store) run() {
+	defer close(s.done)
+	for range s.wake {
+		for {
+			s.mu.Lock()
+			ops := s.queue
+			s.queue = nil
+			summaries := append([]Summary(nil), s.summaries...)
+			s.mu.Unlock()
+			if len(ops) == 0 {
+				break
+			}
+			for _, op := range ops {
+				s.apply(op)
+			}
+			if err := s.writeIndex(summaries); err != nil {
+				s.report(err)
+			}
+		}
+	}
+}
+
+func (s *Store) apply(op diskOp) {
+	if op.entry == nil {
+		if err := os.Remove(s.path(op.id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.report(err)
+		}
+		return
+	}
+	data, err := json.Marshal(op.entry)
+	if err == nil {
+		err = writeFile(s.path(op.id), data)
+	}
+	if err != nil {
+		s.report(err)
+	}
+	s.mu.Lock()
+	if s.pending[op.id] == op.entry {
+		delete(s.pending, op.id)
+	}
+	s.mu.Unlock()
+}
+
+func (s *Store) report(err error) {
+	if s.onError != nil {
+		s.onError(err)
+	}
+}
+
+// Close writes the queued entries and stops the writer goroutine.
+func (s *Store) Close() {
+	s.mu.Lock()
+	if s.closed || s.wake == nil {
+		s.closed = true
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.wake)
+	s.mu.Unlock()
+	<-s.done
+}
+
+func (s *Store) writeIndex(summaries []Summary) error {
+	data, err := json.MarshalIndent(summaries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(s.dir, indexFile), data)
+}
+
+func writeFile(path string, data []byte) error {
+	return output.WriteFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// List returns the summaries of all stored scans, newest first.
+func (s *Store) List() []Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]Summary, 0, len(s.summaries))
+	for i := len(s.summaries) - 1; i >= 0; i-- {
+		summary := s.summaries[i]
+		_, summary.InMemory = s.entries[summary.ID]
+		out = append(out, summary)
+	}
+	return out
+}
+
+// Get returns a stored scan from memory or, for older scans, from disk. The
+// file is read without the lock held, so that Add does not wait for it.
+func (s *Store) Get(id string) (*Entry, error) {
+	s.mu.Lock()
+	if entry, ok := s.entries[id]; ok {
+		s.mu.Unlock()
+		return entry, nil
+	}
+	if entry, ok := s.pending[id]; ok {
+		s.mu.Unlock()
+		return entry, nil
+	}
+	known := false
+	for _, summary := range s.summaries {
+		if summary.ID == id {
+			known = true
+			break
+		}
+	}
+	s.mu.Unlock()
+	if !known || s.disk <= 0 || strings.ContainsAny(id, `/\`) {
+		return nil, fmt.Errorf("unknown scan %q", id)
+	}
+	entry, err := readEntry(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		// Pruned since the lookup.
+		return nil, fmt.Errorf("unknown scan %q", id)
+	}
+	return entry, err
+}
+
+func readEntry(path string) (*Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
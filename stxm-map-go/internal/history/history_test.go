@@ -0,0 +1,86 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+
+	"stxm-map-go/internal/types"
+)
+
+func testEntry(ts string, seriesID int) Entry {
+	return Entry{
+		Summary: Summary{SeriesID: seriesID, RunTimestamp: ts, GridX: 2, GridY: 1},
+		Snapshot: types.UISnapshot{
+			Type: "snapshot",
+			Data: map[string]types.ThresholdSnapshot{
+				"threshold_0": {Values: []uint32{uint32(seriesID), 0}, Mask: []bool{true, false}},
+			},
+		},
+	}
+}
+
+func TestStoreBoundsAndReload(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, 1, 2, func(err error) { t.Error(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		store.Add(testEntry("20260101_000000", i))
+	}
+	list := store.List()
+	if len(list) != 2 || list[0].SeriesID != 3 || !list[0].InMemory || list[1].InMemory {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+	if _, err := store.Get(ID("20260101_000000", 1)); err == nil {
+		t.Fatal("evicted scan still available")
+	}
+	entry, err := store.Get(ID("20260101_000000", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Snapshot.Data["threshold_0"].Values[0] != 2 {
+		t.Fatalf("unexpected snapshot: %+v", entry.Snapshot)
+	}
+	store.Close()
+
+	reopened, err := Open(dir, 1, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.List(); len(list) != 2 || list[0].SeriesID != 3 || list[0].InMemory {
+		t.Fatalf("unexpected list after reopen: %+v", list)
+	}
+	if _, err := reopened.Get("../index"); err == nil {
+		t.Fatal("expected error for unknown id")
+	}
+}
+
+func TestStoreKeepsDiskLimitBelowMemory(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, 3, 1, func(err error) { t.Error(err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		store.Add(testEntry("20260101_000000", i))
+	}
+	if list := store.List(); len(list) != 3 || !list[2].InMemory {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+	store.Close()
+	files, err := filepath.Glob(filepath.Join(dir, "*_s*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Base(files[0]) != ID("20260101_000000", 3)+".json" {
+		t.Fatalf("got files %v, want only the newest scan", files)
+	}
+	reopened, err := Open(dir, 3, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.List(); len(list) != 1 || list[0].SeriesID != 3 {
+		t.Fatalf("unexpected list after reopen: %+v", list)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -45,6 +46,13 @@ type RawRecorder interface {
 	Record(payload []byte) error
 }
 
+// SeriesRecorder is a RawRecorder that is told when a series starts, before
+// its start message is recorded.
+type SeriesRecorder interface {
+	RawRecorder
+	StartSeries(seriesID int) error
+}
+
 func StreamWithLogEveryAndRecorder(ctx context.Context, endpoint string, logEvery int, recorder RawRecorder) (<-chan types.RawMessage, error) {
 	if logEvery < 1 {
 		logEvery = 1
@@ -91,13 +99,19 @@ func streamWithConfig(ctx context.Context, endpoint string, logEvery int, record
 				continue
 			}
 
+			// Messages are recorded whether they decode or not.
+			message, ok := decodeMessage(msg, logEvery)
 			if recorder != nil {
+				if series, isSeries := recorder.(SeriesRecorder); isSeries && ok && message.Type == "start" {
+					seriesID, _ := toInt(message.Meta["series_id"])
+					if err := series.StartSeries(seriesID); err != nil {
+						logEveryN(logEvery, "ingest raw log error: %v", err)
+					}
+				}
 				if err := recorder.Record(msg); err != nil {
 					logEveryN(logEvery, "ingest raw log error: %v", err)
 				}
 			}
-
-			message, ok := decodeMessage(msg, logEvery)
 			if !ok {
 				logEveryN(logEvery, "ingest decode skipped message")
 				continue
@@ -114,6 +128,15 @@ func streamWithConfig(ctx context.Context, endpoint string, logEvery int, record
 	return out, nil
 }
 
+// DecodeMessage decodes a recorded message the way the stream does. Errors
+// are logged, every logEvery-th of them.
+func DecodeMessage(msg []byte, logEvery int) (types.RawMessage, bool) {
+	if logEvery < 1 {
+		logEvery = 1
+	}
+	return decodeMessage(msg, logEvery)
+}
+
 func decodeMessage(msg []byte, logEvery int) (types.RawMessage, bool) {
 	start := time.Now()
 	defer func() {
@@ -121,18 +144,30 @@ func decodeMessage(msg []byte, logEvery int) (types.RawMessage, bool) {
 		decodeNanos.Add(uint64(time.Since(start).Nanoseconds()))
 	}()
 
-	var payload map[string]any
-	if err := cbor.Unmarshal(msg, &payload); err != nil {
-		logEveryN(logEvery, "ingest CBOR decode error: %v", err)
+	message, channelErrs, err := Decode(msg)
+	for _, key := range sortedKeys(channelErrs) {
+		logEveryN(logEvery, "ingest failed to decode %s: %v", key, channelErrs[key])
+	}
+	if err != nil {
+		logEveryN(logEvery, "ingest %v", err)
 		decodeFailures.Add(1)
 		return types.RawMessage{}, false
 	}
+	return message, true
+}
+
+// Decode decodes a Stream V2 message. Image channels that cannot be decoded
+// are left out of the data and returned in channelErrs; an image without
+// any decoded channel is an error.
+func Decode(msg []byte) (message types.RawMessage, channelErrs map[string]error, err error) {
+	var payload map[string]any
+	if err := cbor.Unmarshal(msg, &payload); err != nil {
+		return types.RawMessage{}, nil, fmt.Errorf("CBOR decode error: %w", err)
+	}
 
 	msgType, _ := payload["type"].(string)
 	if msgType == "" {
-		logEveryN(logEvery, "ingest missing message type")
-		decodeFailures.Add(1)
-		return types.RawMessage{}, false
+		return types.RawMessage{}, nil, errors.New("missing message type")
 	}
 
 	if msgType != "image" {
@@ -146,52 +181,60 @@ func decodeMessage(msg []byte, logEvery int) (types.RawMessage, bool) {
 		return types.RawMessage{
 			Type: msgType,
 			Meta: meta,
-		}, true
+		}, nil, nil
 	}
 
 	dataRaw, ok := toStringMap(payload["data"])
 	if !ok {
-		logEveryN(logEvery, "ingest invalid data field")
-		decodeFailures.Add(1)
-		return types.RawMessage{}, false
+		return types.RawMessage{}, nil, errors.New("invalid data field")
 	}
 
 	decoded := make(map[string]any, len(dataRaw))
 	for key, value := range dataRaw {
 		array, err := decodeMultiDimArray(value)
 		if err != nil {
-			logEveryN(logEvery, "ingest failed to decode %s: %v", key, err)
+			if channelErrs == nil {
+				channelErrs = map[string]error{}
+			}
+			channelErrs[key] = err
 			continue
 		}
 		decoded[key] = array
 	}
 	if len(decoded) == 0 {
-		logEveryN(logEvery, "ingest image had no decoded channels")
-		decodeFailures.Add(1)
-		return types.RawMessage{}, false
+		return types.RawMessage{}, channelErrs, errors.New("image had no decoded channels")
 	}
 
 	imageID, err := toInt(payload["image_id"])
 	if err != nil {
-		logEveryN(logEvery, "ingest invalid image_id: %v", err)
-		decodeFailures.Add(1)
-		return types.RawMessage{}, false
+		return types.RawMessage{}, channelErrs, fmt.Errorf("invalid image_id: %w", err)
 	}
 	startTime, err := parseTimeValue(payload["start_time"])
 	if err != nil {
-		logEveryN(logEvery, "ingest invalid start_time: %v", err)
-		decodeFailures.Add(1)
-		return types.RawMessage{}, false
+		return types.RawMessage{}, channelErrs, fmt.Errorf("invalid start_time: %w", err)
 	}
+	seriesID, _ := toInt(payload["series_id"])
+	position := parsePosition(payload["user_data"])
 
 	return types.RawMessage{
 		Type: "image",
 		Image: types.RawFrame{
 			ImageID:   imageID,
+			SeriesID:  seriesID,
 			StartTime: startTime,
+			Position:  position,
 			Data:      decoded,
 		},
-	}, true
+	}, channelErrs, nil
+}
+
+func sortedKeys(m map[string]error) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
 func toInt(v any) (int, error) {
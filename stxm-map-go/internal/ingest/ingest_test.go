@@ -63,3 +63,39 @@ func TestDecodeMessageImage(t *testing.T) {
 		t.Fatalf("unexpected matrix values: %#v", matrix)
 	}
 }
+
+func TestDecodeChannelErrors(t *testing.T) {
+	msg := map[string]any{
+		"type":       "image",
+		"image_id":   1,
+		"start_time": 0.5,
+		"data": map[string]any{
+			"threshold_0": cbor.Tag{
+				Number:  tagMultiDimArray,
+				Content: []any{[]any{1, 1}, cbor.Tag{Number: tagUint8, Content: []byte{3}}},
+			},
+			"threshold_1": "not an array",
+		},
+	}
+	payload, err := cbor.Marshal(msg)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	raw, channelErrs, err := Decode(payload)
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if _, ok := raw.Image.Data["threshold_0"]; !ok || len(raw.Image.Data) != 1 {
+		t.Fatalf("unexpected channels: %#v", raw.Image.Data)
+	}
+	if len(channelErrs) != 1 || channelErrs["threshold_1"] == nil {
+		t.Fatalf("unexpected channel errors: %v", channelErrs)
+	}
+
+	delete(msg["data"].(map[string]any), "threshold_0")
+	payload, _ = cbor.Marshal(msg)
+	if _, channelErrs, err := Decode(payload); err == nil || len(channelErrs) != 1 {
+		t.Fatalf("image without channels: %v, %v", channelErrs, err)
+	}
+}
@@ -0,0 +1,130 @@
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"syscall"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pebbe/zmq4"
+
+	"stxm-map-go/internal/types"
+)
+
+// StreamPositions receives encoder positions from a separate ZMQ PULL socket.
+// Each message is a CBOR or JSON map shaped like
+// { "image_id": <int>, "x": <float>, "y": <float>, "series_id": <int, optional> }.
+func StreamPositions(ctx context.Context, endpoint string, logEvery int) (<-chan types.PositionUpdate, error) {
+	if logEvery < 1 {
+		logEvery = 1
+	}
+	socket, err := zmq4.NewSocket(zmq4.PULL)
+	if err != nil {
+		return nil, err
+	}
+	if err := socket.SetLinger(0); err != nil {
+		_ = socket.Close()
+		return nil, err
+	}
+	if err := socket.SetRcvtimeo(500 * time.Millisecond); err != nil {
+		_ = socket.Close()
+		return nil, err
+	}
+	if err := socket.Connect(endpoint); err != nil {
+		_ = socket.Close()
+		return nil, err
+	}
+
+	out := make(chan types.PositionUpdate, 1024)
+	go func() {
+		defer close(out)
+		defer socket.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			msg, err := socket.RecvBytes(0)
+			if err != nil {
+				if zmq4.AsErrno(err) == zmq4.Errno(syscall.EAGAIN) {
+					continue
+				}
+				logEveryN(logEvery, "position recv error: %v", err)
+				continue
+			}
+
+			update, ok := decodePositionUpdate(msg)
+			if !ok {
+				logEveryN(logEvery, "position decode skipped message")
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case out <- update:
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func decodePositionUpdate(msg []byte) (types.PositionUpdate, bool) {
+	var payload map[string]any
+	if len(msg) > 0 && msg[0] == '{' {
+		if err := json.Unmarshal(msg, &payload); err != nil {
+			return types.PositionUpdate{}, false
+		}
+	} else if err := cbor.Unmarshal(msg, &payload); err != nil {
+		return types.PositionUpdate{}, false
+	}
+
+	imageID, err := toInt(payload["image_id"])
+	if err != nil {
+		return types.PositionUpdate{}, false
+	}
+	position := parsePosition(payload)
+	if position == nil {
+		return types.PositionUpdate{}, false
+	}
+	seriesID, _ := toInt(payload["series_id"])
+	return types.PositionUpdate{
+		SeriesID: seriesID,
+		ImageID:  imageID,
+		Position: *position,
+	}, true
+}
+
+// parsePosition reads a scan position given either as "x"/"y" entries or as
+// a "position" pair. It returns nil when no complete, finite position is
+// present.
+func parsePosition(value any) *types.Position {
+	fields, ok := toStringMap(value)
+	if !ok {
+		return nil
+	}
+	var x, y float64
+	var errX, errY error
+	if pair, ok := fields["position"].([]any); ok && len(pair) == 2 {
+		x, errX = toFloat(pair[0])
+		y, errY = toFloat(pair[1])
+	} else {
+		x, errX = toFloat(fields["x"])
+		y, errY = toFloat(fields["y"])
+	}
+	// NaN and infinite coordinates cannot be placed on the grid.
+	if errX != nil || errY != nil || !isFinite(x) || !isFinite(y) {
+		return nil
+	}
+	return &types.Position{X: x, Y: y}
+}
+
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
@@ -0,0 +1,22 @@
+package ingest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParsePositionRejectsNonFinite(t *testing.T) {
+	if pos := parsePosition(map[string]any{"x": 1.5, "y": int64(2)}); pos == nil || pos.X != 1.5 || pos.Y != 2 {
+		t.Fatalf("unexpected position: %+v", pos)
+	}
+	for _, fields := range []map[string]any{
+		{"x": math.NaN(), "y": 1.0},
+		{"x": 1.0, "y": math.Inf(-1)},
+		{"position": []any{math.Inf(1), 0.0}},
+		{"position": []any{0.0, math.NaN()}},
+	} {
+		if pos := parsePosition(fields); pos != nil {
+			t.Fatalf("%v: accepted %+v", fields, pos)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package output
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// tempMarker is part of the name of every file that is still being written.
+const tempMarker = ".tmp"
+
+// WriteFileAtomic writes filename through write. The data goes to a
+// temporary file in the same directory that is synced and renamed over
+// filename, so after a crash or a failed write the file is either missing,
+// its previous version or complete. Missing directories are created.
+func WriteFileAtomic(filename string, write func(w io.Writer) error) error {
+	if err := replaceFile(filename, write, true); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filename))
+}
+
+// writeBytesAtomic writes data to filename with WriteFileAtomic.
+func writeBytesAtomic(filename string, data []byte) error {
+	return WriteFileAtomic(filename, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeBytesRenamed writes data to filename through a temporary file renamed
+// over it, like writeBytesAtomic, but leaves syncing the file and the
+// directory to the caller, who batches it with syncFiles.
+func writeBytesRenamed(filename string, data []byte) error {
+	return replaceFile(filename, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}, false)
+}
+
+// replaceFile writes filename through a temporary file that is renamed over
+// it; with durable the temporary file is synced first.
+func replaceFile(filename string, write func(w io.Writer) error, durable bool) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(filename)+tempMarker+"*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	fail := func(err error) error {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write %s: %w", filename, err)
+	}
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		return fail(err)
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := f.Chmod(0o644); err != nil {
+		return fail(err)
+	}
+	if durable {
+		if err := f.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write %s: %w", filename, err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// syncFiles makes the files written with writeBytesRenamed in dir durable,
+// with one sync of the directory for all of them.
+func syncFiles(dir string, names []string) error {
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RemoveTempFiles deletes the temporary files left below root by writes that
+// were interrupted, and returns how many it removed.
+func RemoveTempFiles(root string) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !isTempFile(d.Name()) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempMarker)
+}
+
+// WriteManifest writes {run}_manifest.sha256 listing the SHA-256 of every
+// file of a run in the format of sha256sum, with paths relative to the
+// directory of the run: the files named after the run and the contents of
+// its Zarr store. It is rewritten whenever files are added to the run.
+func WriteManifest(outputDir, runTimestamp string) error {
+	name := filepath.Base(runTimestamp) + "_manifest.sha256"
+	runDir := filepath.Join(outputDir, filepath.Dir(runTimestamp))
+	files, err := runFiles(runDir, filepath.Base(runTimestamp))
+	if err != nil {
+		return err
+	}
+	store := filepath.Join(outputDir, runTimestamp+".zarr")
+	err = filepath.WalkDir(store, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, file := range files {
+		base := filepath.Base(file)
+		if base == name || isTempFile(base) {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			continue
+		}
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(runDir, file)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, fmt.Sprintf("%s  %s\n", sum, filepath.ToSlash(rel)))
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i][66:] < lines[j][66:]
+	})
+	return WriteFileAtomic(filepath.Join(runDir, name), func(w io.Writer) error {
+		for _, line := range lines {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,102 @@
+package output
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteFileAtomicKeepsOldFileOnError(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "20260105_101500_series_data.txt")
+	if err := os.WriteFile(filename, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("disk full")
+	err := WriteFileAtomic(filename, func(w io.Writer) error {
+		_, _ = io.WriteString(w, "partial")
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("err = %v, want %v", err, failure)
+	}
+	if data, _ := os.ReadFile(filename); string(data) != "old" {
+		t.Fatalf("file changed to %q", data)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("temporary file left behind: %v", entries)
+	}
+
+	if err := writeBytesAtomic(filename, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filename)
+	if err != nil || info.Mode().Perm() != 0o644 {
+		t.Fatalf("stat = %v, %v", info, err)
+	}
+	if data, _ := os.ReadFile(filename); string(data) != "new" {
+		t.Fatalf("file is %q", data)
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	store := filepath.Join(dir, "20260105_101500.zarr", "maps")
+	if err := os.MkdirAll(store, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		filepath.Join(dir, ".20260105_101500_maps.npz.tmp123"),
+		filepath.Join(store, ".0.0.tmp9"),
+		filepath.Join(dir, "20260105_101500_maps.npz"),
+	} {
+		if err := os.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := RemoveTempFiles(dir)
+	if err != nil || removed != 2 {
+		t.Fatalf("removed %d, %v", removed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "20260105_101500_maps.npz")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	dir := t.TempDir()
+	if err := WriteMetadata(dir, "20260105_101500", "start", map[string]any{"series_id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMetadata(dir, "20260105_101600", "start", map[string]any{"series_id": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateZarrGroup(filepath.Join(dir, "20260105_101500.zarr"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := WriteManifest(dir, "20260105_101500"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "20260105_101500_manifest.sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("manifest:\n%s", data)
+	}
+	start, _ := os.ReadFile(filepath.Join(dir, "20260105_101500_start_data.txt"))
+	sum := sha256.Sum256(start)
+	if !strings.HasSuffix(lines[0], "  20260105_101500.zarr/.zgroup") ||
+		lines[1] != hex.EncodeToString(sum[:])+"  20260105_101500_start_data.txt" {
+		t.Fatalf("manifest:\n%s", data)
+	}
+}
@@ -0,0 +1,52 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"stxm-map-go/internal/processing"
+)
+
+// WriteAverage writes the running average of a repeated scan, one file per
+// channel with columns x, y, mean, std, passes for every measured pixel, and
+// a metadata file listing the averaged series. It is rewritten after every
+// pass under the run timestamp of the first one.
+func WriteAverage(outputDir string, avg processing.AverageSnapshot) error {
+	if avg.Passes == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return err
+	}
+	runTimestamp := avg.RunTimestamp
+	gridX, gridY := avg.GridX, avg.GridY
+	for threshold, maps := range avg.Maps {
+		filename := filepath.Join(outputDir, fmt.Sprintf("%s_average_%s_data.txt", runTimestamp, threshold))
+		err := WriteFileAtomic(filename, func(w io.Writer) error {
+			if _, err := fmt.Fprintln(w, "x, y, mean, std, passes"); err != nil {
+				return err
+			}
+			for idx, n := range maps.Count {
+				if n == 0 {
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "%d, %d, %.6f, %.6f, %d\n", idx%gridX, idx/gridX, maps.Mean[idx], maps.Std[idx], n); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return WriteMetadata(outputDir, runTimestamp, "average", map[string]any{
+		"passes":     avg.Passes,
+		"repeats":    avg.Repeats,
+		"series_ids": avg.SeriesIDs,
+		"grid_x":     gridX,
+		"grid_y":     gridY,
+	})
+}
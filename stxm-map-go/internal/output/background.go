@@ -0,0 +1,36 @@
+package output
+
+// Background runs file writes in the order they are posted on a goroutine of
+// its own, so that the aggregator does not wait for them. It is used for the
+// outputs that are not written by a sink: energy stacks, repeat averages and
+// their manifests and catalog entries.
+type Background struct {
+	jobs chan func()
+	done chan struct{}
+}
+
+// NewBackground starts a writer that queues up to queue writes before Post
+// blocks.
+func NewBackground(queue int) *Background {
+	b := &Background{jobs: make(chan func(), queue), done: make(chan struct{})}
+	go func() {
+		defer close(b.done)
+		for job := range b.jobs {
+			job()
+		}
+	}()
+	return b
+}
+
+// Post queues a write. It blocks while the queue is full: these outputs are
+// never dropped.
+func (b *Background) Post(job func()) {
+	b.jobs <- job
+}
+
+// Close runs the queued writes and stops the writer. Nothing may be posted
+// afterwards.
+func (b *Background) Close() {
+	close(b.jobs)
+	<-b.done
+}
@@ -0,0 +1,20 @@
+package output
+
+import "testing"
+
+func TestBackgroundRunsWritesInOrder(t *testing.T) {
+	b := NewBackground(4)
+	release := make(chan struct{})
+	var order []int
+	b.Post(func() { <-release })
+	// Posting does not wait for the blocked write.
+	for i := 0; i < 3; i++ {
+		i := i
+		b.Post(func() { order = append(order, i) })
+	}
+	close(release)
+	b.Close()
+	if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+		t.Fatalf("writes ran as %v", order)
+	}
+}
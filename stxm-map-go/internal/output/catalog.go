@@ -0,0 +1,371 @@
+package output
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"stxm-map-go/internal/processing"
+)
+
+// runIDPattern matches the run timestamp that prefixes the output files of
+// runs named by the default template.
+var runIDPattern = regexp.MustCompile(`^(\d{8}_\d{6})_`)
+
+// runMetadataSuffixes end the metadata files every series run writes; the
+// rest of their name is the run.
+var runMetadataSuffixes = []string{"_start_data.txt", "_end_data.txt", "_series_data.txt"}
+
+// runName returns the run an output file belongs to, if any.
+func runName(file string) (string, bool) {
+	for _, suffix := range runMetadataSuffixes {
+		if strings.HasSuffix(file, suffix) && len(file) > len(suffix) {
+			return strings.TrimSuffix(file, suffix), true
+		}
+	}
+	// Runs written before templates have at least one *_data.txt file.
+	if match := runIDPattern.FindStringSubmatch(file); match != nil && strings.HasSuffix(file, "_data.txt") {
+		return match[1], true
+	}
+	return "", false
+}
+
+// runFiles returns the files and stores of the run name in dir: those named
+// name_*, except the ones of longer runs in dir such as name_b.
+func runFiles(dir, name string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, name+"_*"))
+	if err != nil {
+		return nil, err
+	}
+	var longer []string
+	for _, match := range matches {
+		base := filepath.Base(match)
+		other, ok := runName(base)
+		if strings.HasSuffix(base, ".zarr") {
+			other, ok = strings.TrimSuffix(base, ".zarr"), true
+		}
+		if ok && other != name {
+			longer = append(longer, other)
+		}
+	}
+	files := matches[:0]
+	for _, match := range matches {
+		base := filepath.Base(match)
+		owned := true
+		for _, other := range longer {
+			if base == other+".zarr" || strings.HasPrefix(base, other+"_") {
+				owned = false
+				break
+			}
+		}
+		if owned {
+			files = append(files, match)
+		}
+	}
+	return files, nil
+}
+
+// CatalogFile is one output file of a run; Path is relative to the catalog.
+type CatalogFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// RunRecord describes one run in the catalog. The run id is the timestamp
+// its files are named after.
+type RunRecord struct {
+	ID         string         `json:"id"`
+	Dir        string         `json:"dir"`
+	Started    time.Time      `json:"started"`
+	SeriesID   int            `json:"series_id,omitempty"`
+	SampleName string         `json:"sample_name,omitempty"`
+	Complete   bool           `json:"complete"`
+	GridX      int            `json:"grid_x,omitempty"`
+	GridY      int            `json:"grid_y,omitempty"`
+	Channels   []string       `json:"channels"`
+	Start      map[string]any `json:"start,omitempty"`
+	End        map[string]any `json:"end,omitempty"`
+	Files      []CatalogFile  `json:"files"`
+}
+
+// RunQuery filters catalog queries; zero fields match everything. Sample
+// matches a substring of the sample name, ignoring case.
+type RunQuery struct {
+	From    time.Time
+	To      time.Time
+	Sample  string
+	Channel string
+}
+
+// Catalog indexes the runs below a root directory in a JSON file.
+type Catalog struct {
+	mu   sync.Mutex
+	root string
+	path string
+	runs map[string]*RunRecord
+}
+
+// OpenCatalog loads the catalog stored at path. Runs are looked up below
+// root; a missing or unreadable index is rebuilt by scanning root.
+func OpenCatalog(root, path string) (*Catalog, error) {
+	c := &Catalog{
+		root: root,
+		path: path,
+		runs: make(map[string]*RunRecord),
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var runs map[string]*RunRecord
+		if err := json.Unmarshal(data, &runs); err == nil && runs != nil {
+			c.runs = runs
+			return c, nil
+		}
+	}
+	return c, c.Rebuild()
+}
+
+// Rebuild replaces the catalog with the runs found in the files below root.
+func (c *Catalog) Rebuild() error {
+	runs := make(map[string]*RunRecord)
+	if err := os.MkdirAll(c.root, 0o755); err != nil {
+		return err
+	}
+	err := filepath.WalkDir(c.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		// Other files, such as the scan history, are not runs.
+		name, ok := runName(d.Name())
+		if !ok {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		if rel, err := filepath.Rel(c.root, filepath.Join(dir, name)); err == nil {
+			if _, ok := runs[filepath.ToSlash(rel)]; ok {
+				return nil
+			}
+		}
+		record, err := scanRun(c.root, dir, name)
+		if err != nil {
+			return err
+		}
+		runs[record.ID] = record
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.runs = runs
+	return c.save()
+}
+
+// Update rescans the files of one run and stores its record. runID is the
+// path of the run relative to dir.
+func (c *Catalog) Update(dir, runID string) error {
+	record, err := scanRun(c.root, filepath.Join(dir, filepath.Dir(runID)), filepath.Base(runID))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.runs[record.ID] = record
+	return c.save()
+}
+
+func (c *Catalog) save() error {
+	data, err := json.MarshalIndent(c.runs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	return writeBytesAtomic(c.path, data)
+}
+
+// Query returns the matching runs, oldest first.
+func (c *Catalog) Query(q RunQuery) []RunRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sample := strings.ToLower(q.Sample)
+	out := make([]RunRecord, 0, len(c.runs))
+	for _, record := range c.runs {
+		if !q.From.IsZero() && record.Started.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && record.Started.After(q.To) {
+			continue
+		}
+		if sample != "" && !strings.Contains(strings.ToLower(record.SampleName), sample) {
+			continue
+		}
+		if q.Channel != "" && !containsString(record.Channels, q.Channel) {
+			continue
+		}
+		out = append(out, *record)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Get returns the record of one run.
+func (c *Catalog) Get(runID string) (RunRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	record, ok := c.runs[runID]
+	if !ok {
+		return RunRecord{}, false
+	}
+	return *record, true
+}
+
+// scanRun builds the record of a run from the files named after it in dir.
+// The id of the run is its path relative to root.
+func scanRun(root, dir, name string) (*RunRecord, error) {
+	files, err := runFiles(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	relDir, err := filepath.Rel(root, dir)
+	if err != nil {
+		relDir = dir
+	}
+	record := &RunRecord{
+		ID:       path.Join(filepath.ToSlash(relDir), name),
+		Dir:      filepath.ToSlash(relDir),
+		Channels: []string{},
+		Files:    []CatalogFile{},
+	}
+	// Runs named after their start time keep it; others started with their
+	// oldest file.
+	timestamped := false
+	if match := runIDPattern.FindStringSubmatch(name + "_"); match != nil {
+		started, err := time.ParseInLocation("20060102_150405", match[1], time.Local)
+		record.Started, timestamped = started, err == nil
+	}
+	var summaryChannels []string
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			rel = file
+		}
+		record.Files = append(record.Files, CatalogFile{
+			Path:   filepath.ToSlash(rel),
+			Size:   info.Size(),
+			SHA256: sum,
+		})
+
+		if !timestamped && (record.Started.IsZero() || info.ModTime().Before(record.Started)) {
+			record.Started = info.ModTime()
+		}
+		switch kind := strings.TrimPrefix(filepath.Base(file), name+"_"); {
+		case kind == "start_data.txt":
+			record.Start = readJSONMap(file)
+		case kind == "end_data.txt":
+			record.End = readJSONMap(file)
+		case kind == "series_data.txt":
+			series := readJSONMap(file)
+			record.Complete, _ = series["complete"].(bool)
+			record.SeriesID = jsonInt(series["series_id"])
+			record.GridX = jsonInt(series["grid_x"])
+			record.GridY = jsonInt(series["grid_y"])
+			if channels, ok := series["channels"].([]any); ok {
+				for _, ch := range channels {
+					summaryChannels = append(summaryChannels, fmt.Sprint(ch))
+				}
+			}
+		case strings.HasPrefix(kind, "output_") && strings.HasSuffix(kind, "_data.txt"):
+			channel := strings.TrimSuffix(strings.TrimPrefix(kind, "output_"), "_data.txt")
+			record.Channels = append(record.Channels, channel)
+		}
+	}
+	// Map file names may come from a template; the series summary lists the
+	// channels either way.
+	if summaryChannels != nil {
+		record.Channels = summaryChannels
+	}
+	record.SampleName = sampleName(record.Start)
+	return record, nil
+}
+
+// sampleName reads sample_name from the start message or its user_data.
+func sampleName(start map[string]any) string {
+	if start == nil {
+		return ""
+	}
+	if name, ok := start["sample_name"].(string); ok {
+		return name
+	}
+	if userData := processing.UserData(start); userData != nil {
+		if name, ok := userData["sample_name"].(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+func readJSONMap(path string) map[string]any {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var out map[string]any
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil
+	}
+	return out
+}
+
+func jsonInt(v any) int {
+	if f, ok := v.(float64); ok {
+		return int(f)
+	}
+	return 0
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func containsString(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
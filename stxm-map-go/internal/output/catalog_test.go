@@ -0,0 +1,88 @@
+package output
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCatalogRebuildAndQuery(t *testing.T) {
+	dir := t.TempDir()
+	start := map[string]any{"user_data": `{"sample_name": "Fe oxide"}`}
+	if err := WriteMetadata(dir, "20260105_101500", "start", start); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMetadata(dir, "20260105_101500", "series", map[string]any{"complete": true, "series_id": 3, "grid_x": 4, "grid_y": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMetadata(dir, "20260107_080000", "start", map[string]any{"sample_name": "cell"}); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog, err := OpenCatalog(dir, filepath.Join(dir, "catalog.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, ok := catalog.Get("20260105_101500")
+	if !ok || record.SampleName != "Fe oxide" || !record.Complete || record.SeriesID != 3 || record.GridX != 4 {
+		t.Fatalf("unexpected record: %+v", record)
+	}
+	if len(record.Files) != 2 || len(record.Files[0].SHA256) != 64 {
+		t.Fatalf("unexpected files: %+v", record.Files)
+	}
+
+	if runs := catalog.Query(RunQuery{Sample: "fe"}); len(runs) != 1 || runs[0].ID != "20260105_101500" {
+		t.Fatalf("sample query returned %+v", runs)
+	}
+	from := time.Date(2026, 1, 6, 0, 0, 0, 0, time.Local)
+	if runs := catalog.Query(RunQuery{From: from}); len(runs) != 1 || runs[0].ID != "20260107_080000" {
+		t.Fatalf("date query returned %+v", runs)
+	}
+	if runs := catalog.Query(RunQuery{Channel: "threshold_0"}); len(runs) != 0 {
+		t.Fatalf("channel query returned %+v", runs)
+	}
+
+	reopened, err := OpenCatalog(dir, filepath.Join(dir, "catalog.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs := reopened.Query(RunQuery{}); len(runs) != 2 {
+		t.Fatalf("reopened catalog has %d runs", len(runs))
+	}
+}
+
+func TestRunFilesSkipLongerRuns(t *testing.T) {
+	dir := t.TempDir()
+	if err := WriteMetadata(dir, "a_b", "start", map[string]any{"sample_name": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := UniqueRunID(dir, "a", nil); got != "a" {
+		t.Fatalf("run id %q, want a", got)
+	}
+	if err := WriteMetadata(dir, "a", "start", map[string]any{"sample_name": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateZarrGroup(filepath.Join(dir, "a_b.zarr"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteManifest(dir, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	catalog, err := OpenCatalog(dir, filepath.Join(dir, "catalog.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, ok := catalog.Get("a")
+	if !ok || record.SampleName != "a" || len(record.Files) != 2 {
+		t.Fatalf("unexpected record: %+v", record)
+	}
+	for _, file := range record.Files {
+		if name := filepath.Base(file.Path); name != "a_start_data.txt" && name != "a_manifest.sha256" {
+			t.Fatalf("run a has file %s", file.Path)
+		}
+	}
+	if record, ok := catalog.Get("a_b"); !ok || len(record.Files) != 1 {
+		t.Fatalf("unexpected record: %+v", record)
+	}
+}
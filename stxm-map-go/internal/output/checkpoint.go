@@ -0,0 +1,180 @@
+package output
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"stxm-map-go/internal/processing"
+)
+
+// CheckpointFile is the name of the checkpoint in the output directory.
+const CheckpointFile = "checkpoint.json"
+
+const checkpointVersion = 1
+
+// Checkpoint is the saved state of the series in progress.
+type Checkpoint struct {
+	Version      int                        `json:"version"`
+	SeriesID     int                        `json:"series_id"`
+	RunTimestamp string                     `json:"run_timestamp"`
+	Saved        time.Time                  `json:"saved"`
+	Start        map[string]any             `json:"start,omitempty"`
+	State        processing.AggregatorState `json:"state"`
+}
+
+// WriteCheckpoint replaces the checkpoint at path.
+func WriteCheckpoint(path string, cp *Checkpoint) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	saved := *cp
+	saved.Version = checkpointVersion
+	saved.Start, _ = NormalizeJSONValue(cp.Start).(map[string]any)
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(&saved)
+	})
+}
+
+// ReadCheckpoint loads the checkpoint at path; it returns nil without an
+// error when there is none.
+func ReadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if cp.Version != checkpointVersion {
+		return nil, fmt.Errorf("read %s: unsupported checkpoint version %d", path, cp.Version)
+	}
+	return &cp, nil
+}
+
+// Continues reports whether seriesID, with the start message start if one
+// arrived, is the series of the checkpoint. Series ids restart with the
+// detector, so the series_unique_id of both start messages must match too
+// when both have one.
+func (cp *Checkpoint) Continues(seriesID int, start map[string]any) bool {
+	if seriesID != cp.SeriesID {
+		return false
+	}
+	saved, ok1 := cp.Start["series_unique_id"]
+	current, ok2 := start["series_unique_id"]
+	return !ok1 || !ok2 || fmt.Sprint(saved) == fmt.Sprint(current)
+}
+
+// Checkpointer writes checkpoints from a goroutine of its own so that the
+// aggregator is not held up by the disk. Saves and clears are applied in
+// order; a save that arrives while the previous request is still waiting is
+// dropped, since the next one supersedes it, and a clear replaces a waiting
+// save.
+type Checkpointer struct {
+	path    string
+	wake    chan struct{}
+	done    chan struct{}
+	onError func(error)
+	onSave  func(*Checkpoint)
+
+	mu sync.Mutex
+	// queued is set while a request waits: a save of pending or, with
+	// pending nil, a clear.
+	queued  bool
+	pending *Checkpoint
+	closed  bool
+}
+
+// NewCheckpointer starts a checkpointer for path. onSave and onError, if not
+// nil, are called from its goroutine after every save or failure.
+func NewCheckpointer(path string, onSave func(*Checkpoint), onError func(error)) *Checkpointer {
+	c := &Checkpointer{
+		path:    path,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		onError: onError,
+		onSave:  onSave,
+	}
+	go c.run()
+	return c
+}
+
+func (c *Checkpointer) run() {
+	defer close(c.done)
+	for {
+		c.mu.Lock()
+		cp, queued, closed := c.pending, c.queued, c.closed
+		c.pending, c.queued = nil, false
+		c.mu.Unlock()
+		if !queued {
+			if closed {
+				return
+			}
+			<-c.wake
+			continue
+		}
+		var err error
+		if cp == nil {
+			err = os.Remove(c.path)
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		} else {
+			err = WriteCheckpoint(c.path, cp)
+			if err == nil && c.onSave != nil {
+				c.onSave(cp)
+			}
+		}
+		if err != nil && c.onError != nil {
+			c.onError(err)
+		}
+	}
+}
+
+// request queues cp, or a clear for nil, and reports whether it was queued.
+func (c *Checkpointer) request(cp *Checkpoint, replace bool) bool {
+	c.mu.Lock()
+	if c.closed || (c.queued && !replace) {
+		c.mu.Unlock()
+		return false
+	}
+	c.pending, c.queued = cp, true
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Save queues cp and reports false if an earlier request is still waiting.
+func (c *Checkpointer) Save(cp *Checkpoint) bool {
+	return c.request(cp, false)
+}
+
+// Clear removes the checkpoint once the request being written is done. It
+// does not wait and replaces a save that has not started.
+func (c *Checkpointer) Clear() {
+	c.request(nil, true)
+}
+
+// Close waits for the queued requests.
+func (c *Checkpointer) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	<-c.done
+}
@@ -0,0 +1,75 @@
+package output
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"stxm-map-go/internal/processing"
+)
+
+func TestCheckpointer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), CheckpointFile)
+	if cp, err := ReadCheckpoint(path); cp != nil || err != nil {
+		t.Fatalf("missing checkpoint read as %v, %v", cp, err)
+	}
+
+	saved := make(chan *Checkpoint, 1)
+	c := NewCheckpointer(path, func(cp *Checkpoint) { saved <- cp }, func(err error) { t.Error(err) })
+	c.Save(&Checkpoint{
+		SeriesID:     4,
+		RunTimestamp: "20260105_101500",
+		Saved:        time.Now(),
+		Start:        map[string]any{"series_unique_id": "abc", "user_data": map[any]any{"grid_x": 2}},
+		State:        processing.AggregatorState{Config: processing.SeriesConfig{GridX: 2, GridY: 1}, FrameCount: 1},
+	})
+	<-saved
+	cp, err := ReadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.SeriesID != 4 || cp.RunTimestamp != "20260105_101500" || cp.State.FrameCount != 1 || cp.State.Config.GridX != 2 {
+		t.Fatalf("checkpoint %+v", cp)
+	}
+	if !cp.Continues(4, nil) || !cp.Continues(4, map[string]any{"series_unique_id": "abc"}) {
+		t.Fatal("same series not continued")
+	}
+	if cp.Continues(5, nil) || cp.Continues(4, map[string]any{"series_unique_id": "def"}) {
+		t.Fatal("other series continued")
+	}
+
+	c.Clear()
+	c.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint not removed: %v", err)
+	}
+}
+
+func TestCheckpointerClearDoesNotWait(t *testing.T) {
+	path := filepath.Join(t.TempDir(), CheckpointFile)
+	release := make(chan struct{})
+	c := NewCheckpointer(path, func(*Checkpoint) { <-release }, func(err error) { t.Error(err) })
+	cp := &Checkpoint{SeriesID: 1, RunTimestamp: "20260105_101500", Saved: time.Now()}
+	if !c.Save(cp) {
+		t.Fatal("first save dropped")
+	}
+	// The first save is written and holds the goroutine in onSave, or it
+	// still waits; either way the clear below must not block.
+	c.Save(cp)
+	cleared := make(chan struct{})
+	go func() {
+		c.Clear()
+		close(cleared)
+	}()
+	select {
+	case <-cleared:
+	case <-time.After(time.Second):
+		t.Fatal("Clear blocked on a busy checkpointer")
+	}
+	close(release)
+	c.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("checkpoint not removed: %v", err)
+	}
+}
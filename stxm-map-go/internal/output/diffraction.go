@@ -0,0 +1,102 @@
+package output
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/types"
+)
+
+// WriteDiffraction writes the accumulated sum and max patterns of each channel
+// as little-endian float64 files, a PNG preview of the mean pattern and a
+// metadata file describing their shape.
+func WriteDiffraction(outputDir, runTimestamp string, frames map[string]types.DiffractionFrame) error {
+	if len(frames) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return err
+	}
+
+	meta := make(map[string]any, len(frames))
+	for channel, frame := range frames {
+		prefix := filepath.Join(outputDir, fmt.Sprintf("%s_diffraction_%s", runTimestamp, channel))
+		if err := writeFloat64File(prefix+"_sum.bin", frame.Sum); err != nil {
+			return err
+		}
+		if err := writeFloat64File(prefix+"_max.bin", frame.Max); err != nil {
+			return err
+		}
+		err := WriteFileAtomic(prefix+"_mean.png", func(w io.Writer) error {
+			return EncodeDiffractionPNG(w, processing.DiffractionMean(frame), frame.Width, frame.Height, true)
+		})
+		if err != nil {
+			return err
+		}
+		meta[channel] = map[string]any{
+			"width":  frame.Width,
+			"height": frame.Height,
+			"frames": frame.Frames,
+			"dtype":  "<f8",
+		}
+	}
+	return WriteMetadata(outputDir, runTimestamp, "diffraction", meta)
+}
+
+// WriteFloat64 writes values as raw little-endian float64.
+func WriteFloat64(w io.Writer, values []float64) error {
+	buf := make([]byte, 8)
+	for _, v := range values {
+		binary.LittleEndian.PutUint64(buf, math.Float64bits(v))
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncodeDiffractionPNG renders a pattern as an 8-bit grayscale PNG scaled
+// between its minimum and maximum, optionally on a log scale.
+func EncodeDiffractionPNG(w io.Writer, values []float64, width, height int, logScale bool) error {
+	if width < 1 || height < 1 || len(values) < width*height {
+		return fmt.Errorf("invalid pattern shape %dx%d", width, height)
+	}
+	scaled := make([]float64, width*height)
+	minVal := math.Inf(1)
+	maxVal := math.Inf(-1)
+	for i := range scaled {
+		v := values[i]
+		if logScale {
+			v = math.Log1p(math.Max(0, v))
+		}
+		scaled[i] = v
+		if v < minVal {
+			minVal = v
+		}
+		if v > maxVal {
+			maxVal = v
+		}
+	}
+	span := maxVal - minVal
+	if span <= 0 {
+		span = 1
+	}
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i, v := range scaled {
+		img.Pix[i] = uint8(math.Round((v - minVal) / span * 255))
+	}
+	return png.Encode(w, img)
+}
+
+func writeFloat64File(filename string, values []float64) error {
+	return WriteFileAtomic(filename, func(w io.Writer) error {
+		return WriteFloat64(w, values)
+	})
+}
@@ -0,0 +1,341 @@
+package output
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/types"
+)
+
+// NumPy dtype descriptors of the exported arrays.
+const (
+	npyUint32  = "<u4"
+	npyFloat64 = "<f8"
+	npyBool    = "|b1"
+)
+
+// MapSet is the maps of one series with their grid and the acquisition time
+// of every pixel, as exported to NumPy.
+type MapSet struct {
+	GridX      int
+	GridY      int
+	Maps       map[string]types.ThresholdSnapshot
+	Timestamps map[string][]float64
+}
+
+// Channels returns the channel names in sorted order.
+func (m MapSet) Channels() []string {
+	channels := make([]string, 0, len(m.Maps))
+	for channel := range m.Maps {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// EncodeNPY writes a C-ordered array in the .npy format, version 1.0. data
+// holds the raw array bytes for the dtype descriptor descr.
+func EncodeNPY(w io.Writer, descr string, shape []int, data []byte) error {
+	dims := make([]string, len(shape))
+	for i, n := range shape {
+		dims[i] = fmt.Sprint(n)
+	}
+	shapeText := strings.Join(dims, ", ")
+	if len(shape) == 1 {
+		shapeText += ","
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }", descr, shapeText)
+	// The preamble and header are padded with spaces to a multiple of 64
+	// bytes and end in a newline.
+	total := 10 + len(header) + 1
+	header += strings.Repeat(" ", (64-total%64)%64) + "\n"
+	if len(header) > math.MaxUint16 {
+		return fmt.Errorf("npy header too long")
+	}
+	preamble := []byte{0x93, 'N', 'U', 'M', 'P', 'Y', 1, 0, 0, 0}
+	binary.LittleEndian.PutUint16(preamble[8:], uint16(len(header)))
+	if _, err := w.Write(preamble); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// EncodeMapNPY writes one map as a uint32 array of shape (grid_y, grid_x).
+func EncodeMapNPY(w io.Writer, gridX, gridY int, snap types.ThresholdSnapshot) error {
+	if len(snap.Values) != gridX*gridY {
+		return fmt.Errorf("map has %d pixels, grid is %dx%d", len(snap.Values), gridX, gridY)
+	}
+	return EncodeNPY(w, npyUint32, []int{gridY, gridX}, uint32Bytes(snap.Values))
+}
+
+// EncodeVarianceNPY writes the sub-frame variance of one map as a float64
+// array of shape (grid_y, grid_x).
+func EncodeVarianceNPY(w io.Writer, gridX, gridY int, snap types.ThresholdSnapshot) error {
+	if len(snap.Variance) != gridX*gridY {
+		return fmt.Errorf("variance has %d pixels, grid is %dx%d", len(snap.Variance), gridX, gridY)
+	}
+	return EncodeNPY(w, npyFloat64, []int{gridY, gridX}, float64Bytes(snap.Variance))
+}
+
+// EncodeMapsNPZ writes a map set as an .npz archive with the arrays
+// {channel} (uint32), {channel}_mask (bool) and {channel}_timestamps
+// (float64 seconds, zero where unmeasured), all of shape (grid_y, grid_x),
+// and {channel}_variance (float64) when the sub-frame variance is kept.
+func EncodeMapsNPZ(w io.Writer, set MapSet) error {
+	pixels := set.GridX * set.GridY
+	shape := []int{set.GridY, set.GridX}
+	zw := zip.NewWriter(w)
+	add := func(name, descr string, data []byte) error {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name + ".npy", Method: zip.Deflate})
+		if err != nil {
+			return err
+		}
+		return EncodeNPY(f, descr, shape, data)
+	}
+	for _, channel := range set.Channels() {
+		snap := set.Maps[channel]
+		if len(snap.Values) != pixels {
+			return fmt.Errorf("channel %s has %d pixels, grid is %dx%d", channel, len(snap.Values), set.GridX, set.GridY)
+		}
+		if err := add(channel, npyUint32, uint32Bytes(snap.Values)); err != nil {
+			return err
+		}
+		mask := make([]byte, pixels)
+		for idx := range mask {
+			if idx >= len(snap.Mask) || snap.Mask[idx] {
+				mask[idx] = 1
+			}
+		}
+		if err := add(channel+"_mask", npyBool, mask); err != nil {
+			return err
+		}
+		timestamps := set.Timestamps[channel]
+		if len(timestamps) != pixels {
+			timestamps = make([]float64, pixels)
+		}
+		if err := add(channel+"_timestamps", npyFloat64, float64Bytes(timestamps)); err != nil {
+			return err
+		}
+		if len(snap.Variance) == pixels {
+			if err := add(channel+processing.VarianceSuffix, npyFloat64, float64Bytes(snap.Variance)); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+// WriteNPY writes every map of a series as {timestamp}_map_{channel}.npy and
+// its sub-frame variance, if kept, as {timestamp}_map_{channel}_variance.npy.
+func WriteNPY(outputDir, runTimestamp string, set MapSet) error {
+	return WriteNPYFiles(outputDir, set, func(channel string) string {
+		return fmt.Sprintf("%s_map_%s.npy", runTimestamp, channel)
+	})
+}
+
+// WriteNPYFiles is WriteNPY with the file of every channel named by name,
+// relative to outputDir.
+func WriteNPYFiles(outputDir string, set MapSet, name func(channel string) string) error {
+	if len(set.Maps) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return err
+	}
+	for _, channel := range set.Channels() {
+		filename := filepath.Join(outputDir, filepath.FromSlash(name(channel)))
+		snap := set.Maps[channel]
+		err := WriteFileAtomic(filename, func(w io.Writer) error {
+			return EncodeMapNPY(w, set.GridX, set.GridY, snap)
+		})
+		if err != nil {
+			return err
+		}
+		if len(snap.Variance) == 0 {
+			continue
+		}
+		filename = filepath.Join(outputDir, filepath.FromSlash(name(channel+processing.VarianceSuffix)))
+		err = WriteFileAtomic(filename, func(w io.Writer) error {
+			return EncodeVarianceNPY(w, set.GridX, set.GridY, snap)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteNPZ writes the map set of a series as {timestamp}_maps.npz.
+func WriteNPZ(outputDir, runTimestamp string, set MapSet) error {
+	if len(set.Maps) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(outputDir, runTimestamp+"_maps.npz"), func(w io.Writer) error {
+		return EncodeMapsNPZ(w, set)
+	})
+}
+
+// WriteStackNPZ writes an energy stack as {timestamp}_stack.npz with one
+// uint32 cube of shape (energies, grid_y, grid_x) per channel, a bool cube
+// "mask" of the measured pixels and the "energies" of the layers.
+func WriteStackNPZ(outputDir string, info processing.StackInfo, layers []processing.StackLayer) error {
+	if len(layers) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return err
+	}
+	pixels := info.GridX * info.GridY
+	shape := []int{len(layers), info.GridY, info.GridX}
+	return WriteFileAtomic(filepath.Join(outputDir, info.RunTimestamp+"_stack.npz"), func(w io.Writer) error {
+		zw := zip.NewWriter(w)
+		add := func(name, descr string, shape []int, data []byte) error {
+			f, err := zw.CreateHeader(&zip.FileHeader{Name: name + ".npy", Method: zip.Deflate})
+			if err != nil {
+				return err
+			}
+			return EncodeNPY(f, descr, shape, data)
+		}
+		mask := make([]byte, len(layers)*pixels)
+		energies := make([]float64, len(layers))
+		for i, layer := range layers {
+			energies[i] = layer.Energy
+			for _, snap := range layer.Channels {
+				for idx, ok := range snap.Mask {
+					if ok && idx < pixels {
+						mask[i*pixels+idx] = 1
+					}
+				}
+			}
+		}
+		for _, channel := range info.Channels {
+			cube := make([]uint32, 0, len(layers)*pixels)
+			for _, layer := range layers {
+				values := layer.Channels[channel].Values
+				if len(values) != pixels {
+					values = make([]uint32, pixels)
+				}
+				cube = append(cube, values...)
+			}
+			if err := add(channel, npyUint32, shape, uint32Bytes(cube)); err != nil {
+				return err
+			}
+		}
+		if err := add("mask", npyBool, shape, mask); err != nil {
+			return err
+		}
+		if err := add("energies", npyFloat64, []int{len(layers)}, float64Bytes(energies)); err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+}
+
+// npyHeaderField matches the entries of a .npy header dictionary.
+var npyHeaderField = regexp.MustCompile(`'(descr|fortran_order|shape)'\s*:\s*('[^']*'|True|False|\([^)]*\))`)
+
+// ReadMaskNPY reads a detector pixel mask from a C-ordered 2-D .npy array of
+// bools or integers; nonzero pixels are masked. It returns the mask in
+// row-major order and the width of the detector.
+func ReadMaskNPY(path string) ([]bool, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < 10 || string(data[:6]) != "\x93NUMPY" {
+		return nil, 0, fmt.Errorf("%s: not a .npy file", path)
+	}
+	headerLen, start := int(binary.LittleEndian.Uint16(data[8:10])), 10
+	if data[6] >= 2 {
+		if len(data) < 12 {
+			return nil, 0, fmt.Errorf("%s: truncated .npy header", path)
+		}
+		headerLen, start = int(binary.LittleEndian.Uint32(data[8:12])), 12
+	}
+	if len(data) < start+headerLen {
+		return nil, 0, fmt.Errorf("%s: truncated .npy header", path)
+	}
+	fields := map[string]string{}
+	for _, m := range npyHeaderField.FindAllStringSubmatch(string(data[start:start+headerLen]), -1) {
+		fields[m[1]] = m[2]
+	}
+	if fields["fortran_order"] != "False" {
+		return nil, 0, fmt.Errorf("%s: mask must be a C-ordered array", path)
+	}
+	var dims []int
+	for _, part := range strings.Split(strings.Trim(fields["shape"], "()"), ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: invalid shape %s", path, fields["shape"])
+		}
+		dims = append(dims, n)
+	}
+	if len(dims) != 2 || dims[0] < 1 || dims[1] < 1 {
+		return nil, 0, fmt.Errorf("%s: mask must be 2-D, shape is %s", path, fields["shape"])
+	}
+	descr := strings.Trim(fields["descr"], "'")
+	size := 0
+	switch descr {
+	case npyBool, "|u1", "|i1":
+		size = 1
+	case "<u2", "<i2":
+		size = 2
+	case "<u4", "<i4":
+		size = 4
+	case "<u8", "<i8":
+		size = 8
+	default:
+		return nil, 0, fmt.Errorf("%s: unsupported mask dtype %s", path, descr)
+	}
+	values := data[start+headerLen:]
+	pixels := dims[0] * dims[1]
+	if len(values) < pixels*size {
+		return nil, 0, fmt.Errorf("%s: %d bytes for %d pixels of %s", path, len(values), pixels, descr)
+	}
+	mask := make([]bool, pixels)
+	for i := range mask {
+		for _, b := range values[i*size : (i+1)*size] {
+			if b != 0 {
+				mask[i] = true
+				break
+			}
+		}
+	}
+	return mask, dims[1], nil
+}
+
+func uint32Bytes(values []uint32) []byte {
+	var buf bytes.Buffer
+	buf.Grow(4 * len(values))
+	_ = WriteUint32(&buf, values)
+	return buf.Bytes()
+}
+
+func float64Bytes(values []float64) []byte {
+	data := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint64(data[8*i:], math.Float64bits(v))
+	}
+	return data
+}
@@ -0,0 +1,130 @@
+package output
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"stxm-map-go/internal/types"
+)
+
+// readNPY splits an .npy file into its header dictionary and data.
+func readNPY(t *testing.T, b []byte) (string, []byte) {
+	t.Helper()
+	if !bytes.HasPrefix(b, []byte("\x93NUMPY\x01\x00")) {
+		t.Fatalf("bad npy magic %q", b[:8])
+	}
+	n := int(binary.LittleEndian.Uint16(b[8:]))
+	if (10+n)%64 != 0 || b[10+n-1] != '\n' {
+		t.Fatalf("header of %d bytes is not aligned", n)
+	}
+	return strings.TrimSpace(string(b[10 : 10+n])), b[10+n:]
+}
+
+func TestEncodeNPY(t *testing.T) {
+	var buf bytes.Buffer
+	snap := types.ThresholdSnapshot{Values: []uint32{1, 2, 3, 4, 5, 6}}
+	if err := EncodeMapNPY(&buf, 3, 2, snap); err != nil {
+		t.Fatal(err)
+	}
+	header, data := readNPY(t, buf.Bytes())
+	if header != "{'descr': '<u4', 'fortran_order': False, 'shape': (2, 3), }" {
+		t.Fatalf("unexpected header %q", header)
+	}
+	if len(data) != 24 || binary.LittleEndian.Uint32(data[20:]) != 6 {
+		t.Fatalf("unexpected data %v", data)
+	}
+
+	buf.Reset()
+	if err := EncodeNPY(&buf, npyFloat64, []int{2}, float64Bytes([]float64{1, 2})); err != nil {
+		t.Fatal(err)
+	}
+	if header, _ := readNPY(t, buf.Bytes()); !strings.Contains(header, "'shape': (2,)") {
+		t.Fatalf("unexpected 1-d header %q", header)
+	}
+}
+
+func TestReadMaskNPY(t *testing.T) {
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	if err := EncodeNPY(&buf, "<u2", []int{2, 3}, []byte{0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "mask.npy")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mask, width, err := ReadMaskNPY(path)
+	if err != nil || width != 3 || !reflect.DeepEqual(mask, []bool{false, true, false, true, false, false}) {
+		t.Fatalf("mask %v, width %d, %v", mask, width, err)
+	}
+
+	buf.Reset()
+	if err := EncodeNPY(&buf, npyFloat64, []int{1, 1}, float64Bytes([]float64{1})); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ReadMaskNPY(path); err == nil {
+		t.Fatal("float mask accepted")
+	}
+}
+
+func TestEncodeMapsNPZ(t *testing.T) {
+	set := MapSet{
+		GridX: 2,
+		GridY: 2,
+		Maps: map[string]types.ThresholdSnapshot{
+			"threshold_0": {Values: []uint32{7, 8, 9, 0}, Mask: []bool{true, true, true, false}, Variance: []float64{0.25, 2.0 / 3, 0, 0}},
+		},
+		Timestamps: map[string][]float64{"threshold_0": {1.5, 2.5, 3.5, 0}},
+	}
+	var buf bytes.Buffer
+	if err := EncodeMapsNPZ(&buf, set); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrays := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, data := readNPY(t, b)
+		if !strings.Contains(header, "'shape': (2, 2)") {
+			t.Fatalf("%s: unexpected header %q", f.Name, header)
+		}
+		arrays[f.Name] = data
+	}
+	if len(arrays) != 4 {
+		t.Fatalf("unexpected arrays %v", arrays)
+	}
+	if got := binary.LittleEndian.Uint32(arrays["threshold_0.npy"][8:]); got != 9 {
+		t.Fatalf("value = %d", got)
+	}
+	if mask := arrays["threshold_0_mask.npy"]; !bytes.Equal(mask, []byte{1, 1, 1, 0}) {
+		t.Fatalf("mask = %v", mask)
+	}
+	if ts := math.Float64frombits(binary.LittleEndian.Uint64(arrays["threshold_0_timestamps.npy"][8:])); ts != 2.5 {
+		t.Fatalf("timestamp = %v", ts)
+	}
+	if v := math.Float64frombits(binary.LittleEndian.Uint64(arrays["threshold_0_variance.npy"][8:])); v != 2.0/3 {
+		t.Fatalf("variance = %v", v)
+	}
+}
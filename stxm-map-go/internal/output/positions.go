@@ -0,0 +1,57 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"stxm-map-go/internal/processing"
+)
+
+// WritePositions writes every measured point of a position based scan with
+// its exact position, one row per image and one value column per channel.
+func WritePositions(outputDir, runTimestamp string, samples []processing.PositionSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return err
+	}
+
+	channelSet := map[string]struct{}{}
+	for _, s := range samples {
+		for channel := range s.Data {
+			channelSet[channel] = struct{}{}
+		}
+	}
+	channels := make([]string, 0, len(channelSet))
+	for channel := range channelSet {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	filename := filepath.Join(outputDir, fmt.Sprintf("%s_positions_data.txt", runTimestamp))
+	header := append([]string{"image_index", "pos_x", "pos_y", "timestamp"}, channels...)
+	return WriteFileAtomic(filename, func(w io.Writer) error {
+		if _, err := fmt.Fprintln(w, strings.Join(header, ", ")); err != nil {
+			return err
+		}
+		for _, s := range samples {
+			line := fmt.Sprintf("%d, %g, %g, %.6f", s.ImageID, s.Position.X, s.Position.Y, s.StartTime)
+			for _, channel := range channels {
+				if value, ok := s.Data[channel]; ok {
+					line += fmt.Sprintf(", %d", value)
+				} else {
+					line += ", "
+				}
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -2,77 +2,622 @@ package output
 
 import (
 	"bufio"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"stxm-map-go/internal/rawlog"
+)
+
+// RawLogOptions controls when a raw log moves on to a new file and how many
+// old files are kept. Zero values disable the respective limit.
+type RawLogOptions struct {
+	// MaxBytes starts a new file before a record would grow the current
+	// one beyond it.
+	MaxBytes int64
+	// MaxAge starts a new file once the current one is older.
+	MaxAge time.Duration
+	// PerSeries starts a new file with every start message.
+	PerSeries bool
+	// RetainBytes deletes the oldest closed files of the directory until
+	// all raw logs together take at most this many bytes.
+	RetainBytes int64
+	// QueueSize bounds the messages waiting for the writer goroutine and
+	// QueueBytes their payload bytes; messages beyond either are dropped
+	// (default 1024 messages and 256 MiB).
+	QueueSize  int
+	QueueBytes int64
+	// FlushBytes is the size of the write buffer, which is flushed to the
+	// file whenever it fills (default 1 MiB).
+	FlushBytes int
+	// FlushInterval flushes a partly filled buffer this often (default 1s).
+	FlushInterval time.Duration
+	// Sync selects when files are synced to disk: RawLogSyncNever,
+	// RawLogSyncClose (default) or RawLogSyncFlush.
+	Sync string
+	// Version is the file format, 1 (default) or 2. Version 2 files record
+	// Compression and Endpoint in their header.
+	Version     int
+	Compression string
+	Endpoint    string
+}
+
+// Sync policies of RawLogOptions.
+const (
+	// RawLogSyncNever leaves syncing to the operating system.
+	RawLogSyncNever = "never"
+	// RawLogSyncClose syncs every file when it is rotated or closed.
+	RawLogSyncClose = "close"
+	// RawLogSyncFlush syncs after every flush, bounding the data lost in a
+	// power failure by FlushInterval at the cost of disk throughput.
+	RawLogSyncFlush = "flush"
 )
 
-const rawLogMagic = "STXMRAW1"
+// errRawLogQueueFull is returned for messages dropped because the writer
+// goroutine fell behind.
+var errRawLogQueueFull = errors.New("raw log queue full, message dropped")
+
+// RawLogFile is one file of a raw log.
+type RawLogFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Records  int       `json:"records"`
+	Opened   time.Time `json:"opened"`
+	SeriesID int       `json:"series_id,omitempty"`
+	// Reason is why the file was closed: size, age, series, endpoint or
+	// close.
+	Reason string `json:"reason,omitempty"`
+}
+
+// RawLogStatus describes a raw log for /status.
+type RawLogStatus struct {
+	Dir        string       `json:"dir"`
+	Current    *RawLogFile  `json:"current,omitempty"`
+	Files      []RawLogFile `json:"files"`
+	TotalBytes int64        `json:"total_bytes"`
+	Rotations  int          `json:"rotations"`
+	Deleted    int          `json:"deleted"`
+	LastError  string       `json:"last_error,omitempty"`
+	// Records counts the messages written, Dropped those lost to a full
+	// queue; Queued are waiting for the writer, with QueuedBytes of payload.
+	Records     int64 `json:"records"`
+	Dropped     int64 `json:"dropped"`
+	Queued      int   `json:"queued"`
+	QueueSize   int   `json:"queue_size"`
+	QueuedBytes int64 `json:"queued_bytes"`
+	QueueBytes  int64 `json:"queue_bytes"`
+	WriteErrors int64 `json:"write_errors"`
+	Flushes     int64 `json:"flushes"`
+	Syncs       int64 `json:"syncs"`
+	// LagSeconds is the time the last message waited in the queue.
+	LagSeconds    float64 `json:"lag_seconds"`
+	MaxLagSeconds float64 `json:"max_lag_seconds"`
+}
 
+// rawLogItem is a message, or the start of a series, waiting for the
+// writer goroutine.
+type rawLogItem struct {
+	payload  []byte
+	received time.Time
+	// series is set for StartSeries.
+	series   int
+	isSeries bool
+	// endpoint is set for SetEndpoint.
+	endpoint   string
+	isEndpoint bool
+}
+
+// rawLogHistory bounds the closed files listed in the status.
+const rawLogHistory = 50
+
+// RawLogWriter records the raw messages of the ingest stream as
+// {timestamp}_{prefix}.bin files (with the series id appended when a file
+// starts with a series), rotating and pruning them per RawLogOptions.
+// Record only queues a message: the files are written by a goroutine of
+// the writer, so that a slow disk never holds up the receive loop.
 type RawLogWriter struct {
-	mu sync.Mutex
-	f  *os.File
-	w  *bufio.Writer
+	queue chan rawLogItem
+	done  chan struct{}
+	// sendMu guards sending to the queue against Close.
+	sendMu      sync.RWMutex
+	stopped     bool
+	dropped     atomic.Int64
+	queuedBytes atomic.Int64
+	closeErr    error
+
+	// The file state below belongs to the writer goroutine.
+	dir    string
+	prefix string
+	opts   RawLogOptions
+	enc    *rawlog.Encoder
+	create func(filename string) (rawLogFile, error)
+	f      rawLogFile
+	w      *bufio.Writer
+
+	// statusMu guards the files listed by Status. The writer goroutine
+	// changes them under it but never holds it across a write, sync or
+	// rotation; it reads them without it.
+	statusMu  sync.Mutex
+	current   RawLogFile
+	isOpen    bool
+	closed    []RawLogFile
+	lastError string
+
+	// total is the size of all raw logs in dir, including the current one.
+	total     atomic.Int64
+	rotations atomic.Int64
+	deleted   atomic.Int64
+	records   atomic.Int64
+	errors    atomic.Int64
+	flushes   atomic.Int64
+	syncs     atomic.Int64
+	lag       atomic.Int64
+	maxLag    atomic.Int64
+}
+
+// rawLogFile is the file a raw log writes to.
+type rawLogFile interface {
+	Write(p []byte) (int, error)
+	Sync() error
+	Close() error
 }
 
-func NewRawLogWriter(outputDir string, prefix string) (*RawLogWriter, error) {
+func createRawLogFile(filename string) (rawLogFile, error) {
+	return os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+}
+
+// NewRawLogWriter opens the first file of a raw log in outputDir.
+func NewRawLogWriter(outputDir string, prefix string, opts RawLogOptions) (*RawLogWriter, error) {
+	return newRawLogWriter(outputDir, prefix, opts, createRawLogFile)
+}
+
+func newRawLogWriter(outputDir string, prefix string, opts RawLogOptions, create func(string) (rawLogFile, error)) (*RawLogWriter, error) {
 	if err := os.MkdirAll(outputDir, 0o755); err != nil {
 		return nil, err
 	}
-	timestamp := time.Now().Format("20060102_150405")
-	filename := filepath.Join(outputDir, fmt.Sprintf("%s_%s.bin", timestamp, prefix))
-	f, err := os.Create(filename)
+	if opts.QueueSize < 1 {
+		opts.QueueSize = 1024
+	}
+	if opts.QueueBytes < 1 {
+		opts.QueueBytes = 256 << 20
+	}
+	if opts.Version == 0 {
+		opts.Version = 1
+	}
+	if opts.FlushBytes < 1 {
+		opts.FlushBytes = 1024 * 1024
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	switch opts.Sync {
+	case "":
+		opts.Sync = RawLogSyncClose
+	case RawLogSyncNever, RawLogSyncClose, RawLogSyncFlush:
+	default:
+		return nil, fmt.Errorf("unknown raw log sync policy %q", opts.Sync)
+	}
+	enc, err := rawlog.NewEncoder(rawlog.Header{Version: opts.Version, Compression: opts.Compression, Endpoint: opts.Endpoint})
 	if err != nil {
 		return nil, err
 	}
-	w := bufio.NewWriterSize(f, 1024*1024)
-	if _, err := w.WriteString(rawLogMagic); err != nil {
-		_ = f.Close()
+	r := &RawLogWriter{
+		queue:  make(chan rawLogItem, opts.QueueSize),
+		done:   make(chan struct{}),
+		dir:    outputDir,
+		prefix: prefix,
+		opts:   opts,
+		enc:    enc,
+		create: create,
+	}
+	files, err := r.logFiles()
+	if err != nil {
 		return nil, err
 	}
+	for _, file := range files {
+		r.total.Add(file.size)
+	}
+	if err := r.open(0); err != nil {
+		return nil, err
+	}
+	r.prune()
+	go r.run()
+	return r, nil
+}
+
+// run writes the queued messages until Close, flushing the buffer when it
+// fills and every FlushInterval.
+func (r *RawLogWriter) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case item, ok := <-r.queue:
+			if !ok {
+				if r.w != nil {
+					r.closeErr = r.closeCurrent("close")
+					r.prune()
+				}
+				return
+			}
+			switch {
+			case item.isSeries:
+				r.fail(r.startSeries(item.series))
+			case item.isEndpoint:
+				r.fail(r.setEndpoint(item.endpoint))
+			default:
+				r.fail(r.write(item))
+				r.queuedBytes.Add(-int64(len(item.payload)))
+			}
+		case <-ticker.C:
+			if r.w != nil && r.w.Buffered() > 0 {
+				r.fail(r.flush())
+			}
+		}
+	}
+}
+
+// open starts a new file.
+func (r *RawLogWriter) open(seriesID int) error {
+	now := time.Now()
+	name := fmt.Sprintf("%s_%s", now.Format("20060102_150405"), r.prefix)
+	if seriesID != 0 {
+		name = fmt.Sprintf("%s_s%d", name, seriesID)
+	}
+	// Files rotated within the same second get a -2, -3, ... suffix.
+	filename := filepath.Join(r.dir, name+".bin")
+	for n := 2; ; n++ {
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			break
+		}
+		filename = filepath.Join(r.dir, fmt.Sprintf("%s-%d.bin", name, n))
+	}
+	f, err := r.create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, r.opts.FlushBytes)
+	n, err := r.enc.WriteHeader(w, now)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
 	if err := w.Flush(); err != nil {
 		_ = f.Close()
-		return nil, err
+		return err
+	}
+	r.f, r.w = f, w
+	r.statusMu.Lock()
+	r.current = RawLogFile{
+		Name:     filepath.Base(filename),
+		Size:     n,
+		Opened:   now,
+		SeriesID: seriesID,
+	}
+	r.isOpen = true
+	r.statusMu.Unlock()
+	r.total.Add(n)
+	return nil
+}
+
+// rotate closes the current file for reason and opens the next one.
+func (r *RawLogWriter) rotate(reason string, seriesID int) error {
+	if err := r.closeCurrent(reason); err != nil {
+		return err
+	}
+	r.rotations.Add(1)
+	if err := r.open(seriesID); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// flush writes the buffer to the file, syncing it with RawLogSyncFlush.
+func (r *RawLogWriter) flush() error {
+	r.flushes.Add(1)
+	if err := r.w.Flush(); err != nil {
+		return err
+	}
+	if r.opts.Sync != RawLogSyncFlush {
+		return nil
+	}
+	r.syncs.Add(1)
+	return r.f.Sync()
+}
+
+func (r *RawLogWriter) closeCurrent(reason string) error {
+	err := r.w.Flush()
+	if err == nil && r.opts.Sync != RawLogSyncNever {
+		r.syncs.Add(1)
+		err = r.f.Sync()
+	}
+	if closeErr := r.f.Close(); err == nil {
+		err = closeErr
 	}
-	return &RawLogWriter{
-		f: f,
-		w: w,
-	}, nil
+	r.f, r.w = nil, nil
+	r.statusMu.Lock()
+	r.current.Reason = reason
+	r.closed = append(r.closed, r.current)
+	if len(r.closed) > rawLogHistory {
+		r.closed = r.closed[len(r.closed)-rawLogHistory:]
+	}
+	r.isOpen = false
+	r.statusMu.Unlock()
+	return err
 }
 
+// StartSeries is called before the start message of seriesID is recorded;
+// with PerSeries the message opens a new file.
+func (r *RawLogWriter) StartSeries(seriesID int) error {
+	if !r.opts.PerSeries {
+		return nil
+	}
+	return r.enqueue(rawLogItem{series: seriesID, isSeries: true})
+}
+
+// Record queues payload, which the caller must not change afterwards. It
+// never blocks: when the queue is full, in messages or in bytes, the
+// message is dropped and counted.
 func (r *RawLogWriter) Record(payload []byte) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	if r.w == nil {
+	return r.enqueue(rawLogItem{payload: payload, received: time.Now()})
+}
+
+func (r *RawLogWriter) enqueue(item rawLogItem) error {
+	r.sendMu.RLock()
+	defer r.sendMu.RUnlock()
+	if r.stopped {
 		return fmt.Errorf("raw log writer is closed")
 	}
-	var header [12]byte
-	binary.LittleEndian.PutUint64(header[:8], uint64(time.Now().UnixNano()))
-	binary.LittleEndian.PutUint32(header[8:12], uint32(len(payload)))
-	if _, err := r.w.Write(header[:]); err != nil {
-		return err
+	// The payload counts until it is written.
+	size := int64(len(item.payload))
+	if r.queuedBytes.Add(size) > r.opts.QueueBytes && size > 0 {
+		r.queuedBytes.Add(-size)
+		r.dropped.Add(1)
+		return errRawLogQueueFull
+	}
+	select {
+	case r.queue <- item:
+		return nil
+	default:
+		r.queuedBytes.Add(-size)
+		r.dropped.Add(1)
+		return errRawLogQueueFull
+	}
+}
+
+// SetEndpoint records that messages now come from endpoint. Version 2
+// files note their endpoint in the header, so the next message starts a new
+// file.
+func (r *RawLogWriter) SetEndpoint(endpoint string) error {
+	return r.enqueue(rawLogItem{endpoint: endpoint, isEndpoint: true})
+}
+
+func (r *RawLogWriter) setEndpoint(endpoint string) error {
+	header := r.enc.Header()
+	if header.Version == 1 || header.Endpoint == endpoint {
+		return nil
 	}
-	if _, err := r.w.Write(payload); err != nil {
+	header.Endpoint = endpoint
+	enc, err := rawlog.NewEncoder(header)
+	if err != nil {
 		return err
 	}
-	return r.w.Flush()
+	r.enc = enc
+	if r.w == nil {
+		return nil
+	}
+	return r.rotate("endpoint", r.current.SeriesID)
 }
 
-func (r *RawLogWriter) Close() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+func (r *RawLogWriter) startSeries(seriesID int) error {
 	if r.w == nil {
+		return r.open(seriesID)
+	}
+	if r.current.Records == 0 {
+		// Nothing recorded yet: the current file becomes the one of the
+		// series.
+		r.statusMu.Lock()
+		r.current.SeriesID = seriesID
+		r.statusMu.Unlock()
 		return nil
 	}
-	if err := r.w.Flush(); err != nil {
-		_ = r.f.Close()
-		r.w = nil
+	return r.rotate("series", seriesID)
+}
+
+// write appends a queued message to the current file. A file that failed
+// to open is retried here.
+func (r *RawLogWriter) write(item rawLogItem) error {
+	if r.w == nil {
+		if err := r.open(0); err != nil {
+			return err
+		}
+	}
+	if r.current.Records > 0 {
+		switch {
+		case r.opts.MaxBytes > 0 && r.current.Size+r.enc.MaxRecordSize(len(item.payload)) > r.opts.MaxBytes:
+			if err := r.rotate("size", r.current.SeriesID); err != nil {
+				return err
+			}
+		case r.opts.MaxAge > 0 && time.Since(r.current.Opened) >= r.opts.MaxAge:
+			if err := r.rotate("age", r.current.SeriesID); err != nil {
+				return err
+			}
+		}
+	}
+	lag := int64(time.Since(item.received))
+	r.lag.Store(lag)
+	if lag > r.maxLag.Load() {
+		r.maxLag.Store(lag)
+	}
+	// The buffer flushes itself when it fills.
+	size, err := r.enc.WriteRecord(r.w, item.received, item.payload)
+	r.total.Add(size)
+	r.statusMu.Lock()
+	r.current.Size += size
+	if err == nil {
+		r.current.Records++
+	}
+	r.statusMu.Unlock()
+	if err != nil {
 		return err
 	}
-	err := r.f.Close()
-	r.w = nil
-	return err
+	r.records.Add(1)
+	return nil
+}
+
+// fail counts err and keeps it for the status.
+func (r *RawLogWriter) fail(err error) {
+	if err != nil {
+		r.errors.Add(1)
+		r.setLastError(err)
+	}
+}
+
+func (r *RawLogWriter) setLastError(err error) {
+	r.statusMu.Lock()
+	r.lastError = err.Error()
+	r.statusMu.Unlock()
+}
+
+type rawLogFileInfo struct {
+	name     string
+	size     int64
+	modified time.Time
+}
+
+// logFiles lists the raw logs of the prefix in the directory, oldest first:
+// files of earlier processes by modification time, then the files of this
+// writer in the order they were opened, since several may share a
+// modification time.
+func (r *RawLogWriter) logFiles() ([]rawLogFileInfo, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []rawLogFileInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".bin") || !strings.Contains(name, "_"+r.prefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, rawLogFileInfo{name: name, size: info.Size(), modified: info.ModTime()})
+	}
+	opened := make(map[string]int, len(r.closed)+1)
+	for i, file := range r.closed {
+		opened[file.Name] = i + 1
+	}
+	if r.w != nil {
+		opened[r.current.Name] = len(r.closed) + 1
+	}
+	sort.Slice(files, func(i, j int) bool {
+		oi, oj := opened[files[i].name], opened[files[j].name]
+		if oi != oj {
+			return oi < oj
+		}
+		if !files[i].modified.Equal(files[j].modified) {
+			return files[i].modified.Before(files[j].modified)
+		}
+		return files[i].name < files[j].name
+	})
+	return files, nil
+}
+
+// prune deletes the oldest files beyond RetainBytes, never the open one.
+func (r *RawLogWriter) prune() {
+	if r.opts.RetainBytes <= 0 || r.total.Load() <= r.opts.RetainBytes {
+		return
+	}
+	files, err := r.logFiles()
+	if err != nil {
+		r.setLastError(err)
+		return
+	}
+	var total int64
+	for _, file := range files {
+		total += file.size
+	}
+	r.total.Store(total)
+	for _, file := range files {
+		if total <= r.opts.RetainBytes {
+			break
+		}
+		if r.w != nil && file.name == r.current.Name {
+			continue
+		}
+		if err := os.Remove(filepath.Join(r.dir, file.name)); err != nil {
+			r.setLastError(err)
+			continue
+		}
+		_ = os.Remove(rawlog.IndexPath(filepath.Join(r.dir, file.name)))
+		total -= file.size
+		r.total.Add(-file.size)
+		r.deleted.Add(1)
+		r.statusMu.Lock()
+		for i := range r.closed {
+			if r.closed[i].Name == file.name {
+				r.closed = append(r.closed[:i], r.closed[i+1:]...)
+				break
+			}
+		}
+		r.statusMu.Unlock()
+	}
+}
+
+// Status lists the current file and the files closed by this writer that
+// are still on disk, newest first. It does not wait for the disk.
+func (r *RawLogWriter) Status() RawLogStatus {
+	status := RawLogStatus{
+		Dir:        r.dir,
+		TotalBytes: r.total.Load(),
+		Rotations:  int(r.rotations.Load()),
+		Deleted:    int(r.deleted.Load()),
+
+		Records:       r.records.Load(),
+		Dropped:       r.dropped.Load(),
+		Queued:        len(r.queue),
+		QueueSize:     cap(r.queue),
+		QueuedBytes:   r.queuedBytes.Load(),
+		QueueBytes:    r.opts.QueueBytes,
+		WriteErrors:   r.errors.Load(),
+		Flushes:       r.flushes.Load(),
+		Syncs:         r.syncs.Load(),
+		LagSeconds:    time.Duration(r.lag.Load()).Seconds(),
+		MaxLagSeconds: time.Duration(r.maxLag.Load()).Seconds(),
+	}
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	status.LastError = r.lastError
+	status.Files = make([]RawLogFile, 0, len(r.closed))
+	if r.isOpen {
+		current := r.current
+		status.Current = &current
+	}
+	for i := len(r.closed) - 1; i >= 0; i-- {
+		status.Files = append(status.Files, r.closed[i])
+	}
+	return status
+}
+
+// Close writes the queued messages and closes the current file.
+func (r *RawLogWriter) Close() error {
+	r.sendMu.Lock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.queue)
+	}
+	r.sendMu.Unlock()
+	<-r.done
+	return r.closeErr
 }
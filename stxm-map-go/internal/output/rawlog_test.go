@@ -0,0 +1,212 @@
+package output
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"stxm-map-go/internal/rawlog"
+)
+
+// stallingFile is a raw log file whose writes of the payload stallOn wait
+// until release is closed; every write that waits is announced on stalled.
+// Messages are handed to the file in order, so a stalled write shows that
+// the writer goroutine has finished the messages before it.
+type stallingFile struct {
+	*os.File
+	stallOn []byte
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (f *stallingFile) Write(p []byte) (int, error) {
+	if bytes.Equal(p, f.stallOn) {
+		select {
+		case f.stalled <- struct{}{}:
+		default:
+		}
+		<-f.release
+	}
+	return f.File.Write(p)
+}
+
+// newStallingRawLog starts a raw log of version 1 in dir whose files stall
+// on writes of stallOn. A one byte buffer hands every record to the file at
+// once.
+func newStallingRawLog(t *testing.T, dir string, opts RawLogOptions, stallOn []byte) (*RawLogWriter, *stallingFile) {
+	t.Helper()
+	gate := &stallingFile{stallOn: stallOn, stalled: make(chan struct{}, 1), release: make(chan struct{})}
+	opts.Version, opts.FlushBytes = 1, 1
+	w, err := newRawLogWriter(dir, "raw_cbor", opts, func(filename string) (rawLogFile, error) {
+		f, err := createRawLogFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return &stallingFile{File: f.(*os.File), stallOn: gate.stallOn, stalled: gate.stalled, release: gate.release}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, gate
+}
+
+func TestRawLogRotationAndRetention(t *testing.T) {
+	dir := t.TempDir()
+	payload := bytes.Repeat([]byte{1}, 100)
+	probe := bytes.Repeat([]byte{2}, 100)
+	// Two records fit a file; three files at most are kept.
+	w, gate := newStallingRawLog(t, dir, RawLogOptions{
+		MaxBytes:    int64(len(rawlog.Magic) + 2*(rawlog.RecordHeaderSize+len(payload))),
+		PerSeries:   true,
+		RetainBytes: 3 * int64(len(rawlog.Magic)+2*(rawlog.RecordHeaderSize+len(payload))),
+	}, probe)
+	if err := w.StartSeries(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := w.Record(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.StartSeries(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Record(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Record(probe); err != nil {
+		t.Fatal(err)
+	}
+	<-gate.stalled
+	status := w.Status()
+	if status.Records != 4 || status.Rotations != 2 || status.Current == nil || status.Current.SeriesID != 2 || status.Current.Records != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if len(status.Files) != 2 || status.Files[0].Reason != "series" || status.Files[1].Reason != "size" || status.Files[1].SeriesID != 1 {
+		t.Fatalf("unexpected files %+v", status.Files)
+	}
+
+	close(gate.release)
+	for i := 0; i < 3; i++ {
+		if err := w.Record(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Record(payload); err == nil {
+		t.Fatal("record after close accepted")
+	}
+	status = w.Status()
+	files, _ := filepath.Glob(filepath.Join(dir, "*.bin"))
+	// The two oldest files went: both files of series 1.
+	if status.Deleted != 2 || len(files) != 3 || len(status.Files) != 3 {
+		t.Fatalf("deleted %d, %d files on disk, status %+v", status.Deleted, len(files), status.Files)
+	}
+	for _, file := range status.Files {
+		if file.SeriesID != 2 {
+			t.Fatalf("file of series %d kept: %+v", file.SeriesID, status.Files)
+		}
+	}
+	var total int64
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += info.Size()
+	}
+	if total != status.TotalBytes {
+		t.Fatalf("total %d, status %d", total, status.TotalBytes)
+	}
+}
+
+func TestRawLogDropsInsteadOfBlocking(t *testing.T) {
+	dir := t.TempDir()
+	payload := []byte("stxm")
+	w, gate := newStallingRawLog(t, dir, RawLogOptions{QueueSize: 2, QueueBytes: 12, FlushInterval: time.Hour, Sync: RawLogSyncFlush}, payload)
+	if err := w.Record(payload); err != nil {
+		t.Fatal(err)
+	}
+	// A stalled disk: the writer goroutine waits in the first record.
+	<-gate.stalled
+	var dropped int
+	for i := 0; i < 10; i++ {
+		if err := w.Record(payload); errors.Is(err, errRawLogQueueFull) {
+			dropped++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Status does not wait for the disk.
+	status := w.Status()
+	if dropped != 8 || status.Dropped != 8 || status.Queued != 2 || status.QueuedBytes != 12 || status.Records != 0 {
+		t.Fatalf("dropped %d of 10 with a queue of 2, status %+v", dropped, status)
+	}
+	// The byte budget holds back a message the queue would take.
+	if err := w.Record(payload); !errors.Is(err, errRawLogQueueFull) {
+		t.Fatalf("message beyond the byte budget: %v", err)
+	}
+	close(gate.release)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	status = w.Status()
+	if status.Dropped != 9 || status.Records != 3 || status.QueuedBytes != 0 || status.Syncs == 0 || status.Current != nil {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.bin"))
+	info, err := os.Stat(files[0])
+	if err != nil || info.Size() != status.TotalBytes {
+		t.Fatalf("file %v, status %d bytes", err, status.TotalBytes)
+	}
+}
+
+func TestRawLogHeaderAndCompression(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewRawLogWriter(dir, "raw_cbor", RawLogOptions{Version: 2, Compression: rawlog.CompressionGzip, Endpoint: "tcp://a:9999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := cbor.Marshal(map[string]any{"type": "image", "series_id": 3, "image_id": 0, "data": bytes.Repeat([]byte{7}, 4096)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Record(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetEndpoint("tcp://b:9999"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Record(payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	status := w.Status()
+	if len(status.Files) != 2 || status.Files[1].Reason != "endpoint" || status.TotalBytes >= int64(len(payload)) {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	for i, endpoint := range []string{"tcp://a:9999", "tcp://b:9999"} {
+		r, err := rawlog.Open(filepath.Join(dir, status.Files[1-i].Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := r.Header()
+		record, err := r.Next()
+		r.Close()
+		if err != nil || header.Version != 2 || header.Compression != rawlog.CompressionGzip || header.Endpoint != endpoint {
+			t.Fatalf("file %d: header %+v, %v", i, header, err)
+		}
+		if record.Flags != rawlog.FlagCompressed|rawlog.FlagImage || !bytes.Equal(record.Payload, payload) {
+			t.Fatalf("file %d: flags %b, %d bytes", i, record.Flags, len(record.Payload))
+		}
+	}
+}
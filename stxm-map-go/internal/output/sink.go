@@ -0,0 +1,558 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/types"
+)
+
+// Run identifies the series a sink event belongs to.
+type Run struct {
+	// RunTimestamp names the run: a path below the output directory whose
+	// last element prefixes the files of the run.
+	RunTimestamp string
+	SeriesID     int
+	Config       processing.SeriesConfig
+	// Fields are the values the run path was expanded from; map templates
+	// use them too.
+	Fields TemplateFields
+}
+
+// SeriesResult is a finished series as handed to the sinks.
+type SeriesResult struct {
+	Run
+	Complete bool
+	// Summary is the series metadata: completeness, reason, frame counts,
+	// grid and scan order.
+	Summary     map[string]any
+	Maps        MapSet
+	Data        map[string]*processing.ThresholdData
+	Mask        []bool
+	Samples     []processing.PositionSample
+	Diffraction map[string]types.DiffractionFrame
+}
+
+// NewSeriesResult collects the series in agg, finalized for reason, for the
+// sinks. The caller adds the diffraction patterns.
+func NewSeriesResult(run Run, agg *processing.Aggregator, reason string) SeriesResult {
+	received := agg.FrameCount()
+	cfg := agg.Config()
+	expected := cfg.ExpectedPoints()
+	complete := received >= expected
+	summary := map[string]any{
+		"series_id":       run.SeriesID,
+		"complete":        complete,
+		"reason":          reason,
+		"frames_received": received,
+		"frames_expected": expected,
+		"grid_x":          cfg.GridX,
+		"grid_y":          cfg.GridY,
+		"scan_order":      cfg.Order.String(),
+	}
+	if cfg.Energy > 0 {
+		summary["energy"] = cfg.Energy
+	}
+	maps := MapsOf(agg)
+	summary["channels"] = maps.Channels()
+	result := SeriesResult{
+		Run:      run,
+		Complete: complete,
+		Summary:  summary,
+		Maps:     maps,
+		Data:     agg.Snapshot(),
+		Mask:     agg.Mask(),
+	}
+	if cfg.PositionMode {
+		result.Samples = agg.Samples()
+	}
+	return result
+}
+
+// MapsOf copies the maps of the series in agg with their pixel timestamps.
+func MapsOf(agg *processing.Aggregator) MapSet {
+	cfg := agg.Config()
+	data := agg.Snapshot()
+	timestamps := make(map[string][]float64, len(data))
+	for threshold, td := range data {
+		timestamps[threshold] = append([]float64(nil), td.Timestamps...)
+	}
+	return MapSet{
+		GridX:      cfg.GridX,
+		GridY:      cfg.GridY,
+		Maps:       agg.SnapshotCopy(),
+		Timestamps: timestamps,
+	}
+}
+
+// Sink receives the output of the pipeline. OnStart is called for the start
+// message of a series, OnFrame for every detector frame if the sink is a
+// FrameSink that needs them, OnSnapshot with the live maps at the UI rate
+// and OnEnd once the series is finalized. A sink gets its events in order
+// from a goroutine of its own, see Registry.
+type Sink interface {
+	Name() string
+	OnStart(run Run, meta map[string]any) error
+	OnFrame(frame types.RawFrame) error
+	OnSnapshot(run Run, maps MapSet) error
+	OnEnd(result SeriesResult) error
+}
+
+// MetadataSink is implemented by sinks that also want the other metadata
+// messages of a series, such as its end message.
+type MetadataSink interface {
+	OnMetadata(run Run, kind string, meta map[string]any) error
+}
+
+// FrameSink is implemented by sinks that use the raw detector frames. Only
+// the sinks whose NeedsFrames reports true get Frame events; the others never
+// hold on to detector images.
+type FrameSink interface {
+	NeedsFrames() bool
+}
+
+// CheckpointSink is implemented by sinks that make what they wrote for a
+// series durable when the series in progress is checkpointed.
+type CheckpointSink interface {
+	OnCheckpoint(run Run) error
+}
+
+// SinkStats counts the events a sink handled, the errors it returned and the
+// frames and snapshots it dropped because its queue was full.
+type SinkStats struct {
+	Events      uint64  `json:"events"`
+	Errors      uint64  `json:"errors"`
+	Dropped     uint64  `json:"dropped"`
+	Queued      int     `json:"queued"`
+	QueuedBytes int64   `json:"queued_bytes"`
+	BusySeconds float64 `json:"busy_seconds"`
+	LastError   string  `json:"last_error,omitempty"`
+	LastErrorAt string  `json:"last_error_at,omitempty"`
+}
+
+// sinkQueue and sinkQueueBytes bound the frames and snapshots waiting for a
+// sink, in events and in payload bytes. Start, metadata, end and checkpoint
+// events are never dropped.
+const (
+	sinkQueue      = 256
+	sinkQueueBytes = 64 << 20
+)
+
+// endFollower is implemented by sinks whose end event waits until the sinks
+// registered before them have handled it, because they read what the others
+// wrote.
+type endFollower interface {
+	followsEnd()
+}
+
+type sinkEvent struct {
+	name string
+	// lossy events are dropped when the queue is full; size is the bytes
+	// of their payload.
+	lossy bool
+	size  int64
+	fn    func(Sink) error
+	end   *endEvent
+	// marker is closed when the sink reaches the event; see Sync.
+	marker chan struct{}
+}
+
+// endEvent tracks an end event through the sinks.
+type endEvent struct {
+	done    []chan struct{}
+	pending atomic.Int32
+	failed  atomic.Int32
+	onDone  func(failed int)
+}
+
+func (e *endEvent) finish(index int, failed bool) {
+	if failed {
+		e.failed.Add(1)
+	}
+	close(e.done[index])
+	if e.pending.Add(-1) == 0 && e.onDone != nil {
+		e.onDone(int(e.failed.Load()))
+	}
+}
+
+type sinkEntry struct {
+	sink      Sink
+	index     int
+	follows   bool
+	frames    bool
+	events    atomic.Uint64
+	errors    atomic.Uint64
+	dropped   atomic.Uint64
+	busyNanos atomic.Uint64
+	done      chan struct{}
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	queue       []sinkEvent
+	lossy       int
+	lossyBytes  int64
+	closed      bool
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// Registry fans events out to its sinks in registration order. Every sink
+// has a queue and a goroutine of its own, so a slow sink neither holds up
+// the pipeline nor the other sinks; frames and snapshots beyond the queue
+// are dropped and counted. An error or panic in one sink is counted against
+// it and reported to OnError; the other sinks still get the event. Sinks are
+// registered before the first event.
+type Registry struct {
+	// OnError is called for every failed event with the sink name and the
+	// event ("start", "frame", "snapshot", "end", "metadata", "checkpoint",
+	// "close" or one reported by the sink itself). It is called from the
+	// goroutines of the sinks.
+	OnError func(sink, event string, err error)
+	// Lossless makes Frame and Snapshot wait for room in a full queue
+	// instead of dropping the event, for offline processing.
+	Lossless bool
+	// QueueBytes bounds the payload of the frames and snapshots queued for
+	// each sink; zero means 64 MiB. Set it before the first event.
+	QueueBytes int64
+
+	mu      sync.RWMutex
+	entries []*sinkEntry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a sink and starts its goroutine. Names must be unique.
+func (r *Registry) Register(sink Sink) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entry := range r.entries {
+		if entry.sink.Name() == sink.Name() {
+			return fmt.Errorf("sink %q registered twice", sink.Name())
+		}
+	}
+	_, follows := sink.(endFollower)
+	fs, frames := sink.(FrameSink)
+	frames = frames && fs.NeedsFrames()
+	entry := &sinkEntry{sink: sink, index: len(r.entries), follows: follows, frames: frames, done: make(chan struct{})}
+	entry.cond = sync.NewCond(&entry.mu)
+	r.entries = append(r.entries, entry)
+	go r.run(entry)
+	return nil
+}
+
+// Names lists the registered sinks in order.
+func (r *Registry) Names() []string {
+	entries := r.list()
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.sink.Name()
+	}
+	return names
+}
+
+func (r *Registry) list() []*sinkEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.entries
+}
+
+// Start sends the start message of a series to every sink.
+func (r *Registry) Start(run Run, meta map[string]any) {
+	r.post("start", func(s Sink) error { return s.OnStart(run, meta) })
+}
+
+// Frame sends a detector frame to the sinks that need frames.
+func (r *Registry) Frame(frame types.RawFrame) {
+	ev := sinkEvent{name: "frame", lossy: true, size: frameBytes(frame), fn: func(s Sink) error { return s.OnFrame(frame) }}
+	for _, entry := range r.list() {
+		if entry.frames {
+			r.push(entry, ev)
+		}
+	}
+}
+
+// Snapshot sends the live maps of a series to every sink.
+func (r *Registry) Snapshot(run Run, maps MapSet) {
+	ev := sinkEvent{name: "snapshot", lossy: true, size: maps.bytes(), fn: func(s Sink) error { return s.OnSnapshot(run, maps) }}
+	for _, entry := range r.list() {
+		r.push(entry, ev)
+	}
+}
+
+// End sends a finished series to every sink. onDone, if not nil, is called
+// with the number of sinks that failed once all of them handled it.
+func (r *Registry) End(result SeriesResult, onDone func(failed int)) {
+	entries := r.list()
+	end := &endEvent{done: make([]chan struct{}, len(entries)), onDone: onDone}
+	for i := range end.done {
+		end.done[i] = make(chan struct{})
+	}
+	end.pending.Store(int32(len(entries)))
+	if len(entries) == 0 && onDone != nil {
+		onDone(0)
+	}
+	for _, entry := range entries {
+		ev := sinkEvent{name: "end", fn: func(s Sink) error { return s.OnEnd(result) }, end: end}
+		if !r.push(entry, ev) {
+			end.finish(entry.index, true)
+		}
+	}
+}
+
+// Metadata sends a metadata message other than start to the sinks that
+// implement MetadataSink.
+func (r *Registry) Metadata(run Run, kind string, meta map[string]any) {
+	r.post("metadata", func(s Sink) error {
+		if ms, ok := s.(MetadataSink); ok {
+			return ms.OnMetadata(run, kind, meta)
+		}
+		return nil
+	})
+}
+
+// Checkpoint tells the sinks that implement CheckpointSink that the series
+// of run was checkpointed.
+func (r *Registry) Checkpoint(run Run) {
+	r.post("checkpoint", func(s Sink) error {
+		if cs, ok := s.(CheckpointSink); ok {
+			return cs.OnCheckpoint(run)
+		}
+		return nil
+	})
+}
+
+// Sync waits until every sink has handled the events sent so far.
+func (r *Registry) Sync() {
+	var markers []chan struct{}
+	for _, entry := range r.list() {
+		marker := make(chan struct{})
+		if r.push(entry, sinkEvent{name: "sync", marker: marker}) {
+			markers = append(markers, marker)
+		}
+	}
+	for _, marker := range markers {
+		<-marker
+	}
+}
+
+func (r *Registry) post(event string, fn func(Sink) error) {
+	for _, entry := range r.list() {
+		r.push(entry, sinkEvent{name: event, fn: fn})
+	}
+}
+
+// frameBytes is the size of the image data of a frame.
+func frameBytes(frame types.RawFrame) int64 {
+	var n int64
+	for _, payload := range frame.Data {
+		n += valueBytes(reflect.ValueOf(payload))
+	}
+	return n
+}
+
+// valueBytes is the size of the elements of a decoded image array, nested
+// slices included.
+func valueBytes(v reflect.Value) int64 {
+	switch v.Kind() {
+	case reflect.Interface:
+		return valueBytes(v.Elem())
+	case reflect.Slice:
+		switch v.Type().Elem().Kind() {
+		case reflect.Slice, reflect.Interface:
+			var n int64
+			for i := 0; i < v.Len(); i++ {
+				n += valueBytes(v.Index(i))
+			}
+			return n
+		}
+		return int64(v.Len()) * int64(v.Type().Elem().Size())
+	case reflect.Invalid:
+		return 0
+	}
+	return int64(v.Type().Size())
+}
+
+// bytes is the size of the maps and timestamps of m.
+func (m MapSet) bytes() int64 {
+	var n int64
+	for _, snapshot := range m.Maps {
+		n += int64(4*len(snapshot.Values) + len(snapshot.Mask) + 8*len(snapshot.Variance))
+	}
+	for _, timestamps := range m.Timestamps {
+		n += int64(8 * len(timestamps))
+	}
+	return n
+}
+
+// full reports whether the queue of entry has no room for a lossy event of
+// size bytes. An empty queue takes any event.
+func (r *Registry) full(entry *sinkEntry, size int64) bool {
+	limit := r.QueueBytes
+	if limit <= 0 {
+		limit = sinkQueueBytes
+	}
+	return entry.lossy >= sinkQueue || (entry.lossy > 0 && entry.lossyBytes+size > limit)
+}
+
+// push queues ev for the sink of entry and reports whether it was queued.
+func (r *Registry) push(entry *sinkEntry, ev sinkEvent) bool {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	for ev.lossy && r.Lossless && r.full(entry, ev.size) && !entry.closed {
+		entry.cond.Wait()
+	}
+	if entry.closed {
+		return false
+	}
+	if ev.lossy && r.full(entry, ev.size) {
+		entry.dropped.Add(1)
+		return false
+	}
+	entry.queue = append(entry.queue, ev)
+	if ev.lossy {
+		entry.lossy++
+		entry.lossyBytes += ev.size
+	}
+	entry.cond.Broadcast()
+	return true
+}
+
+// run handles the events of one sink in order until the registry is closed
+// and the queue is empty.
+func (r *Registry) run(entry *sinkEntry) {
+	defer close(entry.done)
+	for {
+		entry.mu.Lock()
+		for len(entry.queue) == 0 && !entry.closed {
+			entry.cond.Wait()
+		}
+		if len(entry.queue) == 0 {
+			entry.mu.Unlock()
+			return
+		}
+		ev := entry.queue[0]
+		entry.queue[0] = sinkEvent{}
+		entry.queue = entry.queue[1:]
+		if ev.lossy {
+			entry.lossy--
+			entry.lossyBytes -= ev.size
+		}
+		entry.cond.Broadcast()
+		entry.mu.Unlock()
+		r.handle(entry, ev)
+	}
+}
+
+func (r *Registry) handle(entry *sinkEntry, ev sinkEvent) {
+	if ev.marker != nil {
+		close(ev.marker)
+		return
+	}
+	if ev.end != nil && entry.follows {
+		for _, done := range ev.end.done[:entry.index] {
+			<-done
+		}
+	}
+	start := time.Now()
+	err := callSink(entry.sink, ev.fn)
+	entry.events.Add(1)
+	entry.busyNanos.Add(uint64(time.Since(start).Nanoseconds()))
+	if err != nil {
+		r.fail(entry, ev.name, err)
+	}
+	if ev.end != nil {
+		ev.end.finish(entry.index, err != nil)
+	}
+}
+
+func callSink(sink Sink, fn func(Sink) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return fn(sink)
+}
+
+func (r *Registry) fail(entry *sinkEntry, event string, err error) {
+	entry.errors.Add(1)
+	entry.mu.Lock()
+	entry.lastError = fmt.Sprintf("%s: %v", event, err)
+	entry.lastErrorAt = time.Now()
+	entry.mu.Unlock()
+	if r.OnError != nil {
+		r.OnError(entry.sink.Name(), event, err)
+	}
+}
+
+// Report counts an error against the named sink. Sinks that work in the
+// background use it for failures outside the registry's calls.
+func (r *Registry) Report(name, event string, err error) {
+	for _, entry := range r.list() {
+		if entry.sink.Name() == name {
+			r.fail(entry, event, err)
+			return
+		}
+	}
+}
+
+// Stats returns the counters of every sink by name.
+func (r *Registry) Stats() map[string]SinkStats {
+	entries := r.list()
+	out := make(map[string]SinkStats, len(entries))
+	for _, entry := range entries {
+		stats := SinkStats{
+			Events:      entry.events.Load(),
+			Errors:      entry.errors.Load(),
+			Dropped:     entry.dropped.Load(),
+			BusySeconds: float64(entry.busyNanos.Load()) / 1e9,
+		}
+		entry.mu.Lock()
+		stats.Queued = len(entry.queue)
+		stats.QueuedBytes = entry.lossyBytes
+		stats.LastError = entry.lastError
+		if !entry.lastErrorAt.IsZero() {
+			stats.LastErrorAt = entry.lastErrorAt.Format(time.RFC3339)
+		}
+		entry.mu.Unlock()
+		out[entry.sink.Name()] = stats
+	}
+	return out
+}
+
+// Close lets every sink handle its queued events, stops their goroutines and
+// closes the sinks that implement io.Closer, in reverse order. Events sent
+// afterwards are ignored.
+func (r *Registry) Close() error {
+	entries := r.list()
+	for _, entry := range entries {
+		entry.mu.Lock()
+		entry.closed = true
+		entry.cond.Broadcast()
+		entry.mu.Unlock()
+	}
+	for _, entry := range entries {
+		<-entry.done
+	}
+	var first error
+	for i := len(entries) - 1; i >= 0; i-- {
+		closer, ok := entries[i].sink.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			r.fail(entries[i], "close", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
@@ -0,0 +1,256 @@
+package output
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/types"
+)
+
+type testSink struct {
+	nopSink
+	name string
+	fail error
+	ends int
+}
+
+func (s *testSink) Name() string { return s.name }
+
+func (s *testSink) OnEnd(SeriesResult) error {
+	s.ends++
+	if s.fail != nil {
+		return s.fail
+	}
+	return nil
+}
+
+// endAndWait sends result to the sinks of r and returns how many failed.
+func endAndWait(r *Registry, result SeriesResult) int {
+	failed := make(chan int, 1)
+	r.End(result, func(n int) { failed <- n })
+	return <-failed
+}
+
+type panicSink struct{ nopSink }
+
+func (panicSink) Name() string             { return "panic" }
+func (panicSink) OnEnd(SeriesResult) error { panic("boom") }
+
+func TestRegistryIsolatesFailingSinks(t *testing.T) {
+	r := NewRegistry()
+	failing := &testSink{name: "failing", fail: errors.New("disk full")}
+	last := &testSink{name: "last"}
+	for _, sink := range []Sink{failing, panicSink{}, last} {
+		if err := r.Register(sink); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Register(&testSink{name: "last"}); err == nil {
+		t.Fatal("duplicate sink registered")
+	}
+	var mu sync.Mutex
+	var reported []string
+	r.OnError = func(sink, event string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		reported = append(reported, sink+" "+event)
+	}
+
+	if failed := endAndWait(r, SeriesResult{}); failed != 2 {
+		t.Fatalf("failed = %d, want 2", failed)
+	}
+	if last.ends != 1 {
+		t.Fatal("sink after the failing ones not called")
+	}
+	mu.Lock()
+	sort.Strings(reported)
+	if len(reported) != 2 || reported[0] != "failing end" || reported[1] != "panic end" {
+		t.Fatalf("reported %v", reported)
+	}
+	mu.Unlock()
+	stats := r.Stats()
+	if stats["failing"].Errors != 1 || stats["failing"].LastError != "end: disk full" {
+		t.Fatalf("failing stats %+v", stats["failing"])
+	}
+	if stats["panic"].Errors != 1 || stats["last"].Errors != 0 || stats["last"].Events != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+func TestSinkRegistryWritesRun(t *testing.T) {
+	dir := t.TempDir()
+	posted := make(chan map[string]any, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var event map[string]any
+		_ = json.NewDecoder(req.Body).Decode(&event)
+		posted <- event
+	}))
+	defer hook.Close()
+
+	r, err := NewSinkRegistry(SinkConfig{
+		OutputDir:      dir,
+		Formats:        []string{"text", "npz"},
+		WebhookURL:     hook.URL,
+		WebhookTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSinkRegistry(SinkConfig{Formats: []string{"hdf5"}}); err == nil {
+		t.Fatal("unknown format accepted")
+	}
+
+	run := Run{RunTimestamp: "20260105_101500", SeriesID: 3, Config: processing.SeriesConfig{GridX: 2, GridY: 1}}
+	r.Start(run, map[string]any{"series_id": 3})
+	result := SeriesResult{Run: run, Complete: true, Summary: map[string]any{"complete": true}}
+	if failed := endAndWait(r, result); failed != 0 {
+		t.Fatalf("end failed in %d sinks: %+v", failed, r.Stats())
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"_start_data.txt", "_series_data.txt", "_manifest.sha256"} {
+		if _, err := os.Stat(filepath.Join(dir, run.RunTimestamp+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"start", "end"} {
+		event := <-posted
+		if event["event"] != want || event["run"] != run.RunTimestamp {
+			t.Fatalf("webhook event %v, want %s", event, want)
+		}
+	}
+}
+
+// blockingSink holds every frame until release is closed.
+type blockingSink struct {
+	nopSink
+	name    string
+	release chan struct{}
+	frames  int
+	ends    []string
+	mu      *sync.Mutex
+}
+
+func (s *blockingSink) Name() string { return s.name }
+
+func (s *blockingSink) NeedsFrames() bool { return true }
+
+func (s *blockingSink) OnFrame(types.RawFrame) error {
+	<-s.release
+	s.frames++
+	return nil
+}
+
+func (s *blockingSink) OnEnd(SeriesResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ends = append(s.ends, s.name)
+	return nil
+}
+
+type followingSink struct {
+	blockingSink
+}
+
+func (s *followingSink) followsEnd() {}
+
+func TestRegistryQueuesPerSink(t *testing.T) {
+	var mu sync.Mutex
+	release := make(chan struct{})
+	slow := &blockingSink{name: "slow", release: release, mu: &mu}
+	fast := &blockingSink{name: "fast", release: make(chan struct{}), mu: &mu}
+	close(fast.release)
+	follower := &followingSink{blockingSink{name: "follower", release: fast.release, mu: &mu}}
+	r := NewRegistry()
+	for _, sink := range []Sink{slow, fast, follower} {
+		if err := r.Register(sink); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first frame blocks the slow sink; the rest fill its queue and
+	// overflow it without holding up the caller.
+	for i := 0; i < sinkQueue+11; i++ {
+		r.Frame(types.RawFrame{ImageID: i})
+	}
+	ended := make(chan int, 1)
+	r.End(SeriesResult{}, func(failed int) { ended <- failed })
+	select {
+	case <-ended:
+		t.Fatal("end reported before the slow sink handled it")
+	case <-time.After(20 * time.Millisecond):
+	}
+	stats := r.Stats()
+	if stats["slow"].Dropped == 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+	// The follower waits for the sinks before it.
+	mu.Lock()
+	if len(follower.ends) != 0 {
+		t.Fatal("follower handled the end before the slow sink")
+	}
+	mu.Unlock()
+
+	close(release)
+	if failed := <-ended; failed != 0 {
+		t.Fatalf("failed = %d", failed)
+	}
+	r.Sync()
+	stats = r.Stats()
+	for _, sink := range []*blockingSink{slow, fast} {
+		if uint64(sink.frames)+stats[sink.name].Dropped != sinkQueue+11 {
+			t.Fatalf("%s got %d frames, stats %+v", sink.name, sink.frames, stats)
+		}
+	}
+	if stats["slow"].Queued != 0 {
+		t.Fatalf("stats %+v", stats)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegistryBoundsQueueBytes(t *testing.T) {
+	var mu sync.Mutex
+	release := make(chan struct{})
+	slow := &blockingSink{name: "slow", release: release, mu: &mu}
+	// testSink does not need frames.
+	other := &testSink{name: "other"}
+	r := NewRegistry()
+	r.QueueBytes = 3000
+	for _, sink := range []Sink{slow, other} {
+		if err := r.Register(sink); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every frame holds 1000 bytes; the slow sink queues three of them.
+	for i := 0; i < 10; i++ {
+		r.Frame(types.RawFrame{ImageID: i, Data: map[string]any{"threshold_0": [][]uint16{make([]uint16, 250), make([]uint16, 250)}}})
+	}
+	stats := r.Stats()
+	if stats["slow"].QueuedBytes > 3000 || stats["slow"].Dropped < 6 {
+		t.Fatalf("stats %+v", stats["slow"])
+	}
+	close(release)
+	r.Sync()
+	stats = r.Stats()
+	if uint64(slow.frames)+stats["slow"].Dropped != 10 || stats["slow"].QueuedBytes != 0 {
+		t.Fatalf("slow got %d frames, stats %+v", slow.frames, stats["slow"])
+	}
+	if stats["other"].Events != 0 || stats["other"].Dropped != 0 {
+		t.Fatalf("a sink without frames got them: %+v", stats["other"])
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,316 @@
+package output
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"stxm-map-go/internal/types"
+)
+
+// SinkConfig selects and configures the sinks of NewSinkRegistry.
+type SinkConfig struct {
+	OutputDir string
+	// Formats lists the file sinks: text, tiff, npy, npz and zarr.
+	Formats             []string
+	TIFFDtype           string
+	ZarrDiffractionSide int
+	// Catalog is indexed after every run when set.
+	Catalog *Catalog
+	// WebhookURL receives a JSON notification for every start and end of a
+	// series when set.
+	WebhookURL     string
+	WebhookTimeout time.Duration
+	// MapTemplate names the text and npy files of the maps of every channel,
+	// without extension, when set.
+	MapTemplate *PathTemplate
+	// Lossless sets Registry.Lossless.
+	Lossless bool
+}
+
+// NewSinkRegistry builds the registry for cfg. The metadata and manifest
+// sinks are always present; the end of a series reaches the manifest once
+// the file sinks have written it, the catalog indexes the finished files and
+// the webhook is notified last.
+func NewSinkRegistry(cfg SinkConfig) (*Registry, error) {
+	r := NewRegistry()
+	r.Lossless = cfg.Lossless
+	sinks := []Sink{&metadataSink{dir: cfg.OutputDir}}
+	seen := map[string]bool{}
+	for _, format := range cfg.Formats {
+		if seen[format] {
+			continue
+		}
+		seen[format] = true
+		switch format {
+		case "text":
+			sinks = append(sinks, &textSink{dir: cfg.OutputDir, names: cfg.MapTemplate})
+		case "tiff":
+			if cfg.TIFFDtype != TIFFFloat32 && cfg.TIFFDtype != TIFFUint32 {
+				return nil, fmt.Errorf("unsupported tiff dtype %q", cfg.TIFFDtype)
+			}
+			sinks = append(sinks, &tiffSink{dir: cfg.OutputDir, dtype: cfg.TIFFDtype})
+		case "npy":
+			sinks = append(sinks, &npySink{dir: cfg.OutputDir, names: cfg.MapTemplate})
+		case "npz":
+			sinks = append(sinks, &npzSink{dir: cfg.OutputDir})
+		case "zarr":
+			sinks = append(sinks, &zarrSink{dir: cfg.OutputDir, side: cfg.ZarrDiffractionSide, scans: map[int]*ZarrScan{}, latest: map[int]MapSet{}})
+		default:
+			return nil, fmt.Errorf("unknown output format %q", format)
+		}
+	}
+	sinks = append(sinks, &manifestSink{dir: cfg.OutputDir})
+	if cfg.Catalog != nil {
+		sinks = append(sinks, &catalogSink{dir: cfg.OutputDir, catalog: cfg.Catalog})
+	}
+	if cfg.WebhookURL != "" {
+		sinks = append(sinks, newWebhookSink(cfg.WebhookURL, cfg.OutputDir, cfg.WebhookTimeout, func(err error) {
+			r.Report("webhook", "post", err)
+		}))
+	}
+	for _, sink := range sinks {
+		if err := r.Register(sink); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// nopSink ignores every event; sinks embed it and override what they need.
+type nopSink struct{}
+
+func (nopSink) OnStart(Run, map[string]any) error { return nil }
+func (nopSink) OnFrame(types.RawFrame) error      { return nil }
+func (nopSink) OnSnapshot(Run, MapSet) error      { return nil }
+func (nopSink) OnEnd(SeriesResult) error          { return nil }
+
+// metadataSink writes the metadata messages and the series summary as
+// {timestamp}_{kind}_data.txt, and the other files of a series that do not
+// depend on the output formats.
+type metadataSink struct {
+	nopSink
+	dir string
+}
+
+func (s *metadataSink) Name() string { return "metadata" }
+
+func (s *metadataSink) OnStart(run Run, meta map[string]any) error {
+	return WriteMetadata(s.dir, run.RunTimestamp, "start", meta)
+}
+
+func (s *metadataSink) OnMetadata(run Run, kind string, meta map[string]any) error {
+	return WriteMetadata(s.dir, run.RunTimestamp, kind, meta)
+}
+
+// OnEnd writes the series summary and the files every series gets whatever
+// the output formats: the mask of an incomplete series, the positions of a
+// position based scan and the accumulated diffraction patterns.
+func (s *metadataSink) OnEnd(result SeriesResult) error {
+	cfg := result.Config
+	var errs []error
+	if err := WriteMetadata(s.dir, result.RunTimestamp, "series", result.Summary); err != nil {
+		errs = append(errs, err)
+	}
+	if !result.Complete && len(result.Mask) > 0 {
+		if err := WriteMask(s.dir, result.RunTimestamp, cfg.GridX, cfg.GridY, result.Mask); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := WritePositions(s.dir, result.RunTimestamp, result.Samples); err != nil {
+		errs = append(errs, err)
+	}
+	if err := WriteDiffraction(s.dir, result.RunTimestamp, result.Diffraction); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// textSink writes the maps as text.
+type textSink struct {
+	nopSink
+	dir   string
+	names *PathTemplate
+}
+
+func (s *textSink) Name() string { return "text" }
+
+func (s *textSink) OnEnd(result SeriesResult) error {
+	cfg := result.Config
+	if s.names != nil {
+		return WriteSeriesFiles(s.dir, cfg.GridX, cfg.GridY, result.Data, func(threshold string) string {
+			return mapFileName(s.names, result.Run, threshold, ".txt")
+		})
+	}
+	return WriteSeries(s.dir, result.RunTimestamp, cfg.GridX, cfg.GridY, result.Data)
+}
+
+type tiffSink struct {
+	nopSink
+	dir   string
+	dtype string
+}
+
+func (s *tiffSink) Name() string { return "tiff" }
+
+func (s *tiffSink) OnEnd(result SeriesResult) error {
+	info := TIFFInfo{
+		PixelSize: result.Config.StepSize(),
+		Metadata:  map[string]any{"run": result.RunTimestamp, "series": result.Summary},
+	}
+	return WriteTIFF(s.dir, result.RunTimestamp, result.Maps.GridX, result.Maps.GridY, result.Maps.Maps, s.dtype, info)
+}
+
+type npySink struct {
+	nopSink
+	dir   string
+	names *PathTemplate
+}
+
+func (s *npySink) Name() string { return "npy" }
+
+func (s *npySink) OnEnd(result SeriesResult) error {
+	if s.names != nil {
+		return WriteNPYFiles(s.dir, result.Maps, func(channel string) string {
+			return mapFileName(s.names, result.Run, channel, ".npy")
+		})
+	}
+	return WriteNPY(s.dir, result.RunTimestamp, result.Maps)
+}
+
+type npzSink struct {
+	nopSink
+	dir string
+}
+
+func (s *npzSink) Name() string { return "npz" }
+
+func (s *npzSink) OnEnd(result SeriesResult) error {
+	return WriteNPZ(s.dir, result.RunTimestamp, result.Maps)
+}
+
+// zarrSink keeps a Zarr store per series from its start message until it is
+// finalized. The maps in the store are written at every checkpoint from the
+// latest live snapshot, and when the series ends.
+type zarrSink struct {
+	dir  string
+	side int
+
+	mu     sync.Mutex
+	scans  map[int]*ZarrScan
+	latest map[int]MapSet
+}
+
+func (s *zarrSink) Name() string { return "zarr" }
+
+func (s *zarrSink) scan(seriesID int) *ZarrScan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scans[seriesID]
+}
+
+func (s *zarrSink) OnStart(run Run, meta map[string]any) error {
+	scan, err := CreateZarrScan(s.dir, run.RunTimestamp, run.SeriesID, run.Config, s.side, meta)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A series that never got frames is not finalized; keep only the
+	// stores that can still receive data.
+	if len(s.scans) >= maxOpenZarrScans {
+		s.scans = map[int]*ZarrScan{}
+		s.latest = map[int]MapSet{}
+	}
+	s.scans[run.SeriesID] = scan
+	return nil
+}
+
+// maxOpenZarrScans bounds the stores of series that started but never ended.
+const maxOpenZarrScans = 8
+
+// NeedsFrames reports whether the stores keep diffraction patterns.
+func (s *zarrSink) NeedsFrames() bool { return s.side > 0 }
+
+func (s *zarrSink) OnFrame(frame types.RawFrame) error {
+	if scan := s.scan(frame.SeriesID); scan != nil {
+		return scan.AddFrame(frame)
+	}
+	return nil
+}
+
+func (s *zarrSink) OnSnapshot(run Run, maps MapSet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.scans[run.SeriesID]; ok {
+		s.latest[run.SeriesID] = maps
+	}
+	return nil
+}
+
+func (s *zarrSink) OnCheckpoint(run Run) error {
+	s.mu.Lock()
+	scan := s.scans[run.SeriesID]
+	maps, ok := s.latest[run.SeriesID]
+	delete(s.latest, run.SeriesID)
+	s.mu.Unlock()
+	if scan == nil {
+		return nil
+	}
+	if ok {
+		if err := scan.writeMaps(maps); err != nil {
+			return err
+		}
+	}
+	return scan.Sync()
+}
+
+func (s *zarrSink) OnMetadata(run Run, kind string, meta map[string]any) error {
+	if scan := s.scan(run.SeriesID); scan != nil {
+		return scan.SetAttrs(map[string]any{kind: meta})
+	}
+	return nil
+}
+
+func (s *zarrSink) OnEnd(result SeriesResult) error {
+	s.mu.Lock()
+	scan := s.scans[result.SeriesID]
+	delete(s.scans, result.SeriesID)
+	delete(s.latest, result.SeriesID)
+	s.mu.Unlock()
+	if scan == nil {
+		return nil
+	}
+	return scan.Finish(result.Maps, map[string]any{"series": result.Summary})
+}
+
+// manifestSink writes the checksum manifest of a run once its series is
+// finalized and the sinks before it have written their files.
+type manifestSink struct {
+	nopSink
+	dir string
+}
+
+func (s *manifestSink) Name() string { return "manifest" }
+func (s *manifestSink) followsEnd()  {}
+
+func (s *manifestSink) OnEnd(result SeriesResult) error {
+	return WriteManifest(s.dir, result.RunTimestamp)
+}
+
+// catalogSink indexes a run in the catalog after its manifest is written.
+// Hashing the files of a run takes a while; it runs on the goroutine of the
+// sink, one run at a time.
+type catalogSink struct {
+	nopSink
+	dir     string
+	catalog *Catalog
+}
+
+func (s *catalogSink) Name() string { return "catalog" }
+func (s *catalogSink) followsEnd()  {}
+
+func (s *catalogSink) OnEnd(result SeriesResult) error {
+	return s.catalog.Update(s.dir, result.RunTimestamp)
+}
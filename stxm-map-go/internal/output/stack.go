@@ -0,0 +1,85 @@
+package output
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"stxm-map-go/internal/processing"
+)
+
+// WriteStack writes an energy stack as one little-endian uint32 cube per
+// channel with shape (energies, grid_y, grid_x), a uint8 cube marking the
+// measured pixels and a metadata file with the energies of the layers. The
+// files are named after the run timestamp of the first series of the stack.
+func WriteStack(outputDir string, info processing.StackInfo, layers []processing.StackLayer) error {
+	if len(layers) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return err
+	}
+	pixels := info.GridX * info.GridY
+	prefix := filepath.Join(outputDir, info.RunTimestamp+"_stack")
+
+	for _, channel := range info.Channels {
+		cube := make([]uint32, 0, len(layers)*pixels)
+		for _, layer := range layers {
+			values := layer.Channels[channel].Values
+			if len(values) != pixels {
+				values = make([]uint32, pixels)
+			}
+			cube = append(cube, values...)
+		}
+		if err := writeUint32File(fmt.Sprintf("%s_%s.bin", prefix, channel), cube); err != nil {
+			return err
+		}
+	}
+
+	mask := make([]byte, len(layers)*pixels)
+	complete := make([]bool, len(layers))
+	for i, layer := range layers {
+		complete[i] = layer.Complete
+		for _, snap := range layer.Channels {
+			for idx, ok := range snap.Mask {
+				if ok && idx < pixels {
+					mask[i*pixels+idx] = 1
+				}
+			}
+		}
+	}
+	if err := writeBytesAtomic(prefix+"_mask.bin", mask); err != nil {
+		return err
+	}
+
+	return WriteMetadata(outputDir, info.RunTimestamp, "stack", map[string]any{
+		"id":         info.ID,
+		"energies":   info.Energies,
+		"series_ids": info.SeriesIDs,
+		"complete":   complete,
+		"channels":   info.Channels,
+		"shape":      []int{len(layers), info.GridY, info.GridX},
+		"dtype":      "<u4",
+		"mask_dtype": "|u1",
+	})
+}
+
+// WriteUint32 writes values as raw little-endian uint32.
+func WriteUint32(w io.Writer, values []uint32) error {
+	buf := make([]byte, 4)
+	for _, v := range values {
+		binary.LittleEndian.PutUint32(buf, v)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeUint32File(filename string, values []uint32) error {
+	return WriteFileAtomic(filename, func(w io.Writer) error {
+		return WriteUint32(w, values)
+	})
+}
@@ -0,0 +1,223 @@
+package output
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"stxm-map-go/internal/processing"
+)
+
+// TemplateFields are the values a path template is expanded with.
+type TemplateFields struct {
+	Proposal       string
+	SampleName     string
+	SeriesUniqueID string
+	SeriesID       int
+	// Time is the start of the run; it gives {date}, {time} and {timestamp}.
+	Time time.Time
+	// Channel and Run are only known for the files of one channel of a run.
+	Channel string
+	Run     string
+}
+
+var templateFields = map[string]func(TemplateFields) string{
+	"proposal":         func(f TemplateFields) string { return f.Proposal },
+	"sample_name":      func(f TemplateFields) string { return f.SampleName },
+	"series_unique_id": func(f TemplateFields) string { return f.SeriesUniqueID },
+	"series_id":        func(f TemplateFields) string { return fmt.Sprint(f.SeriesID) },
+	"date":             func(f TemplateFields) string { return f.Time.Format("20060102") },
+	"time":             func(f TemplateFields) string { return f.Time.Format("150405") },
+	"timestamp":        func(f TemplateFields) string { return f.Time.Format("20060102_150405") },
+	"channel":          func(f TemplateFields) string { return f.Channel },
+	"run":              func(f TemplateFields) string { return f.Run },
+}
+
+// FieldsFromStart reads the template fields of a series from its start
+// message. The proposal and sample name may also come from user_data.
+func FieldsFromStart(start map[string]any, seriesID int, t time.Time) TemplateFields {
+	fields := TemplateFields{
+		SampleName: sampleName(start),
+		SeriesID:   seriesID,
+		Time:       t,
+	}
+	for _, source := range []map[string]any{start, processing.UserData(start)} {
+		for _, key := range []string{"proposal", "proposal_id"} {
+			if v := source[key]; v != nil && fields.Proposal == "" {
+				fields.Proposal = fmt.Sprint(v)
+			}
+		}
+	}
+	if v := start["series_unique_id"]; v != nil {
+		fields.SeriesUniqueID = fmt.Sprint(v)
+	}
+	return fields
+}
+
+// PathTemplate is a slash separated path with {field} placeholders.
+type PathTemplate struct {
+	text string
+	// parts alternate between literal text (even) and field names (odd).
+	parts []string
+}
+
+// DefaultRunTemplate names runs after their start time in the output
+// directory itself.
+const DefaultRunTemplate = "{timestamp}"
+
+// ParseRunTemplate parses the template of the run paths below the output
+// directory. Its last element names the files of the run, the ones before it
+// are the directories the run is written to.
+func ParseRunTemplate(text string) (*PathTemplate, error) {
+	t, err := parsePathTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range t.Fields() {
+		if field == "channel" || field == "run" {
+			return nil, fmt.Errorf("output template %q: {%s} names the files of a channel, not a run", text, field)
+		}
+	}
+	return t, nil
+}
+
+// ParseMapTemplate parses the template of the file names of the maps in a
+// run directory. It must start with {run}_ so that the maps are part of the
+// run, and contain {channel}.
+func ParseMapTemplate(text string) (*PathTemplate, error) {
+	t, err := parsePathTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(text, "{run}_") {
+		return nil, fmt.Errorf("map template %q must start with {run}_", text)
+	}
+	if !strings.Contains(text, "{channel}") {
+		return nil, fmt.Errorf("map template %q must contain {channel}", text)
+	}
+	if strings.Contains(text, "/") {
+		return nil, fmt.Errorf("map template %q must be a file name", text)
+	}
+	return t, nil
+}
+
+func parsePathTemplate(text string) (*PathTemplate, error) {
+	if text == "" {
+		return nil, fmt.Errorf("empty path template")
+	}
+	if strings.HasPrefix(text, "/") || strings.Contains(text, `\`) {
+		return nil, fmt.Errorf("path template %q must be a relative slash separated path", text)
+	}
+	// Glob characters would break the check for runs that exist; '~' joins
+	// the directories of a run in its history id.
+	if strings.ContainsAny(text, "*?[]~") {
+		return nil, fmt.Errorf("path template %q must not contain *, ?, [, ] or ~", text)
+	}
+	t := &PathTemplate{text: text}
+	rest := text
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			if strings.IndexByte(rest, '}') >= 0 {
+				return nil, fmt.Errorf("path template %q: unmatched }", text)
+			}
+			t.parts = append(t.parts, rest)
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("path template %q: unmatched {", text)
+		}
+		literal, field := rest[:open], rest[open+1:open+end]
+		if strings.IndexByte(literal, '}') >= 0 {
+			return nil, fmt.Errorf("path template %q: unmatched }", text)
+		}
+		if _, ok := templateFields[field]; !ok {
+			return nil, fmt.Errorf("path template %q: unknown field {%s}", text, field)
+		}
+		t.parts = append(t.parts, literal, field)
+		rest = rest[open+end+1:]
+	}
+	for _, element := range strings.Split(t.Expand(TemplateFields{}), "/") {
+		if element == "" || element == "." || element == ".." {
+			return nil, fmt.Errorf("path template %q has an empty, . or .. element", text)
+		}
+	}
+	return t, nil
+}
+
+// String returns the template text.
+func (t *PathTemplate) String() string {
+	return t.text
+}
+
+// Fields lists the fields used in the template.
+func (t *PathTemplate) Fields() []string {
+	var fields []string
+	for i := 1; i < len(t.parts); i += 2 {
+		fields = append(fields, t.parts[i])
+	}
+	return fields
+}
+
+// Expand fills in the fields. Values are reduced to letters, digits, '.',
+// '-' and '_' so that they cannot add path elements; empty values read
+// "unknown".
+func (t *PathTemplate) Expand(f TemplateFields) string {
+	var b strings.Builder
+	for i, part := range t.parts {
+		if i%2 == 0 {
+			b.WriteString(part)
+			continue
+		}
+		b.WriteString(sanitizePathValue(templateFields[part](f)))
+	}
+	return b.String()
+}
+
+func sanitizePathValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, strings.TrimSpace(value))
+	if strings.Trim(value, ".") == "" {
+		return "unknown"
+	}
+	return value
+}
+
+// mapFileName names the map of channel in run from a map template; the
+// result is relative to the output directory.
+func mapFileName(t *PathTemplate, run Run, channel, ext string) string {
+	fields := run.Fields
+	fields.Run = path.Base(run.RunTimestamp)
+	fields.Channel = channel
+	return path.Join(path.Dir(run.RunTimestamp), t.Expand(fields)+ext)
+}
+
+// UniqueRunID returns id, or id with a -2, -3, ... suffix when a run of that
+// name already has files in outputDir or taken reports it in use.
+func UniqueRunID(outputDir, id string, taken func(string) bool) string {
+	candidate := id
+	for n := 2; ; n++ {
+		if (taken == nil || !taken(candidate)) && !runExists(outputDir, candidate) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", id, n)
+	}
+}
+
+func runExists(outputDir, id string) bool {
+	files, _ := runFiles(filepath.Join(outputDir, filepath.Dir(id)), filepath.Base(id))
+	if len(files) > 0 {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(outputDir, id+".zarr"))
+	return err == nil
+}
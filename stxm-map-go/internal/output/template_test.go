@@ -0,0 +1,86 @@
+package output
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"stxm-map-go/internal/processing"
+)
+
+func TestRunTemplateExpand(t *testing.T) {
+	tmpl, err := ParseRunTemplate("{proposal}/{sample_name}/{date}/scan_{series_id}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := map[string]any{
+		"series_unique_id": "abc",
+		"user_data":        `{"sample_name": "Fe oxide/2", "proposal": "p20261234"}`,
+	}
+	fields := FieldsFromStart(start, 7, time.Date(2026, 1, 5, 10, 15, 0, 0, time.Local))
+	if got := tmpl.Expand(fields); got != "p20261234/Fe_oxide_2/20260105/scan_7" {
+		t.Fatalf("expanded to %q", got)
+	}
+	if got := tmpl.Expand(TemplateFields{SampleName: "..", SeriesID: 1}); got != "unknown/unknown/00010101/scan_1" {
+		t.Fatalf("expanded empty fields to %q", got)
+	}
+
+	for _, bad := range []string{"", "/abs/{timestamp}", "{nope}", "a/{timestamp", "a}b", "{proposal}//x", "../{timestamp}", "run*", "a~b/{timestamp}", "{timestamp}_{channel}"} {
+		if _, err := ParseRunTemplate(bad); err == nil {
+			t.Errorf("run template %q accepted", bad)
+		}
+	}
+	for _, bad := range []string{"{channel}", "{run}_maps", "{run}_{channel}/x", "x_{run}_{channel}"} {
+		if _, err := ParseMapTemplate(bad); err == nil {
+			t.Errorf("map template %q accepted", bad)
+		}
+	}
+}
+
+func TestUniqueRunIDAndTemplatedMaps(t *testing.T) {
+	dir := t.TempDir()
+	if got := UniqueRunID(dir, "p1/scan_1", nil); got != "p1/scan_1" {
+		t.Fatalf("free run id %q", got)
+	}
+	if err := WriteMetadata(dir, "p1/scan_1", "start", map[string]any{}); err != nil {
+		t.Fatal(err)
+	}
+	taken := func(id string) bool { return id == "p1/scan_1-2" }
+	if got := UniqueRunID(dir, "p1/scan_1", taken); got != "p1/scan_1-3" {
+		t.Fatalf("run id %q, want p1/scan_1-3", got)
+	}
+
+	names, err := ParseMapTemplate("{run}_{channel}_s{series_id}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewSinkRegistry(SinkConfig{OutputDir: dir, Formats: []string{"text"}, MapTemplate: names})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := Run{RunTimestamp: "p1/scan_1", SeriesID: 4, Config: processing.SeriesConfig{GridX: 1, GridY: 1}, Fields: TemplateFields{SeriesID: 4}}
+	data := map[string]*processing.ThresholdData{
+		"threshold_0": {Values: []uint32{5}, Timestamps: []float64{1}, Mask: []bool{true}, ImageIDs: []int{0}},
+	}
+	summary := map[string]any{"complete": true, "channels": []string{"threshold_0"}}
+	result := SeriesResult{Run: run, Complete: true, Summary: summary, Data: data}
+	if failed := endAndWait(r, result); failed != 0 {
+		t.Fatalf("end failed in %d sinks: %+v", failed, r.Stats())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "p1", "scan_1_threshold_0_s4.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "p1", "scan_1_output_threshold_0_data.txt")); err == nil {
+		t.Fatal("maps also written under the default name")
+	}
+
+	catalog, err := OpenCatalog(dir, filepath.Join(dir, "catalog.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, ok := catalog.Get("p1/scan_1")
+	if !ok || record.Dir != "p1" || len(record.Channels) != 1 || record.Channels[0] != "threshold_0" || record.Started.IsZero() {
+		t.Fatalf("unexpected record: %+v", record)
+	}
+}
@@ -0,0 +1,259 @@
+package output
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/types"
+)
+
+const (
+	TIFFFloat32 = "float32"
+	TIFFUint32  = "uint32"
+)
+
+// TIFFInfo is stored in the tags of every page: the pixel size as X/Y
+// resolution and the metadata as JSON in ImageDescription.
+type TIFFInfo struct {
+	// PixelSize is the scan step in micrometres; zero if unknown.
+	PixelSize float64
+	Metadata  map[string]any
+}
+
+const (
+	tiffShort    = 3
+	tiffLong     = 4
+	tiffASCII    = 2
+	tiffRational = 5
+)
+
+// tiffSamples is the sample data of one page with its SampleFormat.
+type tiffSamples struct {
+	channel      string
+	data         []byte
+	sampleFormat uint16
+}
+
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+// WriteTIFF writes the maps of a run as a multi-page TIFF, one page per
+// channel in channel order.
+func WriteTIFF(outputDir, runTimestamp string, gridX, gridY int, maps map[string]types.ThresholdSnapshot, dtype string, info TIFFInfo) error {
+	if len(maps) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(outputDir, runTimestamp+"_maps.tif"), func(w io.Writer) error {
+		return EncodeMapsTIFF(w, gridX, gridY, maps, dtype, info)
+	})
+}
+
+// EncodeMapsTIFF encodes maps as a little-endian multi-page TIFF with 32-bit
+// float or unsigned integer samples. Unmeasured pixels are NaN in float
+// pages and zero in integer pages. A kept sub-frame variance follows its
+// channel as a float page.
+func EncodeMapsTIFF(w io.Writer, gridX, gridY int, maps map[string]types.ThresholdSnapshot, dtype string, info TIFFInfo) error {
+	if gridX < 1 || gridY < 1 {
+		return fmt.Errorf("invalid grid %dx%d", gridX, gridY)
+	}
+	if dtype != TIFFFloat32 && dtype != TIFFUint32 {
+		return fmt.Errorf("unsupported tiff dtype %q", dtype)
+	}
+	channels := make([]string, 0, len(maps))
+	for channel := range maps {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	pixels := gridX * gridY
+	var pages []tiffSamples
+	for _, channel := range channels {
+		snap := maps[channel]
+		if len(snap.Values) != pixels {
+			return fmt.Errorf("channel %s has %d pixels, grid is %dx%d", channel, len(snap.Values), gridX, gridY)
+		}
+		data := make([]byte, 4*pixels)
+		for idx, value := range snap.Values {
+			measured := idx >= len(snap.Mask) || snap.Mask[idx]
+			switch dtype {
+			case TIFFFloat32:
+				v := float32(value)
+				if !measured {
+					v = float32(math.NaN())
+				}
+				binary.LittleEndian.PutUint32(data[4*idx:], math.Float32bits(v))
+			default:
+				if !measured {
+					value = 0
+				}
+				binary.LittleEndian.PutUint32(data[4*idx:], value)
+			}
+		}
+		page := tiffSamples{channel: channel, data: data, sampleFormat: 1}
+		if dtype == TIFFFloat32 {
+			page.sampleFormat = 3
+		}
+		pages = append(pages, page)
+		// The sub-frame variance is a float page whatever the dtype.
+		if len(snap.Variance) != pixels {
+			continue
+		}
+		data = make([]byte, 4*pixels)
+		for idx, value := range snap.Variance {
+			v := float32(value)
+			if idx < len(snap.Mask) && !snap.Mask[idx] {
+				v = float32(math.NaN())
+			}
+			binary.LittleEndian.PutUint32(data[4*idx:], math.Float32bits(v))
+		}
+		pages = append(pages, tiffSamples{channel: channel + processing.VarianceSuffix, data: data, sampleFormat: 3})
+	}
+
+	out := &bytes.Buffer{}
+	out.Write([]byte{'I', 'I', 42, 0})
+	_ = binary.Write(out, binary.LittleEndian, uint32(8))
+
+	for i, page := range pages {
+		channel, data, sampleFormat := page.channel, page.data, page.sampleFormat
+		meta := map[string]any{
+			"channel": channel,
+			"grid_x":  gridX,
+			"grid_y":  gridY,
+		}
+		if info.PixelSize > 0 {
+			meta["pixel_size_um"] = info.PixelSize
+		}
+		for key, value := range info.Metadata {
+			meta[key] = value
+		}
+		description, err := json.Marshal(NormalizeJSONValue(meta))
+		if err != nil {
+			return err
+		}
+
+		resolutionUnit := uint16(1)
+		resolution := tiffRationalValue(1)
+		if info.PixelSize > 0 {
+			// Resolution in pixels per centimetre.
+			resolutionUnit = 3
+			resolution = tiffRationalValue(1e4 / info.PixelSize)
+		}
+		entries := []tiffEntry{
+			longEntry(256, uint32(gridX)),
+			longEntry(257, uint32(gridY)),
+			shortEntry(258, 32),
+			shortEntry(259, 1),
+			shortEntry(262, 1),
+			asciiEntry(270, string(description)),
+			longEntry(273, 0),
+			shortEntry(277, 1),
+			longEntry(278, uint32(gridY)),
+			longEntry(279, uint32(len(data))),
+			{tag: 282, typ: tiffRational, count: 1, data: resolution},
+			{tag: 283, typ: tiffRational, count: 1, data: resolution},
+			asciiEntry(285, channel),
+			shortEntry(296, resolutionUnit),
+			asciiEntry(305, "stxm-map-go"),
+			shortEntry(339, sampleFormat),
+		}
+
+		ifdStart := uint32(out.Len())
+		ifdSize := uint32(2 + 12*len(entries) + 4)
+		extraOffset := ifdStart + ifdSize
+		var extra bytes.Buffer
+		for j := range entries {
+			if len(entries[j].data) > 4 {
+				entries[j].data = append(entries[j].data, make([]byte, len(entries[j].data)%2)...)
+			}
+		}
+		extraSize := uint32(0)
+		for _, entry := range entries {
+			if len(entry.data) > 4 {
+				extraSize += uint32(len(entry.data))
+			}
+		}
+		dataOffset := extraOffset + extraSize
+		nextIFD := uint32(0)
+		if i < len(pages)-1 {
+			nextIFD = dataOffset + uint32(len(data))
+		}
+
+		_ = binary.Write(out, binary.LittleEndian, uint16(len(entries)))
+		for _, entry := range entries {
+			if entry.tag == 273 {
+				entry.data = u32(dataOffset)
+			}
+			_ = binary.Write(out, binary.LittleEndian, entry.tag)
+			_ = binary.Write(out, binary.LittleEndian, entry.typ)
+			_ = binary.Write(out, binary.LittleEndian, entry.count)
+			if len(entry.data) > 4 {
+				_ = binary.Write(out, binary.LittleEndian, extraOffset+uint32(extra.Len()))
+				extra.Write(entry.data)
+			} else {
+				value := make([]byte, 4)
+				copy(value, entry.data)
+				out.Write(value)
+			}
+		}
+		_ = binary.Write(out, binary.LittleEndian, nextIFD)
+		out.Write(extra.Bytes())
+		out.Write(data)
+	}
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func longEntry(tag uint16, v uint32) tiffEntry {
+	return tiffEntry{tag: tag, typ: tiffLong, count: 1, data: u32(v)}
+}
+
+func shortEntry(tag uint16, v uint16) tiffEntry {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return tiffEntry{tag: tag, typ: tiffShort, count: 1, data: b}
+}
+
+func asciiEntry(tag uint16, s string) tiffEntry {
+	data := append([]byte(s), 0)
+	return tiffEntry{tag: tag, typ: tiffASCII, count: uint32(len(data)), data: data}
+}
+
+// tiffRationalValue encodes v as the most precise uint32 fraction.
+func tiffRationalValue(v float64) []byte {
+	den := uint32(1000000)
+	for den > 1 && v*float64(den) > math.MaxUint32 {
+		den /= 10
+	}
+	num := math.Round(v * float64(den))
+	if num > math.MaxUint32 {
+		num = math.MaxUint32
+	}
+	if num < 1 {
+		num = 1
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b, uint32(num))
+	binary.LittleEndian.PutUint32(b[4:], den)
+	return b
+}
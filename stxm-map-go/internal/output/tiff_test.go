@@ -0,0 +1,111 @@
+package output
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"testing"
+
+	"stxm-map-go/internal/types"
+)
+
+type tiffPage struct {
+	tags   map[uint16][]byte
+	counts map[uint16]uint32
+	data   []byte
+}
+
+// readTIFFPages walks the IFD chain of a little-endian classic TIFF.
+func readTIFFPages(t *testing.T, b []byte) []tiffPage {
+	t.Helper()
+	if !bytes.Equal(b[:4], []byte{'I', 'I', 42, 0}) {
+		t.Fatalf("bad header %v", b[:4])
+	}
+	le := binary.LittleEndian
+	var pages []tiffPage
+	for offset := le.Uint32(b[4:]); offset != 0; {
+		n := int(le.Uint16(b[offset:]))
+		page := tiffPage{tags: map[uint16][]byte{}, counts: map[uint16]uint32{}}
+		for i := 0; i < n; i++ {
+			e := b[int(offset)+2+12*i:]
+			tag, typ, count := le.Uint16(e), le.Uint16(e[2:]), le.Uint32(e[4:])
+			size := map[uint16]uint32{tiffASCII: 1, tiffShort: 2, tiffLong: 4, tiffRational: 8}[typ] * count
+			value := e[8:12]
+			if size > 4 {
+				at := le.Uint32(e[8:])
+				value = b[at : at+size]
+			}
+			page.tags[tag] = value
+			page.counts[tag] = count
+		}
+		start, length := le.Uint32(page.tags[273]), le.Uint32(page.tags[279])
+		page.data = b[start : start+length]
+		pages = append(pages, page)
+		offset = le.Uint32(b[int(offset)+2+12*n:])
+	}
+	return pages
+}
+
+func TestEncodeMapsTIFF(t *testing.T) {
+	maps := map[string]types.ThresholdSnapshot{
+		"threshold_1": {Values: []uint32{1, 2, 3, 4, 5, 6}, Mask: []bool{true, true, true, true, true, false}},
+		"threshold_0": {Values: []uint32{10, 20, 30, 40, 50, 60}, Mask: []bool{true, true, true, true, true, true}},
+	}
+	info := TIFFInfo{PixelSize: 0.05, Metadata: map[string]any{"run": "20260105_101500"}}
+	for _, dtype := range []string{TIFFFloat32, TIFFUint32} {
+		var buf bytes.Buffer
+		if err := EncodeMapsTIFF(&buf, 3, 2, maps, dtype, info); err != nil {
+			t.Fatal(err)
+		}
+		pages := readTIFFPages(t, buf.Bytes())
+		if len(pages) != 2 {
+			t.Fatalf("%s: %d pages", dtype, len(pages))
+		}
+		le := binary.LittleEndian
+		for i, channel := range []string{"threshold_0", "threshold_1"} {
+			page := pages[i]
+			if le.Uint32(page.tags[256]) != 3 || le.Uint32(page.tags[257]) != 2 {
+				t.Fatalf("%s: page %d has wrong size", dtype, i)
+			}
+			if name := string(bytes.TrimRight(page.tags[285], "\x00")); name != channel {
+				t.Fatalf("%s: page %d named %q", dtype, i, name)
+			}
+			var description map[string]any
+			if err := json.Unmarshal(bytes.TrimRight(page.tags[270], "\x00"), &description); err != nil {
+				t.Fatal(err)
+			}
+			if description["channel"] != channel || description["pixel_size_um"] != 0.05 || description["run"] != "20260105_101500" {
+				t.Fatalf("%s: unexpected description %v", dtype, description)
+			}
+			if res := page.tags[282]; le.Uint32(res)/le.Uint32(res[4:]) != 200000 {
+				t.Fatalf("%s: x resolution %v", dtype, res)
+			}
+			format := le.Uint16(page.tags[339])
+			snap := maps[channel]
+			for idx, want := range snap.Values {
+				raw := le.Uint32(page.data[4*idx:])
+				switch {
+				case dtype == TIFFUint32 && format == 1:
+					if !snap.Mask[idx] {
+						want = 0
+					}
+					if raw != want {
+						t.Fatalf("%s %s[%d] = %d, want %d", dtype, channel, idx, raw, want)
+					}
+				case dtype == TIFFFloat32 && format == 3:
+					got := math.Float32frombits(raw)
+					if !snap.Mask[idx] {
+						if !math.IsNaN(float64(got)) {
+							t.Fatalf("unmeasured pixel %s[%d] = %v", channel, idx, got)
+						}
+					} else if got != float32(want) {
+						t.Fatalf("%s %s[%d] = %v, want %d", dtype, channel, idx, got, want)
+					}
+				default:
+					t.Fatalf("%s: sample format %d", dtype, format)
+				}
+			}
+		}
+	}
+}
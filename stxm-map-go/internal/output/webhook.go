@@ -0,0 +1,115 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookQueue bounds the notifications waiting for a slow endpoint.
+const webhookQueue = 64
+
+// webhookSink posts a JSON notification for the start and end of every
+// series. Requests are sent from a goroutine of their own so that a slow or
+// unreachable endpoint never holds up the pipeline; notifications beyond
+// the queue are dropped and reported as errors.
+type webhookSink struct {
+	nopSink
+	url     string
+	dir     string
+	client  *http.Client
+	queue   chan map[string]any
+	done    chan struct{}
+	timeout time.Duration
+	report  func(error)
+}
+
+func newWebhookSink(url, dir string, timeout time.Duration, report func(error)) *webhookSink {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	s := &webhookSink{
+		url:     url,
+		dir:     dir,
+		client:  &http.Client{Timeout: timeout},
+		queue:   make(chan map[string]any, webhookQueue),
+		done:    make(chan struct{}),
+		timeout: timeout,
+		report:  report,
+	}
+	go s.run()
+	return s
+}
+
+func (s *webhookSink) Name() string { return "webhook" }
+
+// followsEnd makes the end notification wait for the files of the run.
+func (s *webhookSink) followsEnd() {}
+
+func (s *webhookSink) run() {
+	defer close(s.done)
+	for event := range s.queue {
+		if err := s.post(event); err != nil && s.report != nil {
+			s.report(err)
+		}
+	}
+}
+
+func (s *webhookSink) post(event map[string]any) error {
+	body, err := json.Marshal(NormalizeJSONValue(event))
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) send(event map[string]any) error {
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+		return fmt.Errorf("webhook queue full, %v notification dropped", event["event"])
+	}
+}
+
+func (s *webhookSink) OnStart(run Run, meta map[string]any) error {
+	return s.send(map[string]any{
+		"event":     "start",
+		"run":       run.RunTimestamp,
+		"series_id": run.SeriesID,
+		"meta":      meta,
+	})
+}
+
+func (s *webhookSink) OnEnd(result SeriesResult) error {
+	return s.send(map[string]any{
+		"event":      "end",
+		"run":        result.RunTimestamp,
+		"series_id":  result.SeriesID,
+		"summary":    result.Summary,
+		"output_dir": s.dir,
+	})
+}
+
+// Close sends the queued notifications, waiting at most one request timeout
+// per notification still queued.
+func (s *webhookSink) Close() error {
+	pending := len(s.queue) + 1
+	close(s.queue)
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(time.Duration(pending) * s.timeout):
+		return fmt.Errorf("webhook notifications not sent before timeout")
+	}
+}
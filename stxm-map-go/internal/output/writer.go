@@ -3,8 +3,11 @@ package output
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 
 	"stxm-map-go/internal/processing"
 )
@@ -15,56 +18,129 @@ func WriteSeries(
 	gridX int,
 	gridY int,
 	data map[string]*processing.ThresholdData,
+) error {
+	return WriteSeriesFiles(outputDir, gridX, gridY, data, func(threshold string) string {
+		return fmt.Sprintf("%s_output_%s_data.txt", runTimestamp, threshold)
+	})
+}
+
+// WriteSeriesFiles is WriteSeries with the file of every channel named by
+// name, relative to outputDir.
+func WriteSeriesFiles(
+	outputDir string,
+	gridX int,
+	gridY int,
+	data map[string]*processing.ThresholdData,
+	name func(threshold string) string,
 ) error {
 	if err := os.MkdirAll(outputDir, 0o755); err != nil {
 		return err
 	}
 
 	for threshold, bundle := range data {
-		filename := filepath.Join(outputDir, fmt.Sprintf("%s_output_%s_data.txt", runTimestamp, threshold))
-		f, err := os.Create(filename)
+		filename := filepath.Join(outputDir, filepath.FromSlash(name(threshold)))
+		err := writeChannelText(filename, gridX, bundle, func(idx int) string {
+			return strconv.FormatUint(uint64(bundle.Values[idx]), 10)
+		})
+		if err != nil {
+			return err
+		}
+		// The sub-frame variance is written as a float channel of its own.
+		if len(bundle.Variance) != len(bundle.Values) {
+			continue
+		}
+		filename = filepath.Join(outputDir, filepath.FromSlash(name(threshold+processing.VarianceSuffix)))
+		err = writeChannelText(filename, gridX, bundle, func(idx int) string {
+			return strconv.FormatFloat(bundle.Variance[idx], 'g', -1, 64)
+		})
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		_, _ = fmt.Fprintln(f, "image_index, x, y, timestamp, value")
-		for imageID, ok := range bundle.Mask {
-			if !ok {
-				continue
-			}
-			x := imageID % gridX
-			y := imageID / gridX
-			_, _ = fmt.Fprintf(
-				f,
-				"%d, %d, %d, %.6f, %d\n",
-				imageID,
+// writeChannelText writes the filled pixels of bundle in acquisition order,
+// one line per pixel with its value formatted by value.
+func writeChannelText(filename string, gridX int, bundle *processing.ThresholdData, value func(idx int) string) error {
+	return WriteFileAtomic(filename, func(w io.Writer) error {
+		if _, err := fmt.Fprintln(w, "image_index, x, y, timestamp, value"); err != nil {
+			return err
+		}
+		for _, idx := range pixelsByImageID(bundle) {
+			x := idx % gridX
+			y := idx / gridX
+			_, err := fmt.Fprintf(
+				w,
+				"%d, %d, %d, %.6f, %s\n",
+				bundle.ImageIDs[idx],
 				x,
 				y,
-				bundle.Timestamps[imageID],
-				bundle.Values[imageID],
+				bundle.Timestamps[idx],
+				value(idx),
 			)
+			if err != nil {
+				return err
+			}
 		}
-		_ = f.Close()
-	}
-	return nil
+		return nil
+	})
 }
 
-func WriteMetadata(outputDir, runTimestamp, kind string, meta map[string]any) error {
+// WriteMask writes which grid pixels were measured as a gridY x gridX matrix
+// of 0/1, one row per line. It accompanies series that ended early.
+func WriteMask(outputDir, runTimestamp string, gridX, gridY int, mask []bool) error {
+	if gridX < 1 || len(mask) != gridX*gridY {
+		return fmt.Errorf("mask has %d pixels, grid is %dx%d", len(mask), gridX, gridY)
+	}
 	if err := os.MkdirAll(outputDir, 0o755); err != nil {
 		return err
 	}
+	row := make([]byte, 2*gridX)
+	return WriteFileAtomic(filepath.Join(outputDir, fmt.Sprintf("%s_mask_data.txt", runTimestamp)), func(w io.Writer) error {
+		for y := 0; y < gridY; y++ {
+			for x := 0; x < gridX; x++ {
+				row[2*x] = '0'
+				if mask[y*gridX+x] {
+					row[2*x] = '1'
+				}
+				row[2*x+1] = ' '
+			}
+			row[len(row)-1] = '\n'
+			if _, err := w.Write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	filename := filepath.Join(outputDir, fmt.Sprintf("%s_%s_data.txt", runTimestamp, kind))
-	f, err := os.Create(filename)
-	if err != nil {
+// pixelsByImageID lists the filled grid pixels in acquisition order.
+func pixelsByImageID(bundle *processing.ThresholdData) []int {
+	pixels := make([]int, 0, len(bundle.Mask))
+	for idx, ok := range bundle.Mask {
+		if ok {
+			pixels = append(pixels, idx)
+		}
+	}
+	sort.Slice(pixels, func(i, j int) bool {
+		return bundle.ImageIDs[pixels[i]] < bundle.ImageIDs[pixels[j]]
+	})
+	return pixels
+}
+
+func WriteMetadata(outputDir, runTimestamp, kind string, meta map[string]any) error {
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
 		return err
 	}
-	defer f.Close()
 
+	filename := filepath.Join(outputDir, fmt.Sprintf("%s_%s_data.txt", runTimestamp, kind))
 	normalized := NormalizeJSONValue(meta)
-	encoder := json.NewEncoder(f)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(normalized)
+	return WriteFileAtomic(filename, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(normalized)
+	})
 }
 
 func NormalizeJSONValue(value any) any {
@@ -0,0 +1,227 @@
+package output
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// zarrGzipLevel trades compression for speed, since chunks are written
+// while the scan runs.
+const zarrGzipLevel = 1
+
+type zarrArrayMeta struct {
+	ZarrFormat         int            `json:"zarr_format"`
+	Shape              []int          `json:"shape"`
+	Chunks             []int          `json:"chunks"`
+	Dtype              string         `json:"dtype"`
+	Compressor         map[string]any `json:"compressor"`
+	FillValue          any            `json:"fill_value"`
+	Order              string         `json:"order"`
+	Filters            []any          `json:"filters"`
+	DimensionSeparator string         `json:"dimension_separator"`
+}
+
+// ZarrArray is a Zarr v2 array in a directory store with gzip compressed
+// chunks. Chunks may be written in any order and from several goroutines;
+// chunks beyond the first dimension grow the array. Chunks replace their
+// file atomically but are only made durable by Sync.
+type ZarrArray struct {
+	mu       sync.Mutex
+	dir      string
+	meta     zarrArrayMeta
+	itemSize int
+	// unsynced are the files written since the last Sync.
+	unsynced map[string]bool
+}
+
+// CreateZarrGroup creates a Zarr v2 group in dir with the given attributes.
+func CreateZarrGroup(dir string, attrs map[string]any) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := writeJSONFile(filepath.Join(dir, ".zgroup"), map[string]any{"zarr_format": 2}); err != nil {
+		return err
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+	return SetZarrAttrs(dir, attrs)
+}
+
+// SetZarrAttrs merges attrs into the .zattrs of a group or array.
+func SetZarrAttrs(dir string, attrs map[string]any) error {
+	path := filepath.Join(dir, ".zattrs")
+	merged := readJSONMap(path)
+	if merged == nil {
+		merged = make(map[string]any, len(attrs))
+	}
+	for key, value := range attrs {
+		merged[key] = NormalizeJSONValue(value)
+	}
+	return writeJSONFile(path, merged)
+}
+
+// CreateZarrArray creates an array of the NumPy dtype in dir. fill is the
+// value of chunks that are never written.
+func CreateZarrArray(dir string, shape, chunks []int, dtype string, fill any) (*ZarrArray, error) {
+	if len(shape) != len(chunks) || len(shape) == 0 {
+		return nil, fmt.Errorf("zarr shape %v does not match chunks %v", shape, chunks)
+	}
+	for _, n := range chunks {
+		if n < 1 {
+			return nil, fmt.Errorf("invalid zarr chunks %v", chunks)
+		}
+	}
+	if len(dtype) < 3 || !strings.ContainsAny(dtype[:1], "<>|") {
+		return nil, fmt.Errorf("unsupported zarr dtype %q", dtype)
+	}
+	itemSize, err := strconv.Atoi(dtype[2:])
+	if err != nil || itemSize < 1 {
+		return nil, fmt.Errorf("unsupported zarr dtype %q", dtype)
+	}
+	a := &ZarrArray{
+		dir: dir,
+		meta: zarrArrayMeta{
+			ZarrFormat:         2,
+			Shape:              append([]int(nil), shape...),
+			Chunks:             append([]int(nil), chunks...),
+			Dtype:              dtype,
+			Compressor:         map[string]any{"id": "gzip", "level": zarrGzipLevel},
+			FillValue:          fill,
+			Order:              "C",
+			DimensionSeparator: ".",
+		},
+		itemSize: itemSize,
+		unsynced: make(map[string]bool),
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if err := a.writeMeta(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *ZarrArray) writeMeta() error {
+	return writeJSONFile(filepath.Join(a.dir, ".zarray"), a.meta)
+}
+
+// ChunkBytes is the size of one uncompressed chunk.
+func (a *ZarrArray) ChunkBytes() int {
+	n := a.itemSize
+	for _, c := range a.meta.Chunks {
+		n *= c
+	}
+	return n
+}
+
+// WriteChunk compresses and stores the chunk at index. data holds a full
+// chunk in C order, also at the edges of the array. A chunk past the end of
+// the first dimension extends the array, so a growing dataset is written by
+// appending chunks along it.
+func (a *ZarrArray) WriteChunk(index []int, data []byte) error {
+	if len(index) != len(a.meta.Chunks) {
+		return fmt.Errorf("zarr chunk index %v has wrong rank", index)
+	}
+	if len(data) != a.ChunkBytes() {
+		return fmt.Errorf("zarr chunk has %d bytes, want %d", len(data), a.ChunkBytes())
+	}
+	keys := make([]string, len(index))
+	for i, n := range index {
+		if n < 0 || (i > 0 && n*a.meta.Chunks[i] >= a.meta.Shape[i]) {
+			return fmt.Errorf("zarr chunk index %v out of range", index)
+		}
+		keys[i] = strconv.Itoa(n)
+	}
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, zarrGzipLevel)
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	name := strings.Join(keys, ".")
+	if err := writeBytesRenamed(filepath.Join(a.dir, name), buf.Bytes()); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.unsynced[name] = true
+	if end := (index[0] + 1) * a.meta.Chunks[0]; end > a.meta.Shape[0] {
+		a.meta.Shape[0] = end
+		meta, err := encodeZarrJSON(a.meta)
+		if err != nil {
+			return err
+		}
+		a.unsynced[".zarray"] = true
+		return writeBytesRenamed(filepath.Join(a.dir, ".zarray"), meta)
+	}
+	return nil
+}
+
+// Sync makes the chunks written so far durable.
+func (a *ZarrArray) Sync() error {
+	a.mu.Lock()
+	names := make([]string, 0, len(a.unsynced))
+	for name := range a.unsynced {
+		names = append(names, name)
+	}
+	a.unsynced = make(map[string]bool)
+	a.mu.Unlock()
+	if len(names) == 0 {
+		return nil
+	}
+	return syncFiles(a.dir, names)
+}
+
+// Shape returns the current shape of the array.
+func (a *ZarrArray) Shape() []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]int(nil), a.meta.Shape...)
+}
+
+// WriteZarrArray stores a whole array as a single chunk.
+func WriteZarrArray(dir string, shape []int, dtype string, fill any, data []byte) error {
+	a, err := CreateZarrArray(dir, shape, shape, dtype, fill)
+	if err != nil {
+		return err
+	}
+	if err := a.WriteChunk(make([]int, len(shape)), data); err != nil {
+		return err
+	}
+	return a.Sync()
+}
+
+// writeJSONFile writes Zarr metadata; dtypes such as "<f4" are not escaped.
+func writeJSONFile(path string, value any) error {
+	data, err := encodeZarrJSON(value)
+	if err != nil {
+		return err
+	}
+	return writeBytesAtomic(path, data)
+}
+
+func encodeZarrJSON(value any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(NormalizeJSONValue(value)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
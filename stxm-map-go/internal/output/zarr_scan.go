@@ -0,0 +1,287 @@
+package output
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sync"
+
+	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/types"
+)
+
+// ZarrScan is the Zarr store of one series, {timestamp}.zarr. Its root
+// attributes hold the start and end metadata; the group "diffraction" gets
+// one float32 array of downsampled patterns per channel, written chunk by
+// chunk while the scan runs, and the group "maps" the finished maps.
+//
+// Grid based scans store patterns as (grid_y, grid_x, height, width) with one
+// chunk per pixel; position based scans as (points, height, width), growing
+// as points arrive. The frames of a point are summed.
+type ZarrScan struct {
+	mu       sync.Mutex
+	dir      string
+	cfg      processing.SeriesConfig
+	seriesID int
+	side     int
+	cubes    map[string]*ZarrArray
+	pending  map[string]map[int]*zarrPoint
+	finished bool
+	failed   error
+}
+
+type zarrPoint struct {
+	frames int
+	sum    []float64
+}
+
+// CreateZarrScan creates the store of a series. Patterns are binned so that
+// neither side exceeds side pixels; zero stores no patterns.
+func CreateZarrScan(outputDir, runTimestamp string, seriesID int, cfg processing.SeriesConfig, side int, start map[string]any) (*ZarrScan, error) {
+	dir := filepath.Join(outputDir, runTimestamp+".zarr")
+	attrs := map[string]any{
+		"run":        runTimestamp,
+		"series_id":  seriesID,
+		"grid_x":     cfg.GridX,
+		"grid_y":     cfg.GridY,
+		"scan_order": cfg.Order.String(),
+	}
+	if start != nil {
+		attrs["start"] = start
+	}
+	if err := CreateZarrGroup(dir, attrs); err != nil {
+		return nil, err
+	}
+	if side > 0 {
+		if err := CreateZarrGroup(filepath.Join(dir, "diffraction"), map[string]any{"max_side": side}); err != nil {
+			return nil, err
+		}
+	}
+	return &ZarrScan{
+		dir:      dir,
+		cfg:      cfg,
+		seriesID: seriesID,
+		side:     side,
+		cubes:    make(map[string]*ZarrArray),
+		pending:  make(map[string]map[int]*zarrPoint),
+	}, nil
+}
+
+// SeriesID is the series the store belongs to.
+func (z *ZarrScan) SeriesID() int {
+	return z.seriesID
+}
+
+// Dir is the directory of the store.
+func (z *ZarrScan) Dir() string {
+	return z.dir
+}
+
+// AddFrame adds the patterns of a detector frame. Workers call it
+// concurrently; frames of other series and frames after Finish are ignored.
+// After a write error the store takes no more patterns, so the error is only
+// reported once.
+func (z *ZarrScan) AddFrame(raw types.RawFrame) error {
+	if z.side <= 0 || raw.SeriesID != z.seriesID || raw.ImageID < 0 {
+		return nil
+	}
+	z.mu.Lock()
+	stopped := z.finished || z.failed != nil
+	z.mu.Unlock()
+	if stopped {
+		return nil
+	}
+	fpp := z.cfg.PointFrames()
+	point := raw.ImageID / fpp
+	positional := z.cfg.PositionMode || raw.Position != nil
+	for channel, payload := range raw.Data {
+		values, width, height, ok := processing.PatternValues(payload)
+		if !ok {
+			continue
+		}
+		values, width, height = processing.BinPattern(values, width, height, z.side)
+
+		z.mu.Lock()
+		if z.finished || z.failed != nil {
+			z.mu.Unlock()
+			return nil
+		}
+		cube, err := z.cube(channel, width, height, positional)
+		if err != nil {
+			z.mu.Unlock()
+			return err
+		}
+		if cube.ChunkBytes() != 4*len(values) {
+			z.mu.Unlock()
+			continue
+		}
+		// The layout is fixed by the first frame of the channel.
+		positional = len(cube.meta.Chunks) == 3
+		if !positional && point >= z.cfg.GridX*z.cfg.GridY {
+			z.mu.Unlock()
+			continue
+		}
+		var sum []float64
+		if fpp > 1 {
+			points := z.pending[channel]
+			p, ok := points[point]
+			if !ok {
+				p = &zarrPoint{sum: make([]float64, len(values))}
+				points[point] = p
+			}
+			for i, v := range values {
+				p.sum[i] += v
+			}
+			p.frames++
+			if p.frames < fpp {
+				z.mu.Unlock()
+				continue
+			}
+			delete(points, point)
+			sum = p.sum
+		} else {
+			sum = values
+		}
+		z.mu.Unlock()
+
+		if err := cube.WriteChunk(z.chunkIndex(point, positional), float32Bytes(sum)); err != nil {
+			z.mu.Lock()
+			z.failed = err
+			z.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// cube returns the pattern array of a channel, creating it on first use.
+func (z *ZarrScan) cube(channel string, width, height int, positional bool) (*ZarrArray, error) {
+	if cube, ok := z.cubes[channel]; ok {
+		return cube, nil
+	}
+	shape := []int{z.cfg.GridY, z.cfg.GridX, height, width}
+	chunks := []int{1, 1, height, width}
+	if positional {
+		shape = []int{0, height, width}
+		chunks = []int{1, height, width}
+	}
+	cube, err := CreateZarrArray(filepath.Join(z.dir, "diffraction", channel), shape, chunks, "<f4", "NaN")
+	if err != nil {
+		z.failed = err
+		return nil, err
+	}
+	z.cubes[channel] = cube
+	z.pending[channel] = make(map[int]*zarrPoint)
+	return cube, nil
+}
+
+func (z *ZarrScan) chunkIndex(point int, positional bool) []int {
+	if positional {
+		return []int{point, 0, 0}
+	}
+	x, y := z.cfg.Order.Position(point, z.cfg.GridX, z.cfg.GridY)
+	return []int{y, x, 0, 0}
+}
+
+// SetAttrs merges attributes into the root of the store.
+func (z *ZarrScan) SetAttrs(attrs map[string]any) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return SetZarrAttrs(z.dir, attrs)
+}
+
+// Finish writes the points of which only some frames arrived, the maps of
+// the series and attrs. Frames added afterwards are ignored.
+func (z *ZarrScan) Finish(maps MapSet, attrs map[string]any) error {
+	z.mu.Lock()
+	z.finished = true
+	pending := z.pending
+	z.pending = make(map[string]map[int]*zarrPoint)
+	z.mu.Unlock()
+
+	for channel, points := range pending {
+		cube := z.cubes[channel]
+		positional := len(cube.meta.Chunks) == 3
+		for point, p := range points {
+			if err := cube.WriteChunk(z.chunkIndex(point, positional), float32Bytes(p.sum)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := z.Sync(); err != nil {
+		return err
+	}
+	if err := z.writeMaps(maps); err != nil {
+		return err
+	}
+	return z.SetAttrs(attrs)
+}
+
+// Sync makes the patterns written so far durable. It is called when the
+// series is finished and at every checkpoint rather than for every chunk.
+func (z *ZarrScan) Sync() error {
+	z.mu.Lock()
+	cubes := make([]*ZarrArray, 0, len(z.cubes))
+	for _, cube := range z.cubes {
+		cubes = append(cubes, cube)
+	}
+	z.mu.Unlock()
+	for _, cube := range cubes {
+		if err := cube.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *ZarrScan) writeMaps(set MapSet) error {
+	if len(set.Maps) == 0 {
+		return nil
+	}
+	dir := filepath.Join(z.dir, "maps")
+	if err := CreateZarrGroup(dir, nil); err != nil {
+		return err
+	}
+	pixels := set.GridX * set.GridY
+	shape := []int{set.GridY, set.GridX}
+	for _, channel := range set.Channels() {
+		snap := set.Maps[channel]
+		if len(snap.Values) != pixels {
+			return fmt.Errorf("channel %s has %d pixels, grid is %dx%d", channel, len(snap.Values), set.GridX, set.GridY)
+		}
+		if err := WriteZarrArray(filepath.Join(dir, channel), shape, npyUint32, 0, uint32Bytes(snap.Values)); err != nil {
+			return err
+		}
+		mask := make([]byte, pixels)
+		for idx := range mask {
+			if idx >= len(snap.Mask) || snap.Mask[idx] {
+				mask[idx] = 1
+			}
+		}
+		if err := WriteZarrArray(filepath.Join(dir, channel+"_mask"), shape, npyBool, false, mask); err != nil {
+			return err
+		}
+		timestamps := set.Timestamps[channel]
+		if len(timestamps) != pixels {
+			timestamps = make([]float64, pixels)
+		}
+		if err := WriteZarrArray(filepath.Join(dir, channel+"_timestamps"), shape, npyFloat64, 0, float64Bytes(timestamps)); err != nil {
+			return err
+		}
+		if len(snap.Variance) == pixels {
+			if err := WriteZarrArray(filepath.Join(dir, channel+processing.VarianceSuffix), shape, npyFloat64, 0, float64Bytes(snap.Variance)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func float32Bytes(values []float64) []byte {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(float32(v)))
+	}
+	return data
+}
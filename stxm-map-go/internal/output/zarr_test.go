@@ -0,0 +1,107 @@
+package output
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/types"
+)
+
+func readZarrChunk(t *testing.T, path string) []byte {
+	t.Helper()
+	compressed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestZarrArrayAppend(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "frames")
+	a, err := CreateZarrArray(dir, []int{0, 2}, []int{1, 2}, npyUint32, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WriteChunk([]int{2, 0}, uint32Bytes([]uint32{5, 6})); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.WriteChunk([]int{0, 1}, uint32Bytes([]uint32{1, 2})); err == nil {
+		t.Fatal("expected an error for a chunk outside the second dimension")
+	}
+	if err := a.WriteChunk([]int{0, 0}, []byte{1}); err == nil {
+		t.Fatal("expected an error for a short chunk")
+	}
+	meta := readJSONMap(filepath.Join(dir, ".zarray"))
+	shape, _ := meta["shape"].([]any)
+	if len(shape) != 2 || shape[0] != float64(3) || meta["dtype"] != "<u4" || meta["zarr_format"] != float64(2) {
+		t.Fatalf("unexpected .zarray %v", meta)
+	}
+	if data := readZarrChunk(t, filepath.Join(dir, "2.0")); binary.LittleEndian.Uint32(data[4:]) != 6 {
+		t.Fatalf("unexpected chunk %v", data)
+	}
+}
+
+func TestZarrScan(t *testing.T) {
+	dir := t.TempDir()
+	cfg := processing.SeriesConfig{GridX: 2, GridY: 2, FramesPerPoint: 2}
+	scan, err := CreateZarrScan(dir, "20260105_101500", 4, cfg, 2, map[string]any{"sample_name": "cell"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pattern := [][]uint16{{1, 1, 2, 2}, {1, 1, 2, 2}, {3, 3, 4, 4}, {3, 3, 4, 4}}
+	for _, imageID := range []int{2, 3, 4} {
+		raw := types.RawFrame{ImageID: imageID, SeriesID: 4, Data: map[string]any{"threshold_0": pattern}}
+		if err := scan.AddFrame(raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cube := filepath.Join(scan.Dir(), "diffraction", "threshold_0")
+	data := readZarrChunk(t, filepath.Join(cube, "0.1.0.0"))
+	if got := math.Float32frombits(binary.LittleEndian.Uint32(data[12:])); got != 8 {
+		t.Fatalf("summed binned pixel = %v, want 8", got)
+	}
+	if _, err := os.Stat(filepath.Join(cube, "1.0.0.0")); !os.IsNotExist(err) {
+		t.Fatalf("incomplete point written before Finish: %v", err)
+	}
+
+	maps := MapSet{
+		GridX: 2,
+		GridY: 2,
+		Maps:  map[string]types.ThresholdSnapshot{"threshold_0": {Values: []uint32{1, 2, 3, 4}, Mask: []bool{true, true, true, false}}},
+	}
+	if err := scan.Finish(maps, map[string]any{"end": map[string]any{"frames": 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cube, "1.0.0.0")); err != nil {
+		t.Fatalf("incomplete point not written on Finish: %v", err)
+	}
+	if mask := readZarrChunk(t, filepath.Join(scan.Dir(), "maps", "threshold_0_mask", "0.0")); !bytes.Equal(mask, []byte{1, 1, 1, 0}) {
+		t.Fatalf("mask = %v", mask)
+	}
+	attrs := readJSONMap(filepath.Join(scan.Dir(), ".zattrs"))
+	start, _ := attrs["start"].(map[string]any)
+	if start["sample_name"] != "cell" || attrs["end"] == nil || attrs["grid_x"] != float64(2) {
+		t.Fatalf("unexpected attributes %v", attrs)
+	}
+	if err := scan.AddFrame(types.RawFrame{ImageID: 7, SeriesID: 4, Data: map[string]any{"threshold_0": pattern}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cube, "1.1.0.0")); !os.IsNotExist(err) {
+		t.Fatal("frame after Finish was written")
+	}
+}
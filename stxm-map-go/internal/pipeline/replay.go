@@ -0,0 +1,237 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"stxm-map-go/internal/ingest"
+	"stxm-map-go/internal/output"
+	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/types"
+)
+
+// ReplayConfig configures a Replayer.
+type ReplayConfig struct {
+	OutputDir string
+	Sinks     *output.Registry
+	RunNames  *output.PathTemplate
+	Reduction processing.Reduction
+	// Defaults is the layout of series whose start message has none; as
+	// in the live service, its grid follows the last series.
+	Defaults processing.SeriesConfig
+	// ForceGrid uses the grid of Defaults for every series.
+	ForceGrid bool
+	// Series, if not 0, is the only series replayed.
+	Series int
+	// Diffraction accumulates the sum and max patterns of every series.
+	Diffraction bool
+}
+
+// Replayer runs recorded messages through the pipeline of the live service
+// on one goroutine: the same decoding, series layout, aggregation and
+// sinks, and the same Tracker deciding when a series is finalized.
+type Replayer struct {
+	cfg         ReplayConfig
+	agg         *processing.Aggregator
+	tracker     *Tracker
+	diffraction *processing.DiffractionAccumulator
+
+	// currentSeries is the series of the last start message; images
+	// without a series_id belong to it.
+	currentSeries int
+	// pending is the layout from the start message of pendingID, applied
+	// with its first image.
+	pendingID    int
+	pending      *processing.SeriesConfig
+	gridX, gridY int
+	runs         map[int]output.Run
+	// names holds every run name given, also those of reused series ids.
+	names  map[string]bool
+	starts map[int]map[string]any
+	// received is the receive time of the current message; runs are named
+	// after the time of their first message.
+	received time.Time
+	checked  bool
+
+	// Messages, Images, Undecodable and Late count the messages read;
+	// Written counts the series handed to the sinks.
+	Messages    int
+	Images      int
+	Undecodable int
+	Late        int
+	Written     int
+}
+
+// NewReplayer starts a replay into the sinks of cfg.
+func NewReplayer(cfg ReplayConfig) *Replayer {
+	r := &Replayer{
+		cfg:    cfg,
+		agg:    processing.NewAggregator(cfg.Defaults.GridX, cfg.Defaults.GridY),
+		gridX:  cfg.Defaults.GridX,
+		gridY:  cfg.Defaults.GridY,
+		runs:   map[int]output.Run{},
+		names:  map[string]bool{},
+		starts: map[int]map[string]any{},
+	}
+	r.agg.Configure(cfg.Defaults)
+	if cfg.Diffraction {
+		r.diffraction = processing.NewDiffractionAccumulator()
+	}
+	r.tracker = NewTracker(r.agg, r.layout, r.write)
+	r.tracker.OnSeries = func(seriesID int, previous processing.SeriesConfig) {
+		cfg := r.agg.Config()
+		r.gridX, r.gridY = cfg.GridX, cfg.GridY
+	}
+	return r
+}
+
+// defaultSeries is the layout of series whose start message has none.
+func (r *Replayer) defaultSeries() processing.SeriesConfig {
+	cfg := r.cfg.Defaults
+	cfg.GridX, cfg.GridY = r.gridX, r.gridY
+	return cfg
+}
+
+// seriesConfig applies ForceGrid to a layout.
+func (r *Replayer) seriesConfig(cfg processing.SeriesConfig) processing.SeriesConfig {
+	if r.cfg.ForceGrid {
+		cfg.GridX, cfg.GridY, cfg.Points = r.cfg.Defaults.GridX, r.cfg.Defaults.GridY, 0
+	}
+	return cfg
+}
+
+// layout is the layout of a new series in the aggregator. A series without
+// a start message gets the defaults, not the layout of the series before it.
+func (r *Replayer) layout(seriesID int) processing.SeriesConfig {
+	if r.pending != nil && r.pendingID == seriesID {
+		return *r.pending
+	}
+	return r.seriesConfig(r.defaultSeries())
+}
+
+// runFor names the run of a series once, like the live service.
+func (r *Replayer) runFor(seriesID int, cfg processing.SeriesConfig) output.Run {
+	run, ok := r.runs[seriesID]
+	if !ok {
+		fields := output.FieldsFromStart(r.starts[seriesID], seriesID, r.received)
+		id := output.UniqueRunID(r.cfg.OutputDir, r.cfg.RunNames.Expand(fields), func(id string) bool {
+			return r.names[id]
+		})
+		r.names[id] = true
+		run = output.Run{RunTimestamp: id, SeriesID: seriesID, Fields: fields}
+		r.runs[seriesID] = run
+	}
+	run.Config = cfg
+	return run
+}
+
+// Message replays one recorded message received at received. It fails
+// for images the reduction does not fit.
+func (r *Replayer) Message(payload []byte, received time.Time) error {
+	r.Messages++
+	r.received = received
+	msg, ok := ingest.DecodeMessage(payload, 1)
+	if !ok {
+		r.Undecodable++
+		return nil
+	}
+	if msg.Type != "image" {
+		r.metadata(msg)
+		return nil
+	}
+	r.Images++
+	raw := msg.Image
+	if raw.SeriesID == 0 {
+		raw.SeriesID = r.currentSeries
+	}
+	if r.cfg.Series != 0 && raw.SeriesID != r.cfg.Series {
+		return nil
+	}
+	return r.image(raw)
+}
+
+func (r *Replayer) metadata(msg types.RawMessage) {
+	cfg := r.seriesConfig(r.defaultSeries())
+	if msg.Type == "start" {
+		r.currentSeries = SeriesIDFromMeta(msg.Meta, r.currentSeries+1)
+		if r.cfg.Series != 0 && r.currentSeries != r.cfg.Series {
+			return
+		}
+		if meta, ok := output.NormalizeJSONValue(msg.Meta).(map[string]any); ok {
+			seriesCfg, warnings := processing.SeriesConfigFromMeta(meta, r.defaultSeries())
+			for _, warning := range warnings {
+				log.Printf("series %d: %s", r.currentSeries, warning)
+			}
+			seriesCfg = r.seriesConfig(seriesCfg)
+			r.pendingID, r.pending = r.currentSeries, &seriesCfg
+			r.starts[r.currentSeries] = meta
+			// A series id reused after a detector restart gets a run of
+			// its own.
+			delete(r.runs, r.currentSeries)
+			cfg = seriesCfg
+		}
+		r.tracker.Start(r.currentSeries)
+	} else if r.cfg.Series != 0 && r.currentSeries != r.cfg.Series {
+		return
+	}
+	run := r.runFor(r.currentSeries, cfg)
+	switch msg.Type {
+	case "start":
+		r.cfg.Sinks.Start(run, msg.Meta)
+	case "":
+		r.cfg.Sinks.Metadata(run, "metadata", msg.Meta)
+	default:
+		r.cfg.Sinks.Metadata(run, msg.Type, msg.Meta)
+	}
+	// The live service finalizes an ended series once its last images
+	// are through the workers; here they already are.
+	if msg.Type == "end" {
+		r.tracker.End(r.currentSeries, "end")
+		r.tracker.FinishEnd()
+	}
+}
+
+func (r *Replayer) image(raw types.RawFrame) error {
+	if !r.checked && len(raw.Data) > 0 {
+		if err := r.cfg.Reduction.Check(raw); err != nil {
+			return fmt.Errorf("image %d of series %d: %w", raw.ImageID, raw.SeriesID, err)
+		}
+		r.checked = true
+	}
+	if r.diffraction != nil {
+		r.diffraction.Add(raw)
+	}
+	r.cfg.Sinks.Frame(raw)
+	frame, ok := r.cfg.Reduction.Process(raw)
+	if !ok {
+		return nil
+	}
+	if !r.tracker.Add(frame) {
+		r.Late++
+	}
+	return nil
+}
+
+// write hands the series in the aggregator to the sinks.
+func (r *Replayer) write(seriesID int, reason string) {
+	cfg := r.agg.Config()
+	received := r.agg.FrameCount()
+	result := output.NewSeriesResult(r.runFor(seriesID, cfg), r.agg, reason)
+	if r.diffraction != nil {
+		result.Diffraction = r.diffraction.Snapshot(seriesID)
+	}
+	r.cfg.Sinks.End(result, func(failed int) {
+		if failed > 0 {
+			log.Printf("series outputs for %s: %d sinks failed", result.RunTimestamp, failed)
+			return
+		}
+		log.Printf("wrote series %d as %s: %d/%d points (%s)", seriesID, result.RunTimestamp, received, cfg.ExpectedPoints(), reason)
+	})
+	r.Written++
+}
+
+// Finish writes the series left at the end of the input.
+func (r *Replayer) Finish() {
+	r.tracker.Finalize(r.tracker.StopReason("end_of_input"))
+}
@@ -0,0 +1,325 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"stxm-map-go/internal/ingest"
+	"stxm-map-go/internal/output"
+	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/rawlog"
+	"stxm-map-go/internal/types"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// image is an image message with a 2x2 uint8 detector frame, encoded as
+// the detector does (RFC 8746 multi-dimensional and typed arrays). The live
+// reduction counts the pixels below 255.
+func image(seriesID, imageID int, pixels ...byte) map[string]any {
+	return map[string]any{
+		"type":       "image",
+		"series_id":  seriesID,
+		"image_id":   imageID,
+		"start_time": float64(imageID),
+		"data": map[string]any{
+			"threshold_0": cbor.Tag{Number: 40, Content: []any{[]any{2, 2}, cbor.Tag{Number: 64, Content: pixels}}},
+		},
+	}
+}
+
+// recordLog writes messages as a raw log, as the service records them.
+func recordLog(t *testing.T, messages []map[string]any) string {
+	t.Helper()
+	enc, err := rawlog.NewEncoder(rawlog.Header{Version: 2, Compression: rawlog.CompressionGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	at := time.Date(2026, 1, 5, 10, 15, 0, 0, time.UTC)
+	if _, err := enc.WriteHeader(&buf, at); err != nil {
+		t.Fatal(err)
+	}
+	for i, msg := range messages {
+		payload, err := cbor.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := enc.WriteRecord(&buf, at.Add(time.Duration(i)*time.Millisecond), payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "20260105_101500_raw_cbor.bin")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readLog passes the records of a raw log to fn.
+func readLog(t *testing.T, path string, fn func(payload []byte, received time.Time)) {
+	t.Helper()
+	r, err := rawlog.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn(record.Payload, record.Received)
+	}
+}
+
+// seriesOutput is what the golden file keeps of a written series.
+type seriesOutput struct {
+	SeriesID int                 `json:"series_id"`
+	Reason   string              `json:"reason"`
+	Frames   int                 `json:"frames_received"`
+	GridX    int                 `json:"grid_x"`
+	GridY    int                 `json:"grid_y"`
+	Maps     map[string][]uint32 `json:"maps"`
+}
+
+// captureSink keeps the series handed to it.
+type captureSink struct {
+	mu     sync.Mutex
+	series []seriesOutput
+}
+
+func (s *captureSink) Name() string                               { return "capture" }
+func (s *captureSink) OnStart(output.Run, map[string]any) error   { return nil }
+func (s *captureSink) OnFrame(types.RawFrame) error               { return nil }
+func (s *captureSink) OnSnapshot(output.Run, output.MapSet) error { return nil }
+
+func (s *captureSink) OnEnd(result output.SeriesResult) error {
+	maps := map[string][]uint32{}
+	for channel, snapshot := range result.Maps.Maps {
+		maps[channel] = snapshot.Values
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.series = append(s.series, seriesOutput{
+		SeriesID: result.SeriesID,
+		Reason:   result.Summary["reason"].(string),
+		Frames:   result.Summary["frames_received"].(int),
+		GridX:    result.Maps.GridX,
+		GridY:    result.Maps.GridY,
+		Maps:     maps,
+	})
+	return nil
+}
+
+func captureRegistry(t *testing.T) (*output.Registry, *captureSink) {
+	t.Helper()
+	sinks := output.NewRegistry()
+	sinks.Lossless = true
+	sink := &captureSink{}
+	if err := sinks.Register(sink); err != nil {
+		t.Fatal(err)
+	}
+	return sinks, sink
+}
+
+// replay runs a raw log through a Replayer, as stxm-reprocess does.
+func replay(t *testing.T, path string, defaults processing.SeriesConfig) []seriesOutput {
+	sinks, sink := captureRegistry(t)
+	runNames, err := output.ParseRunTemplate(output.DefaultRunTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReplayer(ReplayConfig{OutputDir: t.TempDir(), Sinks: sinks, RunNames: runNames, Defaults: defaults})
+	readLog(t, path, func(payload []byte, received time.Time) {
+		if err := r.Message(payload, received); err != nil {
+			t.Fatal(err)
+		}
+	})
+	r.Finish()
+	if err := sinks.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sink.series
+}
+
+// live runs a raw log the way stxm-map runs the detector stream: images
+// are decoded by several workers and aggregated on one goroutine, and an
+// end message finalizes its series once the frames in the workers are
+// through.
+func live(t *testing.T, path string, defaults processing.SeriesConfig) []seriesOutput {
+	sinks, sink := captureRegistry(t)
+	agg := processing.NewAggregator(defaults.GridX, defaults.GridY)
+	agg.Configure(defaults)
+	// The defaults of the service take the grid of the last series.
+	var (
+		mu        sync.Mutex
+		current   = defaults
+		pendingID int
+		pending   *processing.SeriesConfig
+	)
+	tracker := NewTracker(agg, func(seriesID int) processing.SeriesConfig {
+		mu.Lock()
+		defer mu.Unlock()
+		if pending != nil && pendingID == seriesID {
+			return *pending
+		}
+		return current
+	}, func(seriesID int, reason string) {
+		run := output.Run{SeriesID: seriesID, Config: agg.Config()}
+		sinks.End(output.NewSeriesResult(run, agg, reason), nil)
+	})
+	tracker.OnSeries = func(int, processing.SeriesConfig) {
+		cfg := agg.Config()
+		mu.Lock()
+		current.GridX, current.GridY = cfg.GridX, cfg.GridY
+		mu.Unlock()
+	}
+
+	type seriesEvent struct {
+		kind     string
+		seriesID int
+	}
+	frames := make(chan types.Frame)
+	events := make(chan seriesEvent)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case frame, ok := <-frames:
+				if !ok {
+					tracker.Finalize(tracker.StopReason("end_of_input"))
+					return
+				}
+				tracker.Add(frame)
+			case event := <-events:
+				if event.kind == "start" {
+					tracker.Start(event.seriesID)
+					continue
+				}
+				tracker.End(event.seriesID, "end")
+				tracker.FinishEnd()
+			}
+		}
+	}()
+
+	payloads, workers := decodeWorkers(frames)
+	announced := 0
+	readLog(t, path, func(payload []byte, received time.Time) {
+		msg, ok := ingest.DecodeMessage(payload, 1)
+		if !ok {
+			return
+		}
+		switch msg.Type {
+		case "image":
+			payloads <- payload
+		case "start":
+			meta, _ := output.NormalizeJSONValue(msg.Meta).(map[string]any)
+			seriesID := SeriesIDFromMeta(msg.Meta, announced+1)
+			announced = seriesID
+			mu.Lock()
+			cfg, _ := processing.SeriesConfigFromMeta(meta, current)
+			pendingID, pending = seriesID, &cfg
+			mu.Unlock()
+			events <- seriesEvent{kind: "start", seriesID: seriesID}
+		case "end":
+			// The end grace of the service: the frames before the end
+			// message are aggregated first.
+			close(payloads)
+			workers.Wait()
+			events <- seriesEvent{kind: "end", seriesID: SeriesIDFromMeta(msg.Meta, announced)}
+			payloads, workers = decodeWorkers(frames)
+		}
+	})
+	close(payloads)
+	workers.Wait()
+	close(frames)
+	<-done
+	if err := sinks.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sink.series
+}
+
+// decodeWorkers decodes the image payloads sent to the returned channel
+// into frames on four goroutines.
+func decodeWorkers(frames chan<- types.Frame) (chan<- []byte, *sync.WaitGroup) {
+	payloads := make(chan []byte)
+	var workers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for payload := range payloads {
+				if msg, ok := ingest.DecodeMessage(payload, 1); ok {
+					if frame, ok := processing.ProcessRawFrame(msg.Image); ok {
+						frames <- frame
+					}
+				}
+			}
+		}()
+	}
+	return payloads, &workers
+}
+
+// TestReplayMatchesLive feeds a recorded log through the live pipeline and
+// through stxm-reprocess and checks both against the golden maps.
+func TestReplayMatchesLive(t *testing.T) {
+	path := recordLog(t, []map[string]any{
+		{"type": "start", "series_id": 7, "number_of_images": 4, "user_data": map[string]any{"grid_x": 2, "grid_y": 2}},
+		image(7, 0, 1, 0, 0, 0),
+		image(7, 2, 255, 1, 1, 0),
+		image(7, 1, 255, 255, 0, 0),
+		image(7, 3, 255, 255, 255, 1),
+		{"type": "end", "series_id": 7},
+		// A late image of a series already written is dropped.
+		image(7, 3, 0, 0, 0, 0),
+		{"type": "start", "series_id": 8, "number_of_images": 3, "user_data": map[string]any{"grid_x": 3, "grid_y": 1}},
+		image(8, 0, 255, 0, 0, 1),
+		image(8, 1, 255, 255, 1, 1),
+		{"type": "end", "series_id": 8},
+		// A series without a start message gets the defaults.
+		image(9, 0, 255, 255, 255, 1),
+		// After a detector restart series 8 is announced again; its
+		// images are not late. It is written when the input stops.
+		{"type": "start", "series_id": 8, "number_of_images": 2, "user_data": map[string]any{"grid_x": 2, "grid_y": 1}},
+		image(8, 0, 255, 0, 0, 0),
+	})
+	defaults := processing.SeriesConfig{GridX: 2, GridY: 1}
+
+	replayed := replay(t, path, defaults)
+	if got := live(t, path, defaults); !reflect.DeepEqual(replayed, got) {
+		t.Fatalf("replay %+v\nlive %+v", replayed, got)
+	}
+	golden := filepath.Join("testdata", "replay.golden.json")
+	data, err := json.MarshalIndent(replayed, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := os.WriteFile(golden, append(data, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(want), data) {
+		t.Fatalf("replay differs from %s:\n%s", golden, data)
+	}
+}
@@ -0,0 +1,172 @@
+// Package pipeline holds the series logic shared by the live service and
+// stxm-reprocess: which series a frame belongs to, when a series is
+// finalized and for what reason.
+package pipeline
+
+import (
+	"stxm-map-go/internal/processing"
+	"stxm-map-go/internal/types"
+)
+
+// Tracker follows the series of a frame stream through one aggregator. It
+// configures the aggregator for every new series, drops the late frames of
+// the series before, and finalizes a series when it completes, when the
+// next series starts or when its end is due. A Tracker is used from one
+// goroutine.
+type Tracker struct {
+	agg    *processing.Aggregator
+	layout func(seriesID int) processing.SeriesConfig
+	write  func(seriesID int, reason string)
+
+	// OnSeries, if not nil, is called once the aggregator is configured
+	// for a new series, with the layout of the series before it.
+	OnSeries func(seriesID int, previous processing.SeriesConfig)
+
+	// series is in the aggregator; the late frames of previous and
+	// finished are dropped. announced is the series of a start message that
+	// has no frame in the aggregator yet; its frames are never late, so that
+	// a series id reused after a restart is aggregated again.
+	series    int
+	previous  int
+	finished  int
+	announced int
+	// pendingEnd is the series an end message, abort or disarm is waiting
+	// for; it is finalized with pendingReason.
+	pendingEnd    int
+	pendingReason string
+}
+
+// NewTracker tracks the series in agg. layout returns the layout of a new
+// series: the one its start message announced or the defaults. write
+// writes the series in the aggregator for a reason; the tracker resets the
+// aggregator afterwards.
+func NewTracker(agg *processing.Aggregator, layout func(seriesID int) processing.SeriesConfig, write func(seriesID int, reason string)) *Tracker {
+	return &Tracker{agg: agg, layout: layout, write: write}
+}
+
+// Series is the series in the aggregator, 0 before the first frame.
+func (t *Tracker) Series() int {
+	return t.series
+}
+
+// Add aggregates a frame and reports false for a late frame of a series
+// already written, which is dropped. A frame of another series finalizes
+// the current one first.
+func (t *Tracker) Add(frame types.Frame) bool {
+	late := frame.SeriesID != t.announced
+	if late && t.finished != 0 && frame.SeriesID == t.finished {
+		return false
+	}
+	if frame.SeriesID != t.series {
+		if late && frame.SeriesID == t.previous {
+			return false
+		}
+		if !late {
+			t.announced = 0
+		}
+		reason := "next_series"
+		if t.pendingEnd == t.series {
+			reason = t.pendingReason
+		}
+		t.Finalize(reason)
+		t.previous = t.series
+		t.series = frame.SeriesID
+		previous := t.agg.Config()
+		t.agg.Configure(t.layout(frame.SeriesID))
+		if t.OnSeries != nil {
+			t.OnSeries(frame.SeriesID, previous)
+		}
+	}
+	if t.agg.AddFrame(frame) {
+		t.Finalize("complete")
+	}
+	return true
+}
+
+// Start notes the start message of seriesID. Its frames are not dropped as
+// late even if the series was written before, as after a detector or
+// simulator restart that numbers its series from 1 again. Frames of the
+// series before may still be on their way, so the late frames of that one
+// are still dropped.
+func (t *Tracker) Start(seriesID int) {
+	t.announced = seriesID
+}
+
+// End marks seriesID as ending for reason: "end" for its end message,
+// "abort" or "disarm" otherwise. An end message keeps the reason of an
+// abort of the same series. The series is finalized by FinishEnd or by
+// the first frame of the next series.
+func (t *Tracker) End(seriesID int, reason string) {
+	if reason != "end" || t.pendingEnd != seriesID {
+		t.pendingReason = reason
+	}
+	t.pendingEnd = seriesID
+}
+
+// PendingReason is the reason of the pending end, if any.
+func (t *Tracker) PendingReason() string {
+	if t.pendingEnd == 0 {
+		return ""
+	}
+	return t.pendingReason
+}
+
+// FinishEnd finalizes the series of the pending end if it is still in the
+// aggregator, once its frames are through, and clears the pending end.
+func (t *Tracker) FinishEnd() {
+	if t.pendingEnd == t.series {
+		t.Finalize(t.pendingReason)
+	}
+	t.pendingEnd = 0
+}
+
+// StopReason is the reason to finalize the current series with when the
+// input stops: that of its pending end, or fallback.
+func (t *Tracker) StopReason(fallback string) string {
+	if t.pendingEnd != 0 && t.pendingEnd == t.series {
+		return t.pendingReason
+	}
+	return fallback
+}
+
+// Finalize writes the current series for reason, unless it has no frames,
+// and drops its late frames from then on.
+func (t *Tracker) Finalize(reason string) {
+	if t.agg.FrameCount() == 0 {
+		return
+	}
+	t.write(t.series, reason)
+	t.agg.Reset()
+	t.finished = t.series
+}
+
+// Resume makes seriesID the series in the aggregator, which the caller has
+// restored from a checkpoint. The returned function goes back to the series
+// before, for a checkpoint that was written out instead of resumed.
+func (t *Tracker) Resume(seriesID int) func() {
+	series, finished := t.series, t.finished
+	t.series = seriesID
+	return func() {
+		t.series, t.finished = series, finished
+	}
+}
+
+// SeriesIDFromMeta reads the series_id of a start message, or returns
+// fallback.
+func SeriesIDFromMeta(meta map[string]any, fallback int) int {
+	switch n := meta["series_id"].(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case uint64:
+		return int(n)
+	case uint32:
+		return int(n)
+	case float64:
+		return int(n)
+	case float32:
+		return int(n)
+	}
+	return fallback
+}
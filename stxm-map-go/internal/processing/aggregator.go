@@ -6,75 +6,184 @@ import (
 	"stxm-map-go/internal/types"
 )
 
+// ThresholdData holds one channel of the map in row-major grid order.
+// ImageIDs records which image was placed at each grid pixel. Variance is the
+// variance of the sub-frames of every point when SeriesConfig.Variance is set
+// and nil otherwise.
 type ThresholdData struct {
 	Values     []uint32
 	Timestamps []float64
 	Mask       []bool
+	ImageIDs   []int
+	Variance   []float64 `json:",omitempty"`
 }
 
 type Aggregator struct {
+	cfg         SeriesConfig
 	gridX       int
 	gridY       int
 	totalPixels int
 	frameCount  int
 	data        map[string]*ThresholdData
+	// partial holds the points still waiting for sub-frames.
+	partial map[int]*pointAccum
+
+	// Position based scans keep every sample and rebuild data from them.
+	samples   map[int]sample
+	positions map[int]types.Position
+	dirty     bool
 }
 
 func NewAggregator(gridX, gridY int) *Aggregator {
-	return &Aggregator{
-		gridX:       gridX,
-		gridY:       gridY,
-		totalPixels: gridX * gridY,
-		data:        make(map[string]*ThresholdData),
-	}
+	a := &Aggregator{}
+	a.Configure(SeriesConfig{
+		GridX: gridX,
+		GridY: gridY,
+		Order: ScanOrder{Traversal: TraversalRaster},
+	})
+	return a
+}
+
+// Configure switches the aggregator to a new series layout and clears it.
+func (a *Aggregator) Configure(cfg SeriesConfig) {
+	a.cfg = cfg
+	a.gridX = cfg.GridX
+	a.gridY = cfg.GridY
+	a.totalPixels = cfg.GridX * cfg.GridY
+	a.Reset()
+}
+
+func (a *Aggregator) Config() SeriesConfig {
+	return a.cfg
 }
 
 func (a *Aggregator) AddFrame(frame types.Frame) bool {
-	if frame.ImageID < 0 || frame.ImageID >= a.totalPixels {
+	if frame.Position != nil && !finitePosition(*frame.Position) {
+		frame.Position = nil
+	}
+	if !a.cfg.PositionMode && frame.Position != nil && a.frameCount == 0 {
+		a.cfg.PositionMode = true
+	}
+	if a.cfg.PositionMode {
+		return a.addSample(frame)
+	}
+	if frame.ImageID < 0 || frame.ImageID >= a.totalPixels*a.cfg.PointFrames() {
 		return false
 	}
+	point, startTime, data, variance, done := a.combine(frame)
+	if data == nil {
+		return false
+	}
+	x, y := a.cfg.Order.Position(point, a.gridX, a.gridY)
+	idx := y*a.gridX + x
 
-	for threshold, value := range frame.Data {
+	for threshold, value := range data {
 		td, ok := a.data[threshold]
 		if !ok {
 			td = &ThresholdData{
 				Values:     make([]uint32, a.totalPixels),
 				Timestamps: make([]float64, a.totalPixels),
 				Mask:       make([]bool, a.totalPixels),
+				ImageIDs:   make([]int, a.totalPixels),
 			}
 			a.data[threshold] = td
 		}
-		td.Values[frame.ImageID] = value
-		td.Timestamps[frame.ImageID] = frame.StartTime
-		td.Mask[frame.ImageID] = true
+		if v, ok := variance[threshold]; ok {
+			if td.Variance == nil {
+				td.Variance = make([]float64, a.totalPixels)
+			}
+			td.Variance[idx] = v
+		}
+		td.Values[idx] = value
+		td.Timestamps[idx] = startTime
+		td.Mask[idx] = true
+		td.ImageIDs[idx] = point
 	}
 
+	if !done {
+		return false
+	}
 	a.frameCount++
-	if a.frameCount >= a.totalPixels {
+	if a.frameCount >= a.cfg.ExpectedPoints() {
 		return true
 	}
 	return false
 }
 
+func (a *Aggregator) addSample(frame types.Frame) bool {
+	if frame.ImageID < 0 {
+		return false
+	}
+	point, startTime, data, variance, done := a.combine(frame)
+	if data == nil {
+		return false
+	}
+	if frame.Position != nil {
+		if _, ok := a.positions[point]; !ok || frame.ImageID%a.cfg.PointFrames() == 0 {
+			a.positions[point] = *frame.Position
+		}
+	}
+	if _, seen := a.samples[point]; !seen && done {
+		a.frameCount++
+	}
+	a.samples[point] = sample{
+		startTime: startTime,
+		data:      data,
+		variance:  variance,
+	}
+	a.dirty = true
+	return a.frameCount >= a.cfg.ExpectedPoints()
+}
+
 func (a *Aggregator) Reset() {
 	a.frameCount = 0
 	a.data = make(map[string]*ThresholdData)
+	a.partial = make(map[int]*pointAccum)
+	a.samples = make(map[int]sample)
+	a.positions = make(map[int]types.Position, len(a.cfg.Positions))
+	for point, pos := range a.cfg.Positions {
+		a.positions[point] = pos
+	}
+	a.dirty = false
+}
+
+// FrameCount is the number of scan points received for the current series.
+func (a *Aggregator) FrameCount() int {
+	return a.frameCount
+}
+
+// Mask reports which grid pixels hold a measured value in any channel.
+func (a *Aggregator) Mask() []bool {
+	mask := make([]bool, a.totalPixels)
+	for _, td := range a.Snapshot() {
+		for idx, ok := range td.Mask {
+			if ok {
+				mask[idx] = true
+			}
+		}
+	}
+	return mask
 }
 
 func (a *Aggregator) Snapshot() map[string]*ThresholdData {
+	if a.cfg.PositionMode {
+		a.regrid()
+	}
 	return a.data
 }
 
 func (a *Aggregator) SnapshotCopy() map[string]types.ThresholdSnapshot {
-	snapshot := make(map[string]types.ThresholdSnapshot, len(a.data))
-	for threshold, data := range a.data {
+	data := a.Snapshot()
+	snapshot := make(map[string]types.ThresholdSnapshot, len(data))
+	for threshold, data := range data {
 		values := make([]uint32, len(data.Values))
 		copy(values, data.Values)
 		mask := make([]bool, len(data.Mask))
 		copy(mask, data.Mask)
 		snapshot[threshold] = types.ThresholdSnapshot{
-			Values: values,
-			Mask:   mask,
+			Values:   values,
+			Mask:     mask,
+			Variance: append([]float64(nil), data.Variance...),
 		}
 	}
 	return snapshot
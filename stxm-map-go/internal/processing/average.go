@@ -0,0 +1,182 @@
+package processing
+
+import (
+	"math"
+
+	"stxm-map-go/internal/types"
+)
+
+// AverageMap is the running mean and standard deviation of one channel over
+// the passes of a repeated scan. Count is the number of passes that measured
+// each pixel.
+type AverageMap struct {
+	Mean  []float64
+	Std   []float64
+	Count []int
+}
+
+// RepeatAverage accumulates complete passes of the same scan. A pass with a
+// different grid or scan order starts a new average.
+type RepeatAverage struct {
+	repeats   int
+	gridX     int
+	gridY     int
+	order     ScanOrder
+	seriesIDs []int
+	first     string
+	sum       map[string][]float64
+	sumSq     map[string][]float64
+	count     map[string][]int
+}
+
+// NewRepeatAverage averages up to repeats passes; zero means until Reset.
+func NewRepeatAverage(repeats int) *RepeatAverage {
+	r := &RepeatAverage{repeats: repeats}
+	r.Reset()
+	return r
+}
+
+func (r *RepeatAverage) Reset() {
+	r.seriesIDs = nil
+	r.first = ""
+	r.sum = make(map[string][]float64)
+	r.sumSq = make(map[string][]float64)
+	r.count = make(map[string][]int)
+}
+
+// Add accumulates one pass. runTimestamp identifies the pass; the average is
+// named after the first one. It returns true once the configured number of
+// repeats has been reached.
+func (r *RepeatAverage) Add(seriesID int, runTimestamp string, cfg SeriesConfig, data map[string]*ThresholdData) bool {
+	if len(r.seriesIDs) > 0 && (cfg.GridX != r.gridX || cfg.GridY != r.gridY || cfg.Order != r.order) {
+		r.Reset()
+	}
+	if len(r.seriesIDs) == 0 {
+		r.gridX = cfg.GridX
+		r.gridY = cfg.GridY
+		r.order = cfg.Order
+		r.first = runTimestamp
+	}
+	r.seriesIDs = append(r.seriesIDs, seriesID)
+	pixels := r.gridX * r.gridY
+	for threshold, td := range data {
+		if len(td.Values) != pixels {
+			continue
+		}
+		sum, ok := r.sum[threshold]
+		if !ok {
+			sum = make([]float64, pixels)
+			r.sum[threshold] = sum
+			r.sumSq[threshold] = make([]float64, pixels)
+			r.count[threshold] = make([]int, pixels)
+		}
+		sumSq := r.sumSq[threshold]
+		count := r.count[threshold]
+		for idx, ok := range td.Mask {
+			if !ok {
+				continue
+			}
+			v := float64(td.Values[idx])
+			sum[idx] += v
+			sumSq[idx] += v * v
+			count[idx]++
+		}
+	}
+	return r.repeats > 0 && len(r.seriesIDs) >= r.repeats
+}
+
+// Passes is the number of passes in the current average.
+func (r *RepeatAverage) Passes() int {
+	return len(r.seriesIDs)
+}
+
+// Repeats is the configured number of passes, zero if unlimited.
+func (r *RepeatAverage) Repeats() int {
+	return r.repeats
+}
+
+// SeriesIDs lists the series averaged so far.
+func (r *RepeatAverage) SeriesIDs() []int {
+	return append([]int(nil), r.seriesIDs...)
+}
+
+// RunTimestamp is the run timestamp of the first pass.
+func (r *RepeatAverage) RunTimestamp() string {
+	return r.first
+}
+
+func (r *RepeatAverage) Grid() (int, int) {
+	return r.gridX, r.gridY
+}
+
+// Maps returns the mean and population standard deviation of every channel.
+func (r *RepeatAverage) Maps() map[string]AverageMap {
+	out := make(map[string]AverageMap, len(r.sum))
+	for threshold, sum := range r.sum {
+		sumSq := r.sumSq[threshold]
+		count := append([]int(nil), r.count[threshold]...)
+		avg := AverageMap{
+			Mean:  make([]float64, len(sum)),
+			Std:   make([]float64, len(sum)),
+			Count: count,
+		}
+		for idx, n := range count {
+			if n == 0 {
+				continue
+			}
+			mean := sum[idx] / float64(n)
+			avg.Mean[idx] = mean
+			avg.Std[idx] = math.Sqrt(math.Max(0, sumSq[idx]/float64(n)-mean*mean))
+		}
+		out[threshold] = avg
+	}
+	return out
+}
+
+// AverageSnapshot is a copy of a RepeatAverage that can be written out while
+// the average goes on.
+type AverageSnapshot struct {
+	RunTimestamp string
+	GridX        int
+	GridY        int
+	Passes       int
+	Repeats      int
+	SeriesIDs    []int
+	Maps         map[string]AverageMap
+}
+
+// Snapshot copies the current average.
+func (r *RepeatAverage) Snapshot() AverageSnapshot {
+	return AverageSnapshot{
+		RunTimestamp: r.first,
+		GridX:        r.gridX,
+		GridY:        r.gridY,
+		Passes:       r.Passes(),
+		Repeats:      r.repeats,
+		SeriesIDs:    r.SeriesIDs(),
+		Maps:         r.Maps(),
+	}
+}
+
+// AverageSnapshots converts the mean and standard deviation maps into UI
+// snapshots, rounded to whole counts.
+func AverageSnapshots(maps map[string]AverageMap) (map[string]types.ThresholdSnapshot, map[string]types.ThresholdSnapshot) {
+	mean := make(map[string]types.ThresholdSnapshot, len(maps))
+	std := make(map[string]types.ThresholdSnapshot, len(maps))
+	for threshold, avg := range maps {
+		mask := make([]bool, len(avg.Count))
+		meanValues := make([]uint32, len(avg.Count))
+		stdValues := make([]uint32, len(avg.Count))
+		for idx, n := range avg.Count {
+			if n == 0 {
+				continue
+			}
+			mask[idx] = true
+			meanValues[idx] = clampUint32(math.Round(avg.Mean[idx]))
+			stdValues[idx] = clampUint32(math.Round(avg.Std[idx]))
+		}
+		mean[threshold] = types.ThresholdSnapshot{Values: meanValues, Mask: mask}
+		std[threshold] = types.ThresholdSnapshot{Values: stdValues, Mask: append([]bool(nil), mask...)}
+	}
+	return mean, std
+}
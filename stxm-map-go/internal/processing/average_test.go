@@ -0,0 +1,45 @@
+package processing
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRepeatAverage(t *testing.T) {
+	cfg := SeriesConfig{GridX: 2, GridY: 1, Order: ScanOrder{Traversal: TraversalRaster}}
+	pass := func(a, b uint32, maskB bool) map[string]*ThresholdData {
+		return map[string]*ThresholdData{
+			"threshold_0": {Values: []uint32{a, b}, Mask: []bool{true, maskB}},
+		}
+	}
+	avg := NewRepeatAverage(3)
+	if avg.Add(1, "t1", cfg, pass(2, 10, true)) {
+		t.Fatal("average complete after one pass")
+	}
+	avg.Add(2, "t2", cfg, pass(4, 0, false))
+	if !avg.Add(3, "t3", cfg, pass(6, 20, true)) {
+		t.Fatal("average not complete after three passes")
+	}
+	maps := avg.Maps()["threshold_0"]
+	if maps.Mean[0] != 4 || maps.Count[0] != 3 || math.Abs(maps.Std[0]-math.Sqrt(8.0/3)) > 1e-9 {
+		t.Fatalf("unexpected pixel 0: %+v", maps)
+	}
+	if maps.Mean[1] != 15 || maps.Count[1] != 2 || maps.Std[1] != 5 {
+		t.Fatalf("unexpected pixel 1: %+v", maps)
+	}
+	if avg.RunTimestamp() != "t1" {
+		t.Fatalf("got run timestamp %q", avg.RunTimestamp())
+	}
+	snapshot := avg.Snapshot()
+
+	other := cfg
+	other.GridX = 3
+	avg.Add(4, "t4", other, map[string]*ThresholdData{})
+	if avg.Passes() != 1 || avg.RunTimestamp() != "t4" {
+		t.Fatalf("grid change did not restart the average: %d passes", avg.Passes())
+	}
+	// The snapshot is not changed by what the average does afterwards.
+	if snapshot.RunTimestamp != "t1" || snapshot.Passes != 3 || len(snapshot.SeriesIDs) != 3 || snapshot.Maps["threshold_0"].Mean[0] != 4 {
+		t.Fatalf("snapshot changed: %+v", snapshot)
+	}
+}
@@ -0,0 +1,155 @@
+package processing
+
+import (
+	"fmt"
+	"sort"
+
+	"stxm-map-go/internal/types"
+)
+
+// AggregatorState is everything an aggregator holds for the current series,
+// in a form that survives a JSON round trip.
+type AggregatorState struct {
+	Config     SeriesConfig              `json:"config"`
+	FrameCount int                       `json:"frame_count"`
+	Data       map[string]*ThresholdData `json:"data,omitempty"`
+	// Partial holds the scan points still waiting for sub-frames.
+	Partial map[int]PointState `json:"partial,omitempty"`
+	// Samples and Positions are the raw points of position based scans;
+	// their maps are rebuilt on restore.
+	Samples   map[int]SampleState    `json:"samples,omitempty"`
+	Positions map[int]types.Position `json:"positions,omitempty"`
+}
+
+// PointState is a scan point of which only some sub-frames arrived.
+type PointState struct {
+	N         int                `json:"n"`
+	StartTime float64            `json:"start_time"`
+	Sum       map[string]float64 `json:"sum"`
+	SumSq     map[string]float64 `json:"sum_sq"`
+	Max       map[string]uint32  `json:"max"`
+	// Frames are the sub-frame indices that arrived.
+	Frames []int `json:"frames,omitempty"`
+}
+
+// SampleState is one point of a position based scan.
+type SampleState struct {
+	StartTime float64            `json:"start_time"`
+	Data      map[string]uint32  `json:"data"`
+	Variance  map[string]float64 `json:"variance,omitempty"`
+}
+
+// State returns a copy of the aggregator state that stays valid while the
+// aggregator goes on.
+func (a *Aggregator) State() AggregatorState {
+	state := AggregatorState{
+		Config:     a.cfg,
+		FrameCount: a.frameCount,
+	}
+	if a.cfg.PositionMode {
+		state.Samples = make(map[int]SampleState, len(a.samples))
+		for point, s := range a.samples {
+			saved := SampleState{StartTime: s.startTime, Data: copyCounts(s.data)}
+			if s.variance != nil {
+				saved.Variance = copyFloats(s.variance)
+			}
+			state.Samples[point] = saved
+		}
+		state.Positions = make(map[int]types.Position, len(a.positions))
+		for point, pos := range a.positions {
+			state.Positions[point] = pos
+		}
+	} else {
+		state.Data = make(map[string]*ThresholdData, len(a.data))
+		for threshold, td := range a.data {
+			state.Data[threshold] = &ThresholdData{
+				Values:     append([]uint32(nil), td.Values...),
+				Timestamps: append([]float64(nil), td.Timestamps...),
+				Mask:       append([]bool(nil), td.Mask...),
+				ImageIDs:   append([]int(nil), td.ImageIDs...),
+				Variance:   append([]float64(nil), td.Variance...),
+			}
+		}
+	}
+	if len(a.partial) > 0 {
+		state.Partial = make(map[int]PointState, len(a.partial))
+		for point, acc := range a.partial {
+			frames := make([]int, 0, len(acc.seen))
+			for sub := range acc.seen {
+				frames = append(frames, sub)
+			}
+			sort.Ints(frames)
+			state.Partial[point] = PointState{
+				N:         acc.n,
+				StartTime: acc.startTime,
+				Sum:       copyFloats(acc.sum),
+				SumSq:     copyFloats(acc.sumSq),
+				Max:       copyCounts(acc.max),
+				Frames:    frames,
+			}
+		}
+	}
+	return state
+}
+
+// Restore replaces the aggregator content with a saved state.
+func (a *Aggregator) Restore(state AggregatorState) error {
+	pixels := state.Config.GridX * state.Config.GridY
+	if pixels < 1 {
+		return fmt.Errorf("invalid grid %dx%d", state.Config.GridX, state.Config.GridY)
+	}
+	for threshold, td := range state.Data {
+		if td == nil || len(td.Values) != pixels || len(td.Timestamps) != pixels || len(td.Mask) != pixels || len(td.ImageIDs) != pixels || (td.Variance != nil && len(td.Variance) != pixels) {
+			return fmt.Errorf("channel %s does not match the %dx%d grid", threshold, state.Config.GridX, state.Config.GridY)
+		}
+	}
+	a.Configure(state.Config)
+	a.frameCount = state.FrameCount
+	for threshold, td := range state.Data {
+		a.data[threshold] = td
+	}
+	for point, p := range state.Partial {
+		acc := &pointAccum{
+			n:         p.N,
+			startTime: p.StartTime,
+			sum:       copyFloats(p.Sum),
+			sumSq:     copyFloats(p.SumSq),
+			max:       copyCounts(p.Max),
+			seen:      make(map[int]bool, len(p.Frames)),
+		}
+		for _, sub := range p.Frames {
+			acc.seen[sub] = true
+		}
+		a.partial[point] = acc
+	}
+	for point, s := range state.Samples {
+		restored := sample{startTime: s.StartTime, data: copyCounts(s.Data)}
+		if s.Variance != nil {
+			restored.variance = copyFloats(s.Variance)
+		}
+		a.samples[point] = restored
+	}
+	for point, pos := range state.Positions {
+		if finitePosition(pos) {
+			a.positions[point] = pos
+		}
+	}
+	a.dirty = a.cfg.PositionMode
+	return nil
+}
+
+func copyCounts(m map[string]uint32) map[string]uint32 {
+	out := make(map[string]uint32, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func copyFloats(m map[string]float64) map[string]float64 {
+	out := make(map[string]float64, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
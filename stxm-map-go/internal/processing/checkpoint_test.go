@@ -0,0 +1,76 @@
+package processing
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"stxm-map-go/internal/types"
+)
+
+// roundTrip saves agg through JSON into a new aggregator.
+func roundTrip(t *testing.T, agg *Aggregator) *Aggregator {
+	t.Helper()
+	data, err := json.Marshal(agg.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state AggregatorState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewAggregator(1, 1)
+	if err := restored.Restore(state); err != nil {
+		t.Fatal(err)
+	}
+	return restored
+}
+
+func TestAggregatorStateRestoresSubframes(t *testing.T) {
+	agg := NewAggregator(2, 1)
+	agg.Configure(SeriesConfig{GridX: 2, GridY: 1, FramesPerPoint: 2, Order: ScanOrder{Traversal: TraversalRaster}})
+	for id, value := range []uint32{3, 4, 5} {
+		agg.AddFrame(types.Frame{ImageID: id, StartTime: float64(id), Data: map[string]uint32{"threshold_0": value}})
+	}
+
+	restored := roundTrip(t, agg)
+	if restored.FrameCount() != 1 {
+		t.Fatalf("frame count %d, want 1", restored.FrameCount())
+	}
+	// The last sub-frame of the second point completes the series.
+	if !restored.AddFrame(types.Frame{ImageID: 3, Data: map[string]uint32{"threshold_0": 6}}) {
+		t.Fatal("series not complete after the restored point")
+	}
+	data := restored.Snapshot()["threshold_0"]
+	if want := []uint32{7, 11}; !reflect.DeepEqual(data.Values, want) {
+		t.Fatalf("values %v, want %v", data.Values, want)
+	}
+	if want := []float64{0, 2}; !reflect.DeepEqual(data.Timestamps, want) {
+		t.Fatalf("timestamps %v, want %v", data.Timestamps, want)
+	}
+}
+
+func TestAggregatorStateRestoresPositions(t *testing.T) {
+	agg := NewAggregator(2, 2)
+	agg.Configure(SeriesConfig{
+		GridX:        2,
+		GridY:        2,
+		PositionMode: true,
+		Extent:       &Extent{XMin: 0, XMax: 10, YMin: 0, YMax: 10},
+	})
+	agg.AddFrame(types.Frame{ImageID: 0, Position: &types.Position{X: 1, Y: 1}, Data: map[string]uint32{"threshold_0": 10}})
+	agg.AddFrame(types.Frame{ImageID: 1, Position: &types.Position{X: 9, Y: 6}, Data: map[string]uint32{"threshold_0": 7}})
+
+	restored := roundTrip(t, agg)
+	if want := agg.Snapshot()["threshold_0"].Values; !reflect.DeepEqual(restored.Snapshot()["threshold_0"].Values, want) {
+		t.Fatalf("values %v, want %v", restored.Snapshot()["threshold_0"].Values, want)
+	}
+	if samples := restored.Samples(); len(samples) != 2 || samples[1].Position.X != 9 {
+		t.Fatalf("samples %+v", samples)
+	}
+
+	bad := AggregatorState{Config: SeriesConfig{GridX: 3, GridY: 1}, Data: map[string]*ThresholdData{"threshold_0": {}}}
+	if err := NewAggregator(1, 1).Restore(bad); err == nil {
+		t.Fatal("state that does not match its grid restored")
+	}
+}
@@ -0,0 +1,305 @@
+package processing
+
+import (
+	"math"
+	"sync"
+
+	"stxm-map-go/internal/types"
+)
+
+// DiffractionAccumulator keeps a running sum and max pattern per channel for
+// the current series. Workers call Add concurrently; pixels at the maximum
+// value of their data type are treated as masked and skipped.
+type DiffractionAccumulator struct {
+	mu         sync.Mutex
+	seriesID   int
+	current    map[string]*patternSum
+	previousID int
+	previous   map[string]*patternSum
+}
+
+type patternSum struct {
+	mu     sync.Mutex
+	width  int
+	height int
+	frames int
+	sum    []float64
+	max    []float64
+}
+
+func NewDiffractionAccumulator() *DiffractionAccumulator {
+	return &DiffractionAccumulator{
+		current: make(map[string]*patternSum),
+	}
+}
+
+// Add accumulates every channel of raw into the pattern sums of its series.
+// A frame from a new series starts a fresh set of sums; the previous series
+// is kept so that late frames and the final snapshot still find it.
+func (a *DiffractionAccumulator) Add(raw types.RawFrame) {
+	a.mu.Lock()
+	sums := a.current
+	switch {
+	case raw.SeriesID == a.seriesID:
+	case a.previous != nil && raw.SeriesID == a.previousID:
+		sums = a.previous
+	default:
+		if len(a.current) > 0 {
+			a.previous = a.current
+			a.previousID = a.seriesID
+		}
+		a.current = make(map[string]*patternSum)
+		a.seriesID = raw.SeriesID
+		sums = a.current
+	}
+	a.mu.Unlock()
+
+	for channel, payload := range raw.Data {
+		width, height, ok := patternShape(payload)
+		if !ok {
+			continue
+		}
+		a.mu.Lock()
+		ps, ok := sums[channel]
+		if !ok {
+			ps = &patternSum{
+				width:  width,
+				height: height,
+				sum:    make([]float64, width*height),
+				max:    make([]float64, width*height),
+			}
+			sums[channel] = ps
+		}
+		a.mu.Unlock()
+		ps.add(payload, width, height)
+	}
+}
+
+// Snapshot returns a copy of the patterns accumulated for seriesID, or nil if
+// that series is neither current nor the one before it.
+func (a *DiffractionAccumulator) Snapshot(seriesID int) map[string]types.DiffractionFrame {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case seriesID == a.seriesID && len(a.current) > 0:
+		return copyPatternSums(a.current)
+	case a.previous != nil && seriesID == a.previousID:
+		return copyPatternSums(a.previous)
+	default:
+		return nil
+	}
+}
+
+// Latest returns the series id and a copy of the patterns of the current series.
+func (a *DiffractionAccumulator) Latest() (int, map[string]types.DiffractionFrame) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.current) == 0 {
+		return a.seriesID, nil
+	}
+	return a.seriesID, copyPatternSums(a.current)
+}
+
+func (a *DiffractionAccumulator) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.current = make(map[string]*patternSum)
+	a.previous = nil
+}
+
+// DiffractionMean divides the accumulated sum by the number of frames.
+func DiffractionMean(frame types.DiffractionFrame) []float64 {
+	mean := make([]float64, len(frame.Sum))
+	if frame.Frames == 0 {
+		return mean
+	}
+	for i, v := range frame.Sum {
+		mean[i] = v / float64(frame.Frames)
+	}
+	return mean
+}
+
+// BinPattern averages square blocks of values so that neither side of the
+// result exceeds maxSide.
+func BinPattern(values []float64, width, height, maxSide int) ([]float64, int, int) {
+	if maxSide < 1 || (width <= maxSide && height <= maxSide) {
+		return values, width, height
+	}
+	side := width
+	if height > side {
+		side = height
+	}
+	factor := (side + maxSide - 1) / maxSide
+	outW := (width + factor - 1) / factor
+	outH := (height + factor - 1) / factor
+	out := make([]float64, outW*outH)
+	counts := make([]int, outW*outH)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			idx := (y/factor)*outW + x/factor
+			out[idx] += values[y*width+x]
+			counts[idx]++
+		}
+	}
+	for i := range out {
+		if counts[i] > 0 {
+			out[i] /= float64(counts[i])
+		}
+	}
+	return out, outW, outH
+}
+
+func copyPatternSums(sums map[string]*patternSum) map[string]types.DiffractionFrame {
+	out := make(map[string]types.DiffractionFrame, len(sums))
+	for channel, ps := range sums {
+		ps.mu.Lock()
+		out[channel] = types.DiffractionFrame{
+			Width:  ps.width,
+			Height: ps.height,
+			Frames: ps.frames,
+			Sum:    append([]float64(nil), ps.sum...),
+			Max:    append([]float64(nil), ps.max...),
+		}
+		ps.mu.Unlock()
+	}
+	return out
+}
+
+func (p *patternSum) add(payload any, width, height int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if width != p.width || height != p.height {
+		return
+	}
+	switch v := payload.(type) {
+	case [][]uint8:
+		for r, row := range v {
+			p.addUint8(row, r*width)
+		}
+	case [][]uint16:
+		for r, row := range v {
+			p.addUint16(row, r*width)
+		}
+	case [][]uint32:
+		for r, row := range v {
+			p.addUint32(row, r*width)
+		}
+	case [][]float32:
+		for r, row := range v {
+			p.addFloat32(row, r*width)
+		}
+	case []uint8:
+		p.addUint8(v, 0)
+	case []uint16:
+		p.addUint16(v, 0)
+	case []uint32:
+		p.addUint32(v, 0)
+	case []float32:
+		p.addFloat32(v, 0)
+	default:
+		return
+	}
+	p.frames++
+}
+
+func (p *patternSum) accumulate(idx int, value float64) {
+	p.sum[idx] += value
+	if value > p.max[idx] {
+		p.max[idx] = value
+	}
+}
+
+func (p *patternSum) addUint8(values []uint8, offset int) {
+	for i, v := range values {
+		if v < math.MaxUint8 {
+			p.accumulate(offset+i, float64(v))
+		}
+	}
+}
+
+func (p *patternSum) addUint16(values []uint16, offset int) {
+	for i, v := range values {
+		if v < math.MaxUint16 {
+			p.accumulate(offset+i, float64(v))
+		}
+	}
+}
+
+func (p *patternSum) addUint32(values []uint32, offset int) {
+	for i, v := range values {
+		if v < math.MaxUint32 {
+			p.accumulate(offset+i, float64(v))
+		}
+	}
+}
+
+func (p *patternSum) addFloat32(values []float32, offset int) {
+	for i, v := range values {
+		if v < math.MaxFloat32 {
+			p.accumulate(offset+i, float64(v))
+		}
+	}
+}
+
+func patternShape(payload any) (int, int, bool) {
+	switch v := payload.(type) {
+	case [][]uint8:
+		return rowShape(len(v), func(row int) int { return len(v[row]) })
+	case [][]uint16:
+		return rowShape(len(v), func(row int) int { return len(v[row]) })
+	case [][]uint32:
+		return rowShape(len(v), func(row int) int { return len(v[row]) })
+	case [][]float32:
+		return rowShape(len(v), func(row int) int { return len(v[row]) })
+	case []uint8:
+		return len(v), 1, len(v) > 0
+	case []uint16:
+		return len(v), 1, len(v) > 0
+	case []uint32:
+		return len(v), 1, len(v) > 0
+	case []float32:
+		return len(v), 1, len(v) > 0
+	default:
+		return 0, 0, false
+	}
+}
+
+// rowShape is the shape of an image of rows rows. Jagged images have none:
+// every row must have the columns of the first.
+func rowShape(rows int, cols func(int) int) (int, int, bool) {
+	if rows == 0 {
+		return 0, 0, false
+	}
+	width := cols(0)
+	return width, rows, width > 0 && rectangular(rows, width, cols)
+}
+
+// rectangular reports whether all rows have width columns.
+func rectangular(rows, width int, cols func(int) int) bool {
+	for row := 0; row < rows; row++ {
+		if cols(row) != width {
+			return false
+		}
+	}
+	return true
+}
+
+// PatternValues converts a detector image to float64 values in row-major
+// order. Pixels at the maximum value of their data type read as zero.
+func PatternValues(payload any) ([]float64, int, int, bool) {
+	width, height, ok := patternShape(payload)
+	if !ok {
+		return nil, 0, 0, false
+	}
+	ps := &patternSum{
+		width:  width,
+		height: height,
+		sum:    make([]float64, width*height),
+		max:    make([]float64, width*height),
+	}
+	ps.add(payload, width, height)
+	if ps.frames == 0 {
+		return nil, 0, 0, false
+	}
+	return ps.sum, width, height, true
+}
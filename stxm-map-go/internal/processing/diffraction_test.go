@@ -0,0 +1,70 @@
+package processing
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"stxm-map-go/internal/types"
+)
+
+func TestDiffractionAccumulatorSumAndMax(t *testing.T) {
+	acc := NewDiffractionAccumulator()
+	acc.Add(types.RawFrame{
+		SeriesID: 1,
+		Data: map[string]any{
+			"threshold_0": [][]uint16{{1, 2}, {3, math.MaxUint16}},
+		},
+	})
+	acc.Add(types.RawFrame{
+		SeriesID: 1,
+		Data: map[string]any{
+			"threshold_0": [][]uint16{{5, 0}, {1, 4}},
+		},
+	})
+
+	frames := acc.Snapshot(1)
+	frame, ok := frames["threshold_0"]
+	if !ok {
+		t.Fatalf("missing threshold_0")
+	}
+	if frame.Width != 2 || frame.Height != 2 || frame.Frames != 2 {
+		t.Fatalf("unexpected shape: %+v", frame)
+	}
+	if want := []float64{6, 2, 4, 4}; !reflect.DeepEqual(frame.Sum, want) {
+		t.Fatalf("unexpected sum: got %v want %v", frame.Sum, want)
+	}
+	if want := []float64{5, 2, 3, 4}; !reflect.DeepEqual(frame.Max, want) {
+		t.Fatalf("unexpected max: got %v want %v", frame.Max, want)
+	}
+}
+
+func TestDiffractionAccumulatorKeepsPreviousSeries(t *testing.T) {
+	acc := NewDiffractionAccumulator()
+	acc.Add(types.RawFrame{SeriesID: 1, Data: map[string]any{"threshold_0": []uint8{1, 1}}})
+	acc.Add(types.RawFrame{SeriesID: 2, Data: map[string]any{"threshold_0": []uint8{7, 7}}})
+	acc.Add(types.RawFrame{SeriesID: 1, Data: map[string]any{"threshold_0": []uint8{2, 2}}})
+
+	if got := acc.Snapshot(1)["threshold_0"].Sum; !reflect.DeepEqual(got, []float64{3, 3}) {
+		t.Fatalf("unexpected series 1 sum: %v", got)
+	}
+	seriesID, latest := acc.Latest()
+	if seriesID != 2 || !reflect.DeepEqual(latest["threshold_0"].Sum, []float64{7, 7}) {
+		t.Fatalf("unexpected latest series %d: %v", seriesID, latest)
+	}
+}
+
+func TestDiffractionRejectsJaggedImages(t *testing.T) {
+	jagged := [][]uint16{{1, 2}, {3, 4, 5}}
+	acc := NewDiffractionAccumulator()
+	acc.Add(types.RawFrame{SeriesID: 1, Data: map[string]any{"threshold_0": jagged}})
+	if frames := acc.Snapshot(1); frames["threshold_0"].Frames != 0 {
+		t.Fatalf("jagged image accumulated: %+v", frames)
+	}
+	if _, _, _, ok := PatternValues(jagged); ok {
+		t.Fatal("PatternValues accepted a jagged image")
+	}
+	if _, _, _, ok := PatternValues([][]uint16{{1, 2, 3}, {4}}); ok {
+		t.Fatal("PatternValues accepted a short row")
+	}
+}
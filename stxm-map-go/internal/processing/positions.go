@@ -0,0 +1,234 @@
+package processing
+
+import (
+	"math"
+	"sort"
+
+	"stxm-map-go/internal/types"
+)
+
+const (
+	// GriddingBin averages all points that fall into a grid pixel.
+	GriddingBin = "bin"
+	// GriddingNearest bins like GriddingBin and fills empty pixels from the
+	// nearest filled pixel within nearestFillRadius.
+	GriddingNearest = "nearest"
+
+	nearestFillRadius = 2
+)
+
+// Extent is the scan area covered by the display grid, in stage units.
+type Extent struct {
+	XMin float64 `json:"x_min"`
+	XMax float64 `json:"x_max"`
+	YMin float64 `json:"y_min"`
+	YMax float64 `json:"y_max"`
+}
+
+// PositionSample is one measured point of a position based scan.
+type PositionSample struct {
+	ImageID   int
+	Position  types.Position
+	StartTime float64
+	Data      map[string]uint32
+}
+
+type sample struct {
+	startTime float64
+	data      map[string]uint32
+	variance  map[string]float64
+}
+
+// bin returns the grid pixel that contains p, or false if p lies outside.
+func (e Extent) bin(p types.Position, gridX, gridY int) (int, int, bool) {
+	// Written so that NaN coordinates fall outside.
+	if !(p.X >= e.XMin && p.X <= e.XMax && p.Y >= e.YMin && p.Y <= e.YMax) {
+		return 0, 0, false
+	}
+	x := int((p.X - e.XMin) / (e.XMax - e.XMin) * float64(gridX))
+	y := int((p.Y - e.YMin) / (e.YMax - e.YMin) * float64(gridY))
+	if x == gridX {
+		x--
+	}
+	if y == gridY {
+		y--
+	}
+	return x, y, true
+}
+
+// boundingExtent covers all positions; degenerate axes are widened so that
+// a single line or point still maps onto the grid.
+func boundingExtent(positions map[int]types.Position) Extent {
+	ext := Extent{
+		XMin: math.Inf(1),
+		XMax: math.Inf(-1),
+		YMin: math.Inf(1),
+		YMax: math.Inf(-1),
+	}
+	finite := 0
+	for _, p := range positions {
+		if !finitePosition(p) {
+			continue
+		}
+		finite++
+		ext.XMin = math.Min(ext.XMin, p.X)
+		ext.XMax = math.Max(ext.XMax, p.X)
+		ext.YMin = math.Min(ext.YMin, p.Y)
+		ext.YMax = math.Max(ext.YMax, p.Y)
+	}
+	if finite == 0 {
+		return Extent{XMax: 1, YMax: 1}
+	}
+	if ext.XMax <= ext.XMin {
+		ext.XMin -= 0.5
+		ext.XMax += 0.5
+	}
+	if ext.YMax <= ext.YMin {
+		ext.YMin -= 0.5
+		ext.YMax += 0.5
+	}
+	return ext
+}
+
+// regrid rebuilds the map of a position based scan from its samples.
+func (a *Aggregator) regrid() {
+	if !a.dirty {
+		return
+	}
+	a.dirty = false
+	ext := boundingExtent(a.positions)
+	if a.cfg.Extent != nil {
+		ext = *a.cfg.Extent
+	}
+
+	data := make(map[string]*ThresholdData)
+	sums := make(map[string][]float64)
+	variances := make(map[string][]float64)
+	counts := make(map[string][]int)
+	for point, s := range a.samples {
+		pos, ok := a.positions[point]
+		if !ok {
+			continue
+		}
+		x, y, ok := ext.bin(pos, a.gridX, a.gridY)
+		if !ok {
+			continue
+		}
+		idx := y*a.gridX + x
+		for threshold, value := range s.data {
+			td, ok := data[threshold]
+			if !ok {
+				td = &ThresholdData{
+					Values:     make([]uint32, a.totalPixels),
+					Timestamps: make([]float64, a.totalPixels),
+					Mask:       make([]bool, a.totalPixels),
+					ImageIDs:   make([]int, a.totalPixels),
+				}
+				data[threshold] = td
+				sums[threshold] = make([]float64, a.totalPixels)
+				counts[threshold] = make([]int, a.totalPixels)
+			}
+			sums[threshold][idx] += float64(value)
+			if v, ok := s.variance[threshold]; ok {
+				if variances[threshold] == nil {
+					variances[threshold] = make([]float64, a.totalPixels)
+				}
+				variances[threshold][idx] += v
+			}
+			counts[threshold][idx]++
+			if !td.Mask[idx] || s.startTime >= td.Timestamps[idx] {
+				td.Timestamps[idx] = s.startTime
+				td.ImageIDs[idx] = point
+			}
+			td.Mask[idx] = true
+		}
+	}
+	for threshold, td := range data {
+		td.Variance = variances[threshold]
+		for idx, n := range counts[threshold] {
+			if n > 0 {
+				td.Values[idx] = uint32(math.Round(sums[threshold][idx] / float64(n)))
+				if td.Variance != nil {
+					td.Variance[idx] /= float64(n)
+				}
+			}
+		}
+		if a.cfg.Gridding == GriddingNearest {
+			fillNearest(td, a.gridX, a.gridY)
+		}
+	}
+	a.data = data
+}
+
+// fillNearest copies the closest filled pixel into empty pixels. Filled-in
+// pixels keep Mask false so statistics and outputs only see measured data.
+func fillNearest(td *ThresholdData, gridX, gridY int) {
+	source := append([]bool(nil), td.Mask...)
+	for y := 0; y < gridY; y++ {
+		for x := 0; x < gridX; x++ {
+			idx := y*gridX + x
+			if source[idx] {
+				continue
+			}
+			best := -1
+			bestDist := math.MaxInt
+			for dy := -nearestFillRadius; dy <= nearestFillRadius; dy++ {
+				for dx := -nearestFillRadius; dx <= nearestFillRadius; dx++ {
+					nx, ny := x+dx, y+dy
+					if nx < 0 || ny < 0 || nx >= gridX || ny >= gridY {
+						continue
+					}
+					n := ny*gridX + nx
+					if d := dx*dx + dy*dy; source[n] && d < bestDist {
+						best = n
+						bestDist = d
+					}
+				}
+			}
+			if best >= 0 {
+				td.Values[idx] = td.Values[best]
+				if td.Variance != nil {
+					td.Variance[idx] = td.Variance[best]
+				}
+			}
+		}
+	}
+}
+
+// SetPosition records the measured position of an image of the current series.
+// With several frames per point the position applies to the whole point.
+// NaN and infinite positions are ignored.
+func (a *Aggregator) SetPosition(imageID int, pos types.Position) {
+	if !a.cfg.PositionMode || !finitePosition(pos) {
+		return
+	}
+	a.positions[imageID/a.cfg.PointFrames()] = pos
+	a.dirty = true
+}
+
+// Samples lists the measured points of a position based scan in point order.
+// Points whose position is still unknown are left out.
+func (a *Aggregator) Samples() []PositionSample {
+	out := make([]PositionSample, 0, len(a.samples))
+	for point, s := range a.samples {
+		pos, ok := a.positions[point]
+		if !ok {
+			continue
+		}
+		out = append(out, PositionSample{
+			ImageID:   point,
+			Position:  pos,
+			StartTime: s.startTime,
+			Data:      s.data,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].ImageID < out[j].ImageID
+	})
+	return out
+}
+
+// finitePosition reports whether p can be placed on a grid.
+func finitePosition(p types.Position) bool {
+	return !math.IsNaN(p.X) && !math.IsInf(p.X, 0) && !math.IsNaN(p.Y) && !math.IsInf(p.Y, 0)
+}
@@ -0,0 +1,59 @@
+package processing
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"stxm-map-go/internal/types"
+)
+
+func TestAggregatorBinsPositions(t *testing.T) {
+	agg := NewAggregator(2, 2)
+	agg.Configure(SeriesConfig{
+		GridX:        2,
+		GridY:        2,
+		Points:       3,
+		PositionMode: true,
+		Extent:       &Extent{XMin: 0, XMax: 10, YMin: 0, YMax: 10},
+	})
+	agg.AddFrame(types.Frame{ImageID: 0, Position: &types.Position{X: 1, Y: 1}, Data: map[string]uint32{"threshold_0": 10}})
+	agg.AddFrame(types.Frame{ImageID: 1, Data: map[string]uint32{"threshold_0": 20}})
+	agg.SetPosition(1, types.Position{X: 2, Y: 2})
+	done := agg.AddFrame(types.Frame{ImageID: 2, Position: &types.Position{X: 9, Y: 6}, Data: map[string]uint32{"threshold_0": 7}})
+	if !done {
+		t.Fatalf("expected series to complete after 3 points")
+	}
+
+	data := agg.Snapshot()["threshold_0"]
+	if want := []uint32{15, 0, 0, 7}; !reflect.DeepEqual(data.Values, want) {
+		t.Fatalf("unexpected values: got %v want %v", data.Values, want)
+	}
+	if want := []bool{true, false, false, true}; !reflect.DeepEqual(data.Mask, want) {
+		t.Fatalf("unexpected mask: got %v want %v", data.Mask, want)
+	}
+	if samples := agg.Samples(); len(samples) != 3 || samples[1].Position.X != 2 {
+		t.Fatalf("unexpected samples: %+v", samples)
+	}
+}
+
+func TestAggregatorIgnoresNonFinitePositions(t *testing.T) {
+	agg := NewAggregator(2, 2)
+	agg.Configure(SeriesConfig{GridX: 2, GridY: 2, Points: 4, PositionMode: true})
+	agg.AddFrame(types.Frame{ImageID: 0, Position: &types.Position{X: 0, Y: 0}, Data: map[string]uint32{"threshold_0": 1}})
+	agg.AddFrame(types.Frame{ImageID: 1, Position: &types.Position{X: math.NaN(), Y: 0}, Data: map[string]uint32{"threshold_0": 2}})
+	agg.AddFrame(types.Frame{ImageID: 2, Data: map[string]uint32{"threshold_0": 3}})
+	agg.SetPosition(2, types.Position{X: math.Inf(1), Y: 1})
+	agg.AddFrame(types.Frame{ImageID: 3, Position: &types.Position{X: 1, Y: 1}, Data: map[string]uint32{"threshold_0": 4}})
+
+	data := agg.Snapshot()["threshold_0"]
+	if want := []uint32{1, 0, 0, 4}; !reflect.DeepEqual(data.Values, want) {
+		t.Fatalf("unexpected values: got %v want %v", data.Values, want)
+	}
+	if samples := agg.Samples(); len(samples) != 2 {
+		t.Fatalf("samples with non-finite positions: %+v", samples)
+	}
+	if _, err := parsePositions(map[string]any{"positions_x": []any{0.0, math.NaN()}, "positions_y": []any{0.0, 1.0}}); err == nil {
+		t.Fatal("start message positions with NaN accepted")
+	}
+}
@@ -26,7 +26,9 @@ func ProcessRawFrame(raw types.RawFrame) (types.Frame, bool) {
 
 	return types.Frame{
 		ImageID:   raw.ImageID,
+		SeriesID:  raw.SeriesID,
 		StartTime: raw.StartTime,
+		Position:  raw.Position,
 		Data:      data,
 	}, true
 }
@@ -0,0 +1,238 @@
+package processing
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"stxm-map-go/internal/types"
+)
+
+// Reducers of a Reduction.
+const (
+	// ReduceCount counts the pixels below the maximum value of their data
+	// type, as the live pipeline does.
+	ReduceCount = "count"
+	// ReduceSum adds up the pixels below the maximum of their data type.
+	ReduceSum = "sum"
+	// ReduceMax is the largest pixel below the maximum of its data type.
+	ReduceMax = "max"
+)
+
+// ROI is a rectangle of detector pixels. A named ROI is a virtual detector:
+// it adds the channel {channel}_{name} for every detector channel. Without a
+// name it restricts the channel itself.
+type ROI struct {
+	Name   string
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
+// ParseROI parses "[name=]x,y,width,height" in detector pixels.
+func ParseROI(spec string) (ROI, error) {
+	var roi ROI
+	rect := spec
+	if name, rest, ok := strings.Cut(spec, "="); ok {
+		roi.Name, rect = strings.TrimSpace(name), rest
+		if roi.Name == "" {
+			return ROI{}, fmt.Errorf("roi %q: empty name", spec)
+		}
+	}
+	parts := strings.Split(rect, ",")
+	if len(parts) != 4 {
+		return ROI{}, fmt.Errorf("roi %q: want [name=]x,y,width,height", spec)
+	}
+	values := make([]int, 4)
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 0 {
+			return ROI{}, fmt.Errorf("roi %q: invalid value %q", spec, part)
+		}
+		values[i] = n
+	}
+	roi.X, roi.Y, roi.Width, roi.Height = values[0], values[1], values[2], values[3]
+	if roi.Width == 0 || roi.Height == 0 {
+		return ROI{}, fmt.Errorf("roi %q: empty rectangle", spec)
+	}
+	return roi, nil
+}
+
+// Reduction turns the detector images of a frame into one map value per
+// channel. The zero Reduction is the live pipeline: ReduceCount over the
+// whole detector.
+type Reduction struct {
+	Reducer string
+	ROIs    []ROI
+	// Mask excludes the detector pixels set in it. It is row-major with
+	// MaskWidth columns and must match the detector.
+	Mask      []bool
+	MaskWidth int
+}
+
+// Validate checks the reducer and the ROIs.
+func (r Reduction) Validate() error {
+	switch r.Reducer {
+	case "", ReduceCount, ReduceSum, ReduceMax:
+	default:
+		return fmt.Errorf("unknown reducer %q", r.Reducer)
+	}
+	names := map[string]bool{}
+	for _, roi := range r.ROIs {
+		if names[roi.Name] {
+			if roi.Name == "" {
+				return fmt.Errorf("more than one unnamed roi")
+			}
+			return fmt.Errorf("duplicate roi %q", roi.Name)
+		}
+		names[roi.Name] = true
+	}
+	if len(r.Mask) > 0 && (r.MaskWidth < 1 || len(r.Mask)%r.MaskWidth != 0) {
+		return fmt.Errorf("mask of %d pixels is not %d pixels wide", len(r.Mask), r.MaskWidth)
+	}
+	return nil
+}
+
+// isLive reports whether r is the reduction of the live pipeline.
+func (r Reduction) isLive() bool {
+	return (r.Reducer == "" || r.Reducer == ReduceCount) && len(r.ROIs) == 0 && len(r.Mask) == 0
+}
+
+// Check reports detector images of raw that r cannot be applied to: ROIs
+// outside the image and masks of another shape.
+func (r Reduction) Check(raw types.RawFrame) error {
+	if r.isLive() {
+		return nil
+	}
+	for channel, payload := range raw.Data {
+		width, height, _, ok := framePixels(payload)
+		if !ok {
+			continue
+		}
+		for _, roi := range r.ROIs {
+			if roi.X+roi.Width > width || roi.Y+roi.Height > height {
+				return fmt.Errorf("%s: roi %d,%d,%d,%d outside the %dx%d detector", channel, roi.X, roi.Y, roi.Width, roi.Height, width, height)
+			}
+		}
+		if len(r.Mask) > 0 && (r.MaskWidth != width || len(r.Mask) != width*height) {
+			return fmt.Errorf("%s: %dx%d mask for the %dx%d detector", channel, r.MaskWidth, len(r.Mask)/r.MaskWidth, width, height)
+		}
+	}
+	return nil
+}
+
+// Process reduces a frame like ProcessRawFrame, with the reducer, ROIs and
+// mask of r. Channels that r cannot be applied to are left out.
+func (r Reduction) Process(raw types.RawFrame) (types.Frame, bool) {
+	if r.isLive() {
+		return ProcessRawFrame(raw)
+	}
+	if raw.ImageID < 0 {
+		return types.Frame{}, false
+	}
+	rois := r.ROIs
+	data := make(map[string]uint32, len(raw.Data))
+	for channel, payload := range raw.Data {
+		width, height, pixel, ok := framePixels(payload)
+		if !ok {
+			continue
+		}
+		if len(r.Mask) > 0 && (r.MaskWidth != width || len(r.Mask) != width*height) {
+			continue
+		}
+		if len(rois) == 0 {
+			data[channel] = r.reduce(width, ROI{Width: width, Height: height}, pixel)
+			continue
+		}
+		for _, roi := range rois {
+			if roi.X+roi.Width > width || roi.Y+roi.Height > height {
+				continue
+			}
+			name := channel
+			if roi.Name != "" {
+				name = channel + "_" + roi.Name
+			}
+			data[name] = r.reduce(width, roi, pixel)
+		}
+	}
+	if len(data) == 0 {
+		return types.Frame{}, false
+	}
+	return types.Frame{
+		ImageID:   raw.ImageID,
+		SeriesID:  raw.SeriesID,
+		StartTime: raw.StartTime,
+		Position:  raw.Position,
+		Data:      data,
+	}, true
+}
+
+// reduce applies the reducer to the unmasked valid pixels of roi.
+func (r Reduction) reduce(width int, roi ROI, pixel func(int) (float64, bool)) uint32 {
+	var count, sum, peak float64
+	for y := roi.Y; y < roi.Y+roi.Height; y++ {
+		for x := roi.X; x < roi.X+roi.Width; x++ {
+			idx := y*width + x
+			if len(r.Mask) > 0 && r.Mask[idx] {
+				continue
+			}
+			v, ok := pixel(idx)
+			if !ok {
+				continue
+			}
+			count++
+			sum += v
+			peak = math.Max(peak, v)
+		}
+	}
+	switch r.Reducer {
+	case ReduceSum:
+		return clampUint32(sum)
+	case ReduceMax:
+		return clampUint32(peak)
+	}
+	return clampUint32(count)
+}
+
+// framePixels reads a detector image as width x height pixels in row-major
+// order. A pixel is invalid at the maximum value of its data type. Jagged
+// images are rejected by patternShape.
+func framePixels(payload any) (int, int, func(int) (float64, bool), bool) {
+	width, height, ok := patternShape(payload)
+	if !ok {
+		return 0, 0, nil, false
+	}
+	switch v := payload.(type) {
+	case [][]uint8:
+		return width, height, func(i int) (float64, bool) {
+			p := v[i/width][i%width]
+			return float64(p), p < math.MaxUint8
+		}, true
+	case [][]uint16:
+		return width, height, func(i int) (float64, bool) {
+			p := v[i/width][i%width]
+			return float64(p), p < math.MaxUint16
+		}, true
+	case [][]uint32:
+		return width, height, func(i int) (float64, bool) {
+			p := v[i/width][i%width]
+			return float64(p), p < math.MaxUint32
+		}, true
+	case [][]float32:
+		return width, height, func(i int) (float64, bool) {
+			p := v[i/width][i%width]
+			return float64(p), p < math.MaxFloat32
+		}, true
+	case []uint8:
+		return width, height, func(i int) (float64, bool) { return float64(v[i]), v[i] < math.MaxUint8 }, true
+	case []uint16:
+		return width, height, func(i int) (float64, bool) { return float64(v[i]), v[i] < math.MaxUint16 }, true
+	case []uint32:
+		return width, height, func(i int) (float64, bool) { return float64(v[i]), v[i] < math.MaxUint32 }, true
+	case []float32:
+		return width, height, func(i int) (float64, bool) { return float64(v[i]), v[i] < math.MaxFloat32 }, true
+	}
+	return 0, 0, nil, false
+}
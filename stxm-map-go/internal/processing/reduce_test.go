@@ -0,0 +1,83 @@
+package processing
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"stxm-map-go/internal/types"
+)
+
+func TestParseROI(t *testing.T) {
+	roi, err := ParseROI("hot=1, 2,3,4")
+	if err != nil || roi != (ROI{Name: "hot", X: 1, Y: 2, Width: 3, Height: 4}) {
+		t.Fatalf("roi %+v, %v", roi, err)
+	}
+	for _, spec := range []string{"1,2,3", "=1,2,3,4", "1,2,0,4", "a,1,1,1", "-1,0,1,1"} {
+		if _, err := ParseROI(spec); err == nil {
+			t.Fatalf("%q accepted", spec)
+		}
+	}
+}
+
+func TestReductionProcess(t *testing.T) {
+	raw := types.RawFrame{
+		ImageID:  3,
+		SeriesID: 2,
+		Data: map[string]any{
+			"threshold_0": [][]uint16{
+				{1, 2, math.MaxUint16},
+				{4, 5, 6},
+			},
+		},
+	}
+	live, _ := ProcessRawFrame(raw)
+	if frame, ok := (Reduction{}).Process(raw); !ok || !reflect.DeepEqual(frame, live) {
+		t.Fatalf("zero reduction %+v, live %+v", frame, live)
+	}
+
+	r := Reduction{
+		Reducer: ReduceSum,
+		ROIs:    []ROI{{X: 0, Y: 0, Width: 3, Height: 2}, {Name: "right", X: 1, Y: 0, Width: 2, Height: 2}},
+		// Masks pixel (1, 1).
+		Mask:      []bool{false, false, false, false, true, false},
+		MaskWidth: 3,
+	}
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Check(raw); err != nil {
+		t.Fatal(err)
+	}
+	frame, ok := r.Process(raw)
+	want := map[string]uint32{"threshold_0": 1 + 2 + 4 + 6, "threshold_0_right": 2 + 6}
+	if !ok || frame.ImageID != 3 || frame.SeriesID != 2 || !reflect.DeepEqual(frame.Data, want) {
+		t.Fatalf("sum %+v, want %v", frame, want)
+	}
+
+	r.Reducer = ReduceMax
+	if frame, _ := r.Process(raw); frame.Data["threshold_0"] != 6 || frame.Data["threshold_0_right"] != 6 {
+		t.Fatalf("max %v", frame.Data)
+	}
+	r.Reducer = ReduceCount
+	if frame, _ := r.Process(raw); frame.Data["threshold_0"] != 4 || frame.Data["threshold_0_right"] != 2 {
+		t.Fatalf("count %v", frame.Data)
+	}
+
+	outside := Reduction{ROIs: []ROI{{X: 2, Y: 0, Width: 2, Height: 1}}}
+	if err := outside.Check(raw); err == nil {
+		t.Fatal("roi outside the detector accepted")
+	}
+	if _, ok := outside.Process(raw); ok {
+		t.Fatal("frame without channels accepted")
+	}
+	for _, r := range []Reduction{
+		{Reducer: "median"},
+		{ROIs: []ROI{{Width: 1, Height: 1}, {Width: 2, Height: 2}}},
+		{Mask: []bool{true, false, true}, MaskWidth: 2},
+	} {
+		if err := r.Validate(); err == nil {
+			t.Fatalf("%+v accepted", r)
+		}
+	}
+}
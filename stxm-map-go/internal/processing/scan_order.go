@@ -0,0 +1,88 @@
+package processing
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	TraversalRaster      = "raster"
+	TraversalSnake       = "snake"
+	TraversalColumn      = "column"
+	TraversalColumnSnake = "column-snake"
+)
+
+// ScanOrder describes how consecutive image ids walk the scan grid.
+// Raster and snake scans fill rows first, column scans fill columns first;
+// snake variants reverse direction on every other line. FlipX and FlipY
+// mirror the result, e.g. for scans that start at the right or bottom edge.
+type ScanOrder struct {
+	Traversal string `json:"traversal"`
+	FlipX     bool   `json:"flip_x"`
+	FlipY     bool   `json:"flip_y"`
+}
+
+// ParseScanOrder parses a comma separated spec such as "snake" or
+// "column-snake,flip-x,flip-y". An empty spec is a plain raster scan.
+func ParseScanOrder(spec string) (ScanOrder, error) {
+	order := ScanOrder{Traversal: TraversalRaster}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		switch part {
+		case "":
+		case TraversalRaster, TraversalSnake, TraversalColumn, TraversalColumnSnake:
+			order.Traversal = part
+		case "boustrophedon":
+			order.Traversal = TraversalSnake
+		case "flip-x", "flipx":
+			order.FlipX = true
+		case "flip-y", "flipy":
+			order.FlipY = true
+		default:
+			return ScanOrder{}, fmt.Errorf("unknown scan order %q", part)
+		}
+	}
+	return order, nil
+}
+
+func (o ScanOrder) String() string {
+	parts := []string{o.Traversal}
+	if o.Traversal == "" {
+		parts[0] = TraversalRaster
+	}
+	if o.FlipX {
+		parts = append(parts, "flip-x")
+	}
+	if o.FlipY {
+		parts = append(parts, "flip-y")
+	}
+	return strings.Join(parts, ",")
+}
+
+// Position maps the index-th point of the scan to its grid coordinates.
+func (o ScanOrder) Position(index, gridX, gridY int) (int, int) {
+	var x, y int
+	switch o.Traversal {
+	case TraversalSnake:
+		x, y = index%gridX, index/gridX
+		if y%2 == 1 {
+			x = gridX - 1 - x
+		}
+	case TraversalColumn:
+		x, y = index/gridY, index%gridY
+	case TraversalColumnSnake:
+		x, y = index/gridY, index%gridY
+		if x%2 == 1 {
+			y = gridY - 1 - y
+		}
+	default:
+		x, y = index%gridX, index/gridX
+	}
+	if o.FlipX {
+		x = gridX - 1 - x
+	}
+	if o.FlipY {
+		y = gridY - 1 - y
+	}
+	return x, y
+}
@@ -0,0 +1,57 @@
+package processing
+
+import (
+	"reflect"
+	"testing"
+
+	"stxm-map-go/internal/types"
+)
+
+func TestScanOrderPosition(t *testing.T) {
+	cases := []struct {
+		spec string
+		want [][2]int
+	}{
+		{"raster", [][2]int{{0, 0}, {1, 0}, {2, 0}, {0, 1}, {1, 1}, {2, 1}}},
+		{"snake", [][2]int{{0, 0}, {1, 0}, {2, 0}, {2, 1}, {1, 1}, {0, 1}}},
+		{"column", [][2]int{{0, 0}, {0, 1}, {1, 0}, {1, 1}, {2, 0}, {2, 1}}},
+		{"column-snake", [][2]int{{0, 0}, {0, 1}, {1, 1}, {1, 0}, {2, 0}, {2, 1}}},
+		{"snake,flip-x", [][2]int{{2, 0}, {1, 0}, {0, 0}, {0, 1}, {1, 1}, {2, 1}}},
+		{"raster,flip-y", [][2]int{{0, 1}, {1, 1}, {2, 1}, {0, 0}, {1, 0}, {2, 0}}},
+	}
+	for _, tc := range cases {
+		order, err := ParseScanOrder(tc.spec)
+		if err != nil {
+			t.Fatalf("ParseScanOrder(%q): %v", tc.spec, err)
+		}
+		got := make([][2]int, 0, len(tc.want))
+		for i := range tc.want {
+			x, y := order.Position(i, 3, 2)
+			got = append(got, [2]int{x, y})
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: got %v want %v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestParseScanOrderRejectsUnknown(t *testing.T) {
+	if _, err := ParseScanOrder("spiral"); err == nil {
+		t.Fatalf("expected error for unknown scan order")
+	}
+}
+
+func TestAggregatorPlacesSnakeScan(t *testing.T) {
+	agg := NewAggregator(2, 2)
+	agg.Configure(SeriesConfig{GridX: 2, GridY: 2, Order: ScanOrder{Traversal: TraversalSnake}})
+	for id, value := range []uint32{10, 11, 12, 13} {
+		agg.AddFrame(types.Frame{ImageID: id, Data: map[string]uint32{"threshold_0": value}})
+	}
+	data := agg.Snapshot()["threshold_0"]
+	if want := []uint32{10, 11, 13, 12}; !reflect.DeepEqual(data.Values, want) {
+		t.Fatalf("unexpected values: got %v want %v", data.Values, want)
+	}
+	if want := []int{0, 1, 3, 2}; !reflect.DeepEqual(data.ImageIDs, want) {
+		t.Fatalf("unexpected image ids: got %v want %v", data.ImageIDs, want)
+	}
+}
@@ -0,0 +1,421 @@
+package processing
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"stxm-map-go/internal/types"
+)
+
+// SeriesConfig describes how the images of one series are placed on the map.
+type SeriesConfig struct {
+	GridX int
+	GridY int
+	Order ScanOrder
+	// Points is the number of scan points in the series; zero means GridX*GridY.
+	Points int
+	// PositionMode places points by measured position instead of image id.
+	// Positions, Extent and Gridding only apply in this mode.
+	PositionMode bool
+	Positions    map[int]types.Position
+	Extent       *Extent
+	Gridding     string
+	// StageUnit is the unit of the positions and the extent ("nm", "um" or
+	// "mm"); empty if unknown.
+	StageUnit string
+	// PixelSize is the scan step in micrometres; zero if unknown.
+	PixelSize float64
+	// Energy is the photon energy of the series for energy stacks; zero
+	// when unknown. StackID and StackSize group series into one stack.
+	Energy    float64
+	StackID   string
+	StackSize int
+	// FramesPerPoint detector frames make up one scan point; zero derives it
+	// from the start message. The sub-frames are combined by Combine (sum,
+	// mean or max), Variance adds their variance as an extra channel.
+	FramesPerPoint int
+	Combine        string
+	Variance       bool
+}
+
+// stageUnitsPerMicrometre converts the stage units to micrometres.
+var stageUnitsPerMicrometre = map[string]float64{"nm": 1000, "um": 1, "mm": 0.001}
+
+// StepSize is the size of a grid pixel in micrometres: the extent of a
+// position based scan divided by the grid when the stage unit is known, else
+// PixelSize.
+func (c SeriesConfig) StepSize() float64 {
+	perUM, known := stageUnitsPerMicrometre[c.StageUnit]
+	if c.PositionMode && c.Extent != nil && c.GridX > 0 && known {
+		return (c.Extent.XMax - c.Extent.XMin) / float64(c.GridX) / perUM
+	}
+	return c.PixelSize
+}
+
+// ExpectedPoints is the number of scan points that completes the series.
+func (c SeriesConfig) ExpectedPoints() int {
+	if c.Points > 0 {
+		return c.Points
+	}
+	return c.GridX * c.GridY
+}
+
+// SeriesConfigFromMeta derives the layout of a series from its start message:
+// the scan settings in user_data and the image counts announced by the
+// detector, applied on top of defaults. meta must already be normalized to
+// JSON types. Invalid entries and conflicts between the announced image count
+// and the grid are returned as warnings; the affected setting keeps its default.
+func SeriesConfigFromMeta(meta map[string]any, defaults SeriesConfig) (SeriesConfig, []string) {
+	cfg := defaults
+	var warnings []string
+	userData := UserData(meta)
+	if userData != nil {
+		if err := applyScanOrder(&cfg, userData); err != nil {
+			warnings = append(warnings, err.Error())
+		}
+		if err := applyPositionSettings(&cfg, userData); err != nil {
+			warnings = append(warnings, err.Error())
+		}
+		if err := applyStackSettings(&cfg, userData); err != nil {
+			warnings = append(warnings, err.Error())
+		}
+	}
+	if err := applySubframes(&cfg, meta, userData); err != nil {
+		warnings = append(warnings, err.Error())
+	}
+	return cfg, append(warnings, applyGrid(&cfg, meta, userData)...)
+}
+
+func applyScanOrder(cfg *SeriesConfig, userData map[string]any) error {
+	if raw, ok := userData["scan_order"]; ok {
+		spec, ok := raw.(string)
+		if !ok {
+			return fmt.Errorf("user_data scan_order must be a string, got %T", raw)
+		}
+		order, err := ParseScanOrder(spec)
+		if err != nil {
+			return err
+		}
+		cfg.Order = order
+	}
+	if flip, ok := userData["flip_x"].(bool); ok {
+		cfg.Order.FlipX = flip
+	}
+	if flip, ok := userData["flip_y"].(bool); ok {
+		cfg.Order.FlipY = flip
+	}
+	return nil
+}
+
+// applyGrid takes the grid from user_data grid_x/grid_y when present and
+// checks it against the number of images the detector was armed for. Without
+// an explicit grid, a count that fills whole rows of the configured width
+// adjusts the number of rows; any other mismatch keeps the configured grid.
+func applyGrid(cfg *SeriesConfig, meta, userData map[string]any) []string {
+	var warnings []string
+	explicit := false
+	if userData != nil {
+		gridX, okX := toPositiveInt(userData["grid_x"])
+		gridY, okY := toPositiveInt(userData["grid_y"])
+		switch {
+		case okX && okY:
+			cfg.GridX = gridX
+			cfg.GridY = gridY
+			explicit = true
+		case userData["grid_x"] != nil || userData["grid_y"] != nil:
+			warnings = append(warnings, "user_data grid_x and grid_y must both be positive integers; using configured grid")
+		}
+	}
+
+	images := AnnouncedImages(meta)
+	fpp := cfg.PointFrames()
+	points := images / fpp
+	label := fmt.Sprintf("number_of_images %d", images)
+	if fpp > 1 {
+		label = fmt.Sprintf("%d scan points (%d images, %d per point)", points, images, fpp)
+		if images%fpp != 0 {
+			warnings = append(warnings, fmt.Sprintf(
+				"number_of_images %d is not a multiple of %d frames per point", images, fpp))
+		}
+	}
+	if points <= 0 || cfg.PositionMode {
+		if points > 0 && cfg.Points == 0 {
+			cfg.Points = points
+		}
+		return warnings
+	}
+	total := cfg.GridX * cfg.GridY
+	if points == total {
+		return warnings
+	}
+	if !explicit && points%cfg.GridX == 0 {
+		warnings = append(warnings, fmt.Sprintf(
+			"%s does not match configured grid %dx%d; using %dx%d",
+			label, cfg.GridX, cfg.GridY, cfg.GridX, points/cfg.GridX))
+		cfg.GridY = points / cfg.GridX
+		return warnings
+	}
+	source := "configured"
+	if explicit {
+		source = "user_data"
+	}
+	if points < total {
+		cfg.Points = points
+		warnings = append(warnings, fmt.Sprintf(
+			"%s is smaller than %s grid %dx%d; series completes after %d points",
+			label, source, cfg.GridX, cfg.GridY, points))
+	} else {
+		warnings = append(warnings, fmt.Sprintf(
+			"%s exceeds %s grid %dx%d; points beyond %d are dropped",
+			label, source, cfg.GridX, cfg.GridY, total))
+	}
+	return warnings
+}
+
+// AnnouncedImages returns the number of images a start message announces:
+// the images per trigger, number_of_images or else nimages, times ntrigger
+// when present.
+func AnnouncedImages(meta map[string]any) int {
+	images, ok := toPositiveInt(meta["number_of_images"])
+	if !ok {
+		images, ok = toPositiveInt(meta["nimages"])
+	}
+	if !ok {
+		return 0
+	}
+	if ntrigger, ok := toPositiveInt(meta["ntrigger"]); ok {
+		images *= ntrigger
+	}
+	return images
+}
+
+func applyPositionSettings(cfg *SeriesConfig, userData map[string]any) error {
+	if source, ok := userData["position_source"].(string); ok {
+		switch source {
+		case "image", "stream", "start":
+			cfg.PositionMode = true
+		case "grid":
+			cfg.PositionMode = false
+		default:
+			return fmt.Errorf("unknown position_source %q", source)
+		}
+	}
+	positions, err := parsePositions(userData)
+	if err != nil {
+		return err
+	}
+	if positions != nil {
+		cfg.PositionMode = true
+		cfg.Positions = positions
+		cfg.Points = len(positions)
+	}
+	if raw, ok := userData["extent"]; ok {
+		values, ok := toFloatSlice(raw)
+		if !ok || len(values) != 4 || values[1] <= values[0] || values[3] <= values[2] {
+			return fmt.Errorf("user_data extent must be [x_min, x_max, y_min, y_max]")
+		}
+		cfg.Extent = &Extent{XMin: values[0], XMax: values[1], YMin: values[2], YMax: values[3]}
+	}
+	if unit, ok := userData["position_unit"].(string); ok {
+		if unit == "µm" {
+			unit = "um"
+		}
+		if _, known := stageUnitsPerMicrometre[unit]; !known {
+			return fmt.Errorf("unknown position_unit %q", unit)
+		}
+		cfg.StageUnit = unit
+	}
+	if raw, ok := userData["pixel_size"]; ok {
+		size, ok := toFloat(raw)
+		if !ok || size <= 0 {
+			return fmt.Errorf("user_data pixel_size must be a positive number")
+		}
+		cfg.PixelSize = size
+	}
+	if gridding, ok := userData["gridding"].(string); ok {
+		switch gridding {
+		case GriddingBin, GriddingNearest:
+			cfg.Gridding = gridding
+		default:
+			return fmt.Errorf("unknown gridding %q", gridding)
+		}
+	}
+	return nil
+}
+
+func applyStackSettings(cfg *SeriesConfig, userData map[string]any) error {
+	if raw, ok := userData["energy"]; ok {
+		energy, ok := toFloat(raw)
+		if !ok || energy <= 0 {
+			return fmt.Errorf("user_data energy must be a positive number")
+		}
+		cfg.Energy = energy
+	}
+	switch id := userData["stack_id"].(type) {
+	case nil:
+	case string:
+		cfg.StackID = id
+	default:
+		if f, ok := toFloat(id); ok {
+			cfg.StackID = fmt.Sprint(f)
+		} else {
+			return fmt.Errorf("user_data stack_id must be a string or number")
+		}
+	}
+	if raw, ok := userData["stack_size"]; ok {
+		size, ok := toPositiveInt(raw)
+		if !ok {
+			return fmt.Errorf("user_data stack_size must be a positive integer")
+		}
+		cfg.StackSize = size
+	}
+	return nil
+}
+
+// applySubframes sets the number of frames per scan point: user_data
+// frames_per_point, else the configured value, else nimages when the detector
+// takes several images per trigger (ntrigger > 1).
+func applySubframes(cfg *SeriesConfig, meta, userData map[string]any) error {
+	var err error
+	if userData != nil {
+		if raw, ok := userData["frames_per_point"]; ok {
+			if n, ok := toPositiveInt(raw); ok {
+				cfg.FramesPerPoint = n
+			} else {
+				err = fmt.Errorf("user_data frames_per_point must be a positive integer")
+			}
+		}
+		if combine, ok := userData["subframe_combine"].(string); ok {
+			switch combine {
+			case CombineSum, CombineMean, CombineMax:
+				cfg.Combine = combine
+			default:
+				err = fmt.Errorf("unknown subframe_combine %q", combine)
+			}
+		}
+		if variance, ok := userData["subframe_variance"].(bool); ok {
+			cfg.Variance = variance
+		}
+	}
+	if cfg.FramesPerPoint == 0 {
+		nimages, _ := toPositiveInt(meta["nimages"])
+		ntrigger, _ := toPositiveInt(meta["ntrigger"])
+		if nimages > 1 && ntrigger > 1 {
+			cfg.FramesPerPoint = nimages
+		}
+	}
+	return err
+}
+
+// IncidentEnergy returns the photon energy the detector reports in its start
+// message, or zero.
+func IncidentEnergy(meta map[string]any) float64 {
+	for _, key := range []string{"incident_energy", "photon_energy"} {
+		if energy, ok := toFloat(meta[key]); ok && energy > 0 {
+			return energy
+		}
+	}
+	return 0
+}
+
+// parsePositions reads either "positions" as a list of [x, y] pairs or the
+// parallel lists "positions_x" and "positions_y", indexed by scan point: image
+// id divided by FramesPerPoint.
+func parsePositions(userData map[string]any) (map[int]types.Position, error) {
+	if raw, ok := userData["positions"]; ok {
+		list, ok := raw.([]any)
+		if !ok {
+			return nil, fmt.Errorf("user_data positions must be a list of [x, y] pairs")
+		}
+		positions := make(map[int]types.Position, len(list))
+		for i, item := range list {
+			pair, ok := toFloatSlice(item)
+			if !ok || len(pair) != 2 {
+				return nil, fmt.Errorf("user_data positions[%d] must be an [x, y] pair", i)
+			}
+			positions[i] = types.Position{X: pair[0], Y: pair[1]}
+			if !finitePosition(positions[i]) {
+				return nil, fmt.Errorf("user_data positions[%d] is not finite", i)
+			}
+		}
+		return positions, nil
+	}
+	rawX, okX := userData["positions_x"]
+	rawY, okY := userData["positions_y"]
+	if !okX && !okY {
+		return nil, nil
+	}
+	xs, okX := toFloatSlice(rawX)
+	ys, okY := toFloatSlice(rawY)
+	if !okX || !okY || len(xs) != len(ys) {
+		return nil, fmt.Errorf("user_data positions_x and positions_y must be numeric lists of equal length")
+	}
+	positions := make(map[int]types.Position, len(xs))
+	for i := range xs {
+		positions[i] = types.Position{X: xs[i], Y: ys[i]}
+		if !finitePosition(positions[i]) {
+			return nil, fmt.Errorf("user_data positions_x/positions_y[%d] is not finite", i)
+		}
+	}
+	return positions, nil
+}
+
+// UserData returns the user_data object of a start message. Detector control
+// software often passes it as a JSON encoded string, which is decoded here.
+func UserData(meta map[string]any) map[string]any {
+	switch v := meta["user_data"].(type) {
+	case map[string]any:
+		return v
+	case string:
+		var decoded map[string]any
+		if err := json.Unmarshal([]byte(v), &decoded); err != nil {
+			return nil
+		}
+		return decoded
+	default:
+		return nil
+	}
+}
+
+func toFloatSlice(v any) ([]float64, bool) {
+	list, ok := v.([]any)
+	if !ok {
+		return nil, false
+	}
+	out := make([]float64, len(list))
+	for i, item := range list {
+		f, ok := toFloat(item)
+		if !ok {
+			return nil, false
+		}
+		out[i] = f
+	}
+	return out, true
+}
+
+func toPositiveInt(v any) (int, bool) {
+	f, ok := toFloat(v)
+	if !ok || f < 1 || f != float64(int(f)) {
+		return 0, false
+	}
+	return int(f), true
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
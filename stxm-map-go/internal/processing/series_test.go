@@ -0,0 +1,117 @@
+package processing
+
+import (
+	"math"
+	"testing"
+
+	"stxm-map-go/internal/types"
+)
+
+func TestSeriesConfigFromMetaGrid(t *testing.T) {
+	defaults := SeriesConfig{GridX: 10, GridY: 10}
+	cases := []struct {
+		name     string
+		meta     map[string]any
+		gridX    int
+		gridY    int
+		points   int
+		warnings int
+	}{
+		{
+			name:  "matching count",
+			meta:  map[string]any{"number_of_images": float64(100)},
+			gridX: 10, gridY: 10,
+		},
+		{
+			name:  "user_data grid",
+			meta:  map[string]any{"number_of_images": float64(12), "user_data": map[string]any{"grid_x": float64(4), "grid_y": float64(3)}},
+			gridX: 4, gridY: 3,
+		},
+		{
+			name:  "user_data as json string",
+			meta:  map[string]any{"nimages": float64(1), "ntrigger": float64(6), "user_data": `{"grid_x": 3, "grid_y": 2}`},
+			gridX: 3, gridY: 2,
+		},
+		{
+			name:  "images per trigger",
+			meta:  map[string]any{"number_of_images": float64(10), "ntrigger": float64(5)},
+			gridX: 10, gridY: 5, warnings: 1,
+		},
+		{
+			name:  "rows derived from count",
+			meta:  map[string]any{"number_of_images": float64(50)},
+			gridX: 10, gridY: 5, warnings: 1,
+		},
+		{
+			name:  "short series",
+			meta:  map[string]any{"number_of_images": float64(95)},
+			gridX: 10, gridY: 10, points: 95, warnings: 1,
+		},
+		{
+			name:  "conflicting user_data grid",
+			meta:  map[string]any{"number_of_images": float64(30), "user_data": map[string]any{"grid_x": float64(5), "grid_y": float64(5)}},
+			gridX: 5, gridY: 5, warnings: 1,
+		},
+	}
+	for _, tc := range cases {
+		cfg, warnings := SeriesConfigFromMeta(tc.meta, defaults)
+		if cfg.GridX != tc.gridX || cfg.GridY != tc.gridY || cfg.Points != tc.points {
+			t.Fatalf("%s: got grid %dx%d points %d, want %dx%d points %d",
+				tc.name, cfg.GridX, cfg.GridY, cfg.Points, tc.gridX, tc.gridY, tc.points)
+		}
+		if len(warnings) != tc.warnings {
+			t.Fatalf("%s: got warnings %q, want %d", tc.name, warnings, tc.warnings)
+		}
+	}
+}
+
+func TestAggregatorPartialSeriesMask(t *testing.T) {
+	agg := NewAggregator(3, 2)
+	for _, id := range []int{0, 1, 3} {
+		agg.AddFrame(types.Frame{ImageID: id, Data: map[string]uint32{"threshold_0": 1}})
+	}
+	if agg.FrameCount() != 3 {
+		t.Fatalf("got %d frames, want 3", agg.FrameCount())
+	}
+	want := []bool{true, true, false, true, false, false}
+	mask := agg.Mask()
+	for i := range want {
+		if mask[i] != want[i] {
+			t.Fatalf("got mask %v, want %v", mask, want)
+		}
+	}
+	agg.Reset()
+	if agg.FrameCount() != 0 || len(agg.Snapshot()) != 0 {
+		t.Fatal("reset left data behind")
+	}
+}
+
+func TestSeriesConfigStepSize(t *testing.T) {
+	extent := map[string]any{"extent": []any{float64(0), float64(200), float64(0), float64(100)}}
+	cases := []struct {
+		name string
+		unit string
+		want float64
+	}{
+		{"unknown unit keeps pixel_size", "", 0.5},
+		{"micrometres", "um", 20},
+		{"nanometres", "nm", 0.02},
+		{"millimetres", "mm", 20000},
+	}
+	for _, tc := range cases {
+		userData := map[string]any{"position_source": "stream", "pixel_size": 0.5}
+		for key, value := range extent {
+			userData[key] = value
+		}
+		if tc.unit != "" {
+			userData["position_unit"] = tc.unit
+		}
+		cfg, warnings := SeriesConfigFromMeta(map[string]any{"user_data": userData}, SeriesConfig{GridX: 10, GridY: 5})
+		if len(warnings) != 0 {
+			t.Fatalf("%s: unexpected warnings %q", tc.name, warnings)
+		}
+		if got := cfg.StepSize(); math.Abs(got-tc.want) > 1e-9 {
+			t.Fatalf("%s: got step %g, want %g", tc.name, got, tc.want)
+		}
+	}
+}
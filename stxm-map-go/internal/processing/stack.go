@@ -0,0 +1,175 @@
+package processing
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"stxm-map-go/internal/types"
+)
+
+// StackLayer is one energy of a stack: the maps of a single series.
+type StackLayer struct {
+	Energy   float64
+	SeriesID int
+	Complete bool
+	Channels map[string]types.ThresholdSnapshot
+}
+
+// StackInfo describes a stack without its data.
+type StackInfo struct {
+	ID           string    `json:"id"`
+	RunTimestamp string    `json:"run_timestamp"`
+	GridX        int       `json:"grid_x"`
+	GridY        int       `json:"grid_y"`
+	Size         int       `json:"size"`
+	Energies     []float64 `json:"energies"`
+	SeriesIDs    []int     `json:"series_ids"`
+	Channels     []string  `json:"channels"`
+}
+
+// Spectrum is the value of one grid pixel across the energies of a stack.
+// Valid is false where the pixel was not measured at that energy.
+type Spectrum struct {
+	Channel  string    `json:"channel"`
+	X        int       `json:"x"`
+	Y        int       `json:"y"`
+	Energies []float64 `json:"energies"`
+	Values   []uint32  `json:"values"`
+	Valid    []bool    `json:"valid"`
+}
+
+// Stack groups consecutive series of the same grid, one per photon energy,
+// into an energy x y x x cube per channel. Layers are kept sorted by energy;
+// a series at an energy already in the stack replaces the earlier layer.
+type Stack struct {
+	mu     sync.Mutex
+	info   StackInfo
+	layers []StackLayer
+}
+
+func NewStack() *Stack {
+	return &Stack{}
+}
+
+// Fits reports whether a series with this stack id and grid continues the
+// current stack. An empty stack accepts any series.
+func (s *Stack) Fits(id string, gridX, gridY int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.layers) == 0 {
+		return true
+	}
+	return s.info.ID == id && s.info.GridX == gridX && s.info.GridY == gridY
+}
+
+// Add appends a layer, starting a new stack if the current one is empty.
+// size is the number of energies announced for the stack, zero if unknown.
+// It returns true once the stack holds size layers.
+func (s *Stack) Add(id, runTimestamp string, gridX, gridY, size int, layer StackLayer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.layers) == 0 {
+		s.info = StackInfo{
+			ID:           id,
+			RunTimestamp: runTimestamp,
+			GridX:        gridX,
+			GridY:        gridY,
+		}
+	}
+	if size > 0 {
+		s.info.Size = size
+	}
+	pos := sort.Search(len(s.layers), func(i int) bool {
+		return s.layers[i].Energy >= layer.Energy
+	})
+	if pos < len(s.layers) && s.layers[pos].Energy == layer.Energy {
+		s.layers[pos] = layer
+	} else {
+		s.layers = append(s.layers, StackLayer{})
+		copy(s.layers[pos+1:], s.layers[pos:])
+		s.layers[pos] = layer
+	}
+	return s.info.Size > 0 && len(s.layers) >= s.info.Size
+}
+
+// Len is the number of energies in the stack.
+func (s *Stack) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.layers)
+}
+
+// Info describes the current stack.
+func (s *Stack) Info() StackInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.infoLocked()
+}
+
+// Take returns the stack and its layers in energy order and clears it.
+func (s *Stack) Take() (StackInfo, []StackLayer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := s.infoLocked()
+	layers := s.layers
+	s.layers = nil
+	s.info = StackInfo{}
+	return info, layers
+}
+
+func (s *Stack) infoLocked() StackInfo {
+	info := s.info
+	info.Energies = make([]float64, len(s.layers))
+	info.SeriesIDs = make([]int, len(s.layers))
+	channels := map[string]bool{}
+	for i, layer := range s.layers {
+		info.Energies[i] = layer.Energy
+		info.SeriesIDs[i] = layer.SeriesID
+		for channel := range layer.Channels {
+			channels[channel] = true
+		}
+	}
+	info.Channels = make([]string, 0, len(channels))
+	for channel := range channels {
+		info.Channels = append(info.Channels, channel)
+	}
+	sort.Strings(info.Channels)
+	return info
+}
+
+// Spectrum returns the values of pixel (x, y) of channel at every energy.
+func (s *Stack) Spectrum(channel string, x, y int) (Spectrum, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.layers) == 0 {
+		return Spectrum{}, fmt.Errorf("stack is empty")
+	}
+	if x < 0 || y < 0 || x >= s.info.GridX || y >= s.info.GridY {
+		return Spectrum{}, fmt.Errorf("pixel %d,%d outside grid %dx%d", x, y, s.info.GridX, s.info.GridY)
+	}
+	idx := y*s.info.GridX + x
+	spectrum := Spectrum{
+		Channel:  channel,
+		X:        x,
+		Y:        y,
+		Energies: make([]float64, len(s.layers)),
+		Values:   make([]uint32, len(s.layers)),
+		Valid:    make([]bool, len(s.layers)),
+	}
+	found := false
+	for i, layer := range s.layers {
+		spectrum.Energies[i] = layer.Energy
+		snap, ok := layer.Channels[channel]
+		if !ok || idx >= len(snap.Values) {
+			continue
+		}
+		found = true
+		spectrum.Values[i] = snap.Values[idx]
+		spectrum.Valid[i] = snap.Mask[idx]
+	}
+	if !found {
+		return Spectrum{}, fmt.Errorf("unknown channel %q", channel)
+	}
+	return spectrum, nil
+}
@@ -0,0 +1,56 @@
+package processing
+
+import (
+	"testing"
+
+	"stxm-map-go/internal/types"
+)
+
+func stackLayer(energy float64, seriesID int, value uint32) StackLayer {
+	return StackLayer{
+		Energy:   energy,
+		SeriesID: seriesID,
+		Complete: true,
+		Channels: map[string]types.ThresholdSnapshot{
+			"threshold_0": {
+				Values: []uint32{value, value, value, 0},
+				Mask:   []bool{true, true, true, false},
+			},
+		},
+	}
+}
+
+func TestStackSpectrum(t *testing.T) {
+	stack := NewStack()
+	stack.Add("", "ts", 2, 2, 0, stackLayer(710, 1, 7))
+	stack.Add("", "ts", 2, 2, 0, stackLayer(700, 2, 5))
+	if stack.Add("", "ts", 2, 2, 3, stackLayer(705, 3, 6)) != true {
+		t.Fatal("stack of size 3 not complete after 3 layers")
+	}
+
+	spectrum, err := stack.Spectrum("threshold_0", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantEnergies := []float64{700, 705, 710}
+	wantValues := []uint32{5, 6, 7}
+	for i := range wantEnergies {
+		if spectrum.Energies[i] != wantEnergies[i] || spectrum.Values[i] != wantValues[i] || !spectrum.Valid[i] {
+			t.Fatalf("got %+v", spectrum)
+		}
+	}
+	if spectrum, _ := stack.Spectrum("threshold_0", 1, 1); spectrum.Valid[0] {
+		t.Fatal("unmeasured pixel reported valid")
+	}
+	if _, err := stack.Spectrum("threshold_9", 0, 0); err == nil {
+		t.Fatal("expected error for unknown channel")
+	}
+	if stack.Fits("", 3, 2) || stack.Fits("other", 2, 2) || !stack.Fits("", 2, 2) {
+		t.Fatal("unexpected Fits result")
+	}
+
+	info, layers := stack.Take()
+	if len(layers) != 3 || info.SeriesIDs[0] != 2 || stack.Len() != 0 {
+		t.Fatalf("unexpected take: %+v", info)
+	}
+}
@@ -0,0 +1,61 @@
+package processing
+
+// ImageStats describes one detector image. Min, Max and Sum are over the
+// pixels below the maximum value of the data type; Masked counts the pixels
+// at that maximum, which the reducers leave out.
+type ImageStats struct {
+	Dtype  string
+	Width  int
+	Height int
+	Min    float64
+	Max    float64
+	Sum    float64
+	Masked int
+	// Saturated counts the unmasked pixels at or above the saturation
+	// value given to Stats.
+	Saturated int
+}
+
+// Stats describes a detector image as decoded by ingest. saturation is the
+// detector's count cutoff; zero counts no saturated pixels.
+func Stats(payload any, saturation float64) (ImageStats, bool) {
+	width, height, pixel, ok := framePixels(payload)
+	if !ok {
+		return ImageStats{}, false
+	}
+	stats := ImageStats{Dtype: pixelType(payload), Width: width, Height: height}
+	valid := 0
+	for idx := 0; idx < width*height; idx++ {
+		v, ok := pixel(idx)
+		if !ok {
+			stats.Masked++
+			continue
+		}
+		if valid == 0 || v < stats.Min {
+			stats.Min = v
+		}
+		if valid == 0 || v > stats.Max {
+			stats.Max = v
+		}
+		stats.Sum += v
+		if saturation > 0 && v >= saturation {
+			stats.Saturated++
+		}
+		valid++
+	}
+	return stats, true
+}
+
+func pixelType(payload any) string {
+	switch payload.(type) {
+	case []uint8, [][]uint8:
+		return "uint8"
+	case []uint16, [][]uint16:
+		return "uint16"
+	case []uint32, [][]uint32:
+		return "uint32"
+	case []float32, [][]float32:
+		return "float32"
+	}
+	return ""
+}
@@ -0,0 +1,24 @@
+package processing
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	image := [][]uint16{
+		{3, 9, math.MaxUint16},
+		{1, 12, 4},
+	}
+	stats, ok := Stats(image, 9)
+	want := ImageStats{Dtype: "uint16", Width: 3, Height: 2, Min: 1, Max: 12, Sum: 29, Masked: 1, Saturated: 2}
+	if !ok || stats != want {
+		t.Fatalf("stats %+v, want %+v", stats, want)
+	}
+	if stats, _ := Stats(image, 0); stats.Saturated != 0 {
+		t.Fatalf("saturated %d without a cutoff", stats.Saturated)
+	}
+	if _, ok := Stats("not an image", 0); ok {
+		t.Fatal("described a string")
+	}
+}
@@ -0,0 +1,107 @@
+package processing
+
+import (
+	"math"
+
+	"stxm-map-go/internal/types"
+)
+
+const (
+	CombineSum  = "sum"
+	CombineMean = "mean"
+	CombineMax  = "max"
+
+	// VarianceSuffix names the exported float map holding the variance of
+	// the sub-frames of each point, e.g. "threshold_0_variance".
+	VarianceSuffix = "_variance"
+)
+
+// pointAccum collects the sub-frames of one scan point.
+type pointAccum struct {
+	n         int
+	startTime float64
+	sum       map[string]float64
+	sumSq     map[string]float64
+	max       map[string]uint32
+	// seen holds the sub-frame indices that arrived, so that a repeated
+	// image_id is counted once.
+	seen map[int]bool
+}
+
+// PointFrames is the number of detector frames that make up one point.
+func (c SeriesConfig) PointFrames() int {
+	if c.FramesPerPoint > 1 {
+		return c.FramesPerPoint
+	}
+	return 1
+}
+
+// combine adds a frame to the scan point it belongs to and returns the point
+// index, its start time, the combined values so far, their variance when
+// enabled and whether all sub-frames of the point have arrived. A sub-frame
+// that already arrived is ignored and returns nil values.
+func (a *Aggregator) combine(frame types.Frame) (int, float64, map[string]uint32, map[string]float64, bool) {
+	fpp := a.cfg.PointFrames()
+	if fpp == 1 {
+		return frame.ImageID, frame.StartTime, frame.Data, nil, true
+	}
+	point := frame.ImageID / fpp
+	acc, ok := a.partial[point]
+	if !ok {
+		acc = &pointAccum{
+			startTime: frame.StartTime,
+			sum:       make(map[string]float64, len(frame.Data)),
+			sumSq:     make(map[string]float64, len(frame.Data)),
+			max:       make(map[string]uint32, len(frame.Data)),
+			seen:      make(map[int]bool, fpp),
+		}
+		a.partial[point] = acc
+	}
+	sub := frame.ImageID % fpp
+	if acc.seen[sub] {
+		return point, acc.startTime, nil, nil, false
+	}
+	acc.seen[sub] = true
+	acc.n++
+	for threshold, value := range frame.Data {
+		v := float64(value)
+		acc.sum[threshold] += v
+		acc.sumSq[threshold] += v * v
+		if value > acc.max[threshold] {
+			acc.max[threshold] = value
+		}
+	}
+
+	n := float64(acc.n)
+	data := make(map[string]uint32, len(acc.sum))
+	var variance map[string]float64
+	if a.cfg.Variance {
+		variance = make(map[string]float64, len(acc.sum))
+	}
+	for threshold, sum := range acc.sum {
+		switch a.cfg.Combine {
+		case CombineMean:
+			data[threshold] = uint32(math.Round(sum / n))
+		case CombineMax:
+			data[threshold] = acc.max[threshold]
+		default:
+			data[threshold] = clampUint32(sum)
+		}
+		if variance != nil {
+			mean := sum / n
+			variance[threshold] = math.Max(0, acc.sumSq[threshold]/n-mean*mean)
+		}
+	}
+	done := acc.n >= fpp
+	if done {
+		delete(a.partial, point)
+	}
+	return point, acc.startTime, data, variance, done
+}
+
+func clampUint32(v float64) uint32 {
+	if v >= math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(v)
+}
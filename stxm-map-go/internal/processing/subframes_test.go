@@ -0,0 +1,75 @@
+package processing
+
+import (
+	"math"
+	"testing"
+
+	"stxm-map-go/internal/types"
+)
+
+func TestAggregatorCombinesSubframes(t *testing.T) {
+	cases := []struct {
+		combine string
+		want    uint32
+	}{
+		{CombineSum, 12},
+		{CombineMean, 4},
+		{CombineMax, 6},
+	}
+	for _, tc := range cases {
+		agg := NewAggregator(2, 1)
+		agg.Configure(SeriesConfig{GridX: 2, GridY: 1, FramesPerPoint: 3, Combine: tc.combine, Variance: true})
+		done := false
+		for id, value := range []uint32{2, 4, 6, 1, 1, 1} {
+			done = agg.AddFrame(types.Frame{ImageID: id, Data: map[string]uint32{"threshold_0": value}})
+			if id == 2 && agg.FrameCount() != 1 {
+				t.Fatalf("%s: point not complete after its third frame", tc.combine)
+			}
+		}
+		if !done {
+			t.Fatalf("%s: series not complete after 2 points", tc.combine)
+		}
+		data := agg.Snapshot()
+		if got := data["threshold_0"].Values[0]; got != tc.want {
+			t.Fatalf("%s: got %d, want %d", tc.combine, got, tc.want)
+		}
+		// Population variance of 2, 4, 6 is 8/3.
+		if got := data["threshold_0"].Variance[0]; math.Abs(got-8.0/3) > 1e-9 {
+			t.Fatalf("%s: got variance %g, want 8/3", tc.combine, got)
+		}
+		if got := data["threshold_0"].Variance[1]; got != 0 {
+			t.Fatalf("%s: got variance %g, want 0", tc.combine, got)
+		}
+	}
+}
+
+func TestAggregatorCountsRepeatedSubframesOnce(t *testing.T) {
+	agg := NewAggregator(2, 1)
+	agg.Configure(SeriesConfig{GridX: 2, GridY: 1, FramesPerPoint: 3})
+	for _, id := range []int{0, 1, 1, 1} {
+		agg.AddFrame(types.Frame{ImageID: id, Data: map[string]uint32{"threshold_0": 5}})
+	}
+	if agg.FrameCount() != 0 {
+		t.Fatalf("point complete after a repeated sub-frame")
+	}
+	if got := agg.Snapshot()["threshold_0"].Values[0]; got != 10 {
+		t.Fatalf("got sum %d, want 10", got)
+	}
+	// The sub-frames that arrived survive a checkpoint.
+	restored := NewAggregator(1, 1)
+	if err := restored.Restore(agg.State()); err != nil {
+		t.Fatal(err)
+	}
+	restored.AddFrame(types.Frame{ImageID: 0, Data: map[string]uint32{"threshold_0": 5}})
+	if restored.AddFrame(types.Frame{ImageID: 2, Data: map[string]uint32{"threshold_0": 5}}); restored.FrameCount() != 1 {
+		t.Fatalf("got %d points after the last sub-frame, want 1", restored.FrameCount())
+	}
+}
+
+func TestSeriesConfigFramesPerPoint(t *testing.T) {
+	meta := map[string]any{"nimages": float64(4), "ntrigger": float64(50)}
+	cfg, warnings := SeriesConfigFromMeta(meta, SeriesConfig{GridX: 10, GridY: 10})
+	if cfg.FramesPerPoint != 4 || cfg.GridY != 5 || len(warnings) != 1 {
+		t.Fatalf("got %d frames per point, grid %dx%d, warnings %q", cfg.FramesPerPoint, cfg.GridX, cfg.GridY, warnings)
+	}
+}
@@ -0,0 +1,115 @@
+package rawlog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TypeUndecodable selects the records of a Filter whose payload is not a
+// message with a type.
+const TypeUndecodable = "undecodable"
+
+// Filter selects records of a raw log by their index entry. The zero Filter
+// selects every record.
+type Filter struct {
+	// Types are the message types to keep, TypeUndecodable included.
+	Types []string
+	// SeriesID keeps the messages of one series unless it is 0.
+	SeriesID int
+	// Images restricts image messages to an image_id range. Other messages
+	// are kept, so that a selection keeps the start and end of its series.
+	Images *IDRange
+	// Since and Until bound the receive time, Until exclusive; zero times
+	// do not.
+	Since time.Time
+	Until time.Time
+}
+
+// IDRange is an inclusive range of image ids; Last -1 is open.
+type IDRange struct {
+	First int
+	Last  int
+}
+
+// ParseIDRange parses "N", "N-M", "N-" or "-M".
+func ParseIDRange(spec string) (IDRange, error) {
+	first, last, isRange := strings.Cut(strings.TrimSpace(spec), "-")
+	if !isRange {
+		last = first
+	}
+	r := IDRange{Last: -1}
+	if first != "" {
+		n, err := strconv.Atoi(first)
+		if err != nil || n < 0 {
+			return IDRange{}, fmt.Errorf("image range %q: invalid id %q", spec, first)
+		}
+		r.First = n
+	}
+	if last != "" {
+		n, err := strconv.Atoi(last)
+		if err != nil || n < 0 {
+			return IDRange{}, fmt.Errorf("image range %q: invalid id %q", spec, last)
+		}
+		r.Last = n
+	}
+	if first == "" && last == "" {
+		return IDRange{}, fmt.Errorf("image range %q: want N, N-M, N- or -M", spec)
+	}
+	if r.Last >= 0 && r.Last < r.First {
+		return IDRange{}, fmt.Errorf("image range %q: empty", spec)
+	}
+	return r, nil
+}
+
+// Contains reports whether id is in r.
+func (r IDRange) Contains(id int) bool {
+	return id >= r.First && (r.Last < 0 || id <= r.Last)
+}
+
+// IsZero reports whether f selects every record.
+func (f Filter) IsZero() bool {
+	return len(f.Types) == 0 && f.SeriesID == 0 && f.Images == nil && f.Since.IsZero() && f.Until.IsZero()
+}
+
+// Match reports whether f selects the record of entry.
+func (f Filter) Match(entry IndexEntry) bool {
+	if len(f.Types) > 0 {
+		msgType := entry.Type
+		if msgType == "" {
+			msgType = TypeUndecodable
+		}
+		found := false
+		for _, t := range f.Types {
+			found = found || t == msgType
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.SeriesID != 0 && entry.SeriesID != f.SeriesID {
+		return false
+	}
+	if f.Images != nil && entry.Type == "image" && !f.Images.Contains(entry.ImageID) {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Received.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.Received.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Select returns the entries of idx that f selects, from record from on.
+func (idx *Index) Select(f Filter, from int) []IndexEntry {
+	var entries []IndexEntry
+	for i := from; i < len(idx.Entries); i++ {
+		if f.Match(idx.Entries[i]) {
+			entries = append(entries, idx.Entries[i])
+		}
+	}
+	return entries
+}
@@ -0,0 +1,68 @@
+package rawlog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseIDRange(t *testing.T) {
+	for spec, want := range map[string]IDRange{
+		"4":     {First: 4, Last: 4},
+		"2-9":   {First: 2, Last: 9},
+		"3-":    {First: 3, Last: -1},
+		" -5 ":  {First: 0, Last: 5},
+		"10-10": {First: 10, Last: 10},
+	} {
+		got, err := ParseIDRange(spec)
+		if err != nil || got != want {
+			t.Fatalf("%q: %+v, %v", spec, got, err)
+		}
+	}
+	for _, spec := range []string{"", "-", "a", "5-2", "1-b", "-1-3"} {
+		if _, err := ParseIDRange(spec); err == nil {
+			t.Fatalf("%q accepted", spec)
+		}
+	}
+}
+
+func TestFilterSelect(t *testing.T) {
+	at := func(s int) time.Time { return time.Unix(100+int64(s), 0) }
+	idx := &Index{Entries: []IndexEntry{
+		{Index: 0, Received: at(0), Type: "start", SeriesID: 1, ImageID: -1},
+		{Index: 1, Received: at(1), Type: "image", SeriesID: 1, ImageID: 0},
+		{Index: 2, Received: at(2), Type: "image", SeriesID: 1, ImageID: 1},
+		{Index: 3, Received: at(3), Type: "image", SeriesID: 1, ImageID: 2},
+		{Index: 4, Received: at(4), Type: "end", SeriesID: 1, ImageID: -1},
+		{Index: 5, Received: at(5), ImageID: -1},
+		{Index: 6, Received: at(6), Type: "start", SeriesID: 2, ImageID: -1},
+	}}
+	records := func(entries []IndexEntry) []int {
+		out := []int{}
+		for _, e := range entries {
+			out = append(out, e.Index)
+		}
+		return out
+	}
+	images := IDRange{First: 1, Last: 1}
+	for _, tc := range []struct {
+		name   string
+		filter Filter
+		from   int
+		want   []int
+	}{
+		{"all", Filter{}, 0, []int{0, 1, 2, 3, 4, 5, 6}},
+		{"from", Filter{}, 5, []int{5, 6}},
+		{"types", Filter{Types: []string{"start", TypeUndecodable}}, 0, []int{0, 5, 6}},
+		{"series", Filter{SeriesID: 2}, 0, []int{6}},
+		{"images keep start and end", Filter{SeriesID: 1, Images: &images}, 0, []int{0, 2, 4}},
+		{"window", Filter{Since: at(2), Until: at(4)}, 0, []int{2, 3}},
+	} {
+		if got := records(idx.Select(tc.filter, tc.from)); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s: records %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if !(Filter{}).IsZero() || (Filter{Images: &images}).IsZero() {
+		t.Fatal("IsZero")
+	}
+}
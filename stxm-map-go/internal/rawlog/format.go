@@ -0,0 +1,269 @@
+package rawlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// MagicV2 starts raw logs of format version 2. They have a JSON header after
+// the magic, a little-endian uint32 with its length first, and records of
+// RecordHeaderSizeV2 bytes: the receive time in Unix nanoseconds (uint64),
+// the stored payload length (uint32), the record flags (uint8) and the
+// length of the payload before compression (uint32).
+const MagicV2 = "STXMRAW2"
+
+// RecordHeaderSizeV2 is the record header size of format version 2.
+const RecordHeaderSizeV2 = 17
+
+// Compressions of format version 2.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// Record flags of format version 2. The type flags are set by the writer
+// from the message so that tools can filter records without decoding them.
+const (
+	FlagCompressed uint8 = 1 << iota
+	FlagStart
+	FlagImage
+	FlagEnd
+	// FlagUndecodable marks payloads that are not a CBOR message with a
+	// type.
+	FlagUndecodable
+)
+
+// maxHeaderSize bounds the JSON header of a version 2 file.
+const maxHeaderSize = 1 << 20
+
+// Header describes a raw log file. Files of version 1 have no header; their
+// Header only carries the version.
+type Header struct {
+	Version     int       `json:"version"`
+	Compression string    `json:"compression"`
+	Endpoint    string    `json:"endpoint,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// Encoder writes raw log files of one header.
+type Encoder struct {
+	header Header
+	buf    bytes.Buffer
+	gz     *gzip.Writer
+}
+
+// NewEncoder checks h; version 0 means 2 and an empty compression none.
+func NewEncoder(h Header) (*Encoder, error) {
+	if h.Version == 0 {
+		h.Version = 2
+	}
+	if h.Compression == "" {
+		h.Compression = CompressionNone
+	}
+	switch h.Version {
+	case 1:
+		if h.Compression != CompressionNone {
+			return nil, fmt.Errorf("raw log format version 1 cannot be compressed")
+		}
+	case 2:
+		switch h.Compression {
+		case CompressionNone, CompressionGzip:
+		default:
+			return nil, fmt.Errorf("unknown raw log compression %q", h.Compression)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported raw log format version %d", h.Version)
+	}
+	e := &Encoder{header: h}
+	if h.Compression == CompressionGzip {
+		e.gz, _ = gzip.NewWriterLevel(&e.buf, gzip.BestSpeed)
+	}
+	return e, nil
+}
+
+// Header returns the header of the files of e.
+func (e *Encoder) Header() Header {
+	return e.header
+}
+
+// MaxRecordSize bounds the bytes WriteRecord writes for a payload of n
+// bytes.
+func (e *Encoder) MaxRecordSize(n int) int64 {
+	if e.header.Version == 1 {
+		return int64(RecordHeaderSize + n)
+	}
+	return int64(RecordHeaderSizeV2 + n)
+}
+
+// WriteHeader starts a file created at t and returns the bytes written.
+func (e *Encoder) WriteHeader(w io.Writer, t time.Time) (int64, error) {
+	if e.header.Version == 1 {
+		n, err := io.WriteString(w, Magic)
+		return int64(n), err
+	}
+	h := e.header
+	h.Created = t
+	data, err := json.Marshal(h)
+	if err != nil {
+		return 0, err
+	}
+	var prefix [len(MagicV2) + 4]byte
+	copy(prefix[:], MagicV2)
+	binary.LittleEndian.PutUint32(prefix[len(MagicV2):], uint32(len(data)))
+	n, err := w.Write(prefix[:])
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(data)
+	return int64(n + m), err
+}
+
+// WriteRecord appends payload received at t and returns the bytes written.
+// Version 2 payloads are compressed when that makes them smaller.
+func (e *Encoder) WriteRecord(w io.Writer, t time.Time, payload []byte) (int64, error) {
+	if e.header.Version == 1 {
+		var header [RecordHeaderSize]byte
+		binary.LittleEndian.PutUint64(header[:8], uint64(t.UnixNano()))
+		binary.LittleEndian.PutUint32(header[8:12], uint32(len(payload)))
+		return writeAll(w, header[:], payload)
+	}
+	flags := FlagUndecodable
+	if head, ok := Peek(payload); ok {
+		flags = typeFlag(head.Type)
+	}
+	stored := payload
+	if e.gz != nil && len(payload) > 0 {
+		e.buf.Reset()
+		e.gz.Reset(&e.buf)
+		if _, err := e.gz.Write(payload); err != nil {
+			return 0, err
+		}
+		if err := e.gz.Close(); err != nil {
+			return 0, err
+		}
+		if e.buf.Len() < len(payload) {
+			stored = e.buf.Bytes()
+			flags |= FlagCompressed
+		}
+	}
+	var header [RecordHeaderSizeV2]byte
+	binary.LittleEndian.PutUint64(header[:8], uint64(t.UnixNano()))
+	binary.LittleEndian.PutUint32(header[8:12], uint32(len(stored)))
+	header[12] = flags
+	binary.LittleEndian.PutUint32(header[13:17], uint32(len(payload)))
+	return writeAll(w, header[:], stored)
+}
+
+func writeAll(w io.Writer, header, payload []byte) (int64, error) {
+	n, err := w.Write(header)
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(payload)
+	return int64(n + m), err
+}
+
+// FlagNames lists the names of flags separated by "|", or "-" for none.
+func FlagNames(flags uint8) string {
+	var names []string
+	for _, f := range []struct {
+		flag uint8
+		name string
+	}{
+		{FlagCompressed, "compressed"},
+		{FlagStart, "start"},
+		{FlagImage, "image"},
+		{FlagEnd, "end"},
+		{FlagUndecodable, "undecodable"},
+	} {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "-"
+	}
+	return strings.Join(names, "|")
+}
+
+func typeFlag(msgType string) uint8 {
+	switch msgType {
+	case "start":
+		return FlagStart
+	case "image":
+		return FlagImage
+	case "end":
+		return FlagEnd
+	}
+	return 0
+}
+
+// readHeader reads the magic and, for version 2, the header of a file and
+// returns the bytes read.
+func readHeader(r io.Reader) (Header, int64, error) {
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return Header{}, 0, fmt.Errorf("read magic: %w", err)
+	}
+	switch string(magic) {
+	case Magic:
+		return Header{Version: 1, Compression: CompressionNone}, int64(len(magic)), nil
+	case MagicV2:
+	default:
+		return Header{}, 0, fmt.Errorf("unexpected raw log magic %q", magic)
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return Header{}, 0, fmt.Errorf("read header: %w", err)
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n > maxHeaderSize {
+		return Header{}, 0, fmt.Errorf("raw log header of %d bytes", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Header{}, 0, fmt.Errorf("read header: %w", err)
+	}
+	var h Header
+	if err := json.Unmarshal(data, &h); err != nil {
+		return Header{}, 0, fmt.Errorf("read header: %w", err)
+	}
+	if h.Version != 2 {
+		return Header{}, 0, fmt.Errorf("raw log magic %s with header version %d", MagicV2, h.Version)
+	}
+	return h, int64(len(magic) + len(size) + len(data)), nil
+}
+
+// decompress restores the payload of a record with flags.
+func decompress(h Header, flags uint8, stored []byte, size uint32) ([]byte, error) {
+	if flags&FlagCompressed == 0 {
+		return stored, nil
+	}
+	switch h.Compression {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(stored))
+		if err != nil {
+			return nil, err
+		}
+		// The size is untrusted: it bounds what is read instead of
+		// being allocated up front.
+		if size > MaxRecordPayload {
+			return nil, fmt.Errorf("decompressed size %d", size)
+		}
+		payload, err := io.ReadAll(io.LimitReader(zr, int64(size)+1))
+		if err != nil {
+			return nil, fmt.Errorf("decompress record: %w", err)
+		}
+		if len(payload) != int(size) {
+			return nil, fmt.Errorf("decompressed %d bytes, record header gives %d", len(payload), size)
+		}
+		return payload, nil
+	}
+	return nil, fmt.Errorf("compressed record in a raw log with compression %q", h.Compression)
+}
@@ -0,0 +1,157 @@
+package rawlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestEncoderVersions(t *testing.T) {
+	image, err := cbor.Marshal(map[string]any{"type": "image", "series_id": 1, "image_id": 2, "data": bytes.Repeat([]byte{5}, 1000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Too short to gain from compression, and no CBOR message.
+	garbage := []byte{0xff, 0x00}
+	for _, h := range []Header{
+		{Version: 1},
+		{Version: 2},
+		{Version: 2, Compression: CompressionGzip, Endpoint: "tcp://detector:31001"},
+	} {
+		enc, err := NewEncoder(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		created := time.Unix(50, 0)
+		n, err := enc.WriteHeader(&buf, created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, payload := range [][]byte{image, garbage} {
+			m, err := enc.WriteRecord(&buf, time.Unix(100+int64(i), 0), payload)
+			if err != nil || m > enc.MaxRecordSize(len(payload)) {
+				t.Fatalf("%+v: record of %d bytes, %v", h, m, err)
+			}
+			n += m
+		}
+		if n != int64(buf.Len()) {
+			t.Fatalf("%+v: wrote %d bytes, counted %d", h, buf.Len(), n)
+		}
+
+		r, err := NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := r.Header()
+		if header.Version != h.Version || header.Endpoint != h.Endpoint || (h.Version == 2 && !header.Created.Equal(created)) {
+			t.Fatalf("header %+v for %+v", header, h)
+		}
+		offset := r.Offset()
+		for i, payload := range [][]byte{image, garbage} {
+			record, err := r.Next()
+			if err != nil || !bytes.Equal(record.Payload, payload) || record.Offset != offset {
+				t.Fatalf("%+v record %d: %+v, %v", h, i, record, err)
+			}
+			offset += int64(record.StoredSize)
+			var want uint8
+			switch {
+			case h.Version == 1:
+			case i == 1:
+				want = FlagUndecodable
+			case h.Compression == CompressionGzip:
+				want = FlagImage | FlagCompressed
+			default:
+				want = FlagImage
+			}
+			if record.Flags != want {
+				t.Fatalf("%+v record %d: flags %b, want %b", h, i, record.Flags, want)
+			}
+		}
+	}
+
+	for _, h := range []Header{{Version: 1, Compression: CompressionGzip}, {Compression: "zstd"}, {Version: 3}} {
+		if _, err := NewEncoder(h); err == nil {
+			t.Fatalf("encoder for %+v", h)
+		}
+	}
+}
+
+func TestReaderSkipsUnreadableRecords(t *testing.T) {
+	enc, err := NewEncoder(Header{Compression: CompressionGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := enc.WriteHeader(&buf, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("stxm"), 100)
+	for i := 0; i < 2; i++ {
+		if _, err := enc.WriteRecord(&buf, time.Now(), payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := buf.Bytes()
+	// Corrupt the gzip stream of the first record.
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[r.Offset()+RecordHeaderSizeV2] ^= 0xff
+
+	r, err = NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); !errors.Is(err, ErrCorrupt) || !strings.Contains(err.Error(), "record 0") {
+		t.Fatalf("corrupt record: %v", err)
+	}
+	record, err := r.Next()
+	if err != nil || record.Index != 1 || !bytes.Equal(record.Payload, payload) {
+		t.Fatalf("record after a corrupt one: %+v, %v", record, err)
+	}
+}
+
+func TestReaderChecksDecompressedSize(t *testing.T) {
+	enc, err := NewEncoder(Header{Compression: CompressionGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := enc.WriteHeader(&buf, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte("stxm"), 100)
+	start := buf.Len()
+	for i := 0; i < 3; i++ {
+		if _, err := enc.WriteRecord(&buf, time.Now(), payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := buf.Bytes()
+	stored := (len(data) - start) / 3
+	// The first record claims a byte less than it holds, the second more
+	// than any record may.
+	binary.LittleEndian.PutUint32(data[start+13:], uint32(len(payload)-1))
+	binary.LittleEndian.PutUint32(data[start+stored+13:], MaxRecordPayload+1)
+
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Next(); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("record %d: %v", i, err)
+		}
+	}
+	record, err := r.Next()
+	if err != nil || !bytes.Equal(record.Payload, payload) {
+		t.Fatalf("record after the corrupt ones: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package rawlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const indexVersion = 2
+
+// IndexEntry locates one record of a raw log and says what it holds.
+type IndexEntry struct {
+	Index    int       `json:"index"`
+	Offset   int64     `json:"offset"`
+	Received time.Time `json:"received"`
+	// Type is the message type, or empty when the payload is not a CBOR
+	// map with a type.
+	Type     string `json:"type,omitempty"`
+	SeriesID int    `json:"series_id,omitempty"`
+	// ImageID is -1 for messages other than images.
+	ImageID int `json:"image_id"`
+	// Flags and Size are the record flags and size in the file.
+	Flags uint8 `json:"flags,omitempty"`
+	Size  int   `json:"size"`
+}
+
+// Index lists the records of a raw log.
+type Index struct {
+	Version int `json:"version"`
+	// Header is the header of the log.
+	Header Header `json:"header"`
+	// LogSize is the size of the log the index was built from; an index of
+	// another size is out of date.
+	LogSize int64 `json:"log_size"`
+	// Truncated is set when the log ends in a truncated record, which is
+	// not indexed.
+	Truncated bool         `json:"truncated,omitempty"`
+	Entries   []IndexEntry `json:"entries"`
+}
+
+// IndexPath is the sidecar index of the raw log at logPath.
+func IndexPath(logPath string) string {
+	return logPath + ".idx"
+}
+
+// BuildIndex reads the raw log at logPath and indexes its records. A
+// truncated trailing record is left out.
+func BuildIndex(logPath string) (*Index, error) {
+	r, err := Open(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	r.Recover = true
+	idx := &Index{Version: indexVersion, Entries: []IndexEntry{}}
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		idx.Entries = append(idx.Entries, EntryOf(record))
+	}
+	info, err := os.Stat(logPath)
+	if err != nil {
+		return nil, err
+	}
+	idx.LogSize = info.Size()
+	idx.Header = r.Header()
+	idx.Truncated = r.Truncated()
+	return idx, nil
+}
+
+// EntryOf describes a record for the index.
+func EntryOf(record Record) IndexEntry {
+	entry := IndexEntry{
+		Index:    record.Index,
+		Offset:   record.Offset,
+		Received: record.Received,
+		ImageID:  -1,
+		Flags:    record.Flags,
+		Size:     record.StoredSize,
+	}
+	if head, ok := Peek(record.Payload); ok {
+		entry.Type = head.Type
+		entry.SeriesID = head.SeriesID
+		if head.Type == "image" {
+			entry.ImageID = head.ImageID
+		}
+	}
+	return entry
+}
+
+// Head is the type, series and image of a message.
+type Head struct {
+	Type     string
+	SeriesID int
+	ImageID  int
+}
+
+// Peek decodes the head of a Stream V2 CBOR message, skipping its data.
+func Peek(payload []byte) (Head, bool) {
+	var msg struct {
+		Type     string `cbor:"type"`
+		SeriesID any    `cbor:"series_id"`
+		ImageID  any    `cbor:"image_id"`
+	}
+	if err := cbor.Unmarshal(payload, &msg); err != nil || msg.Type == "" {
+		return Head{}, false
+	}
+	return Head{Type: msg.Type, SeriesID: toInt(msg.SeriesID), ImageID: toInt(msg.ImageID)}, true
+}
+
+func toInt(v any) int {
+	switch n := v.(type) {
+	case uint64:
+		return int(n)
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
+
+// WriteIndex stores idx as the sidecar of the raw log at logPath.
+func WriteIndex(logPath string, idx *Index) error {
+	path := IndexPath(logPath)
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := json.NewEncoder(tmp).Encode(idx); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadIndex reads the sidecar index of the raw log at logPath.
+func ReadIndex(logPath string) (*Index, error) {
+	data, err := os.ReadFile(IndexPath(logPath))
+	if err != nil {
+		return nil, err
+	}
+	var idx Index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("read %s: %w", IndexPath(logPath), err)
+	}
+	if idx.Version != indexVersion {
+		return nil, fmt.Errorf("read %s: unsupported index version %d", IndexPath(logPath), idx.Version)
+	}
+	return &idx, nil
+}
+
+// LoadIndex returns the sidecar index of the raw log at logPath, building
+// and saving it when it is missing or out of date. A sidecar that cannot be
+// saved, e.g. next to a read-only log, is not an error: the index is then
+// built again next time.
+func LoadIndex(logPath string) (*Index, error) {
+	info, err := os.Stat(logPath)
+	if err != nil {
+		return nil, err
+	}
+	if idx, err := ReadIndex(logPath); err == nil && idx.LogSize == info.Size() {
+		return idx, nil
+	}
+	idx, err := BuildIndex(logPath)
+	if err != nil {
+		return nil, err
+	}
+	_ = WriteIndex(logPath, idx)
+	return idx, nil
+}
+
+// Record returns the entry of record n.
+func (idx *Index) Record(n int) (IndexEntry, bool) {
+	if n < 0 || n >= len(idx.Entries) {
+		return IndexEntry{}, false
+	}
+	return idx.Entries[n], true
+}
+
+// FindImage returns the first image message with imageID, of seriesID
+// unless it is 0.
+func (idx *Index) FindImage(seriesID, imageID int) (IndexEntry, bool) {
+	for _, entry := range idx.Entries {
+		if entry.Type == "image" && entry.ImageID == imageID && (seriesID == 0 || entry.SeriesID == seriesID) {
+			return entry, true
+		}
+	}
+	return IndexEntry{}, false
+}
@@ -0,0 +1,236 @@
+package rawlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Magic starts raw logs of format version 1, which have no header.
+const Magic = "STXMRAW1"
+
+// RecordHeaderSize is the size of the little-endian receive time in Unix
+// nanoseconds (uint64) and payload length (uint32) before every payload of
+// format version 1.
+const RecordHeaderSize = 12
+
+// ErrTruncated is returned for a record cut short by the end of the file,
+// as left by a writer that did not close its file.
+var ErrTruncated = errors.New("truncated raw log record")
+
+// ErrCorrupt is returned for a record that cannot be decompressed. The
+// reader has moved past it, so Next can go on with the following record,
+// except after a record length beyond MaxRecordPayload: the record after it
+// cannot be found and Next fails from then on.
+var ErrCorrupt = errors.New("corrupt raw log record")
+
+// MaxRecordPayload bounds the stored and the decompressed payload of a
+// record. Longer lengths in a file are corrupt.
+const MaxRecordPayload = 1 << 30
+
+// Record is one message of a raw log.
+type Record struct {
+	// Index counts the records of the file from 0.
+	Index int
+	// Offset is the position of the record header in the file.
+	Offset   int64
+	Received time.Time
+	// Payload is the message, decompressed.
+	Payload []byte
+	// Flags are the record flags of format version 2; version 1 records
+	// have none.
+	Flags uint8
+	// StoredSize is the size of the record in the file, header included.
+	StoredSize int
+}
+
+// Reader reads the records of a raw log of either format version in order.
+type Reader struct {
+	header Header
+	src    io.Reader
+	file   *os.File
+	r      *bufio.Reader
+	offset int64
+	index  int
+	// Recover makes Next end at a truncated trailing record with io.EOF
+	// instead of ErrTruncated; Truncated reports whether it did.
+	Recover   bool
+	truncated bool
+	// size is the file size last seen, for files from Open.
+	size int64
+	err  error
+}
+
+// Open opens the raw log at path. Readers of a file can seek.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	r.file = f
+	return r, nil
+}
+
+// NewReader reads a raw log from src after its magic and header.
+func NewReader(src io.Reader) (*Reader, error) {
+	r := &Reader{src: src, r: bufio.NewReaderSize(src, 1024*1024)}
+	header, n, err := readHeader(r.r)
+	if err != nil {
+		return nil, err
+	}
+	r.header = header
+	r.offset = n
+	return r, nil
+}
+
+// Header describes the file.
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Next returns the next record, or io.EOF after the last one.
+func (r *Reader) Next() (Record, error) {
+	if r.err != nil {
+		return Record{}, r.err
+	}
+	var header [RecordHeaderSizeV2]byte
+	size := RecordHeaderSize
+	if r.header.Version == 2 {
+		size = RecordHeaderSizeV2
+	}
+	n, err := io.ReadFull(r.r, header[:size])
+	if err == io.EOF {
+		return Record{}, io.EOF
+	}
+	if err != nil {
+		return Record{}, r.cut(err, n)
+	}
+	record := Record{
+		Index:    r.index,
+		Offset:   r.offset,
+		Received: time.Unix(0, int64(binary.LittleEndian.Uint64(header[:8]))),
+	}
+	// The length is checked before it is allocated: beyond the end of the
+	// file the record is cut short, beyond MaxRecordPayload it is corrupt.
+	length := binary.LittleEndian.Uint32(header[8:12])
+	if length > MaxRecordPayload {
+		r.err = fmt.Errorf("record %d at offset %d: no record after a corrupt length", record.Index, record.Offset)
+		return Record{}, fmt.Errorf("record %d at offset %d: %w: stored length %d", record.Index, record.Offset, ErrCorrupt, length)
+	}
+	if left, past := r.pastEnd(size, length); past {
+		return Record{}, r.cut(io.ErrUnexpectedEOF, size+int(left))
+	}
+	stored := make([]byte, length)
+	n, err = io.ReadFull(r.r, stored)
+	if err != nil {
+		return Record{}, r.cut(err, size+n)
+	}
+	record.StoredSize = size + len(stored)
+	record.Payload = stored
+	r.offset += int64(record.StoredSize)
+	r.index++
+	r.truncated = false
+	if r.header.Version == 2 {
+		record.Flags = header[12]
+		// A record that cannot be decompressed is skipped; Next goes on
+		// with the one after it.
+		record.Payload, err = decompress(r.header, record.Flags, stored, binary.LittleEndian.Uint32(header[13:17]))
+		if err != nil {
+			return Record{}, fmt.Errorf("record %d at offset %d: %w: %v", record.Index, record.Offset, ErrCorrupt, err)
+		}
+	}
+	return record, nil
+}
+
+// pastEnd reports whether a payload of length bytes after the header of n
+// bytes of the record at the current offset runs past the end of a file from
+// Open, and how many bytes the file has left. The file is looked at again
+// only when the record does not fit the size last seen, as it may have grown.
+func (r *Reader) pastEnd(n int, length uint32) (int64, bool) {
+	if r.file == nil {
+		return 0, false
+	}
+	end := r.offset + int64(n)
+	if end+int64(length) > r.size {
+		if info, err := r.file.Stat(); err == nil {
+			r.size = info.Size()
+		}
+	}
+	if end+int64(length) <= r.size {
+		return 0, false
+	}
+	if r.size < end {
+		return 0, true
+	}
+	return r.size - end, true
+}
+
+// cut handles a read error after n bytes of a record. The bytes read are
+// gone: without Recover Next fails from then on; with it, a reader that can
+// seek moves back to the record header, so that Next reads the record again
+// once the file has grown, and any other reader ends.
+func (r *Reader) cut(err error, n int) error {
+	if err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	if !r.Recover {
+		r.err = fmt.Errorf("record %d at offset %d: %w (%d bytes)", r.index, r.offset, ErrTruncated, n)
+		return r.err
+	}
+	r.truncated = true
+	seeker, ok := r.src.(io.Seeker)
+	if !ok {
+		r.err = io.EOF
+		return io.EOF
+	}
+	if _, err := seeker.Seek(r.offset, io.SeekStart); err != nil {
+		r.err = err
+		return err
+	}
+	r.r.Reset(r.src)
+	return io.EOF
+}
+
+// Truncated reports whether Recover skipped a truncated trailing record.
+func (r *Reader) Truncated() bool {
+	return r.truncated
+}
+
+// Offset is the position of the next record in the file.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Seek moves to the record of an index entry so that Next returns it.
+func (r *Reader) Seek(entry IndexEntry) error {
+	seeker, ok := r.src.(io.Seeker)
+	if !ok {
+		return errors.New("raw log reader cannot seek")
+	}
+	if _, err := seeker.Seek(entry.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.r.Reset(r.src)
+	r.offset = entry.Offset
+	r.index = entry.Index
+	r.truncated = false
+	r.err = nil
+	return nil
+}
+
+// Close closes the file of a reader from Open.
+func (r *Reader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,200 @@
+package rawlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func writeTestLog(t *testing.T, path string, messages []map[string]any, tail []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.WriteString(Magic)
+	for i, msg := range messages {
+		payload, err := cbor.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var header [RecordHeaderSize]byte
+		binary.LittleEndian.PutUint64(header[:8], uint64(time.Unix(100+int64(i), 0).UnixNano()))
+		binary.LittleEndian.PutUint32(header[8:], uint32(len(payload)))
+		buf.Write(header[:])
+		buf.Write(payload)
+	}
+	buf.Write(tail)
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReaderIndexAndSeek(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "20260105_101500_raw_cbor.bin")
+	messages := []map[string]any{
+		{"type": "start", "series_id": 4},
+		{"type": "image", "series_id": 4, "image_id": 0, "data": map[string]any{"threshold_0": []byte{1, 2}}},
+		{"type": "image", "series_id": 4, "image_id": 1, "data": map[string]any{"threshold_0": []byte{3, 4}}},
+		{"type": "end", "series_id": 4},
+	}
+	// A record header that announces more payload than the file holds.
+	tail := []byte{1, 2, 3, 4, 5, 6, 7, 8, 100, 0, 0, 0, 9}
+	writeTestLog(t, path, messages, tail)
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range messages {
+		record, err := r.Next()
+		if err != nil || record.Index != i || !record.Received.Equal(time.Unix(100+int64(i), 0)) {
+			t.Fatalf("record %d: %+v, %v", i, record, err)
+		}
+	}
+	if _, err := r.Next(); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("err = %v, want ErrTruncated", err)
+	}
+	r.Close()
+
+	idx, err := LoadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !idx.Truncated || len(idx.Entries) != 4 || idx.Entries[0].Type != "start" || idx.Entries[3].ImageID != -1 {
+		t.Fatalf("unexpected index %+v", idx)
+	}
+	if saved, err := ReadIndex(path); err != nil || len(saved.Entries) != 4 {
+		t.Fatalf("sidecar %+v, %v", saved, err)
+	}
+
+	entry, ok := idx.FindImage(4, 1)
+	if !ok || entry.Index != 2 || entry.SeriesID != 4 {
+		t.Fatalf("image 1: %+v, %v", entry, ok)
+	}
+	if _, ok := idx.FindImage(5, 1); ok {
+		t.Fatal("image of another series found")
+	}
+	r, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.Recover = true
+	if err := r.Seek(entry); err != nil {
+		t.Fatal(err)
+	}
+	for want := 2; ; want++ {
+		record, err := r.Next()
+		if err == io.EOF {
+			if want != 4 || !r.Truncated() {
+				t.Fatalf("stopped before record %d, truncated %v", want, r.Truncated())
+			}
+			break
+		}
+		if err != nil || record.Index != want || record.Offset != idx.Entries[want].Offset {
+			t.Fatalf("record %d: %+v, %v", want, record, err)
+		}
+		if head, ok := Peek(record.Payload); !ok || head.Type != messages[want]["type"] {
+			t.Fatalf("record %d head %+v", want, head)
+		}
+	}
+}
+
+func TestReaderRejectsRecordLengths(t *testing.T) {
+	messages := []map[string]any{{"type": "start", "series_id": 4}}
+	// A record header claiming more bytes than the file has left.
+	var tail [RecordHeaderSize]byte
+	binary.LittleEndian.PutUint32(tail[8:], 1<<29)
+	path := filepath.Join(t.TempDir(), "20260105_101500_raw_cbor.bin")
+	writeTestLog(t, path, messages, append(tail[:], "short"...))
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("record past the end of the file: %v", err)
+	}
+
+	// A length beyond MaxRecordPayload in a stream is corrupt, and the
+	// reader cannot go on after it.
+	binary.LittleEndian.PutUint32(tail[8:], MaxRecordPayload+1)
+	writeTestLog(t, path, messages, tail[:])
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r2.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r2.Next(); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("oversized record: %v", err)
+	}
+	if _, err := r2.Next(); err == nil || errors.Is(err, ErrCorrupt) || err == io.EOF {
+		t.Fatalf("record after an oversized one: %v", err)
+	}
+}
+
+func TestReaderRetriesTruncatedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "20260105_101500_raw_cbor.bin")
+	messages := []map[string]any{{"type": "start", "series_id": 4}, {"type": "end", "series_id": 4}}
+	writeTestLog(t, path, messages, nil)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last record cut short in its payload, as a writer leaves it.
+	if err := os.WriteFile(path, data[:len(data)-2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Next(); !errors.Is(err, ErrTruncated) {
+			t.Fatalf("try %d: err = %v, want ErrTruncated", i, err)
+		}
+	}
+
+	tail, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+	tail.Recover = true
+	if _, err := tail.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tail.Next(); err != io.EOF || !tail.Truncated() {
+		t.Fatalf("err = %v, truncated %v", err, tail.Truncated())
+	}
+	// Once the writer has finished the record, the retry reads it whole.
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	record, err := tail.Next()
+	if err != nil || record.Index != 1 || tail.Truncated() {
+		t.Fatalf("record %+v, %v, truncated %v", record, err, tail.Truncated())
+	}
+	if head, ok := Peek(record.Payload); !ok || head.Type != "end" {
+		t.Fatalf("record head %+v", head)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"stxm-map-go/internal/output"
+)
+
+// handleHistory lists finished scans at /history, returns the maps of one
+// scan as a UI snapshot at /history/{id} and its metadata and pixel
+// timestamps at /history/{id}/meta. /history/{id}/tiff downloads the maps
+// as a multi-page TIFF; ?dtype=uint32 selects integer samples.
+// /history/{id}/npz and /history/{id}/{channel}.npy download them for NumPy.
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if s.history == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": "scan history disabled",
+		})
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/history"), "/")
+	if path == "" {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"scans": s.history.List(),
+		})
+		return
+	}
+	id, part, _ := strings.Cut(path, "/")
+	entry, err := s.history.Get(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	maps := output.MapSet{
+		GridX:      entry.GridX,
+		GridY:      entry.GridY,
+		Maps:       entry.Snapshot.Data,
+		Timestamps: entry.Timestamps,
+	}
+	switch {
+	case part == "npz":
+		writeNPZ(w, entry.ID, maps)
+	case strings.HasSuffix(part, ".npy"):
+		writeNPY(w, entry.ID, maps, part)
+	case part == "":
+		_ = json.NewEncoder(w).Encode(entry.Snapshot)
+	case part == "meta":
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"summary":    entry.Summary,
+			"meta":       entry.Meta,
+			"timestamps": entry.Timestamps,
+		})
+	case part == "tiff":
+		dtype := r.URL.Query().Get("dtype")
+		if dtype == "" {
+			dtype = output.TIFFFloat32
+		}
+		info := output.TIFFInfo{
+			PixelSize: entry.PixelSize,
+			Metadata:  map[string]any{"run": entry.RunTimestamp, "history_id": entry.ID, "start": entry.Meta},
+		}
+		var buf bytes.Buffer
+		if err := output.EncodeMapsTIFF(&buf, entry.GridX, entry.GridY, entry.Snapshot.Data, dtype, info); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"ok":    false,
+				"error": err.Error(),
+			})
+			return
+		}
+		w.Header().Set("Content-Type", "image/tiff")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", entry.ID+".tif"))
+		_, _ = w.Write(buf.Bytes())
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": "unknown history resource",
+		})
+	}
+}
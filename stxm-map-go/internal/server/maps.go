@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"stxm-map-go/internal/output"
+)
+
+// handleMaps downloads the live maps of the current series: /maps.npz as an
+// .npz bundle with masks and timestamps, /maps/{channel}.npy as one array.
+func (s *Server) handleMaps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var maps output.MapSet
+	ok := false
+	if s.mapsFn != nil {
+		maps, ok = s.mapsFn()
+	}
+	if !ok {
+		writeMapsError(w, http.StatusNotFound, "no maps available")
+		return
+	}
+	if r.URL.Path == "/maps.npz" {
+		writeNPZ(w, "maps", maps)
+		return
+	}
+	writeNPY(w, "maps", maps, strings.TrimPrefix(r.URL.Path, "/maps/"))
+}
+
+// writeNPZ sends a map set as {name}.npz.
+func writeNPZ(w http.ResponseWriter, name string, maps output.MapSet) {
+	var buf bytes.Buffer
+	if err := output.EncodeMapsNPZ(&buf, maps); err != nil {
+		writeMapsError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".npz"))
+	_, _ = w.Write(buf.Bytes())
+}
+
+// writeNPY sends the map of one channel, requested as "{channel}.npy", as
+// {name}_{channel}.npy.
+func writeNPY(w http.ResponseWriter, name string, maps output.MapSet, file string) {
+	channel, isNPY := strings.CutSuffix(file, ".npy")
+	snap, ok := maps.Maps[channel]
+	if !isNPY || !ok {
+		writeMapsError(w, http.StatusNotFound, fmt.Sprintf("unknown map %q", file))
+		return
+	}
+	var buf bytes.Buffer
+	if err := output.EncodeMapNPY(&buf, maps.GridX, maps.GridY, snap); err != nil {
+		writeMapsError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"_"+channel+".npy"))
+	_, _ = w.Write(buf.Bytes())
+}
+
+func writeMapsError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok":    false,
+		"error": message,
+	})
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"stxm-map-go/internal/output"
+)
+
+// handleRuns queries the run catalog at /runs with the optional filters
+// from, to (YYYY-MM-DD or RFC3339), sample and channel, and returns a single
+// run at /runs/{id}.
+func (s *Server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if s.catalog == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": "run catalog disabled",
+		})
+		return
+	}
+	if id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/runs"), "/"); id != "" {
+		record, ok := s.catalog.Get(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"ok":    false,
+				"error": "unknown run",
+			})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(record)
+		return
+	}
+
+	query := r.URL.Query()
+	from, err := parseQueryTime(query.Get("from"), false)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	to, err := parseQueryTime(query.Get("to"), true)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	runs := s.catalog.Query(output.RunQuery{
+		From:    from,
+		To:      to,
+		Sample:  query.Get("sample"),
+		Channel: query.Get("channel"),
+	})
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"runs": runs,
+	})
+}
+
+// parseQueryTime accepts a date or an RFC3339 time. A date used as the end
+// of a range covers the whole day.
+func parseQueryTime(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
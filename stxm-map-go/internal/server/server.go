@@ -15,22 +15,63 @@ import (
 	"github.com/gorilla/websocket"
 
 	"stxm-map-go/internal/config"
+	"stxm-map-go/internal/history"
+	"stxm-map-go/internal/output"
+	"stxm-map-go/internal/processing"
 	"stxm-map-go/internal/simplon"
+	"stxm-map-go/internal/types"
 )
 
 //go:embed web/* web/assets/*
 var webFS embed.FS
 
 type Server struct {
-	upgrader   websocket.Upgrader
-	clients    map[*websocket.Conn]*sync.Mutex
-	mu         sync.Mutex
-	cfg        config.AppConfig
-	statusFn   func() map[string]any
-	snapshotFn func() any
-	configFn   func() map[string]any
-	gridFn     func(int, int) error
-	endpointFn func(string, int, int) error
+	upgrader      websocket.Upgrader
+	clients       map[*websocket.Conn]*sync.Mutex
+	mu            sync.Mutex
+	cfg           config.AppConfig
+	statusFn      func() map[string]any
+	snapshotFn    func() any
+	mapsFn        func() (output.MapSet, bool)
+	configFn      func() map[string]any
+	gridFn        func(int, int) error
+	endpointFn    func(string, int, int) error
+	diffractionFn func() (int, map[string]types.DiffractionFrame)
+	abortFn       func(string) error
+	stack         *processing.Stack
+	stackEnergyFn func(float64) error
+	stackFinishFn func() error
+	averageFn     func() error
+	history       *history.Store
+	catalog       *output.Catalog
+}
+
+// Handlers connects the HTTP endpoints to the acquisition pipeline. Any nil
+// handler disables the endpoints that depend on it.
+type Handlers struct {
+	Status   func() map[string]any
+	Snapshot func() any
+	// Maps returns the live maps of the current series for the NumPy
+	// downloads; false if there are none yet.
+	Maps        func() (output.MapSet, bool)
+	Config      func() map[string]any
+	Grid        func(int, int) error
+	Endpoint    func(string, int, int) error
+	Diffraction func() (int, map[string]types.DiffractionFrame)
+	// Abort finalizes the current series as incomplete; the argument is the
+	// reason recorded in its metadata.
+	Abort func(string) error
+	// Stack is the energy stack being acquired; StackEnergy sets the energy
+	// of the next series and StackFinish writes the stack.
+	Stack       *processing.Stack
+	StackEnergy func(float64) error
+	StackFinish func() error
+	// AverageReset discards the running average of a repeated scan.
+	AverageReset func() error
+	// History holds finished scans for the /history endpoints.
+	History *history.Store
+	// Catalog indexes the output directory for /runs.
+	Catalog *output.Catalog
 }
 
 const (
@@ -39,18 +80,27 @@ const (
 	pingEvery = (pongWait * 9) / 10
 )
 
-func Run(ctx context.Context, cfg config.AppConfig, messages <-chan any, statusFn func() map[string]any, snapshotFn func() any, configFn func() map[string]any, gridFn func(int, int) error, endpointFn func(string, int, int) error) error {
+func Run(ctx context.Context, cfg config.AppConfig, messages <-chan any, handlers Handlers) error {
 	srv := &Server{
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
-		clients:    make(map[*websocket.Conn]*sync.Mutex),
-		cfg:        cfg,
-		statusFn:   statusFn,
-		snapshotFn: snapshotFn,
-		configFn:   configFn,
-		gridFn:     gridFn,
-		endpointFn: endpointFn,
+		clients:       make(map[*websocket.Conn]*sync.Mutex),
+		cfg:           cfg,
+		statusFn:      handlers.Status,
+		snapshotFn:    handlers.Snapshot,
+		mapsFn:        handlers.Maps,
+		configFn:      handlers.Config,
+		gridFn:        handlers.Grid,
+		endpointFn:    handlers.Endpoint,
+		diffractionFn: handlers.Diffraction,
+		abortFn:       handlers.Abort,
+		stack:         handlers.Stack,
+		stackEnergyFn: handlers.StackEnergy,
+		stackFinishFn: handlers.StackFinish,
+		averageFn:     handlers.AverageReset,
+		history:       handlers.History,
+		catalog:       handlers.Catalog,
 	}
 
 	sub, err := fs.Sub(webFS, "web")
@@ -68,6 +118,19 @@ func Run(ctx context.Context, cfg config.AppConfig, messages <-chan any, statusF
 	mux.HandleFunc("/simplon/", srv.handleSimplon)
 	mux.HandleFunc("/ui/grid", srv.handleGrid)
 	mux.HandleFunc("/ui/endpoint", srv.handleEndpoint)
+	mux.HandleFunc("/diffraction", srv.handleDiffraction)
+	mux.HandleFunc("/maps.npz", srv.handleMaps)
+	mux.HandleFunc("/maps/", srv.handleMaps)
+	mux.HandleFunc("/scan/abort", srv.handleAbort)
+	mux.HandleFunc("/stack", srv.handleStack)
+	mux.HandleFunc("/stack/spectrum", srv.handleSpectrum)
+	mux.HandleFunc("/stack/energy", srv.handleStackEnergy)
+	mux.HandleFunc("/stack/finish", srv.handleStackFinish)
+	mux.HandleFunc("/average/reset", srv.handleAverageReset)
+	mux.HandleFunc("/history", srv.handleHistory)
+	mux.HandleFunc("/history/", srv.handleHistory)
+	mux.HandleFunc("/runs", srv.handleRuns)
+	mux.HandleFunc("/runs/", srv.handleRuns)
 
 	httpServer := &http.Server{
 		Addr:              ":" + itoa(cfg.Port),
@@ -232,6 +295,9 @@ func (s *Server) handleDetectorCommand(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	if cmd == "disarm" && s.abortFn != nil {
+		_ = s.abortFn("disarm")
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
 	_ = json.NewEncoder(w).Encode(map[string]any{
@@ -241,6 +307,65 @@ func (s *Server) handleDetectorCommand(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleAbort finalizes the series being acquired without waiting for the
+// remaining scan points.
+func (s *Server) handleAbort(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if s.abortFn == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": "abort not supported",
+		})
+		return
+	}
+	if err := s.abortFn("abort"); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok": true,
+	})
+}
+
+// handleAverageReset starts a new average of a repeated scan.
+func (s *Server) handleAverageReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if s.averageFn == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": "averaging disabled",
+		})
+		return
+	}
+	if err := s.averageFn(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok": true,
+	})
+}
+
 func (s *Server) handleDetectorConfig(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -427,6 +552,72 @@ func (s *Server) handleEndpoint(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *Server) handleDiffraction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.diffractionFn == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": "diffraction accumulation disabled",
+		})
+		return
+	}
+	seriesID, frames := s.diffractionFn()
+	query := r.URL.Query()
+	channel := query.Get("channel")
+	if channel == "" {
+		channel = firstChannel(frames)
+	}
+	frame, ok := frames[channel]
+	if !ok || frame.Frames == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": "no diffraction data for channel",
+		})
+		return
+	}
+	var values []float64
+	switch kind := query.Get("kind"); kind {
+	case "", "mean":
+		values = processing.DiffractionMean(frame)
+	case "sum":
+		values = frame.Sum
+	case "max":
+		values = frame.Max
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": "unsupported kind",
+		})
+		return
+	}
+	w.Header().Set("X-Series-Id", itoa(seriesID))
+	w.Header().Set("X-Channel", channel)
+	w.Header().Set("X-Width", itoa(frame.Width))
+	w.Header().Set("X-Height", itoa(frame.Height))
+	w.Header().Set("X-Frames", itoa(frame.Frames))
+	switch query.Get("format") {
+	case "", "bin":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Dtype", "<f8")
+		_ = output.WriteFloat64(w, values)
+	case "png":
+		w.Header().Set("Content-Type", "image/png")
+		_ = output.EncodeDiffractionPNG(w, values, frame.Width, frame.Height, query.Get("scale") != "linear")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": "unsupported format",
+		})
+	}
+}
+
 func (s *Server) handleSimplon(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/simplon/")
 	parts := strings.SplitN(path, "/", 3)
@@ -669,6 +860,16 @@ func itoa(v int) string {
 	return string(buf)
 }
 
+func firstChannel(frames map[string]types.DiffractionFrame) string {
+	first := ""
+	for key := range frames {
+		if first == "" || key < first {
+			first = key
+		}
+	}
+	return first
+}
+
 func toInt(v any) (int, error) {
 	switch n := v.(type) {
 	case int:
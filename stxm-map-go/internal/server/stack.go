@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// handleStack describes the energy stack being acquired.
+func (s *Server) handleStack(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if s.stack == nil {
+		writeStackDisabled(w)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(s.stack.Info())
+}
+
+// handleSpectrum returns the spectrum of one map pixel across the stack.
+func (s *Server) handleSpectrum(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if s.stack == nil {
+		writeStackDisabled(w)
+		return
+	}
+	query := r.URL.Query()
+	x, errX := strconv.Atoi(query.Get("x"))
+	y, errY := strconv.Atoi(query.Get("y"))
+	if errX != nil || errY != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": "invalid x or y",
+		})
+		return
+	}
+	channel := query.Get("channel")
+	if channel == "" {
+		if channels := s.stack.Info().Channels; len(channels) > 0 {
+			channel = channels[0]
+		}
+	}
+	spectrum, err := s.stack.Spectrum(channel, x, y)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(spectrum)
+}
+
+// handleStackEnergy sets the photon energy of the next series when its start
+// message does not carry one.
+func (s *Server) handleStackEnergy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if s.stackEnergyFn == nil {
+		writeStackDisabled(w)
+		return
+	}
+	var payload map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": "invalid json body",
+		})
+		return
+	}
+	energy, ok := payload["energy"].(float64)
+	if !ok || energy <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": "invalid energy",
+		})
+		return
+	}
+	if err := s.stackEnergyFn(energy); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok":     true,
+		"energy": energy,
+	})
+}
+
+// handleStackFinish writes the current stack and starts a new one.
+func (s *Server) handleStackFinish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if s.stackFinishFn == nil {
+		writeStackDisabled(w)
+		return
+	}
+	if err := s.stackFinishFn(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":    false,
+			"error": err.Error(),
+		})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok": true,
+	})
+}
+
+func writeStackDisabled(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ok":    false,
+		"error": "stack mode disabled",
+	})
+}
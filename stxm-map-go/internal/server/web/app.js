@@ -27,6 +27,9 @@ const gridXInput = document.getElementById("grid-x");
 const gridYInput = document.getElementById("grid-y");
 const gridApplyBtn = document.getElementById("grid-apply");
 const gridStatus = document.getElementById("grid-status");
+const historySelect = document.getElementById("history-select");
+const historyRefreshBtn = document.getElementById("history-refresh");
+const historyStatus = document.getElementById("history-status");
 const detectorIpInput = document.getElementById("detector-ip");
 const detectorZmqPortInput = document.getElementById("detector-zmq-port");
 const detectorApiPortInput = document.getElementById("detector-api-port");
@@ -66,6 +69,8 @@ const staleBanner = document.getElementById("stale-banner");
 
 let gridX = 0;
 let gridY = 0;
+// historyView is the id of the finished scan on display, empty for live data.
+let historyView = "";
 const plots = new Map();
 let lastFrameTime = performance.now();
 let frameCount = 0;
@@ -231,6 +236,72 @@ gridApplyBtn?.addEventListener("click", async () => {
   }
 });
 
+async function refreshHistory() {
+  if (!historySelect) return;
+  try {
+    const res = await fetch("/history");
+    if (!res.ok) {
+      if (historyStatus) historyStatus.textContent = "Scan history disabled.";
+      return;
+    }
+    const data = await res.json();
+    const selected = historySelect.value;
+    historySelect.innerHTML = "";
+    const live = document.createElement("option");
+    live.value = "";
+    live.textContent = "Live";
+    historySelect.appendChild(live);
+    (data.scans || []).forEach((scan) => {
+      const option = document.createElement("option");
+      option.value = scan.id;
+      const state = scan.complete ? "" : ` (${scan.reason})`;
+      option.textContent = `${scan.run_timestamp} #${scan.series_id} ${scan.grid_x}x${scan.grid_y}${state}`;
+      option.dataset.gridX = `${scan.grid_x}`;
+      option.dataset.gridY = `${scan.grid_y}`;
+      historySelect.appendChild(option);
+    });
+    historySelect.value = [...historySelect.options].some((o) => o.value === selected) ? selected : "";
+  } catch (_) {
+    if (historyStatus) historyStatus.textContent = "History unavailable.";
+  }
+}
+
+historyRefreshBtn?.addEventListener("click", refreshHistory);
+
+historySelect?.addEventListener("change", async () => {
+  historyView = historySelect.value;
+  if (!historyView) {
+    if (historyStatus) historyStatus.textContent = "Showing live scan.";
+    if (ws && ws.readyState === WebSocket.OPEN) {
+      ws.send(JSON.stringify({ type: "snapshot_request" }));
+    }
+    return;
+  }
+  const option = historySelect.selectedOptions[0];
+  if (parseInt(option.dataset.gridX, 10) !== gridX || parseInt(option.dataset.gridY, 10) !== gridY) {
+    if (historyStatus) historyStatus.textContent = "Scan grid differs from the current grid.";
+    return;
+  }
+  try {
+    const res = await fetch(`/history/${encodeURIComponent(historyView)}`);
+    const snapshot = await res.json();
+    if (!res.ok) {
+      if (historyStatus) historyStatus.textContent = snapshot.error || "Scan not found.";
+      return;
+    }
+    Object.entries(snapshot.data || {}).forEach(([threshold, payload]) => {
+      applySnapshot(threshold, payload);
+    });
+    plots.forEach((plot) => updatePixelLabels(plot));
+    scheduleHistogramUpdate();
+    if (historyStatus) historyStatus.textContent = `Showing ${option.textContent}.`;
+  } catch (_) {
+    if (historyStatus) historyStatus.textContent = "Loading scan failed.";
+  }
+});
+
+refreshHistory();
+
 endpointApplyBtn?.addEventListener("click", async () => {
   const ip = detectorIpInput?.value?.trim();
   const zmqPort = detectorZmqPortInput?.value ? parseInt(detectorZmqPortInput.value, 10) : NaN;
@@ -1102,6 +1173,41 @@ function updatePixel(threshold, imageId, value) {
   scheduleProjectionUpdate(plot);
 }
 
+// applyAverage shows the running mean and standard deviation of a repeated
+// scan as extra plots next to the live pass.
+function applyAverage(msg) {
+  if (!gridX || !gridY) return;
+  const passes = msg.passes || 0;
+  [["mean", msg.data], ["std", msg.std]].forEach(([kind, channels]) => {
+    Object.entries(channels || {}).forEach(([threshold, payload]) => {
+      const key = `${threshold} ${kind}`;
+      let plot = plots.get(key);
+      if (!plot || !plot.container.isConnected) {
+        createPlot(key);
+        plot = plots.get(key);
+        const rect = plot.canvasWrap.getBoundingClientRect();
+        plot.basePixel.value = Math.max(6, Math.floor(rect.width / gridX));
+        updatePlotScale(plot);
+      }
+      const title = plot.controls.querySelector("h2");
+      if (title) {
+        const repeats = msg.repeats ? `/${msg.repeats}` : "";
+        title.textContent = `${key} (${passes}${repeats} passes)`;
+      }
+      applySnapshot(key, payload);
+    });
+  });
+  if (passes === 0) {
+    plots.forEach((plot, key) => {
+      if (key.endsWith(" mean") || key.endsWith(" std")) {
+        plot.container.remove();
+        plots.delete(key);
+      }
+    });
+  }
+  scheduleLayoutRefresh();
+}
+
 function applySnapshot(threshold, payload) {
   const plot = plots.get(threshold);
   if (!plot || !payload) return;
@@ -1230,8 +1336,19 @@ function connectWebSocket() {
     return;
   }
 
+  if (msg.type === "average") {
+    applyAverage(msg);
+    return;
+  }
+
+  if (msg.type === "warning") {
+    console.warn(`series ${msg.series_id}: ${msg.message}`);
+    statusEl.textContent = `Warning: ${msg.message}`;
+    return;
+  }
+
   if (msg.type === "snapshot") {
-    if (!gridX || !gridY) return;
+    if (!gridX || !gridY || historyView) return;
     Object.entries(msg.data || {}).forEach(([threshold, payload]) => {
       applySnapshot(threshold, payload);
     });
@@ -1249,7 +1366,7 @@ function connectWebSocket() {
     return;
   }
 
-  if (!gridX || !gridY) return;
+  if (!gridX || !gridY || historyView || msg.image_id === undefined) return;
   const imageId = msg.image_id;
   Object.entries(msg.data || {}).forEach(([threshold, value]) => {
     updatePixel(threshold, imageId, value);
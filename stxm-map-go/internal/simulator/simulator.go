@@ -43,7 +43,9 @@ func Stream(ctx context.Context, gridX, gridY int, acqRate float64) <-chan types
 		out <- types.RawMessage{
 			Type: "start",
 			Meta: map[string]any{
-				"scan_id": scanID,
+				"scan_id":          scanID,
+				"series_id":        scanID + 1,
+				"number_of_images": totalPixels,
 			},
 		}
 
@@ -96,6 +98,7 @@ func Stream(ctx context.Context, gridX, gridY int, acqRate float64) <-chan types
 
 				frame := types.RawFrame{
 					ImageID:   imageID,
+					SeriesID:  scanID + 1,
 					StartTime: float64(time.Now().UnixNano()) / 1e9,
 					Data: map[string]any{
 						"threshold_0": image0,
@@ -111,14 +114,17 @@ func Stream(ctx context.Context, gridX, gridY int, acqRate float64) <-chan types
 					out <- types.RawMessage{
 						Type: "end",
 						Meta: map[string]any{
-							"frames": totalPixels,
+							"frames":    totalPixels,
+							"series_id": scanID + 1,
 						},
 					}
 					scanID++
 					out <- types.RawMessage{
 						Type: "start",
 						Meta: map[string]any{
-							"scan_id": scanID,
+							"scan_id":          scanID,
+							"series_id":        scanID + 1,
+							"number_of_images": totalPixels,
 						},
 					}
 					imageID = 0
@@ -2,18 +2,46 @@ package types
 
 type Frame struct {
 	ImageID   int               `json:"image_id"`
+	SeriesID  int               `json:"series_id"`
 	StartTime float64           `json:"start_time"`
+	Position  *Position         `json:"position,omitempty"`
 	Data      map[string]uint32 `json:"data"`
 }
 
 type RawFrame struct {
 	ImageID   int
+	SeriesID  int
 	StartTime float64
+	Position  *Position
 	Data      map[string]any
 }
 
+// Position is a measured scan position in stage units.
+type Position struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// PositionUpdate carries an encoder position received outside the image stream.
+// SeriesID is zero when the source does not know the series.
+type PositionUpdate struct {
+	SeriesID int
+	ImageID  int
+	Position Position
+}
+
 type RawMessage struct {
 	Type  string
 	Image RawFrame
 	Meta  map[string]any
 }
+
+// DiffractionFrame holds the accumulated detector pattern of one channel.
+// Sum and Max are row-major with Width*Height entries.
+type DiffractionFrame struct {
+	Width  int       `json:"width"`
+	Height int       `json:"height"`
+	Frames int       `json:"frames"`
+	Sum    []float64 `json:"sum,omitempty"`
+	Max    []float64 `json:"max,omitempty"`
+}
@@ -3,6 +3,8 @@ package types
 type ThresholdSnapshot struct {
 	Values []uint32 `json:"values"`
 	Mask   []bool   `json:"mask"`
+	// Variance is the sub-frame variance of every pixel, when enabled.
+	Variance []float64 `json:"variance,omitempty"`
 }
 
 type UISnapshot struct {